@@ -0,0 +1,413 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultCacheMaxEntries = 1000
+	defaultCacheMaxTTL     = 24 * time.Hour
+	// Upper bound suggested in https://datatracker.ietf.org/doc/html/rfc2308#section-5.
+	defaultCacheMaxNegativeTTL = 3 * time.Hour
+	// TTL of stale answers, as recommended in https://datatracker.ietf.org/doc/html/rfc8767#section-4.
+	staleAnswerTTL = 30 * time.Second
+	// Prefetching happens when an entry is queried in the last 1/prefetchFraction of its TTL.
+	prefetchFraction = 10
+	// flightTimeout bounds the queries to the underlying resolver, which don't use the context of the callers.
+	flightTimeout = 10 * time.Second
+)
+
+// CachingResolverOptions configures a [CachingResolver]. The zero value is a valid configuration.
+type CachingResolverOptions struct {
+	// MaxEntries is the maximum number of responses in the cache. The least recently used responses are evicted
+	// when the cache is full. Zero means 1000.
+	MaxEntries int
+	// MinTTL and MaxTTL clamp the time positive responses stay in the cache. Zero MaxTTL means 24 hours.
+	MinTTL, MaxTTL time.Duration
+	// MaxNegativeTTL caps the time negative responses (NXDOMAIN and NODATA) stay in the cache. Negative responses
+	// are cached as per RFC 2308, only if they have a SOA record. Zero means 3 hours.
+	MaxNegativeTTL time.Duration
+	// ServeStale is how long expired responses are kept after they expire, to be served when the resolver fails,
+	// as per RFC 8767. Zero disables serving stale responses.
+	ServeStale time.Duration
+	// Prefetch enables refreshing responses in the background when they are queried close to their expiration,
+	// so that popular names never miss the cache.
+	Prefetch bool
+}
+
+// CacheStats is a snapshot of the counters of a [CachingResolver].
+type CacheStats struct {
+	// Entries is the number of responses in the cache, including the stale ones.
+	Entries int
+	// Hits is the number of queries answered from the cache.
+	Hits int64
+	// Misses is the number of queries that needed the underlying resolver.
+	Misses int64
+	// Coalesced is the number of misses that waited for an identical in-flight query instead of sending their own.
+	Coalesced int64
+	// StaleHits is the number of queries answered with a stale response because the resolver failed.
+	StaleHits int64
+	// Prefetches is the number of background refreshes started.
+	Prefetches int64
+	// Evictions is the number of responses removed to make room for new ones.
+	Evictions int64
+}
+
+// CachingResolver is a [Resolver] that caches the responses of another [Resolver].
+// Use [NewCachingResolver] to create instances.
+//
+// Concurrent identical queries are coalesced into a single query to the underlying resolver. That query runs
+// in the background with its own timeout, so that a canceled caller doesn't fail the others. Responses are deep
+// copies with the TTLs decreased by the time spent in the cache, so callers may modify them.
+type CachingResolver struct {
+	resolver Resolver
+	opts     CachingResolverOptions
+	now      func() time.Time
+
+	mu sync.Mutex // Protects the fields below
+	// Elements of lru, by key. The values are *cacheEntry.
+	entries  map[string]*list.Element
+	lru      list.List // Most recently used first
+	inflight map[string]*cacheFlight
+	stats    CacheStats
+}
+
+var _ Resolver = (*CachingResolver)(nil)
+
+type cacheEntry struct {
+	key    string
+	msg    *dnsmessage.Message
+	stored time.Time
+	ttl    time.Duration
+}
+
+func (e *cacheEntry) expiration() time.Time {
+	return e.stored.Add(e.ttl)
+}
+
+// cacheFlight is a query in progress. The fields are set before done is closed.
+type cacheFlight struct {
+	done chan struct{}
+	msg  *dnsmessage.Message
+	err  error
+}
+
+// NewCachingResolver creates a [CachingResolver] that caches the responses of resolver.
+func NewCachingResolver(resolver Resolver, opts CachingResolverOptions) (*CachingResolver, error) {
+	if resolver == nil {
+		return nil, errors.New("argument resolver must not be nil")
+	}
+	if opts.MaxEntries < 0 || opts.MinTTL < 0 || opts.MaxTTL < 0 || opts.MaxNegativeTTL < 0 || opts.ServeStale < 0 {
+		return nil, errors.New("options must not be negative")
+	}
+	if opts.MaxEntries == 0 {
+		opts.MaxEntries = defaultCacheMaxEntries
+	}
+	if opts.MaxTTL == 0 {
+		opts.MaxTTL = defaultCacheMaxTTL
+	}
+	if opts.MaxNegativeTTL == 0 {
+		opts.MaxNegativeTTL = defaultCacheMaxNegativeTTL
+	}
+	if opts.MinTTL > opts.MaxTTL {
+		return nil, errors.New("MinTTL must not be greater than MaxTTL")
+	}
+	return &CachingResolver{
+		resolver: resolver,
+		opts:     opts,
+		now:      time.Now,
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[string]*cacheFlight),
+	}, nil
+}
+
+// Stats returns a snapshot of the cache counters.
+func (r *CachingResolver) Stats() CacheStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	stats.Entries = r.lru.Len()
+	return stats
+}
+
+// Query implements [Resolver].
+func (r *CachingResolver) Query(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	key := cacheKey(q)
+	now := r.now()
+
+	r.mu.Lock()
+	entry := r.getLocked(key, now)
+	if entry != nil && now.Before(entry.expiration()) {
+		r.stats.Hits++
+		var prefetch *cacheFlight
+		if r.opts.Prefetch && entry.expiration().Sub(now) <= entry.ttl/prefetchFraction && r.inflight[key] == nil {
+			r.stats.Prefetches++
+			prefetch = r.startFlightLocked(key)
+		}
+		r.mu.Unlock()
+		if prefetch != nil {
+			go r.runFlight(key, q, prefetch)
+		}
+		return cachedResponse(entry.msg, q, func(ttl uint32) uint32 {
+			return decreaseTTL(ttl, now.Sub(entry.stored))
+		}), nil
+	}
+	r.stats.Misses++
+	flight, coalesced := r.inflight[key]
+	if coalesced {
+		r.stats.Coalesced++
+	} else {
+		flight = r.startFlightLocked(key)
+	}
+	r.mu.Unlock()
+
+	if !coalesced {
+		go r.runFlight(key, q, flight)
+	}
+	select {
+	case <-flight.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if flight.err == nil && flight.msg.RCode != dnsmessage.RCodeServerFailure {
+		return cachedResponse(flight.msg, q, func(ttl uint32) uint32 { return ttl }), nil
+	}
+	if stale := r.stale(key); stale != nil {
+		return cachedResponse(stale.msg, q, func(uint32) uint32 { return uint32(staleAnswerTTL / time.Second) }), nil
+	}
+	if flight.err != nil {
+		return nil, flight.err
+	}
+	return cachedResponse(flight.msg, q, func(ttl uint32) uint32 { return ttl }), nil
+}
+
+// getLocked returns the entry for key, including stale entries. It removes entries past the serve-stale period.
+func (r *CachingResolver) getLocked(key string, now time.Time) *cacheEntry {
+	element, ok := r.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if !now.Before(entry.expiration().Add(r.opts.ServeStale)) {
+		r.lru.Remove(element)
+		delete(r.entries, key)
+		return nil
+	}
+	r.lru.MoveToFront(element)
+	return entry
+}
+
+// stale returns the stale entry for key, if any, and counts it as a stale hit.
+func (r *CachingResolver) stale(key string) *cacheEntry {
+	if r.opts.ServeStale == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry := r.getLocked(key, r.now())
+	if entry == nil {
+		return nil
+	}
+	r.stats.StaleHits++
+	return entry
+}
+
+func (r *CachingResolver) startFlightLocked(key string) *cacheFlight {
+	flight := &cacheFlight{done: make(chan struct{})}
+	r.inflight[key] = flight
+	return flight
+}
+
+// runFlight queries the resolver, caches the response if possible, and completes the flight.
+// The query is detached from the callers, since any of them may go away while others still wait for the flight.
+func (r *CachingResolver) runFlight(key string, q dnsmessage.Question, flight *cacheFlight) {
+	ctx, cancel := context.WithTimeout(context.Background(), flightTimeout)
+	defer cancel()
+	msg, err := r.resolver.Query(ctx, q)
+	now := r.now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		if ttl, ok := r.cacheTTL(msg); ok {
+			r.putLocked(&cacheEntry{key: key, msg: msg, stored: now, ttl: ttl})
+		}
+	}
+	delete(r.inflight, key)
+	flight.msg, flight.err = msg, err
+	close(flight.done)
+}
+
+func (r *CachingResolver) putLocked(entry *cacheEntry) {
+	if element, ok := r.entries[entry.key]; ok {
+		element.Value = entry
+		r.lru.MoveToFront(element)
+		return
+	}
+	for r.lru.Len() >= r.opts.MaxEntries {
+		oldest := r.lru.Back()
+		delete(r.entries, oldest.Value.(*cacheEntry).key)
+		r.lru.Remove(oldest)
+		r.stats.Evictions++
+	}
+	r.entries[entry.key] = r.lru.PushFront(entry)
+}
+
+// cacheTTL returns how long msg can be cached, or false if it can't be cached.
+func (r *CachingResolver) cacheTTL(msg *dnsmessage.Message) (time.Duration, bool) {
+	if msg.Truncated {
+		return 0, false
+	}
+	if msg.RCode == dnsmessage.RCodeSuccess && len(msg.Answers) > 0 {
+		ttl := time.Duration(minTTL(msg.Answers)) * time.Second
+		if ttl < r.opts.MinTTL {
+			ttl = r.opts.MinTTL
+		}
+		if ttl > r.opts.MaxTTL {
+			ttl = r.opts.MaxTTL
+		}
+		return ttl, ttl > 0
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		return 0, false
+	}
+	// Negative response, as per https://datatracker.ietf.org/doc/html/rfc2308#section-5.
+	for _, rr := range msg.Authorities {
+		soa, ok := rr.Body.(*dnsmessage.SOAResource)
+		if !ok {
+			continue
+		}
+		ttl := rr.Header.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		negativeTTL := time.Duration(ttl) * time.Second
+		if negativeTTL > r.opts.MaxNegativeTTL {
+			negativeTTL = r.opts.MaxNegativeTTL
+		}
+		return negativeTTL, negativeTTL > 0
+	}
+	return 0, false
+}
+
+func minTTL(resources []dnsmessage.Resource) uint32 {
+	ttl := resources[0].Header.TTL
+	for _, rr := range resources[1:] {
+		if rr.Header.TTL < ttl {
+			ttl = rr.Header.TTL
+		}
+	}
+	return ttl
+}
+
+func decreaseTTL(ttl uint32, age time.Duration) uint32 {
+	ageSeconds := uint32(age / time.Second)
+	if ageSeconds >= ttl {
+		return 0
+	}
+	return ttl - ageSeconds
+}
+
+// cachedResponse returns a deep copy of msg for the question q, with the TTLs mapped by ttlFunc.
+func cachedResponse(msg *dnsmessage.Message, q dnsmessage.Question, ttlFunc func(uint32) uint32) *dnsmessage.Message {
+	copyResources := func(resources []dnsmessage.Resource) []dnsmessage.Resource {
+		if resources == nil {
+			return nil
+		}
+		copied := make([]dnsmessage.Resource, len(resources))
+		for i, rr := range resources {
+			copied[i] = rr
+			copied[i].Body = copyResourceBody(rr.Body)
+			// The TTL of OPT records holds flags instead.
+			if rr.Header.Type != dnsmessage.TypeOPT {
+				copied[i].Header.TTL = ttlFunc(rr.Header.TTL)
+			}
+		}
+		return copied
+	}
+	response := &dnsmessage.Message{
+		Header:      msg.Header,
+		Answers:     copyResources(msg.Answers),
+		Authorities: copyResources(msg.Authorities),
+		Additionals: copyResources(msg.Additionals),
+	}
+	// Use the name from the question, since the cache key ignores the case.
+	response.Questions = []dnsmessage.Question{q}
+	if len(msg.Questions) > 1 {
+		response.Questions = append(response.Questions, msg.Questions[1:]...)
+	}
+	return response
+}
+
+// copyResourceBody returns a copy of body that doesn't share memory with it.
+func copyResourceBody(body dnsmessage.ResourceBody) dnsmessage.ResourceBody {
+	switch b := body.(type) {
+	case *dnsmessage.AResource:
+		copied := *b
+		return &copied
+	case *dnsmessage.AAAAResource:
+		copied := *b
+		return &copied
+	case *dnsmessage.CNAMEResource:
+		copied := *b
+		return &copied
+	case *dnsmessage.MXResource:
+		copied := *b
+		return &copied
+	case *dnsmessage.NSResource:
+		copied := *b
+		return &copied
+	case *dnsmessage.PTRResource:
+		copied := *b
+		return &copied
+	case *dnsmessage.SOAResource:
+		copied := *b
+		return &copied
+	case *dnsmessage.SRVResource:
+		copied := *b
+		return &copied
+	case *dnsmessage.TXTResource:
+		return &dnsmessage.TXTResource{TXT: append([]string(nil), b.TXT...)}
+	case *dnsmessage.OPTResource:
+		options := make([]dnsmessage.Option, len(b.Options))
+		for i, option := range b.Options {
+			options[i] = dnsmessage.Option{Code: option.Code, Data: append([]byte(nil), option.Data...)}
+		}
+		return &dnsmessage.OPTResource{Options: options}
+	case *dnsmessage.UnknownResource:
+		return &dnsmessage.UnknownResource{Type: b.Type, Data: append([]byte(nil), b.Data...)}
+	default:
+		return body
+	}
+}
+
+// cacheKey identifies a question. Names are compared as per https://datatracker.ietf.org/doc/html/rfc4343#section-3.
+func cacheKey(q dnsmessage.Question) string {
+	var key strings.Builder
+	for i := 0; i < int(q.Name.Length); i++ {
+		key.WriteByte(foldCase(q.Name.Data[i]))
+	}
+	key.WriteString("|" + q.Type.String() + "|" + q.Class.String())
+	return key.String()
+}
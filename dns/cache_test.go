@@ -0,0 +1,433 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCachingResolver_Hit(t *testing.T) {
+	upstream := &fakeUpstream{}
+	upstream.respond = func(q dnsmessage.Question) (*dnsmessage.Message, error) {
+		return newAResponse(q, 300), nil
+	}
+	r, clock := newTestCachingResolver(t, upstream, CachingResolverOptions{})
+
+	q := mustNewQuestion(t, "example.com.", dnsmessage.TypeA)
+	resp, err := r.Query(context.Background(), q)
+	require.NoError(t, err)
+	require.Equal(t, uint32(300), resp.Answers[0].Header.TTL)
+
+	clock.advance(10 * time.Second)
+	// Names are case-insensitive, and the response uses the name of the question.
+	upperQ := mustNewQuestion(t, "EXAMPLE.com.", dnsmessage.TypeA)
+	resp, err = r.Query(context.Background(), upperQ)
+	require.NoError(t, err)
+	require.Equal(t, upperQ, resp.Questions[0])
+	require.Equal(t, uint32(290), resp.Answers[0].Header.TTL)
+	require.Equal(t, int32(1), upstream.calls.Load())
+
+	// Modifying the response doesn't affect the cache.
+	resp.Answers[0].Header.TTL = 1
+	resp.Answers[0].Body.(*dnsmessage.AResource).A = [4]byte{198, 51, 100, 1}
+	resp, err = r.Query(context.Background(), q)
+	require.NoError(t, err)
+	require.Equal(t, uint32(290), resp.Answers[0].Header.TTL)
+	require.Equal(t, [4]byte{192, 0, 2, 1}, resp.Answers[0].Body.(*dnsmessage.AResource).A)
+
+	clock.advance(290 * time.Second)
+	_, err = r.Query(context.Background(), q)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), upstream.calls.Load())
+	require.Equal(t, CacheStats{Entries: 1, Hits: 2, Misses: 2}, r.Stats())
+}
+
+func TestCachingResolver_ClampTTL(t *testing.T) {
+	ttl := uint32(1)
+	upstream := &fakeUpstream{}
+	upstream.respond = func(q dnsmessage.Question) (*dnsmessage.Message, error) {
+		return newAResponse(q, ttl), nil
+	}
+	r, clock := newTestCachingResolver(t, upstream, CachingResolverOptions{MinTTL: time.Minute, MaxTTL: time.Hour})
+	q := mustNewQuestion(t, "example.com.", dnsmessage.TypeA)
+
+	_, err := r.Query(context.Background(), q)
+	require.NoError(t, err)
+	clock.advance(30 * time.Second)
+	_, err = r.Query(context.Background(), q)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), upstream.calls.Load())
+
+	clock.advance(30 * time.Second)
+	ttl = 100000
+	_, err = r.Query(context.Background(), q)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), upstream.calls.Load())
+	clock.advance(time.Hour)
+	_, err = r.Query(context.Background(), q)
+	require.NoError(t, err)
+	require.Equal(t, int32(3), upstream.calls.Load())
+}
+
+func TestCachingResolver_Negative(t *testing.T) {
+	upstream := &fakeUpstream{}
+	upstream.respond = func(q dnsmessage.Question) (*dnsmessage.Message, error) {
+		switch q.Name.String() {
+		case "nxdomain.example.":
+			return newNegativeResponse(q, dnsmessage.RCodeNameError, true), nil
+		case "nodata.example.":
+			return newNegativeResponse(q, dnsmessage.RCodeSuccess, true), nil
+		case "nosoa.example.":
+			return newNegativeResponse(q, dnsmessage.RCodeNameError, false), nil
+		default:
+			return newNegativeResponse(q, dnsmessage.RCodeServerFailure, false), nil
+		}
+	}
+	r, clock := newTestCachingResolver(t, upstream, CachingResolverOptions{})
+
+	for _, tc := range []struct {
+		name   string
+		cached bool
+	}{
+		{"nxdomain.example.", true},
+		{"nodata.example.", true},
+		{"nosoa.example.", false},
+		{"servfail.example.", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := mustNewQuestion(t, tc.name, dnsmessage.TypeA)
+			calls := upstream.calls.Load()
+			_, err := r.Query(context.Background(), q)
+			require.NoError(t, err)
+			resp, err := r.Query(context.Background(), q)
+			require.NoError(t, err)
+			if !tc.cached {
+				require.Equal(t, calls+2, upstream.calls.Load())
+				return
+			}
+			require.Equal(t, calls+1, upstream.calls.Load())
+			// The negative TTL is the SOA MINIMUM, since it's lower than the SOA TTL.
+			clock.advance(59 * time.Second)
+			resp, err = r.Query(context.Background(), q)
+			require.NoError(t, err)
+			require.Equal(t, uint32(3600-59), resp.Authorities[0].Header.TTL)
+			require.Equal(t, calls+1, upstream.calls.Load())
+			clock.advance(time.Second)
+			_, err = r.Query(context.Background(), q)
+			require.NoError(t, err)
+			require.Equal(t, calls+2, upstream.calls.Load())
+		})
+	}
+}
+
+func TestCachingResolver_Eviction(t *testing.T) {
+	upstream := &fakeUpstream{}
+	upstream.respond = func(q dnsmessage.Question) (*dnsmessage.Message, error) {
+		return newAResponse(q, 300), nil
+	}
+	r, _ := newTestCachingResolver(t, upstream, CachingResolverOptions{MaxEntries: 2})
+	qa := mustNewQuestion(t, "a.example.", dnsmessage.TypeA)
+	qb := mustNewQuestion(t, "b.example.", dnsmessage.TypeA)
+	qc := mustNewQuestion(t, "c.example.", dnsmessage.TypeA)
+
+	for _, q := range []dnsmessage.Question{qa, qb, qa, qc} {
+		_, err := r.Query(context.Background(), q)
+		require.NoError(t, err)
+	}
+	require.Equal(t, int32(3), upstream.calls.Load())
+	// b was the least recently used.
+	_, err := r.Query(context.Background(), qa)
+	require.NoError(t, err)
+	require.Equal(t, int32(3), upstream.calls.Load())
+	_, err = r.Query(context.Background(), qb)
+	require.NoError(t, err)
+	require.Equal(t, int32(4), upstream.calls.Load())
+	require.Equal(t, int64(2), r.Stats().Evictions)
+	require.Equal(t, 2, r.Stats().Entries)
+}
+
+func TestCachingResolver_Coalescing(t *testing.T) {
+	release := make(chan struct{})
+	upstream := &fakeUpstream{}
+	upstream.respond = func(q dnsmessage.Question) (*dnsmessage.Message, error) {
+		<-release
+		return newAResponse(q, 300), nil
+	}
+	r, _ := newTestCachingResolver(t, upstream, CachingResolverOptions{})
+	q := mustNewQuestion(t, "example.com.", dnsmessage.TypeA)
+
+	const numQueries = 10
+	var wg sync.WaitGroup
+	for i := 0; i < numQueries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := r.Query(context.Background(), q)
+			require.NoError(t, err)
+			require.Len(t, resp.Answers, 1)
+		}()
+	}
+	require.Eventually(t, func() bool { return r.Stats().Misses == numQueries }, 5*time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), upstream.calls.Load())
+	require.Equal(t, int64(numQueries-1), r.Stats().Coalesced)
+}
+
+func TestCachingResolver_CoalescedContextDone(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	upstream := &fakeUpstream{}
+	upstream.respond = func(q dnsmessage.Question) (*dnsmessage.Message, error) {
+		<-release
+		return newAResponse(q, 300), nil
+	}
+	r, _ := newTestCachingResolver(t, upstream, CachingResolverOptions{})
+	q := mustNewQuestion(t, "example.com.", dnsmessage.TypeA)
+
+	go r.Query(context.Background(), q)
+	require.Eventually(t, func() bool { return upstream.calls.Load() == 1 }, 5*time.Second, time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := r.Query(ctx, q)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestCachingResolver_FirstCallerCanceled(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	upstream := FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		calls.Add(1)
+		select {
+		case <-release:
+			return newAResponse(q, 300), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
+	r, _ := newTestCachingResolver(t, upstream, CachingResolverOptions{})
+	q := mustNewQuestion(t, "example.com.", dnsmessage.TypeA)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	firstDone := make(chan error)
+	go func() {
+		_, err := r.Query(ctx, q)
+		firstDone <- err
+	}()
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, 5*time.Second, time.Millisecond)
+	secondDone := make(chan error)
+	go func() {
+		resp, err := r.Query(context.Background(), q)
+		if err == nil && len(resp.Answers) != 1 {
+			err = errors.New("missing answer")
+		}
+		secondDone <- err
+	}()
+	require.Eventually(t, func() bool { return r.Stats().Coalesced == 1 }, 5*time.Second, time.Millisecond)
+
+	// Canceling the caller that started the query doesn't fail the one waiting for it.
+	cancel()
+	require.ErrorIs(t, <-firstDone, context.Canceled)
+	close(release)
+	require.NoError(t, <-secondDone)
+	require.Equal(t, int32(1), calls.Load())
+}
+
+func TestCachingResolver_ServeStale(t *testing.T) {
+	var upstreamErr error
+	var rcode dnsmessage.RCode
+	upstream := &fakeUpstream{}
+	upstream.respond = func(q dnsmessage.Question) (*dnsmessage.Message, error) {
+		if upstreamErr != nil {
+			return nil, upstreamErr
+		}
+		resp := newAResponse(q, 300)
+		resp.RCode = rcode
+		return resp, nil
+	}
+	r, clock := newTestCachingResolver(t, upstream, CachingResolverOptions{ServeStale: time.Hour})
+	q := mustNewQuestion(t, "example.com.", dnsmessage.TypeA)
+	_, err := r.Query(context.Background(), q)
+	require.NoError(t, err)
+
+	clock.advance(10 * time.Minute)
+	upstreamErr = &nestedError{ErrReceive, errors.New("timeout")}
+	resp, err := r.Query(context.Background(), q)
+	require.NoError(t, err)
+	require.Equal(t, uint32(30), resp.Answers[0].Header.TTL)
+
+	upstreamErr, rcode = nil, dnsmessage.RCodeServerFailure
+	resp, err = r.Query(context.Background(), q)
+	require.NoError(t, err)
+	require.Equal(t, dnsmessage.RCodeSuccess, resp.RCode)
+	require.Equal(t, int64(2), r.Stats().StaleHits)
+
+	clock.advance(time.Hour)
+	upstreamErr = &nestedError{ErrReceive, errors.New("timeout")}
+	_, err = r.Query(context.Background(), q)
+	require.ErrorIs(t, err, ErrReceive)
+	require.Equal(t, 0, r.Stats().Entries)
+}
+
+func TestCachingResolver_NoServeStale(t *testing.T) {
+	var upstreamErr error
+	upstream := &fakeUpstream{}
+	upstream.respond = func(q dnsmessage.Question) (*dnsmessage.Message, error) {
+		if upstreamErr != nil {
+			return nil, upstreamErr
+		}
+		return newAResponse(q, 300), nil
+	}
+	r, clock := newTestCachingResolver(t, upstream, CachingResolverOptions{})
+	q := mustNewQuestion(t, "example.com.", dnsmessage.TypeA)
+	_, err := r.Query(context.Background(), q)
+	require.NoError(t, err)
+
+	clock.advance(300 * time.Second)
+	upstreamErr = &nestedError{ErrReceive, errors.New("timeout")}
+	_, err = r.Query(context.Background(), q)
+	require.ErrorIs(t, err, ErrReceive)
+}
+
+func TestCachingResolver_Prefetch(t *testing.T) {
+	upstream := &fakeUpstream{}
+	upstream.respond = func(q dnsmessage.Question) (*dnsmessage.Message, error) {
+		return newAResponse(q, 100), nil
+	}
+	r, clock := newTestCachingResolver(t, upstream, CachingResolverOptions{Prefetch: true})
+	q := mustNewQuestion(t, "example.com.", dnsmessage.TypeA)
+	_, err := r.Query(context.Background(), q)
+	require.NoError(t, err)
+
+	clock.advance(50 * time.Second)
+	_, err = r.Query(context.Background(), q)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), r.Stats().Prefetches)
+
+	clock.advance(45 * time.Second)
+	resp, err := r.Query(context.Background(), q)
+	require.NoError(t, err)
+	require.Equal(t, uint32(5), resp.Answers[0].Header.TTL)
+	require.Equal(t, int64(1), r.Stats().Prefetches)
+	require.Eventually(t, func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return len(r.inflight) == 0
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, int32(2), upstream.calls.Load())
+
+	// The refreshed entry is fresh past the original expiration.
+	clock.advance(50 * time.Second)
+	resp, err = r.Query(context.Background(), q)
+	require.NoError(t, err)
+	require.Equal(t, uint32(50), resp.Answers[0].Header.TTL)
+	require.Equal(t, int32(2), upstream.calls.Load())
+}
+
+func TestNewCachingResolver_InvalidOptions(t *testing.T) {
+	resolver := FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		return nil, errors.New("not implemented")
+	})
+	_, err := NewCachingResolver(nil, CachingResolverOptions{})
+	require.Error(t, err)
+	_, err = NewCachingResolver(resolver, CachingResolverOptions{MaxEntries: -1})
+	require.Error(t, err)
+	_, err = NewCachingResolver(resolver, CachingResolverOptions{MinTTL: time.Hour, MaxTTL: time.Minute})
+	require.Error(t, err)
+}
+
+/********** Test Utilities **********/
+
+type fakeUpstream struct {
+	calls   atomic.Int32
+	respond func(q dnsmessage.Question) (*dnsmessage.Message, error)
+}
+
+func (u *fakeUpstream) Query(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	u.calls.Add(1)
+	return u.respond(q)
+}
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestCachingResolver(t *testing.T, upstream Resolver, opts CachingResolverOptions) (*CachingResolver, *fakeClock) {
+	r, err := NewCachingResolver(upstream, opts)
+	require.NoError(t, err)
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	r.now = clock.Now
+	return r, clock
+}
+
+func mustNewQuestion(t *testing.T, domain string, qtype dnsmessage.Type) dnsmessage.Question {
+	q, err := NewQuestion(domain, qtype)
+	require.NoError(t, err)
+	return *q
+}
+
+func newAResponse(q dnsmessage.Question, ttl uint32) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RecursionAvailable: true},
+		Questions: []dnsmessage.Question{q},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}},
+		Additionals: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("."), Type: dnsmessage.TypeOPT, Class: 1232},
+			Body:   &dnsmessage.OPTResource{},
+		}},
+	}
+}
+
+// newNegativeResponse creates a response with no answers, and a SOA record with TTL 3600 and MINIMUM 60 if withSOA.
+func newNegativeResponse(q dnsmessage.Question, rcode dnsmessage.RCode, withSOA bool) *dnsmessage.Message {
+	msg := &dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RecursionAvailable: true, RCode: rcode},
+		Questions: []dnsmessage.Question{q},
+	}
+	if withSOA {
+		msg.Authorities = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+			Body: &dnsmessage.SOAResource{
+				NS: dnsmessage.MustNewName("ns.example."), MBox: dnsmessage.MustNewName("admin.example."),
+				Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: 60,
+			},
+		}}
+	}
+	return msg
+}
@@ -0,0 +1,219 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// isServerFailure returns whether the response means that the resolver couldn't answer, in which case another
+// resolver may be able to.
+func isServerFailure(msg *dnsmessage.Message) bool {
+	return msg.RCode == dnsmessage.RCodeServerFailure || msg.RCode == dnsmessage.RCodeRefused
+}
+
+// shouldFallback returns whether the query error means that the resolver is unreachable or not working, as opposed
+// to the request being invalid.
+func shouldFallback(err error) bool {
+	return errors.Is(err, ErrDial) || errors.Is(err, ErrSend) || errors.Is(err, ErrReceive) || errors.Is(err, ErrBadResponse)
+}
+
+func checkResolvers(resolvers []Resolver) error {
+	if len(resolvers) == 0 {
+		return errors.New("must provide at least one resolver")
+	}
+	for i, resolver := range resolvers {
+		if resolver == nil {
+			return fmt.Errorf("resolver %v must not be nil", i)
+		}
+	}
+	return nil
+}
+
+type raceResolver []Resolver
+
+var _ Resolver = (raceResolver)(nil)
+
+// NewRaceResolver creates a [Resolver] that sends each query to all the resolvers in parallel, and returns the
+// first response. Failures are only returned if all the resolvers fail, and responses with a SERVFAIL or REFUSED
+// code are only returned if no resolver answers. The queries that are still in flight are canceled.
+func NewRaceResolver(resolvers ...Resolver) (Resolver, error) {
+	if err := checkResolvers(resolvers); err != nil {
+		return nil, err
+	}
+	return raceResolver(resolvers), nil
+}
+
+// Query implements [Resolver].
+func (r raceResolver) Query(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type queryResult struct {
+		msg *dnsmessage.Message
+		err error
+	}
+	results := make(chan queryResult, len(r))
+	for _, resolver := range r {
+		go func(resolver Resolver) {
+			msg, err := resolver.Query(ctx, q)
+			results <- queryResult{msg, err}
+		}(resolver)
+	}
+	var failure *dnsmessage.Message
+	var errs []error
+	for range r {
+		result := <-results
+		if result.err != nil {
+			errs = append(errs, result.err)
+			continue
+		}
+		if isServerFailure(result.msg) {
+			failure = result.msg
+			continue
+		}
+		return result.msg, nil
+	}
+	if failure != nil {
+		return failure, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+type fallbackResolver []Resolver
+
+var _ Resolver = (fallbackResolver)(nil)
+
+// NewFallbackResolver creates a [Resolver] that sends each query to the resolvers in order, until one answers.
+// It moves on to the next resolver if the query fails with [ErrDial], [ErrSend], [ErrReceive] or [ErrBadResponse],
+// or if the response has a SERVFAIL or REFUSED code. Other errors, such as [ErrBadRequest] and context errors,
+// are returned right away, since the other resolvers would fail the same way.
+func NewFallbackResolver(resolvers ...Resolver) (Resolver, error) {
+	if err := checkResolvers(resolvers); err != nil {
+		return nil, err
+	}
+	return fallbackResolver(resolvers), nil
+}
+
+// Query implements [Resolver].
+func (r fallbackResolver) Query(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	var failure *dnsmessage.Message
+	var errs []error
+	for _, resolver := range r {
+		msg, err := resolver.Query(ctx, q)
+		if err != nil {
+			if ctx.Err() != nil || !shouldFallback(err) {
+				return nil, err
+			}
+			errs = append(errs, err)
+			continue
+		}
+		if isServerFailure(msg) {
+			failure = msg
+			continue
+		}
+		return msg, nil
+	}
+	if failure != nil {
+		return failure, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// DomainRoute sends the queries for a domain to a resolver. See [NewDomainRoutedResolver].
+type DomainRoute struct {
+	// Domain matches the domain name and its subdomains, or, if it starts with "*.", only the subdomains.
+	// "." matches all names. Names are compared case-insensitively.
+	Domain string
+	// Resolver answers the queries that match Domain.
+	Resolver Resolver
+}
+
+// domainRoute is a [DomainRoute] in canonical form.
+type domainRoute struct {
+	// domain is lower case and fully qualified, without the wildcard label.
+	domain        string
+	labels        int
+	subdomainOnly bool
+	resolver      Resolver
+}
+
+type domainRoutedResolver struct {
+	routes []domainRoute
+}
+
+var _ Resolver = (*domainRoutedResolver)(nil)
+
+// NewDomainRoutedResolver creates a [Resolver] that sends each query to the resolver of the most specific route
+// that matches the queried name. For instance, it can send the names under "corp" to an internal resolver, and
+// the others, with the "." route, to a public one. Queries that match no route fail with [ErrBadRequest].
+func NewDomainRoutedResolver(routes []DomainRoute) (Resolver, error) {
+	if len(routes) == 0 {
+		return nil, errors.New("must provide at least one route")
+	}
+	r := &domainRoutedResolver{routes: make([]domainRoute, 0, len(routes))}
+	for _, route := range routes {
+		if route.Resolver == nil {
+			return nil, fmt.Errorf("resolver for domain %q must not be nil", route.Domain)
+		}
+		domain, subdomainOnly := strings.CutPrefix(route.Domain, "*.")
+		name, err := dnsmessage.NewName(makeFQDN(domain))
+		if err != nil || domain == "" || containsString(nameLabels(domain), "") || (subdomainOnly && domain == ".") {
+			return nil, fmt.Errorf("invalid route domain %q", route.Domain)
+		}
+		canonical := canonicalName(name)
+		r.routes = append(r.routes, domainRoute{
+			domain:        canonical,
+			labels:        countLabels(canonical),
+			subdomainOnly: subdomainOnly,
+			resolver:      route.Resolver,
+		})
+	}
+	return r, nil
+}
+
+// Query implements [Resolver].
+func (r *domainRoutedResolver) Query(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	name := lowerString(makeFQDN(q.Name.String()))
+	var best *domainRoute
+	for i := range r.routes {
+		route := &r.routes[i]
+		if !isSubdomain(name, route.domain) || (route.subdomainOnly && name == route.domain) {
+			continue
+		}
+		// Ties go to the subdomain-only route, which is more specific.
+		if best == nil || route.labels > best.labels || (route.labels == best.labels && route.subdomainOnly && !best.subdomainOnly) {
+			best = route
+		}
+	}
+	if best == nil {
+		return nil, &nestedError{ErrBadRequest, fmt.Errorf("no route for name %v", q.Name)}
+	}
+	return best.resolver.Query(ctx, q)
+}
+
+// containsString reports whether s is in list.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
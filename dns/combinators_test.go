@@ -0,0 +1,219 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestRaceResolver_FirstAnswerWins(t *testing.T) {
+	canceled := make(chan struct{})
+	slow := FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		<-ctx.Done()
+		close(canceled)
+		return nil, &nestedError{ErrReceive, ctx.Err()}
+	})
+	failing := newFixedResolver(nil, &nestedError{ErrDial, errors.New("unreachable")})
+	servfail := newFixedResolver(newRCodeResponse(dnsmessage.RCodeServerFailure), nil)
+	working := newFixedResolver(newRCodeResponse(dnsmessage.RCodeSuccess), nil)
+	resolver, err := NewRaceResolver(slow, failing, servfail, working)
+	require.NoError(t, err)
+
+	msg, err := resolver.Query(context.Background(), testQuestion(t))
+	require.NoError(t, err)
+	require.Equal(t, dnsmessage.RCodeSuccess, msg.RCode)
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "slow query was not canceled")
+	}
+}
+
+func TestRaceResolver_AllFail(t *testing.T) {
+	resolver, err := NewRaceResolver(
+		newFixedResolver(nil, &nestedError{ErrDial, errors.New("unreachable")}),
+		newFixedResolver(nil, &nestedError{ErrReceive, errors.New("timeout")}),
+	)
+	require.NoError(t, err)
+	_, err = resolver.Query(context.Background(), testQuestion(t))
+	require.ErrorIs(t, err, ErrDial)
+	require.ErrorIs(t, err, ErrReceive)
+
+	// A SERVFAIL is better than an error.
+	resolver, err = NewRaceResolver(
+		newFixedResolver(nil, &nestedError{ErrDial, errors.New("unreachable")}),
+		newFixedResolver(newRCodeResponse(dnsmessage.RCodeServerFailure), nil),
+	)
+	require.NoError(t, err)
+	msg, err := resolver.Query(context.Background(), testQuestion(t))
+	require.NoError(t, err)
+	require.Equal(t, dnsmessage.RCodeServerFailure, msg.RCode)
+}
+
+func TestFallbackResolver(t *testing.T) {
+	var calls []string
+	record := func(name string, resolver Resolver) Resolver {
+		return FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+			calls = append(calls, name)
+			return resolver.Query(ctx, q)
+		})
+	}
+	resolver, err := NewFallbackResolver(
+		record("dial", newFixedResolver(nil, &nestedError{ErrDial, errors.New("unreachable")})),
+		record("receive", newFixedResolver(nil, &nestedError{ErrReceive, errors.New("timeout")})),
+		record("servfail", newFixedResolver(newRCodeResponse(dnsmessage.RCodeServerFailure), nil)),
+		record("nxdomain", newFixedResolver(newRCodeResponse(dnsmessage.RCodeNameError), nil)),
+		record("unused", newFixedResolver(newRCodeResponse(dnsmessage.RCodeSuccess), nil)),
+	)
+	require.NoError(t, err)
+	msg, err := resolver.Query(context.Background(), testQuestion(t))
+	require.NoError(t, err)
+	// NXDOMAIN is an answer.
+	require.Equal(t, dnsmessage.RCodeNameError, msg.RCode)
+	require.Equal(t, []string{"dial", "receive", "servfail", "nxdomain"}, calls)
+}
+
+func TestFallbackResolver_BadRequest(t *testing.T) {
+	var unusedCalls atomic.Int32
+	resolver, err := NewFallbackResolver(
+		newFixedResolver(nil, &nestedError{ErrBadRequest, errors.New("invalid question")}),
+		FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+			unusedCalls.Add(1)
+			return newRCodeResponse(dnsmessage.RCodeSuccess), nil
+		}),
+	)
+	require.NoError(t, err)
+	_, err = resolver.Query(context.Background(), testQuestion(t))
+	require.ErrorIs(t, err, ErrBadRequest)
+	require.Zero(t, unusedCalls.Load())
+}
+
+func TestFallbackResolver_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var secondCalls atomic.Int32
+	resolver, err := NewFallbackResolver(
+		FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+			cancel()
+			return nil, &nestedError{ErrReceive, ctx.Err()}
+		}),
+		FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+			secondCalls.Add(1)
+			return newRCodeResponse(dnsmessage.RCodeSuccess), nil
+		}),
+	)
+	require.NoError(t, err)
+	_, err = resolver.Query(ctx, testQuestion(t))
+	require.ErrorIs(t, err, context.Canceled)
+	require.Zero(t, secondCalls.Load())
+}
+
+func TestFallbackResolver_AllFail(t *testing.T) {
+	resolver, err := NewFallbackResolver(
+		newFixedResolver(nil, &nestedError{ErrDial, errors.New("unreachable")}),
+		newFixedResolver(nil, &nestedError{ErrBadResponse, errors.New("bad")}),
+	)
+	require.NoError(t, err)
+	_, err = resolver.Query(context.Background(), testQuestion(t))
+	require.ErrorIs(t, err, ErrDial)
+	require.ErrorIs(t, err, ErrBadResponse)
+}
+
+func TestDomainRoutedResolver(t *testing.T) {
+	routed := func(name string) Resolver {
+		return FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+			msg := newRCodeResponse(dnsmessage.RCodeSuccess)
+			msg.Questions = []dnsmessage.Question{{Name: dnsmessage.MustNewName(name + ".")}}
+			return msg, nil
+		})
+	}
+	resolver, err := NewDomainRoutedResolver([]DomainRoute{
+		{Domain: ".", Resolver: routed("public")},
+		{Domain: "corp", Resolver: routed("corp")},
+		{Domain: "*.Lab.Corp.", Resolver: routed("lab")},
+	})
+	require.NoError(t, err)
+	for name, want := range map[string]string{
+		"example.com.":        "public",
+		"corp.":               "corp",
+		"www.CORP.":           "corp",
+		"lab.corp.":           "corp",
+		"host.lab.corp.":      "lab",
+		"a.host.lab.corp.":    "lab",
+		"notcorp.":            "public",
+		"corp.example.":       "public",
+		"host.lab.corp":       "lab",
+		".":                   "public",
+		"www.lab.corp.other.": "public",
+	} {
+		msg, err := resolver.Query(context.Background(), dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+		require.NoError(t, err, name)
+		require.Equal(t, want+".", msg.Questions[0].Name.String(), name)
+	}
+}
+
+func TestDomainRoutedResolver_NoRoute(t *testing.T) {
+	resolver, err := NewDomainRoutedResolver([]DomainRoute{{Domain: "*.corp", Resolver: newFixedResolver(newRCodeResponse(dnsmessage.RCodeSuccess), nil)}})
+	require.NoError(t, err)
+	_, err = resolver.Query(context.Background(), dnsmessage.Question{Name: dnsmessage.MustNewName("corp."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	require.ErrorIs(t, err, ErrBadRequest)
+}
+
+func TestResolverCombinators_InvalidArguments(t *testing.T) {
+	_, err := NewRaceResolver()
+	require.Error(t, err)
+	_, err = NewRaceResolver(FuncResolver(nil), nil)
+	require.Error(t, err)
+	_, err = NewFallbackResolver()
+	require.Error(t, err)
+	_, err = NewFallbackResolver(nil)
+	require.Error(t, err)
+	_, err = NewDomainRoutedResolver(nil)
+	require.Error(t, err)
+	for _, route := range []DomainRoute{
+		{Domain: "corp"},
+		{Domain: "", Resolver: FuncResolver(nil)},
+		{Domain: "*..", Resolver: FuncResolver(nil)},
+		{Domain: "a..b", Resolver: FuncResolver(nil)},
+	} {
+		_, err = NewDomainRoutedResolver([]DomainRoute{route})
+		require.Error(t, err, route.Domain)
+	}
+}
+
+/********** Test Utilities **********/
+
+// newFixedResolver returns a [Resolver] that always returns msg and err.
+func newFixedResolver(msg *dnsmessage.Message, err error) Resolver {
+	return FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		return msg, err
+	})
+}
+
+func newRCodeResponse(rcode dnsmessage.RCode) *dnsmessage.Message {
+	return &dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: rcode}}
+}
+
+func testQuestion(t *testing.T) dnsmessage.Question {
+	q, err := NewQuestion("example.com.", dnsmessage.TypeA)
+	require.NoError(t, err)
+	return *q
+}
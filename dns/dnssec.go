@@ -0,0 +1,1483 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Record types used by DNSSEC, which dnsmessage doesn't define.
+const (
+	typeDS     dnsmessage.Type = 43
+	typeRRSIG  dnsmessage.Type = 46
+	typeNSEC   dnsmessage.Type = 47
+	typeDNSKEY dnsmessage.Type = 48
+	typeNSEC3  dnsmessage.Type = 50
+)
+
+// Algorithm numbers, from https://www.iana.org/assignments/dns-sec-alg-numbers.
+const (
+	algRSASHA256       = 8
+	algRSASHA512       = 10
+	algECDSAP256SHA256 = 13
+	algECDSAP384SHA384 = 14
+	algED25519         = 15
+
+	digestSHA256 = 2
+	digestSHA384 = 4
+
+	nsec3HashSHA1 = 1
+)
+
+const (
+	dnskeyFlagZone   = 0x0100
+	dnskeyFlagRevoke = 0x0080
+	nsec3FlagOptOut  = 0x01
+	// Responses with more NSEC3 iterations are treated as insecure, as allowed by
+	// https://datatracker.ietf.org/doc/html/rfc9276#section-3.2.
+	maxNSEC3Iterations = 150
+	// Upper bound for the time validated zone cuts stay in the cache.
+	maxZoneCutTTL = time.Hour
+	// The zone cut cache is cleared when it reaches this size.
+	maxZoneCuts = 10000
+)
+
+// TrustAnchor is a DS record that authenticates the keys of a zone. The keys it matches are trusted without
+// further validation.
+type TrustAnchor struct {
+	// Zone is the name of the zone, for example "." for the root zone.
+	Zone       string
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+// RootTrustAnchors returns the trust anchors of the root zone, as published in https://data.iana.org/root-anchors/.
+func RootTrustAnchors() []TrustAnchor {
+	return []TrustAnchor{
+		{Zone: ".", KeyTag: 20326, Algorithm: algRSASHA256, DigestType: digestSHA256,
+			Digest: mustDecodeHex("E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D")},
+		{Zone: ".", KeyTag: 38696, Algorithm: algRSASHA256, DigestType: digestSHA256,
+			Digest: mustDecodeHex("683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16")},
+	}
+}
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// BogusError is the error returned when a response fails DNSSEC validation. It's wrapped in an error that
+// matches [ErrBadResponse].
+type BogusError struct {
+	// Name and Type identify the records that failed validation.
+	Name string
+	Type dnsmessage.Type
+	// Reason describes why the validation failed.
+	Reason string
+}
+
+func (e *BogusError) Error() string {
+	return fmt.Sprintf("DNSSEC validation of %v %v failed: %v", e.Name, typeString(e.Type), e.Reason)
+}
+
+func bogus(name string, t dnsmessage.Type, reason error) error {
+	return &nestedError{ErrBadResponse, &BogusError{Name: name, Type: t, Reason: reason.Error()}}
+}
+
+func typeString(t dnsmessage.Type) string {
+	switch t {
+	case typeDS:
+		return "DS"
+	case typeRRSIG:
+		return "RRSIG"
+	case typeNSEC:
+		return "NSEC"
+	case typeDNSKEY:
+		return "DNSKEY"
+	case typeNSEC3:
+		return "NSEC3"
+	case TypeSVCB:
+		return "SVCB"
+	case TypeHTTPS:
+		return "HTTPS"
+	default:
+		return strings.TrimPrefix(t.String(), "Type")
+	}
+}
+
+// ValidatingResolverOptions configures the resolver created by [NewValidatingResolver]. The zero value is a valid
+// configuration.
+type ValidatingResolverOptions struct {
+	// TrustAnchors are the DS records of the zones that are trusted without validation. Nil means [RootTrustAnchors].
+	TrustAnchors []TrustAnchor
+}
+
+type validatingResolver struct {
+	resolver optionsResolver
+	// Trust anchors by canonical zone name.
+	anchors map[string][]*dsRecord
+	now     func() time.Time
+
+	mu    sync.Mutex
+	zones map[string]*zoneCut // By canonical name
+}
+
+var _ Resolver = (*validatingResolver)(nil)
+
+// zoneCut is what the validator learned about a name while walking down the tree from a trust anchor.
+type zoneCut struct {
+	// keys are the validated keys of the zone, if the name is the apex of a signed zone.
+	keys []*dnskey
+	// insecure means that the name is the apex of an unsigned zone, or the DNSSEC algorithms are not supported.
+	insecure bool
+	// nxdomain means that the name doesn't exist.
+	nxdomain bool
+	expiry   time.Time
+}
+
+// NewValidatingResolver creates a [Resolver] that validates the responses of resolver with DNSSEC, as per
+// [RFC 4035]. It sets the DNSSEC OK bit in the queries, and validates the DNSKEY, DS and RRSIG chain from the
+// configured trust anchors, which it fetches through resolver. Authenticated denials of existence are validated
+// with NSEC and NSEC3 records. Like with [NewEDNS0Resolver], resolver must be one of the resolvers of this package
+// that send the requests, possibly wrapped by [NewEDNS0Resolver].
+//
+// Responses that validate have the Authenticated Data (AD) bit set. Responses for names in unsigned zones
+// have the AD bit cleared. If the validation fails, Query returns a [*BogusError].
+//
+// The resolver must pass the records added by the DNSSEC OK bit through. To cache the validated responses,
+// wrap the validating resolver with [NewCachingResolver], rather than the opposite.
+//
+// [RFC 4035]: https://datatracker.ietf.org/doc/html/rfc4035
+func NewValidatingResolver(resolver Resolver, opts ValidatingResolverOptions) (Resolver, error) {
+	inner, err := asOptionsResolver(resolver)
+	if err != nil {
+		return nil, err
+	}
+	trustAnchors := opts.TrustAnchors
+	if trustAnchors == nil {
+		trustAnchors = RootTrustAnchors()
+	}
+	if len(trustAnchors) == 0 {
+		return nil, errors.New("TrustAnchors must not be empty")
+	}
+	anchors := make(map[string][]*dsRecord)
+	for _, anchor := range trustAnchors {
+		question, err := NewQuestion(anchor.Zone, typeDS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor zone %q: %w", anchor.Zone, err)
+		}
+		if len(anchor.Digest) == 0 {
+			return nil, fmt.Errorf("trust anchor for zone %q has no digest", anchor.Zone)
+		}
+		zone := canonicalName(question.Name)
+		anchors[zone] = append(anchors[zone], &dsRecord{
+			keyTag:     anchor.KeyTag,
+			algorithm:  anchor.Algorithm,
+			digestType: anchor.DigestType,
+			digest:     anchor.Digest,
+		})
+	}
+	return &validatingResolver{
+		resolver: inner,
+		anchors:  anchors,
+		now:      time.Now,
+		zones:    make(map[string]*zoneCut),
+	}, nil
+}
+
+// Query implements [Resolver].
+func (r *validatingResolver) Query(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	msg, err := r.resolver.queryWithOptions(ctx, q, requestOptions{dnssecOK: true})
+	if err != nil {
+		return nil, err
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		// Failures have nothing to validate.
+		msg.AuthenticData = false
+		return msg, nil
+	}
+	secure, err := r.validate(ctx, q, msg)
+	if err != nil {
+		return nil, err
+	}
+	msg.AuthenticData = secure
+	return msg, nil
+}
+
+// validate checks the answers of msg, and the proof of nonexistence if the answer is negative or synthesized
+// from a wildcard. It returns whether the response is secure.
+func (r *validatingResolver) validate(ctx context.Context, q dnsmessage.Question, msg *dnsmessage.Message) (bool, error) {
+	secure := true
+	answers := groupRRsets(msg.Answers)
+	type expansion struct {
+		owner  string
+		labels int
+	}
+	var expansions []expansion
+	for _, set := range answers {
+		setSecure, err := r.validateRRset(ctx, set)
+		if err != nil {
+			return false, err
+		}
+		secure = secure && setSecure
+		if set.verifiedBy != nil && int(set.verifiedBy.labels) < countLabels(set.name) {
+			expansions = append(expansions, expansion{set.name, int(set.verifiedBy.labels)})
+		}
+	}
+
+	// Follow the CNAME chain to find the name the answer is about.
+	target := canonicalName(q.Name)
+	answered := false
+	for i := 0; i <= len(answers); i++ {
+		if set := findRRset(answers, target, q.Type); set != nil {
+			answered = true
+			break
+		}
+		set := findRRset(answers, target, dnsmessage.TypeCNAME)
+		if set == nil {
+			break
+		}
+		target = canonicalName(set.rrs[0].Body.(*dnsmessage.CNAMEResource).CNAME)
+	}
+	if answered && len(expansions) == 0 {
+		return secure, nil
+	}
+
+	proof, denialSecure, err := r.validateDenial(ctx, target, q.Type, msg.Authorities)
+	if err != nil || !denialSecure {
+		return false, err
+	}
+	for _, e := range expansions {
+		if err := proof.proveWildcardExpansion(e.owner, e.labels); err != nil {
+			return false, bogus(e.owner, q.Type, err)
+		}
+	}
+	if answered {
+		return secure, nil
+	}
+	var optOut bool
+	if msg.RCode == dnsmessage.RCodeNameError {
+		optOut, err = proof.proveNXDomain(target)
+	} else {
+		_, optOut, err = proof.proveNoData(target, q.Type)
+	}
+	if err != nil {
+		return false, bogus(target, q.Type, err)
+	}
+	return secure && !optOut, nil
+}
+
+// validateDenial validates the SOA, NSEC and NSEC3 records in the authority section of a response about name.
+// It returns false if the records are in an unsigned zone.
+func (r *validatingResolver) validateDenial(ctx context.Context, name string, t dnsmessage.Type, authorities []dnsmessage.Resource) (*denial, bool, error) {
+	found := false
+	for _, set := range groupRRsets(authorities) {
+		if !isDenialType(set.rtype) {
+			continue
+		}
+		found = true
+		secure, err := r.validateRRset(ctx, set)
+		if err != nil || !secure {
+			return nil, false, err
+		}
+	}
+	if !found {
+		_, keys, err := r.findZone(ctx, name)
+		if err != nil || keys == nil {
+			return nil, false, err
+		}
+		return nil, false, bogus(name, t, errors.New("missing proof of nonexistence"))
+	}
+	proof, err := parseDenial(authorities)
+	if err != nil {
+		return nil, false, bogus(name, t, err)
+	}
+	if proof.insecure {
+		return nil, false, nil
+	}
+	return proof, true, nil
+}
+
+// validateRRset checks the signatures of set. It returns false if set is in an unsigned zone.
+func (r *validatingResolver) validateRRset(ctx context.Context, set *rrSet) (bool, error) {
+	if len(set.sigs) == 0 {
+		zoneName := set.name
+		if set.rtype == typeDS {
+			// DS records belong to the parent zone.
+			zoneName = parentName(zoneName)
+		}
+		_, keys, err := r.findZone(ctx, zoneName)
+		if err != nil || keys == nil {
+			return false, err
+		}
+		return false, bogus(set.name, set.rtype, errors.New("missing signature"))
+	}
+	var reason error
+	for _, sig := range set.sigs {
+		if !isSubdomain(set.name, sig.signer) {
+			reason = fmt.Errorf("signer %v is not an ancestor of the owner", sig.signer)
+			continue
+		}
+		zone, keys, err := r.findZone(ctx, sig.signer)
+		if err != nil {
+			return false, err
+		}
+		if keys == nil {
+			return false, nil
+		}
+		if zone != sig.signer {
+			reason = fmt.Errorf("signer %v is not a zone apex", sig.signer)
+			continue
+		}
+		if err := r.verifySignature(set, sig, keys); err != nil {
+			reason = err
+			continue
+		}
+		set.verifiedBy = sig
+		return true, nil
+	}
+	return false, bogus(set.name, set.rtype, reason)
+}
+
+// verifyWithKeys checks that set is signed by one of the keys of zone.
+func (r *validatingResolver) verifyWithKeys(set *rrSet, zone string, keys []*dnskey) error {
+	reason := errors.New("missing signature")
+	for _, sig := range set.sigs {
+		if sig.signer != zone {
+			reason = fmt.Errorf("signer %v is not the zone %v", sig.signer, zone)
+			continue
+		}
+		if err := r.verifySignature(set, sig, keys); err != nil {
+			reason = err
+			continue
+		}
+		set.verifiedBy = sig
+		return nil
+	}
+	return bogus(set.name, set.rtype, reason)
+}
+
+// verifySignature checks that sig is a valid signature of set by one of keys, as per
+// https://datatracker.ietf.org/doc/html/rfc4035#section-5.3.
+func (r *validatingResolver) verifySignature(set *rrSet, sig *rrsig, keys []*dnskey) error {
+	if int(sig.labels) > countLabels(set.name) {
+		return errors.New("RRSIG has more labels than the owner")
+	}
+	if !sig.validAt(r.now()) {
+		return errors.New("RRSIG is expired or not yet valid")
+	}
+	data, err := signedData(set, sig)
+	if err != nil {
+		return err
+	}
+	err = errors.New("no DNSKEY matches the RRSIG")
+	for _, key := range keys {
+		if key.keyTag != sig.keyTag || key.algorithm != sig.algorithm {
+			continue
+		}
+		if err = key.verify(data, sig.signature); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// findZone returns the zone name belongs to and its validated keys, by walking down the tree from the closest
+// trust anchor. The keys are nil if name is in an unsigned zone.
+func (r *validatingResolver) findZone(ctx context.Context, name string) (string, []*dnskey, error) {
+	anchor := ""
+	for zone := range r.anchors {
+		if isSubdomain(name, zone) && countLabels(zone) >= countLabels(anchor) {
+			anchor = zone
+		}
+	}
+	if anchor == "" {
+		return "", nil, nil
+	}
+	cut, err := r.anchorCut(ctx, anchor)
+	if err != nil {
+		return "", nil, err
+	}
+	if cut.insecure {
+		return anchor, nil, nil
+	}
+	zone, keys := anchor, cut.keys
+	for n := countLabels(anchor) + 1; n <= countLabels(name); n++ {
+		child := ancestorName(name, n)
+		cut, err := r.zoneCut(ctx, zone, keys, child)
+		if err != nil {
+			return "", nil, err
+		}
+		switch {
+		case cut.insecure:
+			return child, nil, nil
+		case cut.nxdomain:
+			return zone, keys, nil
+		case cut.keys != nil:
+			zone, keys = child, cut.keys
+		}
+	}
+	return zone, keys, nil
+}
+
+func (r *validatingResolver) cachedCut(name string) *zoneCut {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cut := r.zones[name]
+	if cut == nil || !r.now().Before(cut.expiry) {
+		return nil
+	}
+	return cut
+}
+
+func (r *validatingResolver) storeCut(name string, cut *zoneCut, ttl uint32) {
+	cutTTL := time.Duration(ttl) * time.Second
+	if cutTTL > maxZoneCutTTL {
+		cutTTL = maxZoneCutTTL
+	}
+	cut.expiry = r.now().Add(cutTTL)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.zones) >= maxZoneCuts {
+		r.zones = make(map[string]*zoneCut)
+	}
+	r.zones[name] = cut
+}
+
+// anchorCut validates the keys of a trust anchor zone.
+func (r *validatingResolver) anchorCut(ctx context.Context, zone string) (*zoneCut, error) {
+	if cut := r.cachedCut(zone); cut != nil {
+		return cut, nil
+	}
+	keys, ttl, err := r.zoneKeys(ctx, zone, r.anchors[zone])
+	if err != nil {
+		return nil, err
+	}
+	cut := &zoneCut{keys: keys, insecure: keys == nil}
+	r.storeCut(zone, cut, ttl)
+	return cut, nil
+}
+
+// zoneCut finds whether child, a descendant of zone, is a zone cut, by querying its DS records.
+func (r *validatingResolver) zoneCut(ctx context.Context, zone string, keys []*dnskey, child string) (*zoneCut, error) {
+	if cut := r.cachedCut(child); cut != nil {
+		return cut, nil
+	}
+	msg, err := r.query(ctx, child, typeDS)
+	if err != nil {
+		return nil, err
+	}
+	cut := &zoneCut{}
+	ttl := cutTTL(msg)
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess:
+		answers := groupRRsets(msg.Answers)
+		if set := findRRset(answers, child, typeDS); set != nil {
+			if err := r.verifyWithKeys(set, zone, keys); err != nil {
+				return nil, err
+			}
+			ds, err := parseDSRecords(set)
+			if err != nil {
+				return nil, bogus(child, typeDS, err)
+			}
+			var keysTTL uint32
+			if cut.keys, keysTTL, err = r.zoneKeys(ctx, child, ds); err != nil {
+				return nil, err
+			}
+			cut.insecure = cut.keys == nil
+			if keysTTL < ttl {
+				ttl = keysTTL
+			}
+			break
+		}
+		if findRRset(answers, child, dnsmessage.TypeCNAME) != nil {
+			// Aliases are not zone cuts.
+			break
+		}
+		proof, err := r.verifyDenial(child, msg.Authorities, zone, keys)
+		if err != nil {
+			return nil, err
+		}
+		if proof.insecure {
+			cut.insecure = true
+			break
+		}
+		types, optOut, err := proof.proveNoData(child, typeDS)
+		if err != nil {
+			return nil, bogus(child, typeDS, err)
+		}
+		// A delegation without DS records, as per https://datatracker.ietf.org/doc/html/rfc4035#section-5.2.
+		cut.insecure = optOut || (types.has(dnsmessage.TypeNS) && !types.has(dnsmessage.TypeSOA))
+	case dnsmessage.RCodeNameError:
+		proof, err := r.verifyDenial(child, msg.Authorities, zone, keys)
+		if err != nil {
+			return nil, err
+		}
+		if proof.insecure {
+			cut.insecure = true
+			break
+		}
+		optOut, err := proof.proveNXDomain(child)
+		if err != nil {
+			return nil, bogus(child, typeDS, err)
+		}
+		cut.insecure = optOut
+		cut.nxdomain = !optOut
+	default:
+		return nil, &nestedError{ErrBadResponse, fmt.Errorf("DS query for %v failed with %v", child, msg.RCode)}
+	}
+	r.storeCut(child, cut, ttl)
+	return cut, nil
+}
+
+// verifyDenial checks that the SOA, NSEC and NSEC3 records in authorities are signed by zone.
+func (r *validatingResolver) verifyDenial(name string, authorities []dnsmessage.Resource, zone string, keys []*dnskey) (*denial, error) {
+	found := false
+	for _, set := range groupRRsets(authorities) {
+		if !isDenialType(set.rtype) {
+			continue
+		}
+		found = true
+		if err := r.verifyWithKeys(set, zone, keys); err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, bogus(name, typeDS, errors.New("missing proof of nonexistence"))
+	}
+	proof, err := parseDenial(authorities)
+	if err != nil {
+		return nil, bogus(name, typeDS, err)
+	}
+	return proof, nil
+}
+
+// zoneKeys fetches the DNSKEY records of zone and validates them with the DS records. It returns nil keys
+// if no DS record uses a supported algorithm, which makes the zone insecure.
+func (r *validatingResolver) zoneKeys(ctx context.Context, zone string, dsRecords []*dsRecord) ([]*dnskey, uint32, error) {
+	supported := false
+	for _, ds := range dsRecords {
+		supported = supported || ds.supported()
+	}
+	if !supported {
+		return nil, 0, nil
+	}
+	msg, err := r.query(ctx, zone, typeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, &nestedError{ErrBadResponse, fmt.Errorf("DNSKEY query for %v failed with %v", zone, msg.RCode)}
+	}
+	set := findRRset(groupRRsets(msg.Answers), zone, typeDNSKEY)
+	if set == nil {
+		return nil, 0, bogus(zone, typeDNSKEY, errors.New("missing DNSKEY records"))
+	}
+	var keys, trusted []*dnskey
+	for _, rr := range set.rrs {
+		key, err := parseDNSKEY(rr)
+		if err != nil {
+			return nil, 0, bogus(zone, typeDNSKEY, err)
+		}
+		if key.flags&dnskeyFlagZone == 0 || key.flags&dnskeyFlagRevoke != 0 {
+			continue
+		}
+		keys = append(keys, key)
+		for _, ds := range dsRecords {
+			if ds.matches(zone, key) {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, 0, bogus(zone, typeDNSKEY, errors.New("no DNSKEY matches the DS records"))
+	}
+	if err := r.verifyWithKeys(set, zone, trusted); err != nil {
+		return nil, 0, err
+	}
+	return keys, set.rrs[0].Header.TTL, nil
+}
+
+func (r *validatingResolver) query(ctx context.Context, name string, t dnsmessage.Type) (*dnsmessage.Message, error) {
+	q, err := NewQuestion(name, t)
+	if err != nil {
+		return nil, &nestedError{ErrBadRequest, err}
+	}
+	return r.resolver.queryWithOptions(ctx, *q, requestOptions{dnssecOK: true})
+}
+
+// cutTTL returns the time, in seconds, the zone cut learned from msg can be cached.
+func cutTTL(msg *dnsmessage.Message) uint32 {
+	ttl := uint32(maxZoneCutTTL / time.Second)
+	for _, sections := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities} {
+		for _, rr := range sections {
+			if rr.Header.TTL < ttl {
+				ttl = rr.Header.TTL
+			}
+		}
+	}
+	return ttl
+}
+
+/********** RRsets **********/
+
+// rrSet is a set of records with the same owner, type and class, and the signatures that cover it.
+type rrSet struct {
+	name  string
+	rtype dnsmessage.Type
+	rrs   []dnsmessage.Resource
+	sigs  []*rrsig
+	// verifiedBy is the signature that validated the set, if any.
+	verifiedBy *rrsig
+}
+
+// groupRRsets groups the records of a section into RRsets, and attaches the signatures to them.
+// Malformed signatures are ignored.
+func groupRRsets(rrs []dnsmessage.Resource) []*rrSet {
+	var sets []*rrSet
+	var sigs []dnsmessage.Resource
+	for _, rr := range rrs {
+		switch rr.Header.Type {
+		case typeRRSIG:
+			sigs = append(sigs, rr)
+			continue
+		case dnsmessage.TypeOPT:
+			continue
+		}
+		name := canonicalName(rr.Header.Name)
+		if set := findRRset(sets, name, rr.Header.Type); set != nil {
+			set.rrs = append(set.rrs, rr)
+			continue
+		}
+		sets = append(sets, &rrSet{name: name, rtype: rr.Header.Type, rrs: []dnsmessage.Resource{rr}})
+	}
+	for _, rr := range sigs {
+		sig, err := parseRRSIG(rr)
+		if err != nil {
+			continue
+		}
+		if set := findRRset(sets, canonicalName(rr.Header.Name), sig.typeCovered); set != nil {
+			set.sigs = append(set.sigs, sig)
+		}
+	}
+	return sets
+}
+
+func findRRset(sets []*rrSet, name string, t dnsmessage.Type) *rrSet {
+	for _, set := range sets {
+		if set.name == name && set.rtype == t {
+			return set
+		}
+	}
+	return nil
+}
+
+func isDenialType(t dnsmessage.Type) bool {
+	return t == dnsmessage.TypeSOA || t == typeNSEC || t == typeNSEC3
+}
+
+// signedData returns the data that sig signs, as per https://datatracker.ietf.org/doc/html/rfc4034#section-3.1.8.1.
+func signedData(set *rrSet, sig *rrsig) ([]byte, error) {
+	data := append([]byte(nil), sig.rdata[:18]...)
+	data = appendWireName(data, sig.signer)
+
+	owner := set.name
+	if int(sig.labels) < countLabels(owner) {
+		// The records were synthesized from a wildcard.
+		owner = wildcardName(ancestorName(owner, int(sig.labels)))
+	}
+	rdatas := make([][]byte, 0, len(set.rrs))
+	for _, rr := range set.rrs {
+		rdata, err := canonicalRData(rr)
+		if err != nil {
+			return nil, err
+		}
+		rdatas = append(rdatas, rdata)
+	}
+	// The records are sorted by their canonical RDATA, as per https://datatracker.ietf.org/doc/html/rfc4034#section-6.3.
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+	for i, rdata := range rdatas {
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		data = appendWireName(data, owner)
+		data = binary.BigEndian.AppendUint16(data, uint16(set.rtype))
+		data = binary.BigEndian.AppendUint16(data, uint16(set.rrs[0].Header.Class))
+		data = binary.BigEndian.AppendUint32(data, sig.originalTTL)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(rdata)))
+		data = append(data, rdata...)
+	}
+	return data, nil
+}
+
+// canonicalRData returns the RDATA of rr in canonical form, with uncompressed and lowercase domain names,
+// as per https://datatracker.ietf.org/doc/html/rfc4034#section-6.2.
+func canonicalRData(rr dnsmessage.Resource) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	h := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("."), Type: rr.Header.Type, Class: rr.Header.Class}
+	var err error
+	switch body := rr.Body.(type) {
+	case *dnsmessage.AResource:
+		err = b.AResource(h, *body)
+	case *dnsmessage.AAAAResource:
+		err = b.AAAAResource(h, *body)
+	case *dnsmessage.CNAMEResource:
+		err = b.CNAMEResource(h, dnsmessage.CNAMEResource{CNAME: lowerName(body.CNAME)})
+	case *dnsmessage.NSResource:
+		err = b.NSResource(h, dnsmessage.NSResource{NS: lowerName(body.NS)})
+	case *dnsmessage.PTRResource:
+		err = b.PTRResource(h, dnsmessage.PTRResource{PTR: lowerName(body.PTR)})
+	case *dnsmessage.MXResource:
+		err = b.MXResource(h, dnsmessage.MXResource{Pref: body.Pref, MX: lowerName(body.MX)})
+	case *dnsmessage.SRVResource:
+		srv := *body
+		srv.Target = lowerName(srv.Target)
+		err = b.SRVResource(h, srv)
+	case *dnsmessage.SOAResource:
+		soa := *body
+		soa.NS, soa.MBox = lowerName(soa.NS), lowerName(soa.MBox)
+		err = b.SOAResource(h, soa)
+	case *dnsmessage.TXTResource:
+		err = b.TXTResource(h, *body)
+	case *dnsmessage.UnknownResource:
+		err = b.UnknownResource(h, *body)
+	default:
+		return nil, fmt.Errorf("unsupported record type %v", typeString(rr.Header.Type))
+	}
+	if err != nil {
+		return nil, err
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	// Skip the message header, the root owner name and the fixed fields of the record.
+	return msg[12+1+10:], nil
+}
+
+/********** DNSSEC records **********/
+
+type rrsig struct {
+	typeCovered dnsmessage.Type
+	algorithm   uint8
+	labels      uint8
+	originalTTL uint32
+	expiration  uint32
+	inception   uint32
+	keyTag      uint16
+	signer      string
+	signature   []byte
+	rdata       []byte
+}
+
+func parseRRSIG(rr dnsmessage.Resource) (*rrsig, error) {
+	data, err := unknownRData(rr)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 18 {
+		return nil, errors.New("RRSIG is too short")
+	}
+	signer, n, err := parseWireName(data[18:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid RRSIG signer: %w", err)
+	}
+	return &rrsig{
+		typeCovered: dnsmessage.Type(binary.BigEndian.Uint16(data)),
+		algorithm:   data[2],
+		labels:      data[3],
+		originalTTL: binary.BigEndian.Uint32(data[4:]),
+		expiration:  binary.BigEndian.Uint32(data[8:]),
+		inception:   binary.BigEndian.Uint32(data[12:]),
+		keyTag:      binary.BigEndian.Uint16(data[16:]),
+		signer:      lowerString(signer),
+		signature:   data[18+n:],
+		rdata:       data,
+	}, nil
+}
+
+// validAt reports whether t is in the validity period of the signature, using serial number arithmetic,
+// as per https://datatracker.ietf.org/doc/html/rfc4034#section-3.1.5.
+func (s *rrsig) validAt(t time.Time) bool {
+	now := uint32(t.Unix())
+	return int32(now-s.inception) >= 0 && int32(s.expiration-now) >= 0
+}
+
+type dnskey struct {
+	flags     uint16
+	algorithm uint8
+	keyTag    uint16
+	// publicKey is nil if the algorithm is not supported.
+	publicKey crypto.PublicKey
+	rdata     []byte
+}
+
+func parseDNSKEY(rr dnsmessage.Resource) (*dnskey, error) {
+	data, err := unknownRData(rr)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, errors.New("DNSKEY is too short")
+	}
+	if data[2] != 3 {
+		return nil, fmt.Errorf("DNSKEY has invalid protocol %v", data[2])
+	}
+	key := &dnskey{
+		flags:     binary.BigEndian.Uint16(data),
+		algorithm: data[3],
+		keyTag:    keyTag(data),
+		rdata:     data,
+	}
+	key.publicKey, err = parsePublicKey(key.algorithm, data[4:])
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// keyTag computes the key tag of a DNSKEY RDATA, as per https://datatracker.ietf.org/doc/html/rfc4034#appendix-B.
+func keyTag(rdata []byte) uint16 {
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 1 {
+			ac += uint32(b)
+		} else {
+			ac += uint32(b) << 8
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+	return uint16(ac)
+}
+
+func parsePublicKey(algorithm uint8, key []byte) (crypto.PublicKey, error) {
+	switch algorithm {
+	case algRSASHA256, algRSASHA512:
+		// Format defined in https://datatracker.ietf.org/doc/html/rfc3110#section-2.
+		if len(key) < 1 {
+			return nil, errors.New("RSA key is too short")
+		}
+		expLen := int(key[0])
+		key = key[1:]
+		if expLen == 0 {
+			if len(key) < 2 {
+				return nil, errors.New("RSA key is too short")
+			}
+			expLen = int(binary.BigEndian.Uint16(key))
+			key = key[2:]
+		}
+		if expLen > 4 || expLen >= len(key) {
+			return nil, errors.New("invalid RSA key exponent")
+		}
+		exp := new(big.Int).SetBytes(key[:expLen])
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(key[expLen:]), E: int(exp.Int64())}, nil
+	case algECDSAP256SHA256, algECDSAP384SHA384:
+		// Format defined in https://datatracker.ietf.org/doc/html/rfc6605#section-4.
+		curve := elliptic.P256()
+		if algorithm == algECDSAP384SHA384 {
+			curve = elliptic.P384()
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(key) != 2*size {
+			return nil, errors.New("invalid ECDSA key length")
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(key[:size]),
+			Y:     new(big.Int).SetBytes(key[size:]),
+		}, nil
+	case algED25519:
+		if len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key length")
+		}
+		return ed25519.PublicKey(key), nil
+	default:
+		return nil, nil
+	}
+}
+
+// verify checks that signature is a valid signature of data by the key.
+func (k *dnskey) verify(data, signature []byte) error {
+	switch pub := k.publicKey.(type) {
+	case *rsa.PublicKey:
+		hash := crypto.SHA256
+		if k.algorithm == algRSASHA512 {
+			hash = crypto.SHA512
+		}
+		h := hash.New()
+		h.Write(data)
+		return rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), signature)
+	case *ecdsa.PublicKey:
+		var digest []byte
+		if k.algorithm == algECDSAP384SHA384 {
+			sum := sha512.Sum384(data)
+			digest = sum[:]
+		} else {
+			sum := sha256.Sum256(data)
+			digest = sum[:]
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid ECDSA signature length")
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, data, signature) {
+			return errors.New("invalid Ed25519 signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %v", k.algorithm)
+	}
+}
+
+type dsRecord struct {
+	keyTag     uint16
+	algorithm  uint8
+	digestType uint8
+	digest     []byte
+}
+
+func parseDSRecords(set *rrSet) ([]*dsRecord, error) {
+	records := make([]*dsRecord, 0, len(set.rrs))
+	for _, rr := range set.rrs {
+		data, err := unknownRData(rr)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < 5 {
+			return nil, errors.New("DS is too short")
+		}
+		records = append(records, &dsRecord{
+			keyTag:     binary.BigEndian.Uint16(data),
+			algorithm:  data[2],
+			digestType: data[3],
+			digest:     data[4:],
+		})
+	}
+	return records, nil
+}
+
+func (ds *dsRecord) supported() bool {
+	switch ds.algorithm {
+	case algRSASHA256, algRSASHA512, algECDSAP256SHA256, algECDSAP384SHA384, algED25519:
+	default:
+		return false
+	}
+	return ds.digestType == digestSHA256 || ds.digestType == digestSHA384
+}
+
+// matches reports whether the DS record is the digest of key, as per https://datatracker.ietf.org/doc/html/rfc4034#section-5.1.4.
+func (ds *dsRecord) matches(zone string, key *dnskey) bool {
+	if !ds.supported() || ds.keyTag != key.keyTag || ds.algorithm != key.algorithm {
+		return false
+	}
+	data := append(appendWireName(nil, zone), key.rdata...)
+	var digest []byte
+	if ds.digestType == digestSHA384 {
+		sum := sha512.Sum384(data)
+		digest = sum[:]
+	} else {
+		sum := sha256.Sum256(data)
+		digest = sum[:]
+	}
+	return bytes.Equal(digest, ds.digest)
+}
+
+func unknownRData(rr dnsmessage.Resource) ([]byte, error) {
+	body, ok := rr.Body.(*dnsmessage.UnknownResource)
+	if !ok {
+		return nil, fmt.Errorf("unexpected body for %v record", typeString(rr.Header.Type))
+	}
+	return body.Data, nil
+}
+
+/********** Authenticated denial of existence **********/
+
+// typeBitmap is the type bit maps field of NSEC and NSEC3 records, as per
+// https://datatracker.ietf.org/doc/html/rfc4034#section-4.1.2.
+type typeBitmap []byte
+
+func (b typeBitmap) has(t dnsmessage.Type) bool {
+	window, bit := byte(t>>8), byte(t)
+	for len(b) >= 2 {
+		w, n := b[0], int(b[1])
+		b = b[2:]
+		if n > len(b) {
+			return false
+		}
+		if w == window {
+			i := int(bit / 8)
+			return i < n && b[i]&(0x80>>(bit%8)) != 0
+		}
+		b = b[n:]
+	}
+	return false
+}
+
+// hasData reports whether the bitmap has type t, or a CNAME that would have been followed instead.
+func (b typeBitmap) hasData(t dnsmessage.Type) bool {
+	return b.has(t) || b.has(dnsmessage.TypeCNAME)
+}
+
+type nsecRecord struct {
+	owner string
+	next  string
+	types typeBitmap
+}
+
+// covers reports whether name sorts strictly between the owner and the next name.
+func (n *nsecRecord) covers(name string) bool {
+	if canonicalCompare(n.owner, name) >= 0 {
+		return false
+	}
+	// The last record of the zone points back to the apex.
+	return canonicalCompare(name, n.next) < 0 || canonicalCompare(n.next, n.owner) <= 0
+}
+
+type nsec3Record struct {
+	zone       string
+	hash       []byte
+	flags      uint8
+	iterations uint16
+	salt       []byte
+	next       []byte
+	types      typeBitmap
+}
+
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// hashName computes the hash of name with the parameters of the record, as per
+// https://datatracker.ietf.org/doc/html/rfc5155#section-5.
+func (n *nsec3Record) hashName(name string) []byte {
+	h := sha1.New()
+	h.Write(appendWireName(nil, name))
+	h.Write(n.salt)
+	digest := h.Sum(nil)
+	for i := 0; i < int(n.iterations); i++ {
+		h.Reset()
+		h.Write(digest)
+		h.Write(n.salt)
+		digest = h.Sum(digest[:0])
+	}
+	return digest
+}
+
+func (n *nsec3Record) matches(name string) bool {
+	return isSubdomain(name, n.zone) && bytes.Equal(n.hashName(name), n.hash)
+}
+
+func (n *nsec3Record) covers(name string) bool {
+	if !isSubdomain(name, n.zone) {
+		return false
+	}
+	h := n.hashName(name)
+	if bytes.Compare(n.hash, n.next) < 0 {
+		return bytes.Compare(n.hash, h) < 0 && bytes.Compare(h, n.next) < 0
+	}
+	// The last record of the chain wraps around.
+	return bytes.Compare(n.hash, h) < 0 || bytes.Compare(h, n.next) < 0
+}
+
+// denial holds the NSEC or NSEC3 records of a response.
+type denial struct {
+	nsecs  []*nsecRecord
+	nsec3s []*nsec3Record
+	// insecure is set if the records can't be used, which makes the response insecure.
+	insecure bool
+}
+
+func parseDenial(rrs []dnsmessage.Resource) (*denial, error) {
+	proof := &denial{}
+	for _, rr := range rrs {
+		switch rr.Header.Type {
+		case typeNSEC:
+			data, err := unknownRData(rr)
+			if err != nil {
+				return nil, err
+			}
+			next, n, err := parseWireName(data)
+			if err != nil {
+				return nil, fmt.Errorf("invalid NSEC: %w", err)
+			}
+			proof.nsecs = append(proof.nsecs, &nsecRecord{
+				owner: canonicalName(rr.Header.Name),
+				next:  lowerString(next),
+				types: data[n:],
+			})
+		case typeNSEC3:
+			record, err := parseNSEC3(rr)
+			if err != nil {
+				return nil, err
+			}
+			if record == nil {
+				proof.insecure = true
+				continue
+			}
+			proof.nsec3s = append(proof.nsec3s, record)
+		}
+	}
+	return proof, nil
+}
+
+// parseNSEC3 parses an NSEC3 record. It returns nil if the record uses unsupported parameters.
+func parseNSEC3(rr dnsmessage.Resource) (*nsec3Record, error) {
+	data, err := unknownRData(rr)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 5 || len(data) < 6+int(data[4]) {
+		return nil, errors.New("NSEC3 is too short")
+	}
+	saltLen := int(data[4])
+	hashLen := int(data[5+saltLen])
+	if len(data) < 6+saltLen+hashLen {
+		return nil, errors.New("NSEC3 is too short")
+	}
+	owner := canonicalName(rr.Header.Name)
+	labels := nameLabels(owner)
+	if len(labels) == 0 {
+		return nil, errors.New("NSEC3 owner has no hash")
+	}
+	hash, err := nsec3Encoding.DecodeString(strings.ToUpper(labels[0]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid NSEC3 owner hash: %w", err)
+	}
+	record := &nsec3Record{
+		zone:       parentName(owner),
+		hash:       hash,
+		flags:      data[1],
+		iterations: binary.BigEndian.Uint16(data[2:]),
+		salt:       data[5 : 5+saltLen],
+		next:       data[6+saltLen : 6+saltLen+hashLen],
+		types:      data[6+saltLen+hashLen:],
+	}
+	if data[0] != nsec3HashSHA1 || record.iterations > maxNSEC3Iterations {
+		return nil, nil
+	}
+	return record, nil
+}
+
+// proveNXDomain checks that the records prove that name doesn't exist, as per
+// https://datatracker.ietf.org/doc/html/rfc4035#section-5.4 and https://datatracker.ietf.org/doc/html/rfc5155#section-8.4.
+// It returns true if the proof relies on an opt-out NSEC3 record, which makes the response insecure.
+func (d *denial) proveNXDomain(name string) (bool, error) {
+	if len(d.nsecs) > 0 {
+		covering := d.coveringNSEC(name)
+		if covering == nil {
+			return false, errors.New("no NSEC covers the name")
+		}
+		wildcard := wildcardName(d.nsecClosestEncloser(name, covering))
+		if d.coveringNSEC(wildcard) == nil {
+			return false, errors.New("no NSEC covers the wildcard")
+		}
+		return false, nil
+	}
+	closestEncloser, optOut, err := d.nsec3ClosestEncloser(name)
+	if err != nil {
+		return false, err
+	}
+	if d.coveringNSEC3(wildcardName(closestEncloser)) == nil {
+		return false, errors.New("no NSEC3 covers the wildcard")
+	}
+	return optOut, nil
+}
+
+// proveNoData checks that the records prove that name has no records of type t, as per
+// https://datatracker.ietf.org/doc/html/rfc4035#section-5.4 and https://datatracker.ietf.org/doc/html/rfc5155#section-8.5.
+// It returns the types that exist at name, and true if the proof relies on an opt-out NSEC3 record.
+func (d *denial) proveNoData(name string, t dnsmessage.Type) (typeBitmap, bool, error) {
+	if len(d.nsecs) > 0 {
+		for _, n := range d.nsecs {
+			if n.owner == name {
+				if n.types.hasData(t) {
+					return nil, false, errors.New("NSEC shows that the type exists")
+				}
+				return n.types, false, nil
+			}
+		}
+		covering := d.coveringNSEC(name)
+		if covering == nil {
+			return nil, false, errors.New("no NSEC matches the name")
+		}
+		if isSubdomain(covering.next, name) {
+			// name is an empty non-terminal.
+			return nil, false, nil
+		}
+		wildcard := wildcardName(d.nsecClosestEncloser(name, covering))
+		for _, n := range d.nsecs {
+			if n.owner == wildcard && !n.types.hasData(t) {
+				return n.types, false, nil
+			}
+		}
+		return nil, false, errors.New("no NSEC matches the name")
+	}
+	for _, n := range d.nsec3s {
+		if n.matches(name) {
+			if n.types.hasData(t) {
+				return nil, false, errors.New("NSEC3 shows that the type exists")
+			}
+			return n.types, false, nil
+		}
+	}
+	closestEncloser, optOut, err := d.nsec3ClosestEncloser(name)
+	if err != nil {
+		return nil, false, err
+	}
+	if t == typeDS && optOut {
+		// An insecure delegation in an opt-out span.
+		return nil, true, nil
+	}
+	wildcard := wildcardName(closestEncloser)
+	for _, n := range d.nsec3s {
+		if n.matches(wildcard) && !n.types.hasData(t) {
+			return n.types, false, nil
+		}
+	}
+	return nil, false, errors.New("no NSEC3 matches the name")
+}
+
+// proveWildcardExpansion checks that the records prove that the owner of records synthesized from a wildcard
+// doesn't exist, as per https://datatracker.ietf.org/doc/html/rfc4035#section-5.3.4.
+func (d *denial) proveWildcardExpansion(owner string, labels int) error {
+	if len(d.nsecs) > 0 {
+		if d.coveringNSEC(owner) == nil {
+			return errors.New("no NSEC covers the wildcard expansion")
+		}
+		return nil
+	}
+	if d.coveringNSEC3(ancestorName(owner, labels+1)) == nil {
+		return errors.New("no NSEC3 covers the wildcard expansion")
+	}
+	return nil
+}
+
+func (d *denial) coveringNSEC(name string) *nsecRecord {
+	for _, n := range d.nsecs {
+		if n.covers(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+func (d *denial) coveringNSEC3(name string) *nsec3Record {
+	for _, n := range d.nsec3s {
+		if n.covers(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+// nsecClosestEncloser returns the closest existing ancestor of name, given the NSEC record that covers it.
+func (d *denial) nsecClosestEncloser(name string, covering *nsecRecord) string {
+	encloser := commonAncestor(name, covering.owner)
+	if next := commonAncestor(name, covering.next); countLabels(next) > countLabels(encloser) {
+		encloser = next
+	}
+	return encloser
+}
+
+// nsec3ClosestEncloser finds the closest encloser of name, and checks that the next closer name is covered, as per
+// https://datatracker.ietf.org/doc/html/rfc5155#section-8.3. It returns whether the covering record has opt-out set.
+func (d *denial) nsec3ClosestEncloser(name string) (string, bool, error) {
+	for n := countLabels(name) - 1; n >= 0; n-- {
+		encloser := ancestorName(name, n)
+		matched := false
+		for _, record := range d.nsec3s {
+			if record.matches(encloser) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		covering := d.coveringNSEC3(ancestorName(name, n+1))
+		if covering == nil {
+			return "", false, errors.New("no NSEC3 covers the next closer name")
+		}
+		return encloser, covering.flags&nsec3FlagOptOut != 0, nil
+	}
+	return "", false, errors.New("no NSEC3 matches the closest encloser")
+}
+
+/********** Domain names **********/
+
+// canonicalName returns the lowercase text form of name.
+func canonicalName(name dnsmessage.Name) string {
+	return lowerName(name).String()
+}
+
+func lowerName(name dnsmessage.Name) dnsmessage.Name {
+	for i := 0; i < int(name.Length); i++ {
+		name.Data[i] = lowerASCII(name.Data[i])
+	}
+	return name
+}
+
+// lowerASCII returns the lowercase form of an ASCII letter. Unlike foldCase, it's used for the canonical form
+// of names, which is lowercase.
+func lowerASCII(char byte) byte {
+	if 'A' <= char && char <= 'Z' {
+		return char - 'A' + 'a'
+	}
+	return char
+}
+
+// lowerString returns s with the ASCII letters in lowercase.
+func lowerString(s string) string {
+	b := []byte(s)
+	for i := range b {
+		b[i] = lowerASCII(b[i])
+	}
+	return string(b)
+}
+
+func nameLabels(name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// countLabels returns the number of labels of name, not counting the root or a leading wildcard label,
+// as per https://datatracker.ietf.org/doc/html/rfc4034#section-3.1.3.
+func countLabels(name string) int {
+	labels := nameLabels(name)
+	if len(labels) > 0 && labels[0] == "*" {
+		return len(labels) - 1
+	}
+	return len(labels)
+}
+
+// ancestorName returns the name formed by the last n labels of name.
+func ancestorName(name string, n int) string {
+	labels := nameLabels(name)
+	if n <= 0 {
+		return "."
+	}
+	if n >= len(labels) {
+		return name
+	}
+	return strings.Join(labels[len(labels)-n:], ".") + "."
+}
+
+func parentName(name string) string {
+	return ancestorName(name, len(nameLabels(name))-1)
+}
+
+func wildcardName(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
+
+// isSubdomain reports whether child is parent or a descendant of it.
+func isSubdomain(child, parent string) bool {
+	return parent == "." || child == parent || strings.HasSuffix(child, "."+parent)
+}
+
+// commonAncestor returns the longest name that a and b descend from.
+func commonAncestor(a, b string) string {
+	la, lb := nameLabels(a), nameLabels(b)
+	n := 0
+	for n < len(la) && n < len(lb) && la[len(la)-1-n] == lb[len(lb)-1-n] {
+		n++
+	}
+	return ancestorName(a, n)
+}
+
+// canonicalCompare compares names in the canonical order of https://datatracker.ietf.org/doc/html/rfc4034#section-6.1.
+func canonicalCompare(a, b string) int {
+	la, lb := nameLabels(a), nameLabels(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func appendWireName(b []byte, name string) []byte {
+	for _, label := range nameLabels(name) {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// parseWireName parses an uncompressed domain name, and returns it with the number of bytes it used.
+func parseWireName(data []byte) (string, int, error) {
+	var name strings.Builder
+	offset := 0
+	for {
+		if offset >= len(data) {
+			return "", 0, errors.New("name is truncated")
+		}
+		length := int(data[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		if length > 63 || offset+length > len(data) {
+			return "", 0, errors.New("invalid label")
+		}
+		name.Write(data[offset : offset+length])
+		name.WriteByte('.')
+		offset += length
+	}
+	if name.Len() == 0 {
+		return ".", offset, nil
+	}
+	return name.String(), offset, nil
+}
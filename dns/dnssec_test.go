@@ -0,0 +1,635 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestValidatingResolver_SecureAnswer(t *testing.T) {
+	env := newTestDNSSEC(t, nil)
+	resp, err := env.resolver.Query(context.Background(), mustNewQuestion(t, "www.example.test.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	require.True(t, resp.AuthenticData)
+	require.Equal(t, []dnsmessage.ResourceBody{&dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}}, answerBodies(resp, dnsmessage.TypeA))
+	require.Zero(t, env.withoutDO.Load())
+}
+
+func TestValidatingResolver_CNAME(t *testing.T) {
+	env := newTestDNSSEC(t, nil)
+	resp, err := env.resolver.Query(context.Background(), mustNewQuestion(t, "alias.example.test.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	require.True(t, resp.AuthenticData)
+	require.Len(t, answerBodies(resp, dnsmessage.TypeCNAME), 1)
+	require.Equal(t, []dnsmessage.ResourceBody{&dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}}, answerBodies(resp, dnsmessage.TypeA))
+}
+
+func TestValidatingResolver_Wildcard(t *testing.T) {
+	env := newTestDNSSEC(t, nil)
+	resp, err := env.resolver.Query(context.Background(), mustNewQuestion(t, "foo.wild.example.test.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	require.True(t, resp.AuthenticData)
+	require.Equal(t, []dnsmessage.ResourceBody{&dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}}}, answerBodies(resp, dnsmessage.TypeA))
+}
+
+func TestValidatingResolver_NXDomain(t *testing.T) {
+	env := newTestDNSSEC(t, nil)
+	// example.test. uses NSEC and test. uses NSEC3.
+	for _, name := range []string{"nope.example.test.", "nope.test."} {
+		resp, err := env.resolver.Query(context.Background(), mustNewQuestion(t, name, dnsmessage.TypeA))
+		require.NoError(t, err, name)
+		require.Equal(t, dnsmessage.RCodeNameError, resp.RCode, name)
+		require.True(t, resp.AuthenticData, name)
+	}
+}
+
+func TestValidatingResolver_NoData(t *testing.T) {
+	env := newTestDNSSEC(t, nil)
+	for _, name := range []string{"www.example.test.", "test."} {
+		resp, err := env.resolver.Query(context.Background(), mustNewQuestion(t, name, dnsmessage.TypeAAAA))
+		require.NoError(t, err, name)
+		require.Equal(t, dnsmessage.RCodeSuccess, resp.RCode, name)
+		require.Empty(t, answerBodies(resp, dnsmessage.TypeAAAA), name)
+		require.True(t, resp.AuthenticData, name)
+	}
+}
+
+func TestValidatingResolver_InsecureDelegation(t *testing.T) {
+	env := newTestDNSSEC(t, nil)
+	resp, err := env.resolver.Query(context.Background(), mustNewQuestion(t, "www.insecure.test.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	require.False(t, resp.AuthenticData)
+	require.Equal(t, []dnsmessage.ResourceBody{&dnsmessage.AResource{A: [4]byte{192, 0, 2, 3}}}, answerBodies(resp, dnsmessage.TypeA))
+}
+
+func TestValidatingResolver_NoTrustAnchor(t *testing.T) {
+	env := newTestDNSSEC(t, nil)
+	resolver, err := NewValidatingResolver(env.inner, ValidatingResolverOptions{
+		TrustAnchors: []TrustAnchor{{Zone: "other.", KeyTag: 1, Algorithm: algED25519, DigestType: digestSHA256, Digest: make([]byte, 32)}},
+	})
+	require.NoError(t, err)
+	resp, err := resolver.Query(context.Background(), mustNewQuestion(t, "www.example.test.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	require.False(t, resp.AuthenticData)
+	require.Len(t, answerBodies(resp, dnsmessage.TypeA), 1)
+}
+
+func TestValidatingResolver_TamperedAnswer(t *testing.T) {
+	env := newTestDNSSEC(t, func(q dnsmessage.Question, msg *dnsmessage.Message) {
+		for _, rr := range msg.Answers {
+			if a, ok := rr.Body.(*dnsmessage.AResource); ok {
+				a.A = [4]byte{203, 0, 113, 1}
+			}
+		}
+	})
+	_, err := env.resolver.Query(context.Background(), mustNewQuestion(t, "www.example.test.", dnsmessage.TypeA))
+	require.ErrorIs(t, err, ErrBadResponse)
+	var bogusErr *BogusError
+	require.ErrorAs(t, err, &bogusErr)
+	require.Equal(t, "www.example.test.", bogusErr.Name)
+	require.Equal(t, dnsmessage.TypeA, bogusErr.Type)
+}
+
+func TestValidatingResolver_MissingSignature(t *testing.T) {
+	env := newTestDNSSEC(t, func(q dnsmessage.Question, msg *dnsmessage.Message) {
+		if q.Type == dnsmessage.TypeA {
+			msg.Answers = withoutType(msg.Answers, typeRRSIG)
+		}
+	})
+	_, err := env.resolver.Query(context.Background(), mustNewQuestion(t, "www.example.test.", dnsmessage.TypeA))
+	var bogusErr *BogusError
+	require.ErrorAs(t, err, &bogusErr)
+	require.Equal(t, "missing signature", bogusErr.Reason)
+}
+
+func TestValidatingResolver_ForgedNXDomain(t *testing.T) {
+	env := newTestDNSSEC(t, func(q dnsmessage.Question, msg *dnsmessage.Message) {
+		if q.Type == dnsmessage.TypeA {
+			// Keep the signed SOA, but drop the answer and the NSEC records.
+			msg.RCode = dnsmessage.RCodeNameError
+			msg.Answers = nil
+			msg.Authorities = withoutType(withoutType(msg.Authorities, typeNSEC), typeNSEC3)
+		}
+	})
+	_, err := env.resolver.Query(context.Background(), mustNewQuestion(t, "www.example.test.", dnsmessage.TypeA))
+	var bogusErr *BogusError
+	require.ErrorAs(t, err, &bogusErr)
+}
+
+func TestValidatingResolver_StrippedInsecureDelegation(t *testing.T) {
+	// Removing the DS records of a signed zone must not make it look insecure.
+	env := newTestDNSSEC(t, func(q dnsmessage.Question, msg *dnsmessage.Message) {
+		if q.Type == typeDS {
+			msg.Answers = nil
+		}
+	})
+	_, err := env.resolver.Query(context.Background(), mustNewQuestion(t, "www.example.test.", dnsmessage.TypeA))
+	var bogusErr *BogusError
+	require.ErrorAs(t, err, &bogusErr)
+}
+
+func TestValidatingResolver_ExpiredSignatures(t *testing.T) {
+	env := newTestDNSSEC(t, nil)
+	env.resolver.(*validatingResolver).now = func() time.Time { return time.Now().Add(48 * time.Hour) }
+	_, err := env.resolver.Query(context.Background(), mustNewQuestion(t, "www.example.test.", dnsmessage.TypeA))
+	var bogusErr *BogusError
+	require.ErrorAs(t, err, &bogusErr)
+	require.Contains(t, bogusErr.Reason, "expired")
+}
+
+func TestValidatingResolver_WrongTrustAnchor(t *testing.T) {
+	env := newTestDNSSEC(t, nil)
+	anchor := env.anchor
+	anchor.Digest = make([]byte, len(anchor.Digest))
+	resolver, err := NewValidatingResolver(env.inner, ValidatingResolverOptions{TrustAnchors: []TrustAnchor{anchor}})
+	require.NoError(t, err)
+	_, err = resolver.Query(context.Background(), mustNewQuestion(t, "www.example.test.", dnsmessage.TypeA))
+	var bogusErr *BogusError
+	require.ErrorAs(t, err, &bogusErr)
+	require.Equal(t, typeDNSKEY, bogusErr.Type)
+}
+
+func TestValidatingResolver_ServerFailure(t *testing.T) {
+	env := newTestDNSSEC(t, func(q dnsmessage.Question, msg *dnsmessage.Message) {
+		msg.RCode = dnsmessage.RCodeServerFailure
+		msg.Answers, msg.Authorities = nil, nil
+	})
+	resp, err := env.resolver.Query(context.Background(), mustNewQuestion(t, "www.example.test.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, dnsmessage.RCodeServerFailure, resp.RCode)
+	require.False(t, resp.AuthenticData)
+}
+
+func TestNewValidatingResolver_InvalidArguments(t *testing.T) {
+	_, err := NewValidatingResolver(nil, ValidatingResolverOptions{})
+	require.Error(t, err)
+	inner := NewUDPResolver(&transport.UDPDialer{}, "127.0.0.1")
+	_, err = NewValidatingResolver(inner, ValidatingResolverOptions{TrustAnchors: []TrustAnchor{}})
+	require.Error(t, err)
+	_, err = NewValidatingResolver(inner, ValidatingResolverOptions{TrustAnchors: []TrustAnchor{{Zone: "."}}})
+	require.Error(t, err)
+	resolver, err := NewValidatingResolver(inner, ValidatingResolverOptions{})
+	require.NoError(t, err)
+	require.Len(t, resolver.(*validatingResolver).anchors["."], 2)
+
+	// The DNSSEC OK bit would not reach the requests of resolvers that combine or cache other resolvers.
+	_, err = NewValidatingResolver(answerResolver(1), ValidatingResolverOptions{})
+	require.Error(t, err)
+	cache, err := NewCachingResolver(inner, CachingResolverOptions{})
+	require.NoError(t, err)
+	_, err = NewValidatingResolver(cache, ValidatingResolverOptions{})
+	require.Error(t, err)
+	// EDNS(0) resolvers pass it through.
+	edns0, err := NewEDNS0Resolver(inner, EDNS0Options{PaddingBlockSize: RecommendedPaddingBlockSize})
+	require.NoError(t, err)
+	_, err = NewValidatingResolver(edns0, ValidatingResolverOptions{})
+	require.NoError(t, err)
+}
+
+func Test_canonicalCompare(t *testing.T) {
+	// Example from https://datatracker.ietf.org/doc/html/rfc4034#section-6.1.
+	ordered := []string{"example.", "a.example.", "yljkjljk.a.example.", "z.a.example.", "zabc.a.example.",
+		"z.example.", "\x01.z.example.", "*.z.example.", "\x80.z.example."}
+	for i := 1; i < len(ordered); i++ {
+		require.Negative(t, canonicalCompare(ordered[i-1], ordered[i]), ordered[i])
+		require.Positive(t, canonicalCompare(ordered[i], ordered[i-1]), ordered[i])
+	}
+	require.Zero(t, canonicalCompare("a.example.", "a.example."))
+}
+
+func Test_typeBitmap(t *testing.T) {
+	bitmap := typeBitmap(appendTypeBitmap(nil, []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeMX, typeRRSIG, typeNSEC, 1234}))
+	for _, rtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeMX, typeRRSIG, typeNSEC, 1234} {
+		require.True(t, bitmap.has(rtype), rtype)
+	}
+	for _, rtype := range []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeNS, typeDS, 1235} {
+		require.False(t, bitmap.has(rtype), rtype)
+	}
+}
+
+/********** Test Utilities **********/
+
+// testDNSSEC serves a hierarchy of signed fixture zones over DNS-over-TCP:
+//
+//   - . is signed with ECDSA P-256 and NSEC.
+//   - test. is signed with Ed25519 and NSEC3.
+//   - example.test. is signed with ECDSA P-384 and NSEC. It has www, alias (a CNAME for www) and *.wild.
+//   - insecure.test. is an unsigned delegation, with www.
+type testDNSSEC struct {
+	zones []*testZone
+	// anchor is the trust anchor of the root zone.
+	anchor TrustAnchor
+	tamper func(q dnsmessage.Question, msg *dnsmessage.Message)
+	// withoutDO counts the queries without the DNSSEC OK bit.
+	withoutDO atomic.Int32
+	inner     Resolver
+	resolver  Resolver
+}
+
+// newTestDNSSEC starts the server. If tamper is not nil, it can modify the responses.
+func newTestDNSSEC(t *testing.T, tamper func(q dnsmessage.Question, msg *dnsmessage.Message)) *testDNSSEC {
+	root := newTestZone(t, ".", algECDSAP256SHA256, false)
+	tld := newTestZone(t, "test.", algED25519, true)
+	example := newTestZone(t, "example.test.", algECDSAP384SHA384, false)
+	insecure := newTestZone(t, "insecure.test.", 0, false)
+
+	example.add("www.example.test.", &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+	example.add("alias.example.test.", &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("WWW.Example.Test.")})
+	example.add("*.wild.example.test.", &dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}})
+	insecure.add("www.insecure.test.", &dnsmessage.AResource{A: [4]byte{192, 0, 2, 3}})
+	root.delegate(tld)
+	tld.delegate(example)
+	tld.delegate(insecure)
+	env := &testDNSSEC{zones: []*testZone{root, tld, example, insecure}, tamper: tamper}
+	for _, zone := range env.zones {
+		zone.finish(t)
+	}
+	env.anchor = TrustAnchor{Zone: ".", KeyTag: root.keyTag, Algorithm: root.algorithm, DigestType: digestSHA256, Digest: root.digest()}
+
+	server := newTestTCPServer(t)
+	server.respond = env.respond
+	env.inner = NewTCPResolver(&transport.TCPDialer{}, server.Addr())
+	var err error
+	env.resolver, err = NewValidatingResolver(env.inner, ValidatingResolverOptions{TrustAnchors: []TrustAnchor{env.anchor}})
+	require.NoError(t, err)
+	return env
+}
+
+func (env *testDNSSEC) respond(req dnsmessage.Message) (dnsmessage.Message, error) {
+	q := req.Questions[0]
+	dnssecOK := false
+	for _, rr := range req.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			dnssecOK = rr.Header.DNSSECAllowed()
+		}
+	}
+	if !dnssecOK {
+		env.withoutDO.Add(1)
+	}
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: req.ID, Response: true, RecursionDesired: true, RecursionAvailable: true},
+		Questions: req.Questions,
+	}
+	env.answer(&resp, canonicalName(q.Name), q.Type, 0)
+	if !dnssecOK {
+		for _, rtype := range []dnsmessage.Type{typeRRSIG, typeNSEC, typeNSEC3} {
+			resp.Answers = withoutType(resp.Answers, rtype)
+			resp.Authorities = withoutType(resp.Authorities, rtype)
+		}
+	}
+	if env.tamper != nil {
+		env.tamper(q, &resp)
+	}
+	return resp, nil
+}
+
+// answer adds the answer to the question to resp, like a recursive resolver would.
+func (env *testDNSSEC) answer(resp *dnsmessage.Message, name string, rtype dnsmessage.Type, depth int) {
+	zone := env.zoneFor(name, rtype)
+	if rrs := zone.rrsetWithSig(name, rtype); rrs != nil {
+		resp.Answers = append(resp.Answers, rrs...)
+		return
+	}
+	if rrs := zone.rrsetWithSig(name, dnsmessage.TypeCNAME); rrs != nil && depth < 8 {
+		resp.Answers = append(resp.Answers, rrs...)
+		env.answer(resp, canonicalName(rrs[0].Body.(*dnsmessage.CNAMEResource).CNAME), rtype, depth+1)
+		return
+	}
+	resp.Authorities = append(resp.Authorities, zone.denialRRs...)
+	if zone.exists(name) {
+		return
+	}
+	closestEncloser := name
+	for !zone.exists(closestEncloser) {
+		closestEncloser = parentName(closestEncloser)
+	}
+	if rrs := zone.rrsetWithSig(wildcardName(closestEncloser), rtype); rrs != nil {
+		for _, rr := range rrs {
+			rr.Header.Name = dnsmessage.MustNewName(name)
+			resp.Answers = append(resp.Answers, rr)
+		}
+		return
+	}
+	resp.RCode = dnsmessage.RCodeNameError
+}
+
+// zoneFor returns the zone that is authoritative for the records. DS records are served by the parent zone.
+func (env *testDNSSEC) zoneFor(name string, rtype dnsmessage.Type) *testZone {
+	var best *testZone
+	for _, zone := range env.zones {
+		if !isSubdomain(name, zone.name) || (rtype == typeDS && name == zone.name && name != ".") {
+			continue
+		}
+		if best == nil || countLabels(zone.name) > countLabels(best.name) {
+			best = zone
+		}
+	}
+	return best
+}
+
+// testZone is a zone signed with a single key, or an unsigned zone if the algorithm is 0.
+type testZone struct {
+	name      string
+	algorithm uint8
+	key       crypto.Signer
+	dnskey    []byte
+	keyTag    uint16
+	nsec3     bool
+	// Records by owner name and type. The signatures are stored as RRSIG records keyed by the type they cover.
+	rrsets map[string]map[dnsmessage.Type][]dnsmessage.Resource
+	sigs   map[string]map[dnsmessage.Type]dnsmessage.Resource
+	// denialRRs are the signed SOA, NSEC and NSEC3 records for negative responses.
+	denialRRs []dnsmessage.Resource
+}
+
+func newTestZone(t *testing.T, name string, algorithm uint8, nsec3 bool) *testZone {
+	zone := &testZone{
+		name:      name,
+		algorithm: algorithm,
+		nsec3:     nsec3,
+		rrsets:    make(map[string]map[dnsmessage.Type][]dnsmessage.Resource),
+		sigs:      make(map[string]map[dnsmessage.Type]dnsmessage.Resource),
+	}
+	var pub []byte
+	switch algorithm {
+	case 0:
+		return zone
+	case algECDSAP256SHA256, algECDSAP384SHA384:
+		curve := elliptic.P256()
+		if algorithm == algECDSAP384SHA384 {
+			curve = elliptic.P384()
+		}
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		require.NoError(t, err)
+		ecdhKey, err := key.PublicKey.ECDH()
+		require.NoError(t, err)
+		// Drop the uncompressed point prefix.
+		zone.key, pub = key, ecdhKey.Bytes()[1:]
+	case algED25519:
+		edPub, key, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		zone.key, pub = key, edPub
+	}
+	zone.dnskey = append([]byte{0x01, 0x01, 3, algorithm}, pub...)
+	zone.keyTag = keyTag(zone.dnskey)
+	return zone
+}
+
+func (z *testZone) add(name string, body dnsmessage.ResourceBody) {
+	rtype := dnsmessage.TypeA
+	switch body := body.(type) {
+	case *dnsmessage.CNAMEResource:
+		rtype = dnsmessage.TypeCNAME
+	case *dnsmessage.NSResource:
+		rtype = dnsmessage.TypeNS
+	case *dnsmessage.SOAResource:
+		rtype = dnsmessage.TypeSOA
+	case *dnsmessage.UnknownResource:
+		rtype = body.Type
+	}
+	if z.rrsets[name] == nil {
+		z.rrsets[name] = make(map[dnsmessage.Type][]dnsmessage.Resource)
+	}
+	z.rrsets[name][rtype] = append(z.rrsets[name][rtype], dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: rtype, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   body,
+	})
+}
+
+// digest returns the SHA-256 digest of the key, for DS records.
+func (z *testZone) digest() []byte {
+	sum := sha256.Sum256(append(appendWireName(nil, z.name), z.dnskey...))
+	return sum[:]
+}
+
+// delegate adds the NS records of the child zone and, if it's signed, its DS record.
+func (z *testZone) delegate(child *testZone) {
+	z.add(child.name, &dnsmessage.NSResource{NS: dnsmessage.MustNewName(subdomain("ns", child.name))})
+	if child.algorithm != 0 {
+		ds := binary.BigEndian.AppendUint16(nil, child.keyTag)
+		ds = append(append(ds, child.algorithm, digestSHA256), child.digest()...)
+		z.add(child.name, &dnsmessage.UnknownResource{Type: typeDS, Data: ds})
+	}
+}
+
+// finish adds the SOA and DNSKEY records and the NSEC or NSEC3 chain, and signs the zone.
+func (z *testZone) finish(t *testing.T) {
+	z.add(z.name, &dnsmessage.SOAResource{
+		NS: dnsmessage.MustNewName(subdomain("ns", z.name)), MBox: dnsmessage.MustNewName(subdomain("hostmaster", z.name)),
+		Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: 300,
+	})
+	if z.algorithm == 0 {
+		z.denialRRs = z.rrsets[z.name][dnsmessage.TypeSOA]
+		return
+	}
+	z.add(z.name, &dnsmessage.UnknownResource{Type: typeDNSKEY, Data: z.dnskey})
+
+	var owners []string
+	for owner := range z.rrsets {
+		owners = append(owners, owner)
+	}
+	sort.Slice(owners, func(i, j int) bool { return canonicalCompare(owners[i], owners[j]) < 0 })
+	for owner, rrsets := range z.rrsets {
+		for rtype, rrs := range rrsets {
+			if rtype == dnsmessage.TypeNS && owner != z.name {
+				// Delegations are not signed.
+				continue
+			}
+			if z.sigs[owner] == nil {
+				z.sigs[owner] = make(map[dnsmessage.Type]dnsmessage.Resource)
+			}
+			z.sigs[owner][rtype] = z.sign(t, rrs)
+		}
+	}
+	z.denialRRs = z.rrsetWithSig(z.name, dnsmessage.TypeSOA)
+	if z.nsec3 {
+		z.addNSEC3Chain(t, owners)
+	} else {
+		z.addNSECChain(t, owners)
+	}
+}
+
+func (z *testZone) ownerTypes(owner string, extra ...dnsmessage.Type) []dnsmessage.Type {
+	types := extra
+	for rtype := range z.rrsets[owner] {
+		types = append(types, rtype)
+	}
+	return types
+}
+
+func (z *testZone) addNSECChain(t *testing.T, owners []string) {
+	for i, owner := range owners {
+		next := owners[(i+1)%len(owners)]
+		data := appendWireName(nil, next)
+		data = appendTypeBitmap(data, z.ownerTypes(owner, typeRRSIG, typeNSEC))
+		rr := dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(owner), Type: typeNSEC, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.UnknownResource{Type: typeNSEC, Data: data},
+		}
+		z.denialRRs = append(z.denialRRs, rr, z.sign(t, []dnsmessage.Resource{rr}))
+	}
+}
+
+func (z *testZone) addNSEC3Chain(t *testing.T, owners []string) {
+	params := &nsec3Record{iterations: 2, salt: []byte{0xab, 0xcd}}
+	type hashedOwner struct {
+		hash  []byte
+		owner string
+	}
+	var hashed []hashedOwner
+	for _, owner := range owners {
+		hashed = append(hashed, hashedOwner{params.hashName(owner), owner})
+	}
+	sort.Slice(hashed, func(i, j int) bool { return string(hashed[i].hash) < string(hashed[j].hash) })
+	for i, h := range hashed {
+		next := hashed[(i+1)%len(hashed)].hash
+		data := []byte{nsec3HashSHA1, 0, 0, byte(params.iterations), byte(len(params.salt))}
+		data = append(data, params.salt...)
+		data = append(append(data, byte(len(next))), next...)
+		data = appendTypeBitmap(data, z.ownerTypes(h.owner, typeRRSIG))
+		rr := dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name: dnsmessage.MustNewName(subdomain(nsec3Encoding.EncodeToString(h.hash), z.name)),
+				Type: typeNSEC3, Class: dnsmessage.ClassINET, TTL: 300,
+			},
+			Body: &dnsmessage.UnknownResource{Type: typeNSEC3, Data: data},
+		}
+		z.denialRRs = append(z.denialRRs, rr, z.sign(t, []dnsmessage.Resource{rr}))
+	}
+}
+
+// sign returns the RRSIG record for the RRset, valid for a day before and after now.
+func (z *testZone) sign(t *testing.T, rrs []dnsmessage.Resource) dnsmessage.Resource {
+	owner := canonicalName(rrs[0].Header.Name)
+	now := time.Now()
+	rdata := binary.BigEndian.AppendUint16(nil, uint16(rrs[0].Header.Type))
+	rdata = append(rdata, z.algorithm, byte(countLabels(owner)))
+	rdata = binary.BigEndian.AppendUint32(rdata, rrs[0].Header.TTL)
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(now.Add(24*time.Hour).Unix()))
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(now.Add(-24*time.Hour).Unix()))
+	rdata = binary.BigEndian.AppendUint16(rdata, z.keyTag)
+	rdata = appendWireName(rdata, z.name)
+	sigRR := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: rrs[0].Header.Name, Type: typeRRSIG, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.UnknownResource{Type: typeRRSIG, Data: rdata},
+	}
+	sig, err := parseRRSIG(sigRR)
+	require.NoError(t, err)
+	data, err := signedData(&rrSet{name: owner, rtype: rrs[0].Header.Type, rrs: rrs}, sig)
+	require.NoError(t, err)
+
+	var signature []byte
+	switch key := z.key.(type) {
+	case *ecdsa.PrivateKey:
+		var digest []byte
+		if z.algorithm == algECDSAP384SHA384 {
+			sum := sha512.Sum384(data)
+			digest = sum[:]
+		} else {
+			sum := sha256.Sum256(data)
+			digest = sum[:]
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		require.NoError(t, err)
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, data)
+	}
+	sigRR.Body = &dnsmessage.UnknownResource{Type: typeRRSIG, Data: append(rdata, signature...)}
+	return sigRR
+}
+
+func (z *testZone) rrsetWithSig(name string, rtype dnsmessage.Type) []dnsmessage.Resource {
+	rrs := z.rrsets[name][rtype]
+	if rrs == nil {
+		return nil
+	}
+	rrs = append([]dnsmessage.Resource(nil), rrs...)
+	if sig, ok := z.sigs[name][rtype]; ok {
+		rrs = append(rrs, sig)
+	}
+	return rrs
+}
+
+// exists reports whether the zone has records at name or below it.
+func (z *testZone) exists(name string) bool {
+	for owner := range z.rrsets {
+		if isSubdomain(owner, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func appendTypeBitmap(b []byte, types []dnsmessage.Type) []byte {
+	var windows [256][]byte
+	for _, rtype := range types {
+		window, bit := rtype>>8, byte(rtype)
+		for len(windows[window]) <= int(bit/8) {
+			windows[window] = append(windows[window], 0)
+		}
+		windows[window][bit/8] |= 0x80 >> (bit % 8)
+	}
+	for window, bits := range windows {
+		if len(bits) > 0 {
+			b = append(append(b, byte(window), byte(len(bits))), bits...)
+		}
+	}
+	return b
+}
+
+func subdomain(label, name string) string {
+	if name == "." {
+		return label + "."
+	}
+	return label + "." + name
+}
+
+func withoutType(rrs []dnsmessage.Resource, rtype dnsmessage.Type) []dnsmessage.Resource {
+	var filtered []dnsmessage.Resource
+	for _, rr := range rrs {
+		if rr.Header.Type != rtype {
+			filtered = append(filtered, rr)
+		}
+	}
+	return filtered
+}
+
+func answerBodies(msg *dnsmessage.Message, rtype dnsmessage.Type) []dnsmessage.ResourceBody {
+	var bodies []dnsmessage.ResourceBody
+	for _, rr := range msg.Answers {
+		if rr.Header.Type == rtype {
+			bodies = append(bodies, rr.Body)
+		}
+	}
+	return bodies
+}
@@ -30,6 +30,46 @@ to perform DNS resolution over different transports:
     makes it very easy to block using the port number, as no other protocol is assigned to that port.
   - [DNS-over-HTTPS] (DoH): uses HTTP exchanges for querying the resolver and communicates over a connection encrypted with TLS. It uses
     port 443. That makes the DoH traffic undistinguishable from web traffic, making it harder to block.
+    Package [github.com/Jigsaw-Code/outline-sdk/x/dnsquic] offers DoH over HTTP/3 over QUIC, which helps in networks
+    that throttle TCP, but not UDP.
+  - [DNS-over-QUIC] (DoQ): uses QUIC streams, encrypted with TLS, over UDP port 853. It's provided by package
+    [github.com/Jigsaw-Code/outline-sdk/x/dnsquic].
+  - [Oblivious DNS-over-HTTPS] (ODoH): encrypts the DoH queries to a target resolver, and sends them through a proxy,
+    so that no single party sees both the client IP and the queries.
+
+[NewDO53Resolver] queries over UDP, and retries over TCP when the response is truncated.
+
+[NewRaceResolver], [NewFallbackResolver] and [NewDomainRoutedResolver] combine resolvers, to query them in parallel,
+in order, or depending on the queried domain.
+
+[NewSystemResolver] follows the system configuration in /etc/hosts and /etc/resolv.conf, but sends the queries
+through the dialers you provide.
+
+# Caching
+
+[NewCachingResolver] wraps a [Resolver] with a cache that honors the response TTLs, caches [negative responses],
+coalesces concurrent identical queries, and can [serve stale responses] when the resolver fails.
+
+# DNSSEC
+
+[NewValidatingResolver] wraps a [Resolver] to validate the responses with [DNSSEC], from the root trust anchors or
+the ones you configure. Authenticated responses have the AD bit set, and responses that fail validation return
+a [BogusError]. To cache the validated responses, wrap the validating resolver with [NewCachingResolver].
+
+# EDNS(0) Options
+
+[NewEDNS0Resolver] wraps a [Resolver] to pad the queries, so their length doesn't reveal the names over encrypted
+transports, to set the client subnet the resolver can reveal to authoritative servers, and to use DNS cookies, which
+protect DNS-over-UDP from off-path injection.
+
+Both [NewValidatingResolver] and [NewEDNS0Resolver] change the requests, so they must wrap a resolver that sends
+them, like the one created by [NewUDPResolver], rather than one that combines other resolvers.
+
+# Serving
+
+[Server] exposes a [Resolver] to other applications, serving DNS-over-UDP, DNS-over-TCP and, as an [http.Handler],
+DNS-over-HTTPS. It rewrites the message IDs, truncates UDP responses that don't fit the client's size limit,
+and rate limits the queries of each client.
 
 # Establishing Stream Connections
 
@@ -38,12 +78,24 @@ Typically you will want to use custom DNS resolution to establish connections to
 and the given dialer to establish connections. The dialer efficiently performs resolutions and connection attempts
 in parallel, as per the [Happy Eyeballs v2] algorithm.
 
+With [WithHTTPSRecords], the dialer also looks up the [HTTPS records] of the destination, which can designate
+an alternative endpoint and port, and provide address hints, ALPN protocols and the Encrypted Client Hello
+configuration. The dialer passes them to the connections through the context, as [tls.ServiceHints], so you can use
+a [tls.StreamDialer] as the dialer to take advantage of them. [ParseServiceBinding] parses the records if you want to
+query them yourself.
+
 [Domain Name System]: https://datatracker.ietf.org/doc/html/rfc1034
 [commonly used for network-level filtering]: https://datatracker.ietf.org/doc/html/rfc9505#section-5.1.1
 [DNS-over-UDP]: https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.1
 [DNS-over-TCP]: https://datatracker.ietf.org/doc/html/rfc7766
 [DNS-over-TLS]: https://datatracker.ietf.org/doc/html/rfc7858
 [DNS-over-HTTPS]: https://datatracker.ietf.org/doc/html/rfc8484
+[DNS-over-QUIC]: https://datatracker.ietf.org/doc/html/rfc9250
+[Oblivious DNS-over-HTTPS]: https://datatracker.ietf.org/doc/html/rfc9230
+[negative responses]: https://datatracker.ietf.org/doc/html/rfc2308
+[serve stale responses]: https://datatracker.ietf.org/doc/html/rfc8767
+[DNSSEC]: https://datatracker.ietf.org/doc/html/rfc4033
 [Happy Eyeballs v2]: https://datatracker.ietf.org/doc/html/rfc8305
+[HTTPS records]: https://datatracker.ietf.org/doc/html/rfc9460
 */
 package dns
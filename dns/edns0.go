@@ -0,0 +1,235 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// EDNS(0) option codes, from https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-11.
+const (
+	optionClientSubnet = 8
+	optionCookie       = 10
+	optionPadding      = 12
+)
+
+// rcodeBadCookie is the extended RCODE for a bad or missing server cookie, as per
+// https://datatracker.ietf.org/doc/html/rfc7873#section-8.
+const rcodeBadCookie dnsmessage.RCode = 23
+
+// RecommendedPaddingBlockSize is the block size for padding queries recommended by
+// https://datatracker.ietf.org/doc/html/rfc8467#section-4.1.
+const RecommendedPaddingBlockSize = 128
+
+// PaddingOption returns an EDNS(0) [Padding option] with length bytes of padding. The option adds
+// length+4 bytes to the message.
+//
+// [Padding option]: https://datatracker.ietf.org/doc/html/rfc7830
+func PaddingOption(length int) dnsmessage.Option {
+	return dnsmessage.Option{Code: optionPadding, Data: make([]byte, length)}
+}
+
+// EDNS0Options configures the resolver created by [NewEDNS0Resolver]. The zero value sends the same requests as the
+// resolver it wraps.
+type EDNS0Options struct {
+	// PaddingBlockSize pads the requests with the [Padding option] to a multiple of the block size, so that their
+	// length doesn't reveal the name they query. Padding is only useful over encrypted transports.
+	// Zero means no padding. See [RecommendedPaddingBlockSize].
+	//
+	// [Padding option]: https://datatracker.ietf.org/doc/html/rfc7830
+	PaddingBlockSize int
+	// ClientSubnet, if valid, is sent in the [Client Subnet option], so the resolver uses it instead of the
+	// client address to tailor the answers. A prefix of length zero, such as 0.0.0.0/0, asks the resolver not to
+	// send any part of the client address to the authoritative servers.
+	//
+	// [Client Subnet option]: https://datatracker.ietf.org/doc/html/rfc7871
+	ClientSubnet netip.Prefix
+	// Cookies enables [DNS Cookies]. The resolver sends a random client cookie and the last server cookie it received,
+	// and drops the UDP responses that don't echo its client cookie. That protects the queries from off-path
+	// injection. The client cookie is kept for the lifetime of the resolver, so only enable it with resolvers that
+	// are not shared across networks where it could be used to track the client.
+	//
+	// [DNS Cookies]: https://datatracker.ietf.org/doc/html/rfc7873
+	Cookies bool
+}
+
+// cookieJar holds the DNS cookies of a resolver, as per https://datatracker.ietf.org/doc/html/rfc7873.
+type cookieJar struct {
+	client [8]byte
+	mu     sync.Mutex
+	server []byte
+}
+
+func newCookieJar() (*cookieJar, error) {
+	jar := &cookieJar{}
+	if _, err := rand.Read(jar.client[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate client cookie: %w", err)
+	}
+	return jar, nil
+}
+
+// option returns the COOKIE option to send to the server.
+func (j *cookieJar) option() dnsmessage.Option {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return dnsmessage.Option{Code: optionCookie, Data: append(j.client[:], j.server...)}
+}
+
+// check returns an error if msg is not a valid response to a request with the cookies of j. Responses without
+// cookies are only valid if the server hasn't sent a cookie before.
+func (j *cookieJar) check(msg *dnsmessage.Message) error {
+	cookie, found := findOption(msg, optionCookie)
+	if !found {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if j.server != nil {
+			return errors.New("response is missing the DNS cookie")
+		}
+		return nil
+	}
+	// The server cookie has 8 to 32 bytes.
+	if len(cookie) < 16 || len(cookie) > 40 {
+		return errors.New("response has a malformed DNS cookie")
+	}
+	if !bytes.Equal(cookie[:8], j.client[:]) {
+		return errors.New("response has the wrong client cookie")
+	}
+	return nil
+}
+
+// update stores the server cookie of a valid response.
+func (j *cookieJar) update(msg *dnsmessage.Message) {
+	cookie, found := findOption(msg, optionCookie)
+	if !found || len(cookie) < 16 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.server = bytes.Clone(cookie[8:])
+}
+
+// findOption returns the data of the first EDNS(0) option of msg with the given code.
+func findOption(msg *dnsmessage.Message, code uint16) ([]byte, bool) {
+	for _, rr := range msg.Additionals {
+		opt, ok := rr.Body.(*dnsmessage.OPTResource)
+		if !ok {
+			continue
+		}
+		for _, option := range opt.Options {
+			if option.Code == code {
+				return option.Data, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// extendedRCode returns the RCODE of msg, including the upper bits in the OPT record.
+func extendedRCode(msg *dnsmessage.Message) dnsmessage.RCode {
+	for _, rr := range msg.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			return rr.Header.ExtendedRCode(msg.RCode)
+		}
+	}
+	return msg.RCode
+}
+
+// clientSubnetOption encodes prefix as a Client Subnet option, as per
+// https://datatracker.ietf.org/doc/html/rfc7871#section-6.
+func clientSubnetOption(prefix netip.Prefix) dnsmessage.Option {
+	prefix = prefix.Masked()
+	family := uint16(1)
+	if prefix.Addr().Is6() {
+		family = 2
+	}
+	data := binary.BigEndian.AppendUint16(nil, family)
+	// Source prefix length, and scope prefix length, which must be zero in queries.
+	data = append(data, byte(prefix.Bits()), 0)
+	// The address is truncated to the bytes of the prefix.
+	data = append(data, prefix.Addr().AsSlice()[:(prefix.Bits()+7)/8]...)
+	return dnsmessage.Option{Code: optionClientSubnet, Data: data}
+}
+
+type edns0Resolver struct {
+	resolver optionsResolver
+	opts     EDNS0Options
+	cookies  *cookieJar
+}
+
+var _ optionsResolver = (*edns0Resolver)(nil)
+
+// NewEDNS0Resolver creates a [Resolver] that adds the EDNS(0) options configured by opts to the requests of
+// resolver, which must be one of the resolvers created by this package that send the requests, such as
+// [NewUDPResolver] and [NewHTTPSResolver], or another EDNS(0) resolver. Resolvers that combine or cache other
+// resolvers are rejected, since the options would not reach the requests. Use one per resolver address, as the
+// server cookies are specific to a server. To query a server over UDP and TCP, wrap a [NewDO53Resolver].
+func NewEDNS0Resolver(resolver Resolver, opts EDNS0Options) (Resolver, error) {
+	inner, err := asOptionsResolver(resolver)
+	if err != nil {
+		return nil, err
+	}
+	if opts.PaddingBlockSize < 0 || opts.PaddingBlockSize > maxUDPMessageSize {
+		return nil, fmt.Errorf("padding block size must be between 0 and %v", maxUDPMessageSize)
+	}
+	r := &edns0Resolver{resolver: inner, opts: opts}
+	if opts.Cookies {
+		if r.cookies, err = newCookieJar(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Query implements [Resolver].
+func (r *edns0Resolver) Query(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	return r.queryWithOptions(ctx, q, requestOptions{})
+}
+
+func (r *edns0Resolver) queryWithOptions(ctx context.Context, q dnsmessage.Question, opts requestOptions) (*dnsmessage.Message, error) {
+	opts.paddingBlockSize = r.opts.PaddingBlockSize
+	opts.clientSubnet = r.opts.ClientSubnet
+	opts.cookies = r.cookies
+
+	msg, err := r.resolver.queryWithOptions(ctx, q, opts)
+	if err != nil || r.cookies == nil {
+		return msg, err
+	}
+	if err := r.cookies.check(msg); err != nil {
+		return nil, &nestedError{ErrBadResponse, err}
+	}
+	r.cookies.update(msg)
+	if extendedRCode(msg) == rcodeBadCookie {
+		// The server rejected the server cookie we sent, and sent a fresh one. Retry once with it, as per
+		// https://datatracker.ietf.org/doc/html/rfc7873#section-5.3.
+		msg, err = r.resolver.queryWithOptions(ctx, q, opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.cookies.check(msg); err != nil {
+			return nil, &nestedError{ErrBadResponse, err}
+		}
+		r.cookies.update(msg)
+	}
+	return msg, nil
+}
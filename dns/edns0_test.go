@@ -0,0 +1,314 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestAppendRequest_Padding(t *testing.T) {
+	q, err := NewQuestion("example.com.", dnsmessage.TypeAAAA)
+	require.NoError(t, err)
+	for _, blockSize := range []int{1, 64, RecommendedPaddingBlockSize, 468} {
+		// Stream transports reserve 2 bytes for the length prefix, which are not padded.
+		buf, err := appendRequestWithOptions(1, *q, requestOptions{paddingBlockSize: blockSize}, make([]byte, 2, 514))
+		require.NoError(t, err)
+		require.Zero(t, (len(buf)-2)%blockSize, "block size %v", blockSize)
+
+		var msg dnsmessage.Message
+		require.NoError(t, msg.Unpack(buf[2:]))
+		padding, found := findOption(&msg, optionPadding)
+		require.True(t, found)
+		require.Equal(t, make([]byte, len(padding)), padding)
+	}
+}
+
+func TestAppendRequest_NoOptions(t *testing.T) {
+	q, err := NewQuestion("example.com.", dnsmessage.TypeAAAA)
+	require.NoError(t, err)
+	buf, err := appendRequestWithOptions(1, *q, requestOptions{}, nil)
+	require.NoError(t, err)
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(buf))
+	require.Len(t, msg.Additionals, 1)
+	require.Empty(t, msg.Additionals[0].Body.(*dnsmessage.OPTResource).Options)
+}
+
+func Test_clientSubnetOption(t *testing.T) {
+	require.Equal(t, []byte{0, 1, 24, 0, 192, 0, 2},
+		clientSubnetOption(netip.MustParsePrefix("192.0.2.77/24")).Data)
+	require.Equal(t, []byte{0, 1, 0, 0},
+		clientSubnetOption(netip.MustParsePrefix("0.0.0.0/0")).Data)
+	require.Equal(t, []byte{0, 2, 52, 0, 0x20, 0x01, 0x0d, 0xb8, 0x12, 0x34, 0x50},
+		clientSubnetOption(netip.MustParsePrefix("2001:db8:1234:5678::/52")).Data)
+}
+
+func TestNewEDNS0Resolver_Options(t *testing.T) {
+	var requests []dnsmessage.Message
+	inner := optionsFuncResolver(func(ctx context.Context, q dnsmessage.Question, opts requestOptions) (*dnsmessage.Message, error) {
+		buf, err := appendRequestWithOptions(0, q, opts, nil)
+		require.NoError(t, err)
+		var request dnsmessage.Message
+		require.NoError(t, request.Unpack(buf))
+		requests = append(requests, request)
+		resp, err := newMessageResponse(request, &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}}, 100)
+		require.NoError(t, err)
+		return &resp, nil
+	})
+	resolver, err := NewEDNS0Resolver(inner, EDNS0Options{
+		PaddingBlockSize: RecommendedPaddingBlockSize,
+		ClientSubnet:     netip.MustParsePrefix("0.0.0.0/0"),
+	})
+	require.NoError(t, err)
+	q, err := NewQuestion("example.com.", dnsmessage.TypeA)
+	require.NoError(t, err)
+	_, err = resolver.Query(context.Background(), *q)
+	require.NoError(t, err)
+
+	require.Len(t, requests, 1)
+	ecs, found := findOption(&requests[0], optionClientSubnet)
+	require.True(t, found)
+	require.Equal(t, []byte{0, 1, 0, 0}, ecs)
+	_, found = findOption(&requests[0], optionPadding)
+	require.True(t, found)
+	_, found = findOption(&requests[0], optionCookie)
+	require.False(t, found)
+
+	// The options of a wrapping resolver, like the DNSSEC OK bit, are kept.
+	_, err = resolver.(optionsResolver).queryWithOptions(context.Background(), *q, requestOptions{dnssecOK: true})
+	require.NoError(t, err)
+	require.Len(t, requests, 2)
+	require.True(t, requests[1].Additionals[0].Header.DNSSECAllowed())
+	_, found = findOption(&requests[1], optionPadding)
+	require.True(t, found)
+}
+
+func TestNewEDNS0Resolver_Cookies(t *testing.T) {
+	serverCookies := [][]byte{[]byte("server-1"), []byte("server-2-longer")}
+	var mu sync.Mutex
+	var receivedCookies [][]byte
+	// Each handler gets a request and returns the responses to send.
+	handlers := []func(request dnsmessage.Message, clientCookie []byte) []dnsmessage.Message{
+		// The first response is injected by an off-path attacker that doesn't know the client cookie.
+		func(request dnsmessage.Message, clientCookie []byte) []dnsmessage.Message {
+			injected := newCookieResponse(t, request, append([]byte("guessed!"), serverCookies[0]...), dnsmessage.RCodeSuccess, [4]byte{6, 6, 6, 6})
+			valid := newCookieResponse(t, request, append(clientCookie, serverCookies[0]...), dnsmessage.RCodeSuccess, [4]byte{127, 0, 0, 1})
+			return []dnsmessage.Message{injected, valid}
+		},
+		// The server rotates its cookie.
+		func(request dnsmessage.Message, clientCookie []byte) []dnsmessage.Message {
+			return []dnsmessage.Message{newCookieResponse(t, request, append(clientCookie, serverCookies[1]...), rcodeBadCookie, [4]byte{})}
+		},
+		// Responses without cookies are now suspicious.
+		func(request dnsmessage.Message, clientCookie []byte) []dnsmessage.Message {
+			missing, err := newMessageResponse(request, &dnsmessage.AResource{A: [4]byte{6, 6, 6, 6}}, 100)
+			require.NoError(t, err)
+			valid := newCookieResponse(t, request, append(clientCookie, serverCookies[1]...), dnsmessage.RCodeSuccess, [4]byte{127, 0, 0, 2})
+			return []dnsmessage.Message{missing, valid}
+		},
+	}
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+	go func() {
+		buf := make([]byte, maxUDPMessageSize)
+		for _, handler := range handlers {
+			n, clientAddr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var request dnsmessage.Message
+			require.NoError(t, request.Unpack(buf[:n]))
+			cookie, found := findOption(&request, optionCookie)
+			require.True(t, found)
+			mu.Lock()
+			receivedCookies = append(receivedCookies, cookie)
+			mu.Unlock()
+			for _, response := range handler(request, cookie[:8]) {
+				out, err := response.Pack()
+				require.NoError(t, err)
+				_, err = server.WriteTo(out, clientAddr)
+				require.NoError(t, err)
+			}
+		}
+	}()
+
+	resolver, err := NewEDNS0Resolver(NewUDPResolver(&transport.UDPDialer{}, server.LocalAddr().String()), EDNS0Options{Cookies: true})
+	require.NoError(t, err)
+	q, err := NewQuestion("example.com.", dnsmessage.TypeA)
+	require.NoError(t, err)
+
+	resp, err := resolver.Query(context.Background(), *q)
+	require.NoError(t, err)
+	require.Equal(t, [4]byte{127, 0, 0, 1}, resp.Answers[0].Body.(*dnsmessage.AResource).A)
+
+	resp, err = resolver.Query(context.Background(), *q)
+	require.NoError(t, err)
+	require.Equal(t, [4]byte{127, 0, 0, 2}, resp.Answers[0].Body.(*dnsmessage.AResource).A)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, receivedCookies, 3)
+	clientCookie := receivedCookies[0][:8]
+	// The first request only has the client cookie.
+	require.Equal(t, clientCookie, receivedCookies[0])
+	require.Equal(t, append(clientCookie, serverCookies[0]...), receivedCookies[1])
+	// The retry after BADCOOKIE uses the new server cookie.
+	require.Equal(t, append(clientCookie, serverCookies[1]...), receivedCookies[2])
+}
+
+func TestNewEDNS0Resolver_WrongCookieOverStream(t *testing.T) {
+	inner := optionsFuncResolver(func(ctx context.Context, q dnsmessage.Question, _ requestOptions) (*dnsmessage.Message, error) {
+		request := dnsmessage.Message{Questions: []dnsmessage.Question{q}}
+		resp := newCookieResponse(t, request, []byte("wrong-client-cookie!"), dnsmessage.RCodeSuccess, [4]byte{6, 6, 6, 6})
+		return &resp, nil
+	})
+	resolver, err := NewEDNS0Resolver(inner, EDNS0Options{Cookies: true})
+	require.NoError(t, err)
+	q, err := NewQuestion("example.com.", dnsmessage.TypeA)
+	require.NoError(t, err)
+	_, err = resolver.Query(context.Background(), *q)
+	require.ErrorIs(t, err, ErrBadResponse)
+}
+
+func TestNewEDNS0Resolver_DO53SharesCookies(t *testing.T) {
+	serverCookie := []byte("server-1")
+	udpServer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer udpServer.Close()
+	go func() {
+		buf := make([]byte, maxUDPMessageSize)
+		n, clientAddr, err := udpServer.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var request dnsmessage.Message
+		require.NoError(t, request.Unpack(buf[:n]))
+		cookie, found := findOption(&request, optionCookie)
+		require.True(t, found)
+		response := newCookieResponse(t, request, append(cookie[:8:8], serverCookie...), dnsmessage.RCodeSuccess, [4]byte{})
+		response.Answers = nil
+		response.Truncated = true
+		out, err := response.Pack()
+		require.NoError(t, err)
+		udpServer.WriteTo(out, clientAddr)
+	}()
+
+	tcpServer, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tcpServer.Close()
+	tcpCookies := make(chan []byte, 1)
+	go func() {
+		conn, err := tcpServer.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		var request dnsmessage.Message
+		require.NoError(t, request.Unpack(buf))
+		cookie, found := findOption(&request, optionCookie)
+		require.True(t, found)
+		tcpCookies <- cookie
+		response := newCookieResponse(t, request, cookie, dnsmessage.RCodeSuccess, [4]byte{127, 0, 0, 1})
+		out, err := response.AppendPack(make([]byte, 2))
+		require.NoError(t, err)
+		binary.BigEndian.PutUint16(out, uint16(len(out)-2))
+		conn.Write(out)
+	}()
+
+	// Both transports go to the same server address, so the dialers ignore it.
+	pd := transport.FuncPacketDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return (&transport.UDPDialer{}).DialPacket(ctx, udpServer.LocalAddr().String())
+	})
+	sd := transport.FuncStreamDialer(func(ctx context.Context, _ string) (transport.StreamConn, error) {
+		return (&transport.TCPDialer{}).DialStream(ctx, tcpServer.Addr().String())
+	})
+	resolver, err := NewEDNS0Resolver(NewDO53Resolver(pd, sd, "192.0.2.1"), EDNS0Options{Cookies: true})
+	require.NoError(t, err)
+	q, err := NewQuestion("example.com.", dnsmessage.TypeA)
+	require.NoError(t, err)
+	resp, err := resolver.Query(context.Background(), *q)
+	require.NoError(t, err)
+	require.Equal(t, [4]byte{127, 0, 0, 1}, resp.Answers[0].Body.(*dnsmessage.AResource).A)
+	// The TCP retry sends the server cookie learned over UDP.
+	require.Equal(t, serverCookie, (<-tcpCookies)[8:])
+}
+
+func TestNewEDNS0Resolver_InvalidArguments(t *testing.T) {
+	_, err := NewEDNS0Resolver(nil, EDNS0Options{})
+	require.Error(t, err)
+	_, err = NewEDNS0Resolver(optionsFuncResolver(nil), EDNS0Options{PaddingBlockSize: -1})
+	require.Error(t, err)
+	// The options would not reach the requests of resolvers that combine or cache other resolvers.
+	_, err = NewEDNS0Resolver(answerResolver(1), EDNS0Options{})
+	require.Error(t, err)
+	fallback, err := NewFallbackResolver(NewUDPResolver(&transport.UDPDialer{}, "127.0.0.1"))
+	require.NoError(t, err)
+	_, err = NewEDNS0Resolver(fallback, EDNS0Options{})
+	require.Error(t, err)
+}
+
+/********** Test Utilities **********/
+
+// optionsFuncResolver is an [optionsResolver] that calls the function with the request options.
+type optionsFuncResolver func(ctx context.Context, q dnsmessage.Question, opts requestOptions) (*dnsmessage.Message, error)
+
+func (f optionsFuncResolver) Query(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	return f(ctx, q, requestOptions{})
+}
+
+func (f optionsFuncResolver) queryWithOptions(ctx context.Context, q dnsmessage.Question, opts requestOptions) (*dnsmessage.Message, error) {
+	return f(ctx, q, opts)
+}
+
+// newCookieResponse returns a response to request with the given COOKIE option and extended RCODE, and with an
+// A record if the RCODE is success.
+func newCookieResponse(t *testing.T, request dnsmessage.Message, cookie []byte, rcode dnsmessage.RCode, ip [4]byte) dnsmessage.Message {
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: request.ID, Response: true, RCode: rcode & 0xf},
+		Questions: request.Questions,
+	}
+	if rcode == dnsmessage.RCodeSuccess {
+		resp.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: request.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 100},
+			Body:   &dnsmessage.AResource{A: ip},
+		}}
+	}
+	var rh dnsmessage.ResourceHeader
+	require.NoError(t, rh.SetEDNS0(maxUDPMessageSize, rcode, false))
+	resp.Additionals = []dnsmessage.Resource{{
+		Header: rh,
+		Body:   &dnsmessage.OPTResource{Options: []dnsmessage.Option{{Code: optionCookie, Data: cookie}}},
+	}}
+	return resp
+}
@@ -0,0 +1,474 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/cloudflare/circl/hpke"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Constants from https://datatracker.ietf.org/doc/html/rfc9230.
+const (
+	odohVersion         = 0x0001
+	odohMessageQuery    = 0x01
+	odohMessageResponse = 0x02
+	odohMediaType       = "application/oblivious-dns-message"
+	odohConfigsPath     = "/.well-known/odohconfigs"
+	// Plaintext messages are padded to a multiple of this size, as recommended for queries in
+	// https://datatracker.ietf.org/doc/html/rfc8467#section-4.1.
+	odohPaddingBlockSize = 128
+)
+
+// defaultODoHConfigTTL is how long a fetched target config is used, if the target doesn't specify a max-age.
+const defaultODoHConfigTTL = time.Hour
+
+// odohConfigFetchTimeout bounds a config fetch. The fetch is shared by the queries waiting for the config,
+// so it doesn't use the context of any of them.
+const odohConfigFetchTimeout = 30 * time.Second
+
+// odohConfig is the ObliviousDoHConfigContents of a target, as per
+// https://datatracker.ietf.org/doc/html/rfc9230#section-6.1.
+type odohConfig struct {
+	suite     hpke.Suite
+	kdf       hpke.KDF
+	publicKey []byte
+	// contents is the serialized ObliviousDoHConfigContents.
+	contents []byte
+}
+
+// parseODoHConfigs returns the first config with a supported version and suite from the serialized
+// ObliviousDoHConfigs.
+func parseODoHConfigs(configs []byte) (*odohConfig, error) {
+	if len(configs) < 2 || int(binary.BigEndian.Uint16(configs)) != len(configs)-2 {
+		return nil, errors.New("invalid ObliviousDoHConfigs length")
+	}
+	configs = configs[2:]
+	for len(configs) > 0 {
+		if len(configs) < 4 {
+			return nil, errors.New("truncated ObliviousDoHConfig")
+		}
+		version := binary.BigEndian.Uint16(configs)
+		length := int(binary.BigEndian.Uint16(configs[2:]))
+		if len(configs) < 4+length {
+			return nil, errors.New("truncated ObliviousDoHConfig")
+		}
+		contents := configs[4 : 4+length]
+		configs = configs[4+length:]
+		if version != odohVersion {
+			continue
+		}
+		if config, err := parseODoHConfigContents(contents); err == nil {
+			return config, nil
+		}
+	}
+	return nil, errors.New("no supported ObliviousDoHConfig")
+}
+
+func parseODoHConfigContents(contents []byte) (*odohConfig, error) {
+	if len(contents) < 8 {
+		return nil, errors.New("truncated ObliviousDoHConfigContents")
+	}
+	kemID := hpke.KEM(binary.BigEndian.Uint16(contents))
+	kdfID := hpke.KDF(binary.BigEndian.Uint16(contents[2:]))
+	aeadID := hpke.AEAD(binary.BigEndian.Uint16(contents[4:]))
+	keyLen := int(binary.BigEndian.Uint16(contents[6:]))
+	if len(contents) != 8+keyLen {
+		return nil, errors.New("invalid public key length")
+	}
+	if !kemID.IsValid() || !kdfID.IsValid() || !aeadID.IsValid() {
+		return nil, fmt.Errorf("unsupported suite (%v, %v, %v)", kemID, kdfID, aeadID)
+	}
+	publicKey := contents[8:]
+	if _, err := kemID.Scheme().UnmarshalBinaryPublicKey(publicKey); err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	return &odohConfig{
+		suite:     hpke.NewSuite(kemID, kdfID, aeadID),
+		kdf:       kdfID,
+		publicKey: publicKey,
+		contents:  contents,
+	}, nil
+}
+
+// keyID identifies the config to the target, as per https://datatracker.ietf.org/doc/html/rfc9230#section-6.2.
+func (c *odohConfig) keyID() []byte {
+	return c.kdf.Expand(c.kdf.Extract(c.contents, nil), []byte("odoh key id"), uint(c.kdf.ExtractSize()))
+}
+
+// appendODoHMessage serializes an ObliviousDoHMessage, as per https://datatracker.ietf.org/doc/html/rfc9230#section-6.2.
+func appendODoHMessage(buf []byte, messageType byte, keyID []byte, encrypted []byte) []byte {
+	buf = append(buf, messageType)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(keyID)))
+	buf = append(buf, keyID...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(encrypted)))
+	return append(buf, encrypted...)
+}
+
+// parseODoHMessage parses an ObliviousDoHMessage, and returns the key ID and the encrypted message.
+func parseODoHMessage(msg []byte, messageType byte) ([]byte, []byte, error) {
+	if len(msg) < 3 || msg[0] != messageType {
+		return nil, nil, fmt.Errorf("expected ObliviousDoHMessage of type %v", messageType)
+	}
+	keyIDLen := int(binary.BigEndian.Uint16(msg[1:]))
+	if len(msg) < 3+keyIDLen+2 {
+		return nil, nil, errors.New("truncated ObliviousDoHMessage")
+	}
+	keyID := msg[3 : 3+keyIDLen]
+	rest := msg[3+keyIDLen:]
+	encryptedLen := int(binary.BigEndian.Uint16(rest))
+	if len(rest) != 2+encryptedLen {
+		return nil, nil, errors.New("invalid ObliviousDoHMessage length")
+	}
+	return keyID, rest[2:], nil
+}
+
+// odohAAD returns the additional authenticated data for a message of the given type.
+func odohAAD(messageType byte, keyID []byte) []byte {
+	aad := []byte{messageType}
+	aad = binary.BigEndian.AppendUint16(aad, uint16(len(keyID)))
+	return append(aad, keyID...)
+}
+
+// appendODoHPlaintext serializes an ObliviousDoHMessagePlaintext, with padding so that the length is a multiple
+// of the padding block size.
+func appendODoHPlaintext(buf []byte, dnsMessage []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(dnsMessage)))
+	buf = append(buf, dnsMessage...)
+	paddingLen := (odohPaddingBlockSize - (len(dnsMessage)+4)%odohPaddingBlockSize) % odohPaddingBlockSize
+	buf = binary.BigEndian.AppendUint16(buf, uint16(paddingLen))
+	return append(buf, make([]byte, paddingLen)...)
+}
+
+// parseODoHPlaintext returns the DNS message in an ObliviousDoHMessagePlaintext.
+// The padding must be all zeros, as per https://datatracker.ietf.org/doc/html/rfc9230#section-6.3.
+func parseODoHPlaintext(plaintext []byte) ([]byte, error) {
+	if len(plaintext) < 2 {
+		return nil, errors.New("truncated plaintext")
+	}
+	msgLen := int(binary.BigEndian.Uint16(plaintext))
+	if len(plaintext) < 2+msgLen+2 {
+		return nil, errors.New("truncated plaintext")
+	}
+	dnsMessage := plaintext[2 : 2+msgLen]
+	padding := plaintext[2+msgLen:]
+	paddingLen := int(binary.BigEndian.Uint16(padding))
+	if len(padding) != 2+paddingLen {
+		return nil, errors.New("invalid padding length")
+	}
+	for _, b := range padding[2:] {
+		if b != 0 {
+			return nil, errors.New("invalid padding")
+		}
+	}
+	return dnsMessage, nil
+}
+
+// odohResponseAEAD derives the key and nonce that encrypt the response to the query plaintext,
+// as per https://datatracker.ietf.org/doc/html/rfc9230#section-6.4.
+func odohResponseAEAD(hpkeContext hpke.Context, queryPlaintext []byte, responseNonce []byte) (cipher.AEAD, []byte, error) {
+	_, kdf, aead := hpkeContext.Suite().Params()
+	secret := hpkeContext.Export([]byte("odoh response"), aead.KeySize())
+	salt := append([]byte(nil), queryPlaintext...)
+	salt = binary.BigEndian.AppendUint16(salt, uint16(len(responseNonce)))
+	salt = append(salt, responseNonce...)
+	prk := kdf.Extract(secret, salt)
+	key := kdf.Expand(prk, []byte("odoh key"), aead.KeySize())
+	nonce := kdf.Expand(prk, []byte("odoh nonce"), aead.NonceSize())
+	responseCipher, err := aead.New(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return responseCipher, nonce, nil
+}
+
+// odohResponseNonceSize is the size of the response nonce, as per https://datatracker.ietf.org/doc/html/rfc9230#section-6.4.
+func odohResponseNonceSize(aead hpke.AEAD) int {
+	if aead.KeySize() > aead.NonceSize() {
+		return int(aead.KeySize())
+	}
+	return int(aead.NonceSize())
+}
+
+type odohResolver struct {
+	httpClient *http.Client
+	// queryURL is the proxy URL with the target parameters.
+	queryURL string
+	// configURL is where to fetch the target configs through the proxy, if none was provided.
+	configURL string
+
+	mu           sync.Mutex // Protects the fields below
+	config       *odohConfig
+	configExpiry time.Time
+	// fetch is the config fetch in progress, if any.
+	fetch *odohConfigFetch
+}
+
+// odohConfigFetch is a config fetch shared by the queries that need the config.
+type odohConfigFetch struct {
+	done   chan struct{}
+	config *odohConfig
+	err    error
+}
+
+var _ optionsResolver = (*odohResolver)(nil)
+
+// NewObliviousHTTPSResolver creates a [Resolver] that implements the [Oblivious DNS-over-HTTPS] (ODoH) protocol.
+// Queries are encrypted to the target with HPKE, and sent through the proxy, so that the proxy can't see the
+// queries, and the target can't see the client IP. The proxyURL and targetURL are the DoH URLs of the proxy
+// and the target, such as "https://proxy.example/proxy" and "https://target.example/dns-query".
+//
+// targetConfig is the serialized ObliviousDoHConfigs of the target. If nil, the configs are fetched from the
+// target's well-known URL through the proxy, so that the target doesn't see the client IP, and cached for the
+// max-age set by the target, or one hour. The configs are fetched again if the target rejects a query with a
+// 401 status. That requires a proxy that also forwards GET requests. With other proxies, get the configs out
+// of band and pass them as targetConfig. Don't fetch them directly from the target on the same network, as that
+// reveals the client IP to the target.
+//
+// The resolver uses sd to connect to the proxy and the target. The [HTTPSResolverOption] values apply to
+// both connections.
+//
+// [Oblivious DNS-over-HTTPS]: https://datatracker.ietf.org/doc/html/rfc9230
+func NewObliviousHTTPSResolver(sd transport.StreamDialer, proxyURL string, targetURL string, targetConfig []byte, options ...HTTPSResolverOption) (Resolver, error) {
+	proxy, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	target, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target URL: %w", err)
+	}
+	if proxy.Scheme != "https" || target.Scheme != "https" {
+		return nil, errors.New("proxy and target URLs must use https")
+	}
+	if target.Host == "" {
+		return nil, errors.New("target URL must have a host")
+	}
+	var opts httpsResolverOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	r := &odohResolver{
+		httpClient: newHTTPClient(sd, func(addr string) string { return addr }, &opts),
+	}
+	targetPath := target.Path
+	if targetPath == "" {
+		targetPath = "/"
+	}
+	r.queryURL = odohProxyURL(*proxy, target.Host, targetPath)
+	if targetConfig != nil {
+		if r.config, err = parseODoHConfigs(targetConfig); err != nil {
+			return nil, fmt.Errorf("invalid target config: %w", err)
+		}
+	} else {
+		r.configURL = odohProxyURL(*proxy, target.Host, odohConfigsPath)
+	}
+	return r, nil
+}
+
+// odohProxyURL returns the URL that makes the proxy forward the request to the target host and path, as per
+// https://datatracker.ietf.org/doc/html/rfc9230#section-4.1.
+func odohProxyURL(proxy url.URL, targetHost string, targetPath string) string {
+	values := proxy.Query()
+	values.Set("targethost", targetHost)
+	values.Set("targetpath", targetPath)
+	proxy.RawQuery = values.Encode()
+	return proxy.String()
+}
+
+// getConfig returns the target config, fetching it if needed. Concurrent calls share the same fetch, and
+// stop waiting for it when their context is done.
+func (r *odohResolver) getConfig(ctx context.Context) (*odohConfig, error) {
+	r.mu.Lock()
+	if r.config != nil && (r.configURL == "" || time.Now().Before(r.configExpiry)) {
+		config := r.config
+		r.mu.Unlock()
+		return config, nil
+	}
+	fetch := r.fetch
+	if fetch == nil {
+		fetch = &odohConfigFetch{done: make(chan struct{})}
+		r.fetch = fetch
+		go r.runFetch(fetch)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-fetch.done:
+		return fetch.config, fetch.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// runFetch fetches the config, stores it if the fetch succeeds, and then completes fetch.
+func (r *odohResolver) runFetch(fetch *odohConfigFetch) {
+	ctx, cancel := context.WithTimeout(context.Background(), odohConfigFetchTimeout)
+	defer cancel()
+	config, maxAge, err := r.fetchConfig(ctx)
+
+	r.mu.Lock()
+	r.fetch = nil
+	if err == nil {
+		r.config = config
+		r.configExpiry = time.Now().Add(maxAge)
+	}
+	r.mu.Unlock()
+	fetch.config, fetch.err = config, err
+	close(fetch.done)
+}
+
+// invalidateConfig drops the config if it was fetched, so that the next query fetches it again.
+func (r *odohResolver) invalidateConfig(config *odohConfig) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.configURL == "" {
+		return false
+	}
+	if r.config == config {
+		r.config = nil
+	}
+	return true
+}
+
+func (r *odohResolver) fetchConfig(ctx context.Context) (*odohConfig, time.Duration, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", r.configURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	httpResp, err := r.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get HTTP response: %w", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, 0, &httpStatusError{httpResp.StatusCode}
+	}
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<16+2))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read response: %w", err)
+	}
+	config, err := parseODoHConfigs(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return config, parseMaxAge(httpResp.Header.Get("Cache-Control"), defaultODoHConfigTTL), nil
+}
+
+// parseMaxAge returns the max-age directive of a Cache-Control header, or defaultMaxAge if absent.
+func parseMaxAge(cacheControl string, defaultMaxAge time.Duration) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(directive), "=")
+		if !found || !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return defaultMaxAge
+}
+
+func (r *odohResolver) Query(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	return r.queryWithOptions(ctx, q, requestOptions{})
+}
+
+func (r *odohResolver) queryWithOptions(ctx context.Context, q dnsmessage.Question, opts requestOptions) (*dnsmessage.Message, error) {
+	config, err := r.getConfig(ctx)
+	if err != nil {
+		return nil, &nestedError{ErrDial, fmt.Errorf("failed to get ODoH target config: %w", err)}
+	}
+	msg, err := r.query(ctx, config, q, opts)
+	var statusErr *httpStatusError
+	// The target rejects queries for unknown keys with 401, as per
+	// https://datatracker.ietf.org/doc/html/rfc9230#section-4.3. The key may have been rotated.
+	if errors.As(err, &statusErr) && statusErr.code == http.StatusUnauthorized && r.invalidateConfig(config) {
+		if config, err = r.getConfig(ctx); err != nil {
+			return nil, &nestedError{ErrDial, fmt.Errorf("failed to get ODoH target config: %w", err)}
+		}
+		return r.query(ctx, config, q, opts)
+	}
+	return msg, err
+}
+
+func (r *odohResolver) query(ctx context.Context, config *odohConfig, q dnsmessage.Question, opts requestOptions) (*dnsmessage.Message, error) {
+	request, err := appendRequestWithOptions(0, q, opts, make([]byte, 0, 512))
+	if err != nil {
+		return nil, &nestedError{ErrBadRequest, fmt.Errorf("append request failed: %w", err)}
+	}
+	kemID, _, _ := config.suite.Params()
+	pkR, err := kemID.Scheme().UnmarshalBinaryPublicKey(config.publicKey)
+	if err != nil {
+		return nil, &nestedError{ErrBadRequest, err}
+	}
+	sender, err := config.suite.NewSender(pkR, []byte("odoh query"))
+	if err != nil {
+		return nil, &nestedError{ErrBadRequest, err}
+	}
+	enc, sealer, err := sender.Setup(rand.Reader)
+	if err != nil {
+		return nil, &nestedError{ErrBadRequest, err}
+	}
+	keyID := config.keyID()
+	queryPlaintext := appendODoHPlaintext(nil, request)
+	ct, err := sealer.Seal(queryPlaintext, odohAAD(odohMessageQuery, keyID))
+	if err != nil {
+		return nil, &nestedError{ErrBadRequest, err}
+	}
+	encrypted := append(enc, ct...)
+	response, err := exchangeHTTP(ctx, r.httpClient, r.queryURL, odohMediaType, appendODoHMessage(nil, odohMessageQuery, keyID, encrypted))
+	if err != nil {
+		return nil, err
+	}
+
+	responseNonce, encryptedResponse, err := parseODoHMessage(response, odohMessageResponse)
+	if err != nil {
+		return nil, &nestedError{ErrBadResponse, err}
+	}
+	aead, nonce, err := odohResponseAEAD(sealer, queryPlaintext, responseNonce)
+	if err != nil {
+		return nil, &nestedError{ErrBadResponse, err}
+	}
+	responsePlaintext, err := aead.Open(nil, nonce, encryptedResponse, odohAAD(odohMessageResponse, responseNonce))
+	if err != nil {
+		return nil, &nestedError{ErrBadResponse, fmt.Errorf("failed to decrypt response: %w", err)}
+	}
+	dnsResponse, err := parseODoHPlaintext(responsePlaintext)
+	if err != nil {
+		return nil, &nestedError{ErrBadResponse, err}
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(dnsResponse); err != nil {
+		return nil, &nestedError{ErrBadResponse, fmt.Errorf("failed to unpack DNS response: %w", err)}
+	}
+	if err := checkResponse(0, q, msg.Header, msg.Questions); err != nil {
+		return nil, &nestedError{ErrBadResponse, err}
+	}
+	return &msg, nil
+}
@@ -0,0 +1,391 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/cloudflare/circl/hpke"
+	"github.com/cloudflare/circl/kem"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestObliviousHTTPSResolver_FetchesConfig(t *testing.T) {
+	target := newTestODoHTarget(t)
+	proxy := newTestODoHProxy(t)
+	resolver, err := NewObliviousHTTPSResolver(&transport.TCPDialer{}, proxy.server.URL+"/proxy", target.server.URL+"/dns-query", nil, withTestRoots(proxy.server))
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		resp, err := resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+		require.NoError(t, err)
+		require.Len(t, resp.Answers, 1)
+	}
+	require.Equal(t, int32(1), target.configFetches.Load())
+	require.Equal(t, int32(2), target.queries.Load())
+	// The config fetch also goes through the proxy.
+	require.Equal(t, int32(3), proxy.forwarded.Load())
+}
+
+func TestObliviousHTTPSResolver_SharesConfigFetch(t *testing.T) {
+	target := newTestODoHTarget(t)
+	target.configsReady = make(chan struct{})
+	proxy := newTestODoHProxy(t)
+	resolver, err := NewObliviousHTTPSResolver(&transport.TCPDialer{}, proxy.server.URL+"/proxy", target.server.URL+"/dns-query", nil, withTestRoots(proxy.server))
+	require.NoError(t, err)
+
+	// A query stops waiting for the config when its context is done, without cancelling the fetch.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = resolver.Query(ctx, mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.ErrorIs(t, err, context.Canceled)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+		}(i)
+	}
+	close(target.configsReady)
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+	require.Equal(t, int32(1), target.configFetches.Load())
+	require.Equal(t, int32(5), target.queries.Load())
+}
+
+func TestObliviousHTTPSResolver_ProvidedConfig(t *testing.T) {
+	target := newTestODoHTarget(t)
+	proxy := newTestODoHProxy(t)
+	resolver, err := NewObliviousHTTPSResolver(&transport.TCPDialer{}, proxy.server.URL+"/proxy", target.server.URL+"/dns-query", target.marshalConfigs(), withTestRoots(proxy.server))
+	require.NoError(t, err)
+
+	resp, err := resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	require.Len(t, resp.Answers, 1)
+	require.Equal(t, int32(0), target.configFetches.Load())
+
+	// The provided config is not refreshed when the target rotates its key.
+	target.rotateKey(t)
+	_, err = resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.ErrorIs(t, err, ErrReceive)
+	require.ErrorContains(t, err, "401")
+}
+
+func TestObliviousHTTPSResolver_KeyRotation(t *testing.T) {
+	target := newTestODoHTarget(t)
+	proxy := newTestODoHProxy(t)
+	resolver, err := NewObliviousHTTPSResolver(&transport.TCPDialer{}, proxy.server.URL+"/proxy", target.server.URL+"/dns-query", nil, withTestRoots(proxy.server))
+	require.NoError(t, err)
+
+	_, err = resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	target.rotateKey(t)
+	resp, err := resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	require.Len(t, resp.Answers, 1)
+	require.Equal(t, int32(2), target.configFetches.Load())
+}
+
+func TestObliviousHTTPSResolver_ConfigFetchFails(t *testing.T) {
+	target := newTestODoHTarget(t)
+	target.failConfigs = true
+	proxy := newTestODoHProxy(t)
+	resolver, err := NewObliviousHTTPSResolver(&transport.TCPDialer{}, proxy.server.URL+"/proxy", target.server.URL+"/dns-query", nil, withTestRoots(proxy.server))
+	require.NoError(t, err)
+	_, err = resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.ErrorIs(t, err, ErrDial)
+	require.Equal(t, int32(0), target.queries.Load())
+}
+
+func TestNewObliviousHTTPSResolver_InvalidArguments(t *testing.T) {
+	_, err := NewObliviousHTTPSResolver(&transport.TCPDialer{}, "http://proxy.example/proxy", "https://target.example/dns-query", nil)
+	require.Error(t, err)
+	_, err = NewObliviousHTTPSResolver(&transport.TCPDialer{}, "https://proxy.example/proxy", "https:///dns-query", nil)
+	require.Error(t, err)
+	_, err = NewObliviousHTTPSResolver(&transport.TCPDialer{}, "https://proxy.example/proxy", "https://target.example/dns-query", []byte{0, 1, 2})
+	require.Error(t, err)
+}
+
+func Test_parseODoHConfigs(t *testing.T) {
+	target := newTestODoHTarget(t)
+	configs := target.marshalConfigs()
+	// Prepend a config with an unknown version, which must be skipped.
+	unknown := []byte{0xff, 0xff, 0, 2, 1, 2}
+	withUnknown := binary.BigEndian.AppendUint16(nil, uint16(len(unknown)+len(configs)-2))
+	withUnknown = append(withUnknown, unknown...)
+	withUnknown = append(withUnknown, configs[2:]...)
+
+	config, err := parseODoHConfigs(withUnknown)
+	require.NoError(t, err)
+	require.Equal(t, target.config.keyID(), config.keyID())
+	require.Len(t, config.keyID(), 32)
+
+	_, err = parseODoHConfigs(configs[:len(configs)-1])
+	require.Error(t, err)
+	_, err = parseODoHConfigs([]byte{0, 6, 0xff, 0xff, 0, 2, 1, 2})
+	require.Error(t, err)
+}
+
+func Test_ODoHPlaintext(t *testing.T) {
+	for _, size := range []int{1, 50, 124, 125, 300} {
+		msg := bytes.Repeat([]byte{1}, size)
+		plaintext := appendODoHPlaintext(nil, msg)
+		require.Zero(t, len(plaintext)%odohPaddingBlockSize)
+		parsed, err := parseODoHPlaintext(plaintext)
+		require.NoError(t, err)
+		require.Equal(t, msg, parsed)
+	}
+	plaintext := appendODoHPlaintext(nil, []byte{1, 2, 3})
+	plaintext[len(plaintext)-1] = 1
+	_, err := parseODoHPlaintext(plaintext)
+	require.Error(t, err)
+}
+
+func Test_parseMaxAge(t *testing.T) {
+	require.Equal(t, defaultODoHConfigTTL, parseMaxAge("", defaultODoHConfigTTL))
+	require.Equal(t, defaultODoHConfigTTL, parseMaxAge("no-cache", defaultODoHConfigTTL))
+	require.Equal(t, int64(60), int64(parseMaxAge("public, max-age=60", defaultODoHConfigTTL).Seconds()))
+}
+
+/********** Test Utilities **********/
+
+// withTestRoots makes the resolver trust the certificate of the httptest TLS servers.
+func withTestRoots(server *httptest.Server) HTTPSResolverOption {
+	roots := server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	return func(opts *httpsResolverOptions) {
+		opts.tlsConfig = &tls.Config{RootCAs: roots}
+	}
+}
+
+const testProxyHeader = "X-Test-Proxy"
+
+// testODoHTarget is an ODoH target that answers with answerResolver, and only accepts queries from the proxy.
+type testODoHTarget struct {
+	server        *httptest.Server
+	dnsServer     *Server
+	configFetches atomic.Int32
+	queries       atomic.Int32
+	failConfigs   bool
+	// configsReady, if not nil, delays the config responses until it's closed.
+	configsReady chan struct{}
+
+	mu         sync.Mutex
+	privateKey kem.PrivateKey
+	config     *odohConfig
+}
+
+var testODoHSuite = struct {
+	kem  hpke.KEM
+	kdf  hpke.KDF
+	aead hpke.AEAD
+}{hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM}
+
+func newTestODoHTarget(t *testing.T) *testODoHTarget {
+	target := &testODoHTarget{dnsServer: newTestServer(t, answerResolver(1), ServerOptions{})}
+	target.rotateKey(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc(odohConfigsPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(testProxyHeader) == "" {
+			http.Error(w, "configs must be fetched through the proxy", http.StatusForbidden)
+			return
+		}
+		target.configFetches.Add(1)
+		if target.configsReady != nil {
+			<-target.configsReady
+		}
+		if target.failConfigs {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Write(target.marshalConfigs())
+	})
+	mux.HandleFunc("/dns-query", target.handleQuery)
+	target.server = httptest.NewTLSServer(mux)
+	t.Cleanup(target.server.Close)
+	return target
+}
+
+// rotateKey generates a new key pair, so that queries for the previous key are rejected.
+func (target *testODoHTarget) rotateKey(t *testing.T) {
+	publicKey, privateKey, err := testODoHSuite.kem.Scheme().GenerateKeyPair()
+	require.NoError(t, err)
+	publicKeyBytes, err := publicKey.MarshalBinary()
+	require.NoError(t, err)
+	contents := binary.BigEndian.AppendUint16(nil, uint16(testODoHSuite.kem))
+	contents = binary.BigEndian.AppendUint16(contents, uint16(testODoHSuite.kdf))
+	contents = binary.BigEndian.AppendUint16(contents, uint16(testODoHSuite.aead))
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(publicKeyBytes)))
+	contents = append(contents, publicKeyBytes...)
+	config, err := parseODoHConfigContents(contents)
+	require.NoError(t, err)
+
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	target.privateKey = privateKey
+	target.config = config
+}
+
+// marshalConfigs returns the serialized ObliviousDoHConfigs with the current config.
+func (target *testODoHTarget) marshalConfigs() []byte {
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	config := binary.BigEndian.AppendUint16(nil, odohVersion)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(target.config.contents)))
+	config = append(config, target.config.contents...)
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(config))), config...)
+}
+
+func (target *testODoHTarget) handleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(testProxyHeader) == "" {
+		http.Error(w, "queries must go through the proxy", http.StatusForbidden)
+		return
+	}
+	target.queries.Add(1)
+	if r.Header.Get("Content-Type") != odohMediaType {
+		http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	keyID, encrypted, err := parseODoHMessage(body, odohMessageQuery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	target.mu.Lock()
+	config, privateKey := target.config, target.privateKey
+	target.mu.Unlock()
+	if !bytes.Equal(keyID, config.keyID()) {
+		http.Error(w, "unknown key", http.StatusUnauthorized)
+		return
+	}
+
+	encSize := testODoHSuite.kem.Scheme().CiphertextSize()
+	if len(encrypted) < encSize {
+		http.Error(w, "truncated message", http.StatusBadRequest)
+		return
+	}
+	receiver, err := config.suite.NewReceiver(privateKey, []byte("odoh query"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	opener, err := receiver.Setup(encrypted[:encSize])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	queryPlaintext, err := opener.Open(encrypted[encSize:], odohAAD(odohMessageQuery, keyID))
+	if err != nil {
+		http.Error(w, "decryption failed", http.StatusBadRequest)
+		return
+	}
+	query, err := parseODoHPlaintext(queryPlaintext)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, _ := target.dnsServer.answer(r.Context(), "", query)
+	if resp == nil {
+		http.Error(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+	dnsResponse, err := resp.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	responseNonce := make([]byte, odohResponseNonceSize(testODoHSuite.aead))
+	rand.Read(responseNonce)
+	aead, nonce, err := odohResponseAEAD(opener, queryPlaintext, responseNonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ct := aead.Seal(nil, nonce, appendODoHPlaintext(nil, dnsResponse), odohAAD(odohMessageResponse, responseNonce))
+	w.Header().Set("Content-Type", odohMediaType)
+	w.Write(appendODoHMessage(nil, odohMessageResponse, responseNonce, ct))
+}
+
+// testODoHProxy forwards the requests to the target in the targethost and targetpath parameters, and checks
+// that it can't see the queries.
+type testODoHProxy struct {
+	server    *httptest.Server
+	forwarded atomic.Int32
+}
+
+func newTestODoHProxy(t *testing.T) *testODoHProxy {
+	proxy := &testODoHProxy{}
+	proxy.server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targetHost := r.URL.Query().Get("targethost")
+		targetPath := r.URL.Query().Get("targetpath")
+		if (r.Method != http.MethodPost && r.Method != http.MethodGet) || targetHost == "" || targetPath == "" {
+			http.Error(w, "invalid proxy request", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		if bytes.Contains(body, []byte("example")) {
+			http.Error(w, "the proxy can see the query", http.StatusBadRequest)
+			return
+		}
+		proxy.forwarded.Add(1)
+		targetURL := url.URL{Scheme: "https", Host: targetHost, Path: targetPath}
+		req, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL.String(), bytes.NewReader(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+		req.Header.Set(testProxyHeader, "1")
+		resp, err := proxy.server.Client().Do(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	t.Cleanup(proxy.server.Close)
+	return proxy
+}
@@ -17,14 +17,16 @@ package dns
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
+	stdtls "crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Jigsaw-Code/outline-sdk/transport"
@@ -93,8 +95,68 @@ func NewQuestion(domain string, qtype dnsmessage.Type) (*dnsmessage.Question, er
 // for the IPv6 and UDP headers".
 const maxUDPMessageSize = 1232
 
+// requestOptions holds the settings that the resolvers in this package apply to the requests they send.
+type requestOptions struct {
+	// dnssecOK sets the DNSSEC OK (DO) bit, asking the server to include the DNSSEC records.
+	dnssecOK bool
+	// paddingBlockSize pads the request to a multiple of the block size, if not zero.
+	paddingBlockSize int
+	// clientSubnet is sent in the Client Subnet option, if valid.
+	clientSubnet netip.Prefix
+	// cookies, if not nil, holds the DNS cookies to send and check.
+	cookies *cookieJar
+}
+
+// optionsResolver is a [Resolver] that can apply [requestOptions] to its requests. The resolvers that send the
+// requests, like the one created by [NewUDPResolver], implement it, and so does [NewEDNS0Resolver], which adds
+// its own options. Wrapping resolvers pass the options explicitly, rather than in the context, so they only
+// apply to the resolver they wrap, and not to resolvers nested in other ones, like [NewFallbackResolver].
+type optionsResolver interface {
+	Resolver
+	queryWithOptions(ctx context.Context, q dnsmessage.Question, opts requestOptions) (*dnsmessage.Message, error)
+}
+
+// asOptionsResolver returns resolver as an [optionsResolver], or an error if it can't apply request options.
+func asOptionsResolver(resolver Resolver) (optionsResolver, error) {
+	if resolver == nil {
+		return nil, errors.New("argument resolver must not be nil")
+	}
+	r, ok := resolver.(optionsResolver)
+	if !ok {
+		return nil, errors.New("resolver must send the requests itself, like the ones created by NewUDPResolver, NewTCPResolver, NewDO53Resolver, NewTLSResolver or NewHTTPSResolver")
+	}
+	return r, nil
+}
+
 // appendRequest appends the bytes a DNS request using the id and question to buf.
 func appendRequest(id uint16, q dnsmessage.Question, buf []byte) ([]byte, error) {
+	return appendRequestWithOptions(id, q, requestOptions{}, buf)
+}
+
+// appendRequestWithOptions is like appendRequest, but applies opts to the request.
+func appendRequestWithOptions(id uint16, q dnsmessage.Question, opts requestOptions, buf []byte) ([]byte, error) {
+	var options []dnsmessage.Option
+	if opts.clientSubnet.IsValid() {
+		options = append(options, clientSubnetOption(opts.clientSubnet))
+	}
+	if opts.cookies != nil {
+		options = append(options, opts.cookies.option())
+	}
+	start := len(buf)
+	msg, err := appendRequestWithEDNS0Options(id, q, opts.dnssecOK, options, buf)
+	if err != nil || opts.paddingBlockSize <= 0 {
+		return msg, err
+	}
+	// Pad the message to a multiple of the block size, as per https://datatracker.ietf.org/doc/html/rfc8467#section-4.1.
+	// The padding option itself takes 4 bytes.
+	size := len(msg) - start + 4
+	padding := (opts.paddingBlockSize - size%opts.paddingBlockSize) % opts.paddingBlockSize
+	options = append(options, PaddingOption(padding))
+	return appendRequestWithEDNS0Options(id, q, opts.dnssecOK, options, buf[:start])
+}
+
+// appendRequestWithEDNS0Options appends a DNS request with the given OPT record flag and options to buf.
+func appendRequestWithEDNS0Options(id uint16, q dnsmessage.Question, dnssecOK bool, options []dnsmessage.Option, buf []byte) ([]byte, error) {
 	b := dnsmessage.NewBuilder(buf, dnsmessage.Header{ID: id, RecursionDesired: true})
 	if err := b.StartQuestions(); err != nil {
 		return nil, fmt.Errorf("start questions failed: %w", err)
@@ -108,10 +170,10 @@ func appendRequest(id uint16, q dnsmessage.Question, buf []byte) ([]byte, error)
 
 	var rh dnsmessage.ResourceHeader
 	// Set the maximum payload size we support, as per https://datatracker.ietf.org/doc/html/rfc6891#section-4.3
-	if err := rh.SetEDNS0(maxUDPMessageSize, dnsmessage.RCodeSuccess, false); err != nil {
+	if err := rh.SetEDNS0(maxUDPMessageSize, dnsmessage.RCodeSuccess, dnssecOK); err != nil {
 		return nil, fmt.Errorf("set EDNS(0) failed: %w", err)
 	}
-	if err := b.OPTResource(rh, dnsmessage.OPTResource{}); err != nil {
+	if err := b.OPTResource(rh, dnsmessage.OPTResource{Options: options}); err != nil {
 		return nil, fmt.Errorf("add OPT RR failed: %w", err)
 	}
 
@@ -167,10 +229,10 @@ func checkResponse(reqID uint16, reqQues dnsmessage.Question, respHdr dnsmessage
 }
 
 // queryDatagram implements a DNS query over a datagram protocol.
-func queryDatagram(conn io.ReadWriter, q dnsmessage.Question) (*dnsmessage.Message, error) {
+func queryDatagram(conn io.ReadWriter, q dnsmessage.Question, opts requestOptions) (*dnsmessage.Message, error) {
 	// Reference: https://cs.opensource.google/go/go/+/master:src/net/dnsclient_unix.go?q=func:dnsPacketRoundTrip&ss=go%2Fgo
 	id := uint16(rand.Uint32())
-	buf, err := appendRequest(id, q, make([]byte, 0, maxUDPMessageSize))
+	buf, err := appendRequestWithOptions(id, q, opts, make([]byte, 0, maxUDPMessageSize))
 	if err != nil {
 		return nil, &nestedError{ErrBadRequest, fmt.Errorf("append request failed: %w", err)}
 	}
@@ -198,52 +260,17 @@ func queryDatagram(conn io.ReadWriter, q dnsmessage.Question) (*dnsmessage.Messa
 			returnErr = errors.Join(returnErr, err)
 			continue
 		}
+		if opts.cookies != nil {
+			// Responses with the wrong cookie could be injected.
+			if err := opts.cookies.check(&msg); err != nil {
+				returnErr = errors.Join(returnErr, err)
+				continue
+			}
+		}
 		return &msg, nil
 	}
 }
 
-// queryStream implements a DNS query over a stream protocol. It frames the messages by prepending them with a 2-byte length prefix.
-func queryStream(conn io.ReadWriter, q dnsmessage.Question) (*dnsmessage.Message, error) {
-	// Reference: https://cs.opensource.google/go/go/+/master:src/net/dnsclient_unix.go?q=func:dnsStreamRoundTrip&ss=go%2Fgo
-	id := uint16(rand.Uint32())
-	buf, err := appendRequest(id, q, make([]byte, 2, 514))
-	if err != nil {
-		return nil, &nestedError{ErrBadRequest, fmt.Errorf("append request failed: %w", err)}
-	}
-	// Buffer length must fit in a uint16.
-	if len(buf) > 1<<16-1 {
-		return nil, &nestedError{ErrBadRequest, fmt.Errorf("message too large: %v bytes", len(buf))}
-	}
-	binary.BigEndian.PutUint16(buf[:2], uint16(len(buf)-2))
-
-	// TODO: Consider writer.ReadFrom(net.Buffers) in case the writer is a TCPConn.
-	if _, err := conn.Write(buf); err != nil {
-		return nil, &nestedError{ErrSend, err}
-	}
-
-	var msgLen uint16
-	if err := binary.Read(conn, binary.BigEndian, &msgLen); err != nil {
-		return nil, &nestedError{ErrReceive, fmt.Errorf("read message length failed: %w", err)}
-	}
-	if int(msgLen) <= cap(buf) {
-		buf = buf[:msgLen]
-	} else {
-		buf = make([]byte, msgLen)
-	}
-	if _, err = io.ReadFull(conn, buf); err != nil {
-		return nil, &nestedError{ErrReceive, fmt.Errorf("read message failed: %w", err)}
-	}
-
-	var msg dnsmessage.Message
-	if err = msg.Unpack(buf); err != nil {
-		return nil, &nestedError{ErrBadResponse, fmt.Errorf("response failed to unpack: %w", err)}
-	}
-	if err := checkResponse(id, q, msg.Header, msg.Questions); err != nil {
-		return nil, &nestedError{ErrBadResponse, err}
-	}
-	return &msg, nil
-}
-
 func ensurePort(address string, defaultPort string) string {
 	host, port, err := net.SplitHostPort(address)
 	if err != nil {
@@ -261,82 +288,196 @@ func ensurePort(address string, defaultPort string) string {
 //
 // [DNS-over-UDP]: https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.1
 func NewUDPResolver(pd transport.PacketDialer, resolverAddr string) Resolver {
-	resolverAddr = ensurePort(resolverAddr, "53")
-	return FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
-		conn, err := pd.DialPacket(ctx, resolverAddr)
-		if err != nil {
-			return nil, &nestedError{ErrDial, err}
-		}
-		defer conn.Close()
-		if deadline, ok := ctx.Deadline(); ok {
-			conn.SetDeadline(deadline)
-		}
-		return queryDatagram(conn, q)
-	})
+	return &udpResolver{pd: pd, resolverAddr: ensurePort(resolverAddr, "53")}
 }
 
-type streamResolver struct {
-	NewConn func(context.Context) (transport.StreamConn, error)
+type udpResolver struct {
+	pd           transport.PacketDialer
+	resolverAddr string
 }
 
-func (r *streamResolver) Query(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
-	conn, err := r.NewConn(ctx)
+var _ optionsResolver = (*udpResolver)(nil)
+
+func (r *udpResolver) Query(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	return r.queryWithOptions(ctx, q, requestOptions{})
+}
+
+func (r *udpResolver) queryWithOptions(ctx context.Context, q dnsmessage.Question, opts requestOptions) (*dnsmessage.Message, error) {
+	conn, err := r.pd.DialPacket(ctx, r.resolverAddr)
 	if err != nil {
 		return nil, &nestedError{ErrDial, err}
 	}
-	// TODO: reuse connection, as per https://datatracker.ietf.org/doc/html/rfc7766#section-6.2.1.
 	defer conn.Close()
 	if deadline, ok := ctx.Deadline(); ok {
 		conn.SetDeadline(deadline)
 	}
-	return queryStream(conn, q)
+	return queryDatagram(conn, q, opts)
+}
+
+// defaultStreamIdleTimeout is how long a stream connection is kept open without pending queries.
+const defaultStreamIdleTimeout = 10 * time.Second
+
+type streamResolver struct {
+	NewConn     func(context.Context) (transport.StreamConn, error)
+	idleTimeout time.Duration
+
+	mu   sync.Mutex // Protects conn
+	conn *pipelinedConn
+}
+
+func newStreamResolver(newConn func(context.Context) (transport.StreamConn, error)) *streamResolver {
+	return &streamResolver{NewConn: newConn, idleTimeout: defaultStreamIdleTimeout}
+}
+
+// getConn returns the current connection, or dials a new one if there's no usable connection.
+// The returned bool indicates whether the connection was reused.
+func (r *streamResolver) getConn(ctx context.Context) (*pipelinedConn, bool, error) {
+	r.mu.Lock()
+	if r.conn != nil && r.conn.usable() {
+		conn := r.conn
+		r.mu.Unlock()
+		return conn, true, nil
+	}
+	r.mu.Unlock()
+
+	// Dial without holding the lock, so that a slow dial doesn't block the queries on a new connection.
+	streamConn, err := r.NewConn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	conn := newPipelinedConn(streamConn, r.idleTimeout)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != nil && r.conn.usable() {
+		// Another query established a connection first.
+		conn.close(errConnClosed)
+		return r.conn, true, nil
+	}
+	r.conn = conn
+	return conn, false, nil
+}
+
+var _ optionsResolver = (*streamResolver)(nil)
+
+func (r *streamResolver) Query(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	return r.queryWithOptions(ctx, q, requestOptions{})
+}
+
+func (r *streamResolver) queryWithOptions(ctx context.Context, q dnsmessage.Question, opts requestOptions) (*dnsmessage.Message, error) {
+	conn, reused, err := r.getConn(ctx)
+	if err != nil {
+		return nil, &nestedError{ErrDial, err}
+	}
+	msg, err := conn.query(ctx, q, opts)
+	// The server may have closed a reused connection, in which case we retry once on a new connection,
+	// as per https://datatracker.ietf.org/doc/html/rfc7766#section-6.2.1.
+	if err != nil && reused && ctx.Err() == nil && !conn.usable() &&
+		(errors.Is(err, ErrSend) || errors.Is(err, ErrReceive)) {
+		conn, _, err = r.getConn(ctx)
+		if err != nil {
+			return nil, &nestedError{ErrDial, err}
+		}
+		return conn.query(ctx, q, opts)
+	}
+	return msg, err
 }
 
 // NewTCPResolver creates a [Resolver] that implements the [DNS-over-TCP] protocol, using a [transport.StreamDialer] for transport.
-// It creates a new connection to the resolver for every request.
+// It keeps a persistent connection to the resolver, pipelines concurrent requests over it, and transparently
+// reconnects if the connection is closed. The connection is closed after it's idle for 10 seconds, or when it stops
+// answering: a query times out before any response, or several queries time out in a row.
 //
 // [DNS-over-TCP]: https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.2
 func NewTCPResolver(sd transport.StreamDialer, resolverAddr string) Resolver {
 	// TODO: Consider handling Authenticated Data.
 	resolverAddr = ensurePort(resolverAddr, "53")
-	return &streamResolver{
-		NewConn: func(ctx context.Context) (transport.StreamConn, error) {
-			return sd.DialStream(ctx, resolverAddr)
-		},
+	return newStreamResolver(func(ctx context.Context) (transport.StreamConn, error) {
+		return sd.DialStream(ctx, resolverAddr)
+	})
+}
+
+// NewDO53Resolver creates a [Resolver] that sends the queries to resolverAddr over UDP, as [NewUDPResolver] does,
+// and retries them over TCP, as [NewTCPResolver] does, when the response is truncated, as per
+// https://datatracker.ietf.org/doc/html/rfc1123#page-75.
+// When wrapped by [NewEDNS0Resolver], both transports send the same DNS cookies, so the server cookie learned
+// over UDP is sent in the TCP retry.
+func NewDO53Resolver(pd transport.PacketDialer, sd transport.StreamDialer, resolverAddr string) Resolver {
+	return &do53Resolver{
+		udp: &udpResolver{pd: pd, resolverAddr: ensurePort(resolverAddr, "53")},
+		tcp: NewTCPResolver(sd, resolverAddr).(*streamResolver),
 	}
 }
 
+type do53Resolver struct {
+	udp *udpResolver
+	tcp *streamResolver
+}
+
+var _ optionsResolver = (*do53Resolver)(nil)
+
+func (r *do53Resolver) Query(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	return r.queryWithOptions(ctx, q, requestOptions{})
+}
+
+func (r *do53Resolver) queryWithOptions(ctx context.Context, q dnsmessage.Question, opts requestOptions) (*dnsmessage.Message, error) {
+	msg, err := r.udp.queryWithOptions(ctx, q, opts)
+	if err != nil || !msg.Truncated {
+		return msg, err
+	}
+	if opts.cookies != nil {
+		// The truncated response passed the cookie check, so its server cookie can be used for the retry.
+		opts.cookies.update(msg)
+	}
+	return r.tcp.queryWithOptions(ctx, q, opts)
+}
+
 // NewTLSResolver creates a [Resolver] that implements the [DNS-over-TLS] protocol, using a [transport.StreamDialer]
 // to connect to the resolverAddr, and the resolverName as the TLS server name.
-// It creates a new connection to the resolver for every request.
+// Connections are reused and pipelined the same way as [NewTCPResolver].
 //
 // [DNS-over-TLS]: https://datatracker.ietf.org/doc/html/rfc7858
 func NewTLSResolver(sd transport.StreamDialer, resolverAddr string, resolverName string) Resolver {
 	resolverAddr = ensurePort(resolverAddr, "853")
-	return &streamResolver{
-		NewConn: func(ctx context.Context) (transport.StreamConn, error) {
-			baseConn, err := sd.DialStream(ctx, resolverAddr)
-			if err != nil {
-				return nil, err
-			}
-			return tls.WrapConn(ctx, baseConn, resolverName)
-		},
+	return newStreamResolver(func(ctx context.Context) (transport.StreamConn, error) {
+		baseConn, err := sd.DialStream(ctx, resolverAddr)
+		if err != nil {
+			return nil, err
+		}
+		return tls.WrapConn(ctx, baseConn, resolverName)
+	})
+}
+
+// httpsResolverOptions holds the configuration set by the [HTTPSResolverOption] values.
+type httpsResolverOptions struct {
+	httpClient *http.Client
+	// tlsConfig overrides the default TLS configuration. Used in tests to trust a local server.
+	tlsConfig *stdtls.Config
+}
+
+// HTTPSResolverOption configures the resolver created by [NewHTTPSResolver].
+type HTTPSResolverOption func(*httpsResolverOptions)
+
+// WithHTTPClient makes the resolver send the requests with client, instead of a client that connects to the
+// resolver with the [transport.StreamDialer]. The client must connect to the resolver address by itself.
+// This allows other transports, such as HTTP/3, which package [github.com/Jigsaw-Code/outline-sdk/x/dnsquic] provides.
+func WithHTTPClient(client *http.Client) HTTPSResolverOption {
+	return func(opts *httpsResolverOptions) {
+		opts.httpClient = client
 	}
 }
 
-// NewHTTPSResolver creates a [Resolver] that implements the [DNS-over-HTTPS] protocol, using a [transport.StreamDialer]
-// to connect to the resolverAddr, and the url as the DoH template URI.
-// It uses an internal HTTP client that reuses connections when possible.
-//
-// [DNS-over-HTTPS]: https://datatracker.ietf.org/doc/html/rfc8484
-func NewHTTPSResolver(sd transport.StreamDialer, resolverAddr string, url string) Resolver {
-	resolverAddr = ensurePort(resolverAddr, "443")
+// newHTTPClient creates the HTTP client used by the DNS-over-HTTPS resolvers. For each requested address,
+// it connects to the address returned by dialAddr using sd, unless [WithHTTPClient] sets the client.
+func newHTTPClient(sd transport.StreamDialer, dialAddr func(addr string) string, opts *httpsResolverOptions) *http.Client {
+	if opts.httpClient != nil {
+		return opts.httpClient
+	}
 	dialContext := func(ctx context.Context, network, addr string) (net.Conn, error) {
 		if !strings.HasPrefix(network, "tcp") {
-			// TODO: Support UDP for QUIC.
 			return nil, fmt.Errorf("protocol not supported: %v", network)
 		}
-		conn, err := sd.DialStream(ctx, resolverAddr)
+		conn, err := sd.DialStream(ctx, dialAddr(addr))
 		if err != nil {
 			return nil, &nestedError{ErrDial, err}
 		}
@@ -344,50 +485,94 @@ func NewHTTPSResolver(sd transport.StreamDialer, resolverAddr string, url string
 	}
 	// TODO: add mechanism to close idle connections.
 	// Copied from Intra: https://github.com/Jigsaw-Code/Intra/blob/d3554846a1146ae695e28a8ed6dd07f0cd310c5a/Android/tun2socks/intra/doh/doh.go#L213-L219
-	httpClient := http.Client{
+	return &http.Client{
 		Transport: &http.Transport{
 			DialContext:           dialContext,
+			TLSClientConfig:       opts.tlsConfig,
 			ForceAttemptHTTP2:     true,
 			TLSHandshakeTimeout:   10 * time.Second,
 			ResponseHeaderTimeout: 20 * time.Second, // Same value as Android DNS-over-TLS
 		},
 	}
-	return FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
-		// Prepare request.
-		buf, err := appendRequest(0, q, make([]byte, 0, 512))
-		if err != nil {
-			return nil, &nestedError{ErrBadRequest, fmt.Errorf("append request failed: %w", err)}
-		}
-		httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(buf))
-		if err != nil {
-			return nil, &nestedError{ErrBadRequest, fmt.Errorf("create HTTP request failed: %w", err)}
-		}
-		const mimetype = "application/dns-message"
-		httpReq.Header.Add("Accept", mimetype)
-		httpReq.Header.Add("Content-Type", mimetype)
+}
 
-		// Send request and get response.
-		httpResp, err := httpClient.Do(httpReq)
-		if err != nil {
-			return nil, &nestedError{ErrReceive, fmt.Errorf("failed to get HTTP response: %w", err)}
-		}
-		defer httpResp.Body.Close()
-		if httpResp.StatusCode != http.StatusOK {
-			return nil, &nestedError{ErrReceive, fmt.Errorf("got HTTP status %v", httpResp.StatusCode)}
-		}
-		response, err := io.ReadAll(httpResp.Body)
-		if err != nil {
-			return nil, &nestedError{ErrReceive, fmt.Errorf("failed to read response: %w", err)}
-		}
+// httpStatusError reports an unexpected HTTP status code.
+type httpStatusError struct {
+	code int
+}
 
-		// Process response.
-		var msg dnsmessage.Message
-		if err = msg.Unpack(response); err != nil {
-			return nil, &nestedError{ErrBadResponse, fmt.Errorf("failed to unpack DNS response: %w", err)}
-		}
-		if err := checkResponse(0, q, msg.Header, msg.Questions); err != nil {
-			return nil, &nestedError{ErrBadResponse, err}
-		}
-		return &msg, nil
-	})
+func (e *httpStatusError) Error() string { return fmt.Sprintf("got HTTP status %v", e.code) }
+
+// exchangeHTTP posts the request to url with the given media type, and returns the response body.
+func exchangeHTTP(ctx context.Context, httpClient *http.Client, url string, mimetype string, request []byte) ([]byte, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(request))
+	if err != nil {
+		return nil, &nestedError{ErrBadRequest, fmt.Errorf("create HTTP request failed: %w", err)}
+	}
+	httpReq.Header.Add("Accept", mimetype)
+	httpReq.Header.Add("Content-Type", mimetype)
+
+	// Send request and get response.
+	httpResp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, &nestedError{ErrReceive, fmt.Errorf("failed to get HTTP response: %w", err)}
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, &nestedError{ErrReceive, &httpStatusError{httpResp.StatusCode}}
+	}
+	response, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, &nestedError{ErrReceive, fmt.Errorf("failed to read response: %w", err)}
+	}
+	return response, nil
+}
+
+// NewHTTPSResolver creates a [Resolver] that implements the [DNS-over-HTTPS] protocol, using a [transport.StreamDialer]
+// to connect to the resolverAddr, and the url as the DoH template URI.
+// It uses an internal HTTP client that reuses connections when possible.
+// With [WithHTTPClient], the resolver uses the given client instead, and sd may be nil.
+//
+// [DNS-over-HTTPS]: https://datatracker.ietf.org/doc/html/rfc8484
+func NewHTTPSResolver(sd transport.StreamDialer, resolverAddr string, url string, options ...HTTPSResolverOption) Resolver {
+	var opts httpsResolverOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	resolverAddr = ensurePort(resolverAddr, "443")
+	httpClient := newHTTPClient(sd, func(string) string { return resolverAddr }, &opts)
+	return &httpsResolver{httpClient: httpClient, url: url}
+}
+
+type httpsResolver struct {
+	httpClient *http.Client
+	url        string
+}
+
+var _ optionsResolver = (*httpsResolver)(nil)
+
+func (r *httpsResolver) Query(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	return r.queryWithOptions(ctx, q, requestOptions{})
+}
+
+func (r *httpsResolver) queryWithOptions(ctx context.Context, q dnsmessage.Question, opts requestOptions) (*dnsmessage.Message, error) {
+	// Prepare request.
+	buf, err := appendRequestWithOptions(0, q, opts, make([]byte, 0, 512))
+	if err != nil {
+		return nil, &nestedError{ErrBadRequest, fmt.Errorf("append request failed: %w", err)}
+	}
+	response, err := exchangeHTTP(ctx, r.httpClient, r.url, "application/dns-message", buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Process response.
+	var msg dnsmessage.Message
+	if err = msg.Unpack(response); err != nil {
+		return nil, &nestedError{ErrBadResponse, fmt.Errorf("failed to unpack DNS response: %w", err)}
+	}
+	if err := checkResponse(0, q, msg.Header, msg.Questions); err != nil {
+		return nil, &nestedError{ErrBadResponse, err}
+	}
+	return &msg, nil
 }
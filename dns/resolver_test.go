@@ -210,7 +210,7 @@ func testDatagramExchange(t *testing.T, server func(request dnsmessage.Message,
 	require.NoError(t, err)
 	clientDone := make(chan queryResult)
 	go func() {
-		msg, err := queryDatagram(front, *q)
+		msg, err := queryDatagram(front, *q, requestOptions{})
 		clientDone <- queryResult{msg, err}
 	}()
 	// Read request.
@@ -281,7 +281,7 @@ func Test_queryDatagram(t *testing.T) {
 		require.NoError(t, err)
 		clientDone := make(chan queryResult)
 		go func() {
-			msg, err := queryDatagram(front, *q)
+			msg, err := queryDatagram(front, *q, requestOptions{})
 			clientDone <- queryResult{msg, err}
 		}()
 		// Wait for queryDatagram.
@@ -295,142 +295,7 @@ func Test_queryDatagram(t *testing.T) {
 		require.NoError(t, err)
 		clientDone := make(chan queryResult)
 		go func() {
-			msg, err := queryDatagram(front, *q)
-			clientDone <- queryResult{msg, err}
-		}()
-		back.Read(make([]byte, 521))
-		back.Close()
-		// Wait for queryDatagram.
-		result := <-clientDone
-		require.ErrorIs(t, result.err, ErrReceive)
-		require.ErrorIs(t, result.err, io.EOF)
-	})
-}
-
-func testStreamExchange(t *testing.T, server func(request dnsmessage.Message, conn net.Conn)) (*dnsmessage.Message, error) {
-	front, back := net.Pipe()
-	q, err := NewQuestion("example.com.", dnsmessage.TypeAAAA)
-	require.NoError(t, err)
-	clientDone := make(chan queryResult)
-	go func() {
-		msg, err := queryStream(front, *q)
-		clientDone <- queryResult{msg, err}
-	}()
-	// Read request.
-	var msgLen uint16
-	require.NoError(t, binary.Read(back, binary.BigEndian, &msgLen))
-	buf := make([]byte, msgLen)
-	n, err := back.Read(buf)
-	require.NoError(t, err)
-	buf = buf[:n]
-	// Verify request.
-	var reqMsg dnsmessage.Message
-	reqMsg.Unpack(buf)
-	reqID := reqMsg.ID
-	expectedBuf, err := appendRequest(reqID, *q, make([]byte, 0, 512))
-	require.NoError(t, err)
-	require.Equal(t, expectedBuf, buf)
-
-	server(reqMsg, back)
-
-	result := <-clientDone
-	return result.msg, result.err
-}
-
-func Test_queryStream(t *testing.T) {
-	t.Run("Success", func(t *testing.T) {
-		var respSent dnsmessage.Message
-		respRcvd, err := testStreamExchange(t, func(req dnsmessage.Message, conn net.Conn) {
-			var err error
-			// Prepare response message.
-			respSent, err = newMessageResponse(req, &dnsmessage.AAAAResource{AAAA: [16]byte(net.IPv6loopback)}, 100)
-			require.NoError(t, err)
-
-			// Send response.
-			buf, err := (&respSent).Pack()
-			require.NoError(t, err)
-			require.NoError(t, binary.Write(conn, binary.BigEndian, uint16(len(buf))))
-			_, err = conn.Write(buf)
-			require.NoError(t, err)
-		})
-		require.NoError(t, err)
-		require.NotNil(t, respRcvd)
-		require.Equal(t, respSent, *respRcvd)
-	})
-	t.Run("ShortRead", func(t *testing.T) {
-		_, err := testStreamExchange(t, func(req dnsmessage.Message, conn net.Conn) {
-			// Send response.
-			_, err := conn.Write([]byte{0})
-			require.NoError(t, err)
-
-			// Close writer.
-			conn.Close()
-		})
-		require.ErrorIs(t, err, ErrReceive)
-		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
-	})
-	t.Run("ShortMessage", func(t *testing.T) {
-		_, err := testStreamExchange(t, func(req dnsmessage.Message, conn net.Conn) {
-			// Send response.
-			_, err := conn.Write([]byte{0, 100, 0})
-			require.NoError(t, err)
-			// Close writer.
-			conn.Close()
-		})
-		require.ErrorIs(t, err, ErrReceive)
-		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
-	})
-	t.Run("BadMessageFormat", func(t *testing.T) {
-		_, err := testStreamExchange(t, func(req dnsmessage.Message, conn net.Conn) {
-			// Send response.
-			_, err := conn.Write([]byte{0, 2, 0, 0})
-			require.NoError(t, err)
-
-			// Close writer.
-			conn.Close()
-		})
-		require.ErrorIs(t, err, ErrBadResponse)
-	})
-	t.Run("BadMessageContent", func(t *testing.T) {
-		_, err := testStreamExchange(t, func(req dnsmessage.Message, conn net.Conn) {
-			// Make response with no answer and invalid ID.
-			resp := req
-			resp.ID = req.ID + 1
-			resp.Response = true
-			buf, err := resp.AppendPack(make([]byte, 2, 514))
-			require.NoError(t, err)
-			binary.BigEndian.PutUint16(buf, uint16(len(buf)-2))
-			// Send response.
-			_, err = conn.Write(buf)
-			require.NoError(t, err)
-
-			// Close writer.
-			conn.Close()
-		})
-		require.ErrorIs(t, err, ErrBadResponse)
-	})
-	t.Run("FailedClientWrite", func(t *testing.T) {
-		front, back := net.Pipe()
-		back.Close()
-		q, err := NewQuestion("example.com.", dnsmessage.TypeAAAA)
-		require.NoError(t, err)
-		clientDone := make(chan queryResult)
-		go func() {
-			msg, err := queryStream(front, *q)
-			clientDone <- queryResult{msg, err}
-		}()
-		// Wait for client.
-		result := <-clientDone
-		require.ErrorIs(t, result.err, ErrSend)
-		require.ErrorIs(t, result.err, io.ErrClosedPipe)
-	})
-	t.Run("FailedClientRead", func(t *testing.T) {
-		front, back := net.Pipe()
-		q, err := NewQuestion("example.com.", dnsmessage.TypeAAAA)
-		require.NoError(t, err)
-		clientDone := make(chan queryResult)
-		go func() {
-			msg, err := queryStream(front, *q)
+			msg, err := queryDatagram(front, *q, requestOptions{})
 			clientDone <- queryResult{msg, err}
 		}()
 		back.Read(make([]byte, 521))
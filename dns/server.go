@@ -0,0 +1,516 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrServerClosed is returned by the Serve methods of a [Server] after it's closed.
+var ErrServerClosed = errors.New("DNS server closed")
+
+const (
+	defaultServerQueryTimeout   = 5 * time.Second
+	defaultServerTCPIdleTimeout = 10 * time.Second
+	defaultServerMaxUDPQueries  = 1000
+	// Minimum UDP message size every DNS client supports, as per https://datatracker.ietf.org/doc/html/rfc1035#section-2.3.4.
+	minUDPMessageSize = 512
+	// maxRateLimitClients bounds the number of clients tracked by the rate limiter.
+	maxRateLimitClients = 10000
+)
+
+// ServerOptions configures a [Server].
+type ServerOptions struct {
+	// QueriesPerSecond is the sustained rate of queries allowed per client IP. Queries above the rate
+	// get a REFUSED response. Zero disables rate limiting.
+	QueriesPerSecond float64
+	// Burst is the number of queries a client IP can send at once. Defaults to QueriesPerSecond, and at least 1.
+	Burst int
+	// QueryTimeout bounds the time to get a response from the resolver. Defaults to 5 seconds.
+	QueryTimeout time.Duration
+	// TCPIdleTimeout is how long a TCP connection is kept open without queries. Defaults to 10 seconds.
+	TCPIdleTimeout time.Duration
+	// MaxUDPQueries is the maximum number of UDP queries answered concurrently on each connection passed to
+	// ServeUDP. Reading new queries waits while the limit is reached. Defaults to 1000.
+	MaxUDPQueries int
+}
+
+// Server is a DNS server that answers the queries with a [Resolver]. It serves [DNS-over-UDP], [DNS-over-TCP]
+// and, as an [http.Handler], [DNS-over-HTTPS].
+//
+// Only standard queries with one question are supported. The response to each query is the response of the
+// resolver, with the ID and question of the query. UDP responses that don't fit in the size supported by the
+// client are truncated, so that the client retries over TCP. Failures of the resolver result in SERVFAIL.
+//
+// [DNS-over-UDP]: https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.1
+// [DNS-over-TCP]: https://datatracker.ietf.org/doc/html/rfc7766
+// [DNS-over-HTTPS]: https://datatracker.ietf.org/doc/html/rfc8484
+type Server struct {
+	resolver       Resolver
+	queryTimeout   time.Duration
+	tcpIdleTimeout time.Duration
+	maxUDPQueries  int
+	limiter        *rateLimiter
+
+	mu        sync.Mutex // Protects the fields below
+	closed    bool
+	closers   map[io.Closer]struct{}
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+}
+
+var _ http.Handler = (*Server)(nil)
+
+// NewServer creates a [Server] that answers the queries with resolver.
+func NewServer(resolver Resolver, opts ServerOptions) (*Server, error) {
+	if resolver == nil {
+		return nil, errors.New("argument resolver must not be nil")
+	}
+	if opts.QueriesPerSecond < 0 {
+		return nil, fmt.Errorf("QueriesPerSecond must not be negative: %v", opts.QueriesPerSecond)
+	}
+	if opts.Burst < 0 {
+		return nil, fmt.Errorf("Burst must not be negative: %v", opts.Burst)
+	}
+	if opts.QueryTimeout < 0 || opts.TCPIdleTimeout < 0 {
+		return nil, errors.New("timeouts must not be negative")
+	}
+	if opts.MaxUDPQueries < 0 {
+		return nil, fmt.Errorf("MaxUDPQueries must not be negative: %v", opts.MaxUDPQueries)
+	}
+	s := &Server{
+		resolver:       resolver,
+		queryTimeout:   opts.QueryTimeout,
+		tcpIdleTimeout: opts.TCPIdleTimeout,
+		maxUDPQueries:  opts.MaxUDPQueries,
+		closers:        make(map[io.Closer]struct{}),
+	}
+	if s.queryTimeout == 0 {
+		s.queryTimeout = defaultServerQueryTimeout
+	}
+	if s.tcpIdleTimeout == 0 {
+		s.tcpIdleTimeout = defaultServerTCPIdleTimeout
+	}
+	if s.maxUDPQueries == 0 {
+		s.maxUDPQueries = defaultServerMaxUDPQueries
+	}
+	if opts.QueriesPerSecond > 0 {
+		burst := float64(opts.Burst)
+		if burst == 0 {
+			burst = opts.QueriesPerSecond
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		s.limiter = newRateLimiter(opts.QueriesPerSecond, burst)
+	}
+	s.ctx, s.cancelCtx = context.WithCancel(context.Background())
+	return s, nil
+}
+
+// track registers c to be closed by [Server.Close]. It returns false if the server is already closed.
+func (s *Server) track(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.closers[c] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.closers, c)
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Close closes the listeners and connections passed to ServeUDP and ServeTCP, and cancels their ongoing queries.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	closers := s.closers
+	s.closers = nil
+	s.mu.Unlock()
+
+	s.cancelCtx()
+	var errs []error
+	for c := range closers {
+		if err := c.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ServeUDP answers the queries received on conn, until the server is closed or conn fails.
+// It returns [ErrServerClosed] if the server was closed.
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	if !s.track(conn) {
+		return ErrServerClosed
+	}
+	defer s.untrack(conn)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	// Bounds the goroutines answering queries.
+	sem := make(chan struct{}, s.maxUDPQueries)
+	buf := make([]byte, 1<<16)
+	for {
+		sem <- struct{}{}
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		request := append([]byte(nil), buf[:n]...)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			resp, udpSize := s.answer(s.ctx, clientKey(addr.String()), request)
+			if resp == nil {
+				return
+			}
+			if out, err := packUDPResponse(resp, udpSize); err == nil {
+				conn.WriteTo(out, addr)
+			}
+		}()
+	}
+}
+
+// ServeTCP accepts connections from listener and answers the queries received on them, until the server
+// is closed or listener fails. Queries on the same connection are answered concurrently, possibly out of order,
+// as per https://datatracker.ietf.org/doc/html/rfc7766#section-6.2.1.1.
+// It returns [ErrServerClosed] if the server was closed.
+func (s *Server) ServeTCP(listener net.Listener) error {
+	if !s.track(listener) {
+		return ErrServerClosed
+	}
+	defer s.untrack(listener)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.untrack(conn)
+			s.serveTCPConn(conn)
+		}()
+	}
+}
+
+func (s *Server) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	client := clientKey(conn.RemoteAddr().String())
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	// Wait for the pending responses before closing the connection.
+	defer wg.Wait()
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.tcpIdleTimeout))
+		var msgLen uint16
+		if err := binary.Read(conn, binary.BigEndian, &msgLen); err != nil {
+			return
+		}
+		request := make([]byte, msgLen)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, _ := s.answer(s.ctx, client, request)
+			if resp == nil {
+				return
+			}
+			out, err := resp.AppendPack(make([]byte, 2, 514))
+			if err != nil || len(out) > 1<<16-1 {
+				return
+			}
+			binary.BigEndian.PutUint16(out, uint16(len(out)-2))
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			if _, err := conn.Write(out); err != nil {
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// ServeHTTP implements [http.Handler].ServeHTTP for DNS-over-HTTPS, with both the GET and the POST methods,
+// as per https://datatracker.ietf.org/doc/html/rfc8484#section-4.1.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const mimetype = "application/dns-message"
+	var request []byte
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		request, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(request) == 0 {
+			http.Error(w, "missing or invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != mimetype {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		request, err = io.ReadAll(io.LimitReader(r.Body, 1<<16))
+		if err != nil {
+			http.Error(w, "failed to read request", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The lifetime of the HTTP requests is managed by the http.Server, not by Close.
+	resp, _ := s.answer(r.Context(), clientKey(r.RemoteAddr), request)
+	if resp == nil {
+		http.Error(w, "invalid DNS request", http.StatusBadRequest)
+		return
+	}
+	out, err := resp.Pack()
+	if err != nil {
+		http.Error(w, "failed to pack response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", mimetype)
+	if ttl, ok := responseMaxAge(resp); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	w.Write(out)
+}
+
+// clientKey returns the key used to rate limit the client with the given address.
+func clientKey(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// responseMaxAge returns the smallest TTL of the records in the response, ignoring the OPT record,
+// as per https://datatracker.ietf.org/doc/html/rfc8484#section-5.1.
+func responseMaxAge(msg *dnsmessage.Message) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, sections := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, r := range sections {
+			if r.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if !found || r.Header.TTL < ttl {
+				ttl = r.Header.TTL
+				found = true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// answer resolves the request and returns the response, together with the UDP message size supported by
+// the client. It returns a nil response if the request must be dropped.
+func (s *Server) answer(ctx context.Context, client string, request []byte) (*dnsmessage.Message, int) {
+	var p dnsmessage.Parser
+	reqHdr, err := p.Start(request)
+	if err != nil || reqHdr.Response {
+		// Without a valid header, there's nothing we can respond to.
+		return nil, 0
+	}
+	resp := &dnsmessage.Message{Header: dnsmessage.Header{
+		ID:               reqHdr.ID,
+		Response:         true,
+		OpCode:           reqHdr.OpCode,
+		RecursionDesired: reqHdr.RecursionDesired,
+	}}
+	var req dnsmessage.Message
+	if err := req.Unpack(request); err != nil {
+		resp.RCode = dnsmessage.RCodeFormatError
+		return resp, minUDPMessageSize
+	}
+
+	udpSize := minUDPMessageSize
+	hasEDNS0 := false
+	for _, r := range req.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			hasEDNS0 = true
+			if size := int(r.Header.Class); size > udpSize {
+				udpSize = size
+			}
+		}
+	}
+	// Avoid IP fragmentation, as per https://datatracker.ietf.org/doc/html/rfc8085#section-3.2.
+	if udpSize > maxUDPMessageSize {
+		udpSize = maxUDPMessageSize
+	}
+	if hasEDNS0 {
+		var opt dnsmessage.ResourceHeader
+		if err := opt.SetEDNS0(maxUDPMessageSize, dnsmessage.RCodeSuccess, false); err == nil {
+			resp.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+		}
+	}
+
+	if reqHdr.OpCode != 0 {
+		resp.RCode = dnsmessage.RCodeNotImplemented
+		return resp, udpSize
+	}
+	if len(req.Questions) != 1 {
+		resp.RCode = dnsmessage.RCodeFormatError
+		return resp, udpSize
+	}
+	resp.Questions = req.Questions
+	if s.limiter != nil && !s.limiter.allow(client) {
+		resp.RCode = dnsmessage.RCodeRefused
+		return resp, udpSize
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	result, err := s.resolver.Query(ctx, req.Questions[0])
+	if err != nil {
+		resp.RCode = dnsmessage.RCodeServerFailure
+		return resp, udpSize
+	}
+	resp.RCode = result.RCode
+	resp.Authoritative = result.Authoritative
+	resp.RecursionAvailable = result.RecursionAvailable
+	resp.AuthenticData = result.AuthenticData
+	resp.Answers = result.Answers
+	resp.Authorities = result.Authorities
+	for _, r := range result.Additionals {
+		// The OPT record is hop-by-hop, so we don't forward the one from the resolver.
+		if r.Header.Type != dnsmessage.TypeOPT {
+			resp.Additionals = append(resp.Additionals, r)
+		}
+	}
+	return resp, udpSize
+}
+
+// packUDPResponse packs the response, truncating it if it doesn't fit in maxSize bytes, as per
+// https://datatracker.ietf.org/doc/html/rfc2181#section-9.
+func packUDPResponse(resp *dnsmessage.Message, maxSize int) ([]byte, error) {
+	out, err := resp.Pack()
+	if err != nil || len(out) <= maxSize {
+		return out, err
+	}
+	truncated := *resp
+	truncated.Truncated = true
+	truncated.Answers = nil
+	truncated.Authorities = nil
+	truncated.Additionals = nil
+	for _, r := range resp.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			truncated.Additionals = append(truncated.Additionals, r)
+		}
+	}
+	return truncated.Pack()
+}
+
+// rateLimiter is a per-client token bucket rate limiter.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex // Protects buckets
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: burst, now: time.Now, buckets: make(map[string]*tokenBucket)}
+}
+
+// refill adds the tokens accumulated since the last update.
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+}
+
+// allow consumes a token from the client bucket, and returns whether there was one available.
+func (l *rateLimiter) allow(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitClients {
+			l.prune(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	l.refill(b, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune removes the buckets that are full, since they are equivalent to a new bucket.
+func (l *rateLimiter) prune(now time.Time) {
+	for client, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
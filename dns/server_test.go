@@ -0,0 +1,335 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestServer_UDP(t *testing.T) {
+	server := newTestServer(t, answerResolver(1), ServerOptions{})
+	addr := serveTestUDP(t, server)
+	resolver := NewUDPResolver(&transport.UDPDialer{}, addr)
+
+	// The resolver response has a different ID and question case, which the client rejects unless rewritten.
+	resp, err := resolver.Query(context.Background(), mustNewQuestion(t, "Example.COM.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, dnsmessage.RCodeSuccess, resp.RCode)
+	require.Equal(t, "Example.COM.", resp.Questions[0].Name.String())
+	require.Len(t, resp.Answers, 1)
+	require.False(t, resp.Truncated)
+}
+
+func TestServer_UDPTruncation(t *testing.T) {
+	server := newTestServer(t, answerResolver(200), ServerOptions{})
+	udpAddr := serveTestUDP(t, server)
+
+	resp := exchangeUDP(t, udpAddr, mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.True(t, resp.Truncated)
+	require.Empty(t, resp.Answers)
+	// The OPT record is kept.
+	require.Len(t, resp.Additionals, 1)
+	require.Equal(t, dnsmessage.TypeOPT, resp.Additionals[0].Header.Type)
+
+	// The client can get the full response over TCP.
+	tcpAddr := serveTestTCP(t, server)
+	resp2, err := NewTCPResolver(&transport.TCPDialer{}, tcpAddr).Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	require.False(t, resp2.Truncated)
+	require.Len(t, resp2.Answers, 200)
+}
+
+func TestServer_UDPMaxQueries(t *testing.T) {
+	release := make(chan struct{})
+	var active, maxActive atomic.Int32
+	resolver := FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			m := maxActive.Load()
+			if n <= m || maxActive.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		<-release
+		return newAResponse(q, 300), nil
+	})
+	server := newTestServer(t, resolver, ServerOptions{MaxUDPQueries: 2})
+	addr := serveTestUDP(t, server)
+
+	const numQueries = 5
+	conns := make([]net.Conn, numQueries)
+	for i := range conns {
+		conn, err := net.Dial("udp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		request, err := appendRequest(uint16(i), mustNewQuestion(t, "example.com.", dnsmessage.TypeA), nil)
+		require.NoError(t, err)
+		_, err = conn.Write(request)
+		require.NoError(t, err)
+		conns[i] = conn
+	}
+	require.Eventually(t, func() bool { return active.Load() == 2 }, 5*time.Second, time.Millisecond)
+	require.Never(t, func() bool { return active.Load() > 2 }, 50*time.Millisecond, time.Millisecond)
+
+	// All the queries are answered once the pending ones complete.
+	close(release)
+	for _, conn := range conns {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Read(make([]byte, 1<<16))
+		require.NoError(t, err)
+	}
+	require.Equal(t, int32(2), maxActive.Load())
+}
+
+func TestServer_TCP(t *testing.T) {
+	server := newTestServer(t, answerResolver(1), ServerOptions{})
+	addr := serveTestTCP(t, server)
+	resolver := NewTCPResolver(&transport.TCPDialer{}, addr)
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"a.example.", "b.example.", "c.example.", "d.example."} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			resp, err := resolver.Query(context.Background(), mustNewQuestion(t, name, dnsmessage.TypeA))
+			require.NoError(t, err)
+			require.Equal(t, name, resp.Questions[0].Name.String())
+			require.Len(t, resp.Answers, 1)
+		}(name)
+	}
+	wg.Wait()
+}
+
+func TestServer_HTTPS(t *testing.T) {
+	server := newTestServer(t, answerResolver(1), ServerOptions{})
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	t.Run("POST", func(t *testing.T) {
+		resolver := NewHTTPSResolver(&transport.TCPDialer{}, httpServer.Listener.Addr().String(), httpServer.URL)
+		resp, err := resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+		require.NoError(t, err)
+		require.Len(t, resp.Answers, 1)
+	})
+
+	t.Run("GET", func(t *testing.T) {
+		request, err := appendRequest(0, mustNewQuestion(t, "example.com.", dnsmessage.TypeA), nil)
+		require.NoError(t, err)
+		httpResp, err := http.Get(httpServer.URL + "?dns=" + base64.RawURLEncoding.EncodeToString(request))
+		require.NoError(t, err)
+		defer httpResp.Body.Close()
+		require.Equal(t, http.StatusOK, httpResp.StatusCode)
+		require.Equal(t, "application/dns-message", httpResp.Header.Get("Content-Type"))
+		require.Equal(t, "max-age=300", httpResp.Header.Get("Cache-Control"))
+	})
+
+	t.Run("BadRequests", func(t *testing.T) {
+		httpResp, err := http.Get(httpServer.URL + "?dns=not-base64!")
+		require.NoError(t, err)
+		httpResp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, httpResp.StatusCode)
+
+		httpResp, err = http.Post(httpServer.URL, "text/plain", nil)
+		require.NoError(t, err)
+		httpResp.Body.Close()
+		require.Equal(t, http.StatusUnsupportedMediaType, httpResp.StatusCode)
+
+		req, err := http.NewRequest(http.MethodPut, httpServer.URL, nil)
+		require.NoError(t, err)
+		httpResp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		httpResp.Body.Close()
+		require.Equal(t, http.StatusMethodNotAllowed, httpResp.StatusCode)
+	})
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	server := newTestServer(t, answerResolver(1), ServerOptions{QueriesPerSecond: 0.001, Burst: 2})
+	addr := serveTestUDP(t, server)
+	q := mustNewQuestion(t, "example.com.", dnsmessage.TypeA)
+
+	require.Equal(t, dnsmessage.RCodeSuccess, exchangeUDP(t, addr, q).RCode)
+	require.Equal(t, dnsmessage.RCodeSuccess, exchangeUDP(t, addr, q).RCode)
+	resp := exchangeUDP(t, addr, q)
+	require.Equal(t, dnsmessage.RCodeRefused, resp.RCode)
+	require.Empty(t, resp.Answers)
+}
+
+func TestServer_ResolverError(t *testing.T) {
+	resolver := FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		return nil, &nestedError{ErrReceive, errors.New("upstream failed")}
+	})
+	server := newTestServer(t, resolver, ServerOptions{})
+	addr := serveTestUDP(t, server)
+	resp := exchangeUDP(t, addr, mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.Equal(t, dnsmessage.RCodeServerFailure, resp.RCode)
+}
+
+func TestServer_FormatError(t *testing.T) {
+	server := newTestServer(t, answerResolver(1), ServerOptions{})
+	addr := serveTestUDP(t, server)
+
+	q := mustNewQuestion(t, "example.com.", dnsmessage.TypeA)
+	msg := dnsmessage.Message{Header: dnsmessage.Header{ID: 42}, Questions: []dnsmessage.Question{q, q}}
+	request, err := msg.Pack()
+	require.NoError(t, err)
+	resp := exchangeUDPRaw(t, addr, request)
+	require.Equal(t, uint16(42), resp.ID)
+	require.Equal(t, dnsmessage.RCodeFormatError, resp.RCode)
+
+	msg = dnsmessage.Message{Header: dnsmessage.Header{ID: 43, OpCode: 2}, Questions: []dnsmessage.Question{q}}
+	request, err = msg.Pack()
+	require.NoError(t, err)
+	resp = exchangeUDPRaw(t, addr, request)
+	require.Equal(t, uint16(43), resp.ID)
+	require.Equal(t, dnsmessage.RCodeNotImplemented, resp.RCode)
+}
+
+func TestServer_Close(t *testing.T) {
+	server, err := NewServer(answerResolver(1), ServerOptions{})
+	require.NoError(t, err)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	udpDone := make(chan error)
+	go func() { udpDone <- server.ServeUDP(conn) }()
+	tcpDone := make(chan error)
+	go func() { tcpDone <- server.ServeTCP(listener) }()
+
+	// Make sure the servers are running.
+	exchangeUDP(t, conn.LocalAddr().String(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	_, err = NewTCPResolver(&transport.TCPDialer{}, listener.Addr().String()).Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+
+	require.NoError(t, server.Close())
+	require.ErrorIs(t, <-udpDone, ErrServerClosed)
+	require.ErrorIs(t, <-tcpDone, ErrServerClosed)
+	require.ErrorIs(t, server.ServeUDP(conn), ErrServerClosed)
+}
+
+func TestNewServer_InvalidArguments(t *testing.T) {
+	_, err := NewServer(nil, ServerOptions{})
+	require.Error(t, err)
+	_, err = NewServer(answerResolver(1), ServerOptions{QueriesPerSecond: -1})
+	require.Error(t, err)
+	_, err = NewServer(answerResolver(1), ServerOptions{QueryTimeout: -time.Second})
+	require.Error(t, err)
+	_, err = NewServer(answerResolver(1), ServerOptions{MaxUDPQueries: -1})
+	require.Error(t, err)
+}
+
+func Test_rateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := newRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		require.True(t, limiter.allow("a"))
+	}
+	require.False(t, limiter.allow("a"))
+	// Clients are limited independently.
+	require.True(t, limiter.allow("b"))
+
+	now = now.Add(500 * time.Millisecond)
+	require.True(t, limiter.allow("a"))
+	require.False(t, limiter.allow("a"))
+
+	// Tokens don't accumulate beyond the burst.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		require.True(t, limiter.allow("a"))
+	}
+	require.False(t, limiter.allow("a"))
+
+	// Full buckets are pruned.
+	limiter.prune(now.Add(time.Hour))
+	require.Empty(t, limiter.buckets)
+}
+
+/********** Test Utilities **********/
+
+// answerResolver returns a resolver that answers with numAnswers A records with TTL 300, using a fixed ID and
+// a lowercase question.
+func answerResolver(numAnswers int) Resolver {
+	return FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		q.Name = dnsmessage.MustNewName("example.com.")
+		resp := newAResponse(q, 300)
+		resp.ID = 1234
+		for i := 1; i < numAnswers; i++ {
+			rr := resp.Answers[0]
+			rr.Body = &dnsmessage.AResource{A: [4]byte{192, 0, byte(i >> 8), byte(i)}}
+			resp.Answers = append(resp.Answers, rr)
+		}
+		return resp, nil
+	})
+}
+
+func newTestServer(t *testing.T, resolver Resolver, opts ServerOptions) *Server {
+	server, err := NewServer(resolver, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func serveTestUDP(t *testing.T, server *Server) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.ServeUDP(conn)
+	return conn.LocalAddr().String()
+}
+
+func serveTestTCP(t *testing.T, server *Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.ServeTCP(listener)
+	return listener.Addr().String()
+}
+
+// exchangeUDP sends a query for q with EDNS(0) and returns the response, without checking it.
+func exchangeUDP(t *testing.T, addr string, q dnsmessage.Question) *dnsmessage.Message {
+	request, err := appendRequest(1, q, nil)
+	require.NoError(t, err)
+	return exchangeUDPRaw(t, addr, request)
+}
+
+func exchangeUDPRaw(t *testing.T, addr string, request []byte) *dnsmessage.Message {
+	conn, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write(request)
+	require.NoError(t, err)
+	buf := make([]byte, 1<<16)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.LessOrEqual(t, n, maxUDPMessageSize)
+	var resp dnsmessage.Message
+	require.NoError(t, resp.Unpack(buf[:n]))
+	return &resp
+}
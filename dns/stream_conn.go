@@ -0,0 +1,271 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// errConnClosed is returned for queries on a connection that is already closed.
+var errConnClosed = errors.New("connection closed")
+
+// maxConsecutiveTimeouts is the number of queries in a row that can time out before the connection is
+// considered unresponsive and closed.
+const maxConsecutiveTimeouts = 3
+
+// pipelinedConn sends multiple queries over a single stream connection, and matches the responses to the
+// queries by message ID, as per https://datatracker.ietf.org/doc/html/rfc7766#section-6.2.1.1.
+// Responses may arrive in any order.
+type pipelinedConn struct {
+	conn        transport.StreamConn
+	idleTimeout time.Duration
+
+	writeMu sync.Mutex // Serializes writes to conn
+
+	mu        sync.Mutex // Protects the fields below
+	pending   map[uint16]*pendingQuery
+	closed    bool
+	idleTimer *time.Timer
+	// answered is whether the connection received any response.
+	answered bool
+	// timeouts is the number of queries that timed out since the last response.
+	timeouts int
+}
+
+type pendingQuery struct {
+	q      dnsmessage.Question
+	result chan pipelineResult
+}
+
+type pipelineResult struct {
+	msg *dnsmessage.Message
+	err error
+}
+
+// newPipelinedConn starts reading the responses from conn. The connection is closed after idleTimeout without
+// pending queries.
+func newPipelinedConn(conn transport.StreamConn, idleTimeout time.Duration) *pipelinedConn {
+	c := &pipelinedConn{
+		conn:        conn,
+		idleTimeout: idleTimeout,
+		pending:     make(map[uint16]*pendingQuery),
+	}
+	c.idleTimer = time.AfterFunc(idleTimeout, c.closeIfIdle)
+	go c.readLoop()
+	return c
+}
+
+// usable returns whether the connection can take new queries.
+func (c *pipelinedConn) usable() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.closed
+}
+
+// onTimeout records a query that timed out. It closes the connection if it never received a response, or
+// if the last [maxConsecutiveTimeouts] queries timed out, since a connection that goes silent would otherwise
+// keep being reused. The next query then dials a new connection.
+func (c *pipelinedConn) onTimeout() {
+	c.mu.Lock()
+	c.timeouts++
+	unresponsive := !c.answered || c.timeouts >= maxConsecutiveTimeouts
+	c.mu.Unlock()
+	if unresponsive {
+		c.close(&nestedError{ErrReceive, errors.New("connection is unresponsive")})
+	}
+}
+
+func (c *pipelinedConn) closeIfIdle() {
+	c.mu.Lock()
+	idle := len(c.pending) == 0
+	c.mu.Unlock()
+	if idle {
+		c.close(errConnClosed)
+	}
+}
+
+// close closes the connection and fails the pending queries with err.
+func (c *pipelinedConn) close(err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.idleTimer.Stop()
+	pending := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+
+	c.conn.Close()
+	for _, pq := range pending {
+		pq.result <- pipelineResult{nil, err}
+	}
+}
+
+// register allocates an unused message ID for the query.
+func (c *pipelinedConn) register(q dnsmessage.Question) (uint16, *pendingQuery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, nil, errConnClosed
+	}
+	if len(c.pending) >= 1<<16 {
+		return 0, nil, errors.New("too many pending queries")
+	}
+	id := uint16(rand.Uint32())
+	for c.pending[id] != nil {
+		id++
+	}
+	pq := &pendingQuery{q: q, result: make(chan pipelineResult, 1)}
+	c.pending[id] = pq
+	c.idleTimer.Stop()
+	return id, pq, nil
+}
+
+// unregister removes the query, and returns whether it was still pending.
+func (c *pipelinedConn) unregister(id uint16, pq *pendingQuery) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending[id] != pq {
+		return false
+	}
+	delete(c.pending, id)
+	if len(c.pending) == 0 && !c.closed {
+		c.idleTimer.Reset(c.idleTimeout)
+	}
+	return true
+}
+
+// query sends the question with opts and waits for its response.
+func (c *pipelinedConn) query(ctx context.Context, q dnsmessage.Question, opts requestOptions) (*dnsmessage.Message, error) {
+	id, pq, err := c.register(q)
+	if err != nil {
+		return nil, &nestedError{ErrSend, err}
+	}
+	buf, err := appendRequestWithOptions(id, q, opts, make([]byte, 2, 514))
+	if err != nil {
+		c.unregister(id, pq)
+		return nil, &nestedError{ErrBadRequest, fmt.Errorf("append request failed: %w", err)}
+	}
+	// Buffer length must fit in a uint16.
+	if len(buf) > 1<<16-1 {
+		c.unregister(id, pq)
+		return nil, &nestedError{ErrBadRequest, fmt.Errorf("message too large: %v bytes", len(buf))}
+	}
+	binary.BigEndian.PutUint16(buf[:2], uint16(len(buf)-2))
+
+	if err := c.write(ctx, buf); err != nil {
+		c.unregister(id, pq)
+		// A partial write corrupts the stream for the other queries.
+		c.close(&nestedError{ErrSend, err})
+		return nil, &nestedError{ErrSend, err}
+	}
+
+	select {
+	case result := <-pq.result:
+		return result.msg, result.err
+	case <-ctx.Done():
+		if !c.unregister(id, pq) {
+			// The result was delivered concurrently.
+			result := <-pq.result
+			return result.msg, result.err
+		}
+		err := ctx.Err()
+		if errors.Is(err, context.DeadlineExceeded) {
+			c.onTimeout()
+			// Report it like a connection deadline, since callers expect an I/O timeout.
+			err = fmt.Errorf("%w: %w", os.ErrDeadlineExceeded, err)
+		}
+		return nil, &nestedError{ErrReceive, err}
+	}
+}
+
+func (c *pipelinedConn) write(ctx context.Context, buf []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	deadline, _ := ctx.Deadline()
+	c.conn.SetWriteDeadline(deadline)
+	// TODO: Consider writer.ReadFrom(net.Buffers) in case the writer is a TCPConn.
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// readLoop reads the responses and delivers them to the pending queries, until the connection fails.
+func (c *pipelinedConn) readLoop() {
+	var buf []byte
+	for {
+		var msgLen uint16
+		if err := binary.Read(c.conn, binary.BigEndian, &msgLen); err != nil {
+			c.close(&nestedError{ErrReceive, fmt.Errorf("read message length failed: %w", err)})
+			return
+		}
+		if int(msgLen) <= cap(buf) {
+			buf = buf[:msgLen]
+		} else {
+			buf = make([]byte, msgLen)
+		}
+		if _, err := io.ReadFull(c.conn, buf); err != nil {
+			c.close(&nestedError{ErrReceive, fmt.Errorf("read message failed: %w", err)})
+			return
+		}
+		if len(buf) < 2 {
+			// Without the ID, we can't tell which query is affected.
+			c.close(&nestedError{ErrBadResponse, errors.New("response too short")})
+			return
+		}
+		c.deliver(binary.BigEndian.Uint16(buf), buf)
+	}
+}
+
+// deliver unpacks the response and sends it to the query with the given ID, if it's still pending.
+func (c *pipelinedConn) deliver(id uint16, buf []byte) {
+	c.mu.Lock()
+	c.answered = true
+	c.timeouts = 0
+	pq := c.pending[id]
+	if pq == nil {
+		// Late response to a query that was cancelled.
+		c.mu.Unlock()
+		return
+	}
+	delete(c.pending, id)
+	if len(c.pending) == 0 && !c.closed {
+		c.idleTimer.Reset(c.idleTimeout)
+	}
+	c.mu.Unlock()
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf); err != nil {
+		pq.result <- pipelineResult{nil, &nestedError{ErrBadResponse, fmt.Errorf("response failed to unpack: %w", err)}}
+		return
+	}
+	if err := checkResponse(id, pq.q, msg.Header, msg.Questions); err != nil {
+		pq.result <- pipelineResult{nil, &nestedError{ErrBadResponse, err}}
+		return
+	}
+	pq.result <- pipelineResult{&msg, nil}
+}
@@ -0,0 +1,400 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestStreamResolver_ReusesConnection(t *testing.T) {
+	server := newTestTCPServer(t)
+	resolver := NewTCPResolver(&transport.TCPDialer{}, server.Addr())
+	for i := 0; i < 5; i++ {
+		resp, err := resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+		require.NoError(t, err)
+		require.Len(t, resp.Answers, 1)
+	}
+	require.Equal(t, int32(1), server.accepted.Load())
+}
+
+func TestStreamResolver_Pipelining(t *testing.T) {
+	const numQueries = 10
+	server := newTestTCPServer(t)
+	// Answer only once all queries arrived, in reverse order.
+	server.batchSize = numQueries
+	resolver := NewTCPResolver(&transport.TCPDialer{}, server.Addr())
+	// Establish the connection first, so that all queries share it.
+	_, err := resolver.Query(context.Background(), mustNewQuestion(t, warmupName, dnsmessage.TypeA))
+	require.NoError(t, err)
+
+	names := []string{"a.example.", "b.example.", "c.example.", "d.example.", "e.example.", "f.example.", "g.example.", "h.example.", "i.example.", "j.example."}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			resp, err := resolver.Query(context.Background(), mustNewQuestion(t, name, dnsmessage.TypeA))
+			require.NoError(t, err)
+			require.Equal(t, name, resp.Questions[0].Name.String())
+		}(name)
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), server.accepted.Load())
+}
+
+func TestStreamResolver_IdleTimeout(t *testing.T) {
+	server := newTestTCPServer(t)
+	resolver := NewTCPResolver(&transport.TCPDialer{}, server.Addr())
+	sr := resolver.(*streamResolver)
+	sr.idleTimeout = 50 * time.Millisecond
+
+	_, err := resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		sr.mu.Lock()
+		defer sr.mu.Unlock()
+		return !sr.conn.usable()
+	}, time.Second, 10*time.Millisecond)
+	_, err = resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, int32(2), server.accepted.Load())
+}
+
+func TestStreamResolver_ReconnectsAfterServerClose(t *testing.T) {
+	server := newTestTCPServer(t)
+	server.closeAfterResponse = true
+	resolver := NewTCPResolver(&transport.TCPDialer{}, server.Addr())
+	for i := 0; i < 3; i++ {
+		_, err := resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+		require.NoError(t, err)
+	}
+	require.Equal(t, int32(3), server.accepted.Load())
+}
+
+func TestStreamResolver_CancelDoesNotAffectOtherQueries(t *testing.T) {
+	server := newTestTCPServer(t)
+	server.ignoreName = "ignored.example."
+	resolver := NewTCPResolver(&transport.TCPDialer{}, server.Addr())
+	// The connection must have answered, or the timeout closes it.
+	_, err := resolver.Query(context.Background(), mustNewQuestion(t, warmupName, dnsmessage.TypeA))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = resolver.Query(ctx, mustNewQuestion(t, "ignored.example.", dnsmessage.TypeA))
+	require.ErrorIs(t, err, ErrReceive)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	resp, err := resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, "example.com.", resp.Questions[0].Name.String())
+	require.Equal(t, int32(1), server.accepted.Load())
+}
+
+func TestStreamResolver_ReplacesSilentConnection(t *testing.T) {
+	server := newTestTCPServer(t)
+	server.ignoreName = "ignored.example."
+	resolver := NewTCPResolver(&transport.TCPDialer{}, server.Addr())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := resolver.Query(ctx, mustNewQuestion(t, "ignored.example.", dnsmessage.TypeA))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The connection never answered, so the next query uses a new one.
+	_, err = resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, int32(2), server.accepted.Load())
+}
+
+func TestStreamResolver_ReplacesConnectionAfterConsecutiveTimeouts(t *testing.T) {
+	server := newTestTCPServer(t)
+	server.ignoreName = "ignored.example."
+	resolver := NewTCPResolver(&transport.TCPDialer{}, server.Addr())
+	_, err := resolver.Query(context.Background(), mustNewQuestion(t, warmupName, dnsmessage.TypeA))
+	require.NoError(t, err)
+
+	for i := 0; i < maxConsecutiveTimeouts; i++ {
+		require.Equal(t, int32(1), server.accepted.Load())
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err = resolver.Query(ctx, mustNewQuestion(t, "ignored.example.", dnsmessage.TypeA))
+		cancel()
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	}
+	_, err = resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, int32(2), server.accepted.Load())
+}
+
+func TestStreamResolver_BadResponse(t *testing.T) {
+	server := newTestTCPServer(t)
+	server.badResponse = true
+	resolver := NewTCPResolver(&transport.TCPDialer{}, server.Addr())
+	_, err := resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.ErrorIs(t, err, ErrBadResponse)
+}
+
+func TestStreamResolver_DialError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	resolver := NewTCPResolver(&transport.TCPDialer{}, addr)
+	_, err = resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.ErrorIs(t, err, ErrDial)
+}
+
+func Test_pipelinedConn(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		var respSent dnsmessage.Message
+		respRcvd, err := testPipelinedExchange(t, func(req dnsmessage.Message, conn net.Conn) {
+			var err error
+			respSent, err = newMessageResponse(req, &dnsmessage.AAAAResource{AAAA: [16]byte(net.IPv6loopback)}, 100)
+			require.NoError(t, err)
+			buf, err := (&respSent).Pack()
+			require.NoError(t, err)
+			require.NoError(t, binary.Write(conn, binary.BigEndian, uint16(len(buf))))
+			_, err = conn.Write(buf)
+			require.NoError(t, err)
+		})
+		require.NoError(t, err)
+		require.NotNil(t, respRcvd)
+		require.Equal(t, respSent, *respRcvd)
+	})
+	t.Run("ShortRead", func(t *testing.T) {
+		_, err := testPipelinedExchange(t, func(req dnsmessage.Message, conn net.Conn) {
+			_, err := conn.Write([]byte{0})
+			require.NoError(t, err)
+			conn.Close()
+		})
+		require.ErrorIs(t, err, ErrReceive)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+	t.Run("ShortMessage", func(t *testing.T) {
+		_, err := testPipelinedExchange(t, func(req dnsmessage.Message, conn net.Conn) {
+			_, err := conn.Write([]byte{0, 100, 0})
+			require.NoError(t, err)
+			conn.Close()
+		})
+		require.ErrorIs(t, err, ErrReceive)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+	t.Run("MessageWithoutID", func(t *testing.T) {
+		_, err := testPipelinedExchange(t, func(req dnsmessage.Message, conn net.Conn) {
+			_, err := conn.Write([]byte{0, 1, 0})
+			require.NoError(t, err)
+		})
+		require.ErrorIs(t, err, ErrBadResponse)
+	})
+	t.Run("BadMessageFormat", func(t *testing.T) {
+		_, err := testPipelinedExchange(t, func(req dnsmessage.Message, conn net.Conn) {
+			// Only the ID of the request, so that the response is matched to it.
+			_, err := conn.Write(binary.BigEndian.AppendUint16([]byte{0, 2}, req.ID))
+			require.NoError(t, err)
+		})
+		require.ErrorIs(t, err, ErrBadResponse)
+	})
+	t.Run("FailedClientWrite", func(t *testing.T) {
+		front, back := net.Pipe()
+		defer back.Close()
+		c := newPipelinedConn(&failedWriteConn{pipeStreamConn{front}}, time.Minute)
+		defer c.close(errConnClosed)
+		_, err := c.query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeAAAA), requestOptions{})
+		require.ErrorIs(t, err, ErrSend)
+		require.ErrorIs(t, err, io.ErrClosedPipe)
+		// The stream may be corrupted, so the connection is not reused.
+		require.False(t, c.usable())
+	})
+	t.Run("FailedClientRead", func(t *testing.T) {
+		_, err := testPipelinedExchange(t, func(req dnsmessage.Message, conn net.Conn) {
+			conn.Close()
+		})
+		require.ErrorIs(t, err, ErrReceive)
+		require.ErrorIs(t, err, io.EOF)
+	})
+}
+
+/********** Test Utilities **********/
+
+// testPipelinedExchange sends a query on a [pipelinedConn] over a pipe, checks the request, and lets server
+// respond on the other end of the pipe.
+func testPipelinedExchange(t *testing.T, server func(request dnsmessage.Message, conn net.Conn)) (*dnsmessage.Message, error) {
+	front, back := net.Pipe()
+	defer back.Close()
+	c := newPipelinedConn(pipeStreamConn{front}, time.Minute)
+	defer c.close(errConnClosed)
+	q := mustNewQuestion(t, "example.com.", dnsmessage.TypeAAAA)
+	clientDone := make(chan queryResult)
+	go func() {
+		msg, err := c.query(context.Background(), q, requestOptions{})
+		clientDone <- queryResult{msg, err}
+	}()
+	// Read request.
+	var msgLen uint16
+	require.NoError(t, binary.Read(back, binary.BigEndian, &msgLen))
+	buf := make([]byte, msgLen)
+	_, err := io.ReadFull(back, buf)
+	require.NoError(t, err)
+	// Verify request.
+	var reqMsg dnsmessage.Message
+	require.NoError(t, reqMsg.Unpack(buf))
+	expectedBuf, err := appendRequest(reqMsg.ID, q, make([]byte, 0, 512))
+	require.NoError(t, err)
+	require.Equal(t, expectedBuf, buf)
+
+	server(reqMsg, back)
+
+	result := <-clientDone
+	return result.msg, result.err
+}
+
+// pipeStreamConn makes an end of a [net.Pipe] a [transport.StreamConn].
+type pipeStreamConn struct {
+	net.Conn
+}
+
+func (c pipeStreamConn) CloseRead() error {
+	return c.Close()
+}
+
+func (c pipeStreamConn) CloseWrite() error {
+	return c.Close()
+}
+
+// failedWriteConn is a [transport.StreamConn] whose writes fail.
+type failedWriteConn struct {
+	pipeStreamConn
+}
+
+func (c *failedWriteConn) Write([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+const warmupName = "warmup.example."
+
+// testTCPServer is a DNS-over-TCP server that counts the accepted connections.
+type testTCPServer struct {
+	listener net.Listener
+	accepted atomic.Int32
+
+	// batchSize makes the server wait for that many queries before answering them in reverse order.
+	// Queries for warmupName are always answered right away.
+	batchSize int
+	// closeAfterResponse makes the server close the connection after each response.
+	closeAfterResponse bool
+	// ignoreName makes the server never answer queries for that name.
+	ignoreName string
+	// badResponse makes the server reply with a response to a different question.
+	badResponse bool
+	// respond, if set, computes the responses instead of the default A record answer.
+	respond func(request dnsmessage.Message) (dnsmessage.Message, error)
+}
+
+func newTestTCPServer(t *testing.T) *testTCPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &testTCPServer{listener: listener, batchSize: 1}
+	t.Cleanup(func() { listener.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *testTCPServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testTCPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.accepted.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *testTCPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	var batch []dnsmessage.Message
+	for {
+		var msgLen uint16
+		if err := binary.Read(conn, binary.BigEndian, &msgLen); err != nil {
+			return
+		}
+		buf := make([]byte, msgLen)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		var req dnsmessage.Message
+		if err := req.Unpack(buf); err != nil {
+			return
+		}
+		if req.Questions[0].Name.String() == s.ignoreName {
+			continue
+		}
+		batch = append(batch, req)
+		if len(batch) < s.batchSize && req.Questions[0].Name.String() != warmupName {
+			continue
+		}
+		for i := len(batch) - 1; i >= 0; i-- {
+			var resp dnsmessage.Message
+			var err error
+			if s.respond != nil {
+				resp, err = s.respond(batch[i])
+			} else {
+				resp, err = newMessageResponse(batch[i], &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}}, 100)
+			}
+			if err != nil {
+				return
+			}
+			if s.badResponse {
+				resp.Questions[0].Name = dnsmessage.MustNewName("other.example.")
+			}
+			if s.writeMessage(conn, resp) != nil {
+				return
+			}
+			if s.closeAfterResponse {
+				return
+			}
+		}
+		batch = nil
+	}
+}
+
+func (s *testTCPServer) writeMessage(conn net.Conn, msg dnsmessage.Message) error {
+	buf, err := msg.AppendPack(make([]byte, 2, 514))
+	if err != nil {
+		return err
+	}
+	if len(buf) > 1<<16-1 {
+		return errors.New("message too large")
+	}
+	binary.BigEndian.PutUint16(buf, uint16(len(buf)-2))
+	_, err = conn.Write(buf)
+	return err
+}
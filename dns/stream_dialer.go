@@ -18,29 +18,72 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-sdk/transport/tls"
 	"golang.org/x/net/dns/dnsmessage"
 )
 
-func resolveIP(ctx context.Context, resolver Resolver, rrType dnsmessage.Type, hostname string) ([]netip.Addr, error) {
-	ips := []netip.Addr{}
+// Maximum number of CNAME or AliasMode records followed for a name, to prevent loops.
+const maxAliasChain = 8
+
+// queryFollowingCNAMEs queries the records of type rrType for hostname, following the CNAME chain explicitly.
+// Resolvers usually include the whole chain in the answer, but if they don't, it queries the rest of the chain.
+// It returns the name at the end of the chain and its records.
+func queryFollowingCNAMEs(ctx context.Context, resolver Resolver, rrType dnsmessage.Type, hostname string) (dnsmessage.Name, []dnsmessage.Resource, error) {
 	q, err := NewQuestion(hostname, rrType)
 	if err != nil {
-		return nil, err
+		return dnsmessage.Name{}, nil, err
 	}
-	response, err := resolver.Query(ctx, *q)
+	target := q.Name
+	for hops := 0; hops <= maxAliasChain; {
+		response, err := resolver.Query(ctx, *q)
+		if err != nil {
+			return dnsmessage.Name{}, nil, err
+		}
+		if response.RCode != dnsmessage.RCodeSuccess {
+			return dnsmessage.Name{}, nil, fmt.Errorf("got %v (%d)", response.RCode.String(), response.RCode)
+		}
+		for ; hops <= maxAliasChain; hops++ {
+			var records []dnsmessage.Resource
+			var cname *dnsmessage.CNAMEResource
+			for _, answer := range response.Answers {
+				if !equalASCIIName(answer.Header.Name, target) {
+					continue
+				}
+				if answer.Header.Type == rrType {
+					records = append(records, answer)
+				} else if rr, ok := answer.Body.(*dnsmessage.CNAMEResource); ok && cname == nil {
+					cname = rr
+				}
+			}
+			if len(records) > 0 || cname == nil {
+				if len(records) == 0 && !equalASCIIName(target, q.Name) {
+					// The chain ends outside of the answer. Query the rest of it.
+					break
+				}
+				return target, records, nil
+			}
+			target = cname.CNAME
+		}
+		q.Name = target
+	}
+	return dnsmessage.Name{}, nil, fmt.Errorf("CNAME chain of %v is too long", hostname)
+}
+
+func resolveIP(ctx context.Context, resolver Resolver, rrType dnsmessage.Type, hostname string) ([]netip.Addr, error) {
+	ips := []netip.Addr{}
+	_, answers, err := queryFollowingCNAMEs(ctx, resolver, rrType, hostname)
 	if err != nil {
 		return nil, err
 	}
-	if response.RCode != dnsmessage.RCodeSuccess {
-		return nil, fmt.Errorf("got %v (%d)", response.RCode.String(), response.RCode)
-	}
-	for _, answer := range response.Answers {
-		if answer.Header.Type != rrType {
-			continue
-		}
+	for _, answer := range answers {
 		if rr, ok := answer.Body.(*dnsmessage.AResource); ok {
 			ips = append(ips, netip.AddrFrom4(rr.A))
 		}
@@ -51,15 +94,92 @@ func resolveIP(ctx context.Context, resolver Resolver, rrType dnsmessage.Type, h
 	return ips, nil
 }
 
+// lookupServiceBinding finds the preferred HTTPS record for the host and port, following CNAME and
+// AliasMode records. It returns nil if the host has no usable record. The Target of the returned record is
+// never ".".
+func lookupServiceBinding(ctx context.Context, resolver Resolver, host string, port string) (*ServiceBinding, error) {
+	// Port prefix naming, as per https://datatracker.ietf.org/doc/html/rfc9460#section-9.1.
+	name := host
+	if port != "443" {
+		name = "_" + port + "._https." + host
+	}
+	for aliases := 0; aliases <= maxAliasChain; aliases++ {
+		owner, answers, err := queryFollowingCNAMEs(ctx, resolver, TypeHTTPS, name)
+		if err != nil {
+			return nil, err
+		}
+		var alias, best *ServiceBinding
+		for _, answer := range answers {
+			binding, err := ParseServiceBinding(answer)
+			if err != nil {
+				// Malformed and incompatible records are ignored.
+				continue
+			}
+			if binding.Priority == 0 {
+				alias = binding
+			} else if best == nil || binding.Priority < best.Priority {
+				best = binding
+			}
+		}
+		// ServiceMode records are ignored if there's an AliasMode record, as per
+		// https://datatracker.ietf.org/doc/html/rfc9460#section-2.4.2.
+		if alias != nil {
+			if alias.Target == "." {
+				return nil, nil
+			}
+			name = alias.Target
+			continue
+		}
+		if best != nil && best.Target == "." {
+			best.Target = owner.String()
+			if prefix := "_" + port + "._https."; port != "443" && strings.HasPrefix(strings.ToLower(best.Target), prefix) {
+				best.Target = best.Target[len(prefix):]
+			}
+		}
+		return best, nil
+	}
+	return nil, fmt.Errorf("alias chain of %v is too long", host)
+}
+
+// StreamDialerOption configures the dialer created by [NewStreamDialer].
+type StreamDialerOption func(*streamDialerOptions)
+
+type streamDialerOptions struct {
+	httpsRecords bool
+}
+
+// WithHTTPSRecords makes the dialer query the [HTTPS records] of the destination along with its addresses.
+// If the destination has a usable record, the dialer connects to the endpoint and port it designates, and
+// tries the ipv4hint and ipv6hint addresses while the A and AAAA queries are in flight. If the HTTPS query
+// fails, or is still unanswered shortly after the addresses resolve, the dialer connects without it.
+//
+// The dialer passes the original host name, the ALPN protocols and the ECH configuration to the connections
+// it dials through the context, as [tls.ServiceHints]. That allows a [tls.StreamDialer] used as the dialer
+// to validate the certificate of the host, and to use Encrypted Client Hello.
+//
+// [HTTPS records]: https://datatracker.ietf.org/doc/html/rfc9460
+func WithHTTPSRecords() StreamDialerOption {
+	return func(opts *streamDialerOptions) {
+		opts.httpsRecords = true
+	}
+}
+
 // NewStreamDialer creates a [transport.StreamDialer] that uses Happy Eyeballs v2 to establish a connection.
 // It uses resolver to map host names to IP addresses, and the given dialer to attempt connections.
-func NewStreamDialer(resolver Resolver, dialer transport.StreamDialer) (transport.StreamDialer, error) {
+func NewStreamDialer(resolver Resolver, dialer transport.StreamDialer, options ...StreamDialerOption) (transport.StreamDialer, error) {
 	if resolver == nil {
 		return nil, errors.New("resolver must not be nil")
 	}
 	if dialer == nil {
 		return nil, errors.New("dialer must not be nil")
 	}
+	var opts streamDialerOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	if opts.httpsRecords {
+		return &serviceStreamDialer{resolver: resolver, dialer: dialer}, nil
+	}
 	return &transport.HappyEyeballsStreamDialer{
 		Dialer: dialer,
 		Resolve: transport.NewParallelHappyEyeballsResolveFunc(
@@ -72,3 +192,184 @@ func NewStreamDialer(resolver Resolver, dialer transport.StreamDialer) (transpor
 		),
 	}, nil
 }
+
+// serviceStreamDialer is the dialer created by [NewStreamDialer] with [WithHTTPSRecords].
+type serviceStreamDialer struct {
+	resolver Resolver
+	dialer   transport.StreamDialer
+}
+
+var _ transport.StreamDialer = (*serviceStreamDialer)(nil)
+
+// httpsResolutionDelay is how long the dialer waits for the HTTPS records once the A and AAAA queries of the
+// host are answered. It's the Resolution Delay of Happy Eyeballs v2.
+const httpsResolutionDelay = 50 * time.Millisecond
+
+// DialStream implements [transport.StreamDialer].
+func (d *serviceStreamDialer) DialStream(ctx context.Context, addr string) (transport.StreamConn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse address: %w", err)
+	}
+	if net.ParseIP(host) != nil {
+		return d.dialer.DialStream(ctx, addr)
+	}
+	lookupCtx, cancelLookups := context.WithCancel(ctx)
+	defer cancelLookups()
+	// The HTTPS query runs in parallel with the A and AAAA queries of the host, so it doesn't delay the dial.
+	bindingCh := make(chan *ServiceBinding, 1)
+	go func() {
+		// The lookup errors are ignored, as the HTTPS records are optional.
+		binding, _ := lookupServiceBinding(lookupCtx, d.resolver, host, port)
+		bindingCh <- binding
+	}()
+	lookups := d.startIPLookups(lookupCtx, host)
+	binding := waitServiceBinding(ctx, bindingCh, lookups)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	hints := tls.ServiceHints{ServerName: host}
+	var hintIPs []netip.Addr
+	if binding != nil {
+		if target := strings.TrimSuffix(binding.Target, "."); !strings.EqualFold(target, host) {
+			lookups = d.startIPLookups(lookupCtx, target)
+			host = target
+		}
+		if binding.Port != 0 {
+			port = strconv.Itoa(int(binding.Port))
+		}
+		hints.ALPN = binding.ALPN
+		if !binding.NoDefaultALPN && !containsString(hints.ALPN, "http/1.1") {
+			hints.ALPN = append(hints.ALPN, "http/1.1")
+		}
+		hints.ECHConfigList = binding.ECHConfigList
+		hintIPs = append(append([]netip.Addr(nil), binding.IPv6Hint...), binding.IPv4Hint...)
+	}
+	heDialer := &transport.HappyEyeballsStreamDialer{
+		Dialer: transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+			attemptHints := hints
+			attemptHints.Address = addr
+			return d.dialer.DialStream(tls.ContextWithServiceHints(ctx, attemptHints), addr)
+		}),
+		Resolve: resolveWithHints(hintIPs, lookups),
+	}
+	return heDialer.DialStream(ctx, net.JoinHostPort(host, port))
+}
+
+// startIPLookups starts the AAAA and A lookups of hostname, in that order.
+func (d *serviceStreamDialer) startIPLookups(ctx context.Context, hostname string) []*ipLookup {
+	return []*ipLookup{
+		startIPLookup(ctx, d.resolver, dnsmessage.TypeAAAA, hostname),
+		startIPLookup(ctx, d.resolver, dnsmessage.TypeA, hostname),
+	}
+}
+
+// waitServiceBinding returns the result of the HTTPS lookup. Some resolvers drop HTTPS queries, so it stops
+// waiting [httpsResolutionDelay] after one of the lookups returns addresses, or after all of them fail.
+// It returns nil if it stops waiting.
+func waitServiceBinding(ctx context.Context, bindingCh <-chan *ServiceBinding, lookups []*ipLookup) *ServiceBinding {
+	resolvedCh := make(chan struct{})
+	var once sync.Once
+	var wg sync.WaitGroup
+	for _, lookup := range lookups {
+		wg.Add(1)
+		go func(lookup *ipLookup) {
+			defer wg.Done()
+			<-lookup.done
+			if len(lookup.ips) > 0 {
+				once.Do(func() { close(resolvedCh) })
+			}
+		}(lookup)
+	}
+	go func() {
+		wg.Wait()
+		once.Do(func() { close(resolvedCh) })
+	}()
+
+	select {
+	case binding := <-bindingCh:
+		return binding
+	case <-ctx.Done():
+		return nil
+	case <-resolvedCh:
+	}
+	timer := time.NewTimer(httpsResolutionDelay)
+	defer timer.Stop()
+	select {
+	case binding := <-bindingCh:
+		return binding
+	case <-ctx.Done():
+		return nil
+	case <-timer.C:
+		return nil
+	}
+}
+
+// ipLookup is an A or AAAA lookup that runs in the background.
+type ipLookup struct {
+	done chan struct{}
+	ips  []netip.Addr
+	err  error
+}
+
+func startIPLookup(ctx context.Context, resolver Resolver, rrType dnsmessage.Type, hostname string) *ipLookup {
+	lookup := &ipLookup{done: make(chan struct{})}
+	go func() {
+		defer close(lookup.done)
+		lookup.ips, lookup.err = resolveIP(ctx, resolver, rrType, hostname)
+	}()
+	return lookup
+}
+
+// wait returns the result of the lookup, or the context error if ctx is done first.
+func (l *ipLookup) wait(ctx context.Context) ([]netip.Addr, error) {
+	select {
+	case <-l.done:
+		return l.ips, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolveWithHints returns a [transport.HappyEyeballsResolveFunc] that sends the hint addresses first, and then
+// the addresses of the lookups that were not hints.
+func resolveWithHints(hintIPs []netip.Addr, lookups []*ipLookup) transport.HappyEyeballsResolveFunc {
+	return func(ctx context.Context, hostname string) <-chan transport.HappyEyeballsResolution {
+		resultsCh := make(chan transport.HappyEyeballsResolution, len(lookups)+1)
+		if len(hintIPs) > 0 {
+			resultsCh <- transport.HappyEyeballsResolution{IPs: hintIPs, Err: nil}
+		}
+		var mu sync.Mutex
+		seen := make(map[netip.Addr]bool)
+		for _, ip := range hintIPs {
+			seen[ip] = true
+		}
+		var wg sync.WaitGroup
+		for _, lookup := range lookups {
+			wg.Add(1)
+			go func(lookup *ipLookup) {
+				defer wg.Done()
+				ips, err := lookup.wait(ctx)
+				if err != nil && len(hintIPs) > 0 {
+					// The hints may still work.
+					return
+				}
+				mu.Lock()
+				newIPs := make([]netip.Addr, 0, len(ips))
+				for _, ip := range ips {
+					if !seen[ip] {
+						seen[ip] = true
+						newIPs = append(newIPs, ip)
+					}
+				}
+				mu.Unlock()
+				resultsCh <- transport.HappyEyeballsResolution{IPs: newIPs, Err: err}
+			}(lookup)
+		}
+		go func() {
+			wg.Wait()
+			close(resultsCh)
+		}()
+		return resultsCh
+	}
+}
@@ -18,9 +18,12 @@ import (
 	"context"
 	"errors"
 	"net/netip"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-sdk/transport/tls"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/dns/dnsmessage"
 )
@@ -68,3 +71,285 @@ func TestNewStreamDialer_NoDialer(t *testing.T) {
 	_, err := NewStreamDialer(FuncResolver(nil), nil)
 	require.Error(t, err)
 }
+
+func TestNewStreamDialer_CNAMEChain(t *testing.T) {
+	var queries []string
+	resolver := newCannedResolver(map[string][]dnsmessage.Resource{
+		// The first response has part of the chain only.
+		"a.test.|A": {
+			newCNAMERecord("a.test.", "b.test."),
+			newCNAMERecord("b.test.", "c.test."),
+		},
+		"c.test.|A": {
+			newCNAMERecord("c.test.", "d.test."),
+			newARecord("d.test.", "10.0.0.1"),
+			// Unrelated records must be ignored.
+			newARecord("other.test.", "10.0.0.2"),
+		},
+	}, &queries)
+	ips, err := resolveIP(context.Background(), resolver, dnsmessage.TypeA, "a.test")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.1")}, ips)
+	require.Equal(t, []string{"a.test.|A", "c.test.|A"}, queries)
+}
+
+func TestNewStreamDialer_CNAMELoop(t *testing.T) {
+	resolver := newCannedResolver(map[string][]dnsmessage.Resource{
+		"a.test.|A": {newCNAMERecord("a.test.", "b.test.")},
+		"b.test.|A": {newCNAMERecord("b.test.", "a.test.")},
+	}, nil)
+	_, err := resolveIP(context.Background(), resolver, dnsmessage.TypeA, "a.test")
+	require.ErrorContains(t, err, "too long")
+}
+
+func TestNewStreamDialer_HTTPSRecords(t *testing.T) {
+	echConfigList := []byte{0, 3, 1, 2, 3}
+	resolver := newCannedResolver(map[string][]dnsmessage.Resource{
+		"example.test.|HTTPS": {
+			newHTTPSRecord("example.test.", &ServiceBinding{Priority: 2, Target: "backup.example.test."}),
+			newHTTPSRecord("example.test.", &ServiceBinding{
+				Priority:      1,
+				Target:        "svc.example.test.",
+				ALPN:          []string{"h2"},
+				Port:          8443,
+				IPv4Hint:      []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+				IPv6Hint:      []netip.Addr{netip.MustParseAddr("2001:db8::1")},
+				ECHConfigList: echConfigList,
+			}),
+		},
+		"svc.example.test.|A": {
+			newARecord("svc.example.test.", "192.0.2.1"),
+			newARecord("svc.example.test.", "192.0.2.9"),
+		},
+	}, nil)
+	var mu sync.Mutex
+	var addrs []string
+	var hints []tls.ServiceHints
+	baseDialer := transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		addrs = append(addrs, addr)
+		h, ok := tls.ServiceHintsFromContext(ctx)
+		require.True(t, ok)
+		hints = append(hints, h)
+		return nil, errors.New("not implemented")
+	})
+	dialer, err := NewStreamDialer(resolver, baseDialer, WithHTTPSRecords())
+	require.NoError(t, err)
+	_, err = dialer.DialStream(context.Background(), "example.test:443")
+	require.Error(t, err)
+
+	// The hints are attempted first, and addresses are not attempted twice.
+	require.Len(t, addrs, 3)
+	require.ElementsMatch(t, []string{"[2001:db8::1]:8443", "192.0.2.1:8443"}, addrs[:2])
+	require.Equal(t, "192.0.2.9:8443", addrs[2])
+	for i, h := range hints {
+		require.Equal(t, tls.ServiceHints{
+			Address:       addrs[i],
+			ServerName:    "example.test",
+			ALPN:          []string{"h2", "http/1.1"},
+			ECHConfigList: echConfigList,
+		}, h)
+	}
+}
+
+func TestNewStreamDialer_HTTPSAliasMode(t *testing.T) {
+	canned := newCannedResolver(map[string][]dnsmessage.Resource{
+		"_8080._https.example.test.|HTTPS": {
+			newHTTPSRecord("_8080._https.example.test.", &ServiceBinding{Priority: 0, Target: "pool.test."}),
+			// ServiceMode records are ignored when there's an alias.
+			newHTTPSRecord("_8080._https.example.test.", &ServiceBinding{Priority: 1, Target: "ignored.test."}),
+		},
+		"pool.test.|HTTPS": {
+			newCNAMERecord("pool.test.", "_8080._https.pool2.test."),
+			newHTTPSRecord("_8080._https.pool2.test.", &ServiceBinding{Priority: 1, Target: ".", ALPN: []string{"h2"}, NoDefaultALPN: true}),
+		},
+		"pool2.test.|A": {newARecord("pool2.test.", "10.0.0.1")},
+	}, nil)
+	// The A and AAAA queries run in parallel, so only the HTTPS queries are recorded.
+	var httpsQueries []string
+	resolver := FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		if q.Type == TypeHTTPS {
+			httpsQueries = append(httpsQueries, q.Name.String())
+		}
+		return canned.Query(ctx, q)
+	})
+	var addrs []string
+	var hints []tls.ServiceHints
+	baseDialer := transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		addrs = append(addrs, addr)
+		h, _ := tls.ServiceHintsFromContext(ctx)
+		hints = append(hints, h)
+		return nil, errors.New("not implemented")
+	})
+	dialer, err := NewStreamDialer(resolver, baseDialer, WithHTTPSRecords())
+	require.NoError(t, err)
+	_, err = dialer.DialStream(context.Background(), "example.test:8080")
+	require.Error(t, err)
+	require.Equal(t, []string{"10.0.0.1:8080"}, addrs)
+	require.Equal(t, []tls.ServiceHints{{Address: "10.0.0.1:8080", ServerName: "example.test", ALPN: []string{"h2"}}}, hints)
+	require.Equal(t, []string{"_8080._https.example.test.", "pool.test."}, httpsQueries)
+}
+
+func TestNewStreamDialer_HTTPSNotAvailable(t *testing.T) {
+	resolver := newCannedResolver(map[string][]dnsmessage.Resource{
+		"example.test.|HTTPS": {newHTTPSRecord("example.test.", &ServiceBinding{Priority: 0, Target: "."})},
+		"example.test.|A":     {newARecord("example.test.", "10.0.0.1")},
+	}, nil)
+	var addrs []string
+	var hints []tls.ServiceHints
+	baseDialer := transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		addrs = append(addrs, addr)
+		h, _ := tls.ServiceHintsFromContext(ctx)
+		hints = append(hints, h)
+		return nil, errors.New("not implemented")
+	})
+	dialer, err := NewStreamDialer(resolver, baseDialer, WithHTTPSRecords())
+	require.NoError(t, err)
+	_, err = dialer.DialStream(context.Background(), "example.test:443")
+	require.Error(t, err)
+	require.Equal(t, []string{"10.0.0.1:443"}, addrs)
+	require.Equal(t, []tls.ServiceHints{{Address: "10.0.0.1:443", ServerName: "example.test"}}, hints)
+}
+
+func TestNewStreamDialer_HTTPSQueryFails(t *testing.T) {
+	resolver := FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		if q.Type == TypeHTTPS {
+			return nil, errors.New("query failed")
+		}
+		return newCannedResolver(map[string][]dnsmessage.Resource{
+			"example.test.|A": {newARecord("example.test.", "10.0.0.1")},
+		}, nil).Query(ctx, q)
+	})
+	var addrs []string
+	baseDialer := transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		addrs = append(addrs, addr)
+		return nil, errors.New("not implemented")
+	})
+	dialer, err := NewStreamDialer(resolver, baseDialer, WithHTTPSRecords())
+	require.NoError(t, err)
+	_, err = dialer.DialStream(context.Background(), "example.test:443")
+	require.Error(t, err)
+	require.Equal(t, []string{"10.0.0.1:443"}, addrs)
+}
+
+func TestNewStreamDialer_HTTPSQueryDropped(t *testing.T) {
+	canned := newCannedResolver(map[string][]dnsmessage.Resource{
+		"example.test.|A": {newARecord("example.test.", "10.0.0.1")},
+	}, nil)
+	resolver := FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		if q.Type == TypeHTTPS {
+			// The resolver never answers.
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return canned.Query(ctx, q)
+	})
+	var addrs []string
+	var hints []tls.ServiceHints
+	baseDialer := transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		addrs = append(addrs, addr)
+		h, _ := tls.ServiceHintsFromContext(ctx)
+		hints = append(hints, h)
+		return nil, errors.New("not implemented")
+	})
+	dialer, err := NewStreamDialer(resolver, baseDialer, WithHTTPSRecords())
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = dialer.DialStream(ctx, "example.test:443")
+	require.ErrorContains(t, err, "not implemented")
+	require.NoError(t, ctx.Err())
+	require.Equal(t, []string{"10.0.0.1:443"}, addrs)
+	require.Equal(t, []tls.ServiceHints{{Address: "10.0.0.1:443", ServerName: "example.test"}}, hints)
+}
+
+func TestNewStreamDialer_HTTPSQueryInParallel(t *testing.T) {
+	canned := newCannedResolver(map[string][]dnsmessage.Resource{
+		"example.test.|HTTPS": {newHTTPSRecord("example.test.", &ServiceBinding{Priority: 1, Target: ".", ALPN: []string{"h2"}})},
+		"example.test.|A":     {newARecord("example.test.", "10.0.0.1")},
+	}, nil)
+	aQueried := make(chan struct{})
+	resolver := FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		switch q.Type {
+		case TypeHTTPS:
+			// The HTTPS answer only arrives once the A query is sent.
+			select {
+			case <-aQueried:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		case dnsmessage.TypeA:
+			close(aQueried)
+		}
+		return canned.Query(ctx, q)
+	})
+	var addrs []string
+	var hints []tls.ServiceHints
+	baseDialer := transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		addrs = append(addrs, addr)
+		h, _ := tls.ServiceHintsFromContext(ctx)
+		hints = append(hints, h)
+		return nil, errors.New("not implemented")
+	})
+	dialer, err := NewStreamDialer(resolver, baseDialer, WithHTTPSRecords())
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = dialer.DialStream(ctx, "example.test:443")
+	require.ErrorContains(t, err, "not implemented")
+	require.Equal(t, []string{"10.0.0.1:443"}, addrs)
+	require.Equal(t, []tls.ServiceHints{{Address: "10.0.0.1:443", ServerName: "example.test", ALPN: []string{"h2", "http/1.1"}}}, hints)
+}
+
+func TestNewStreamDialer_HTTPSWithIP(t *testing.T) {
+	resolver := FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		require.FailNow(t, "unexpected query", q.GoString())
+		return nil, nil
+	})
+	var addrs []string
+	baseDialer := transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		addrs = append(addrs, addr)
+		return nil, errors.New("not implemented")
+	})
+	dialer, err := NewStreamDialer(resolver, baseDialer, WithHTTPSRecords())
+	require.NoError(t, err)
+	_, err = dialer.DialStream(context.Background(), "[2001:db8::1]:443")
+	require.Error(t, err)
+	require.Equal(t, []string{"[2001:db8::1]:443"}, addrs)
+}
+
+/********** Test Utilities **********/
+
+// newCannedResolver returns a [Resolver] that answers with the records for "name|type" keys, or with an empty
+// answer if there's no key. If queries is not nil, it records the keys of the queries.
+func newCannedResolver(answers map[string][]dnsmessage.Resource, queries *[]string) Resolver {
+	var mu sync.Mutex
+	return FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		key := q.Name.String() + "|" + typeString(q.Type)
+		if queries != nil {
+			mu.Lock()
+			*queries = append(*queries, key)
+			mu.Unlock()
+		}
+		resp := new(dnsmessage.Message)
+		resp.Header.Response = true
+		resp.Questions = []dnsmessage.Question{q}
+		resp.Answers = answers[key]
+		return resp, nil
+	})
+}
+
+func newCNAMERecord(name string, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)},
+	}
+}
+
+func newARecord(name string, ip string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.AResource{A: netip.MustParseAddr(ip).As4()},
+	}
+}
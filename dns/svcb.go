@@ -0,0 +1,154 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Record types for service binding, as per https://datatracker.ietf.org/doc/html/rfc9460.
+// They are not defined by dnsmessage.
+const (
+	TypeSVCB  dnsmessage.Type = 64
+	TypeHTTPS dnsmessage.Type = 65
+)
+
+// Keys of the service parameters, from https://www.iana.org/assignments/dns-svcb/dns-svcb.xhtml.
+const (
+	svcParamMandatory     = 0
+	svcParamALPN          = 1
+	svcParamNoDefaultALPN = 2
+	svcParamPort          = 3
+	svcParamIPv4Hint      = 4
+	svcParamECH           = 5
+	svcParamIPv6Hint      = 6
+)
+
+// ServiceBinding is the content of an SVCB or HTTPS record, as per [RFC 9460].
+//
+// [RFC 9460]: https://datatracker.ietf.org/doc/html/rfc9460
+type ServiceBinding struct {
+	// Priority is 0 for records in AliasMode, which delegate to Target. Otherwise, lower values are preferred.
+	Priority uint16
+	// Target is the domain name of the service endpoint. "." means the owner name of the record in ServiceMode,
+	// and that the service is not available in AliasMode.
+	Target string
+	// ALPN is the list of protocols the endpoint supports.
+	ALPN []string
+	// NoDefaultALPN means that the endpoint doesn't support the default protocol of the scheme, which is
+	// "http/1.1" for HTTPS records.
+	NoDefaultALPN bool
+	// Port is the port of the endpoint, or 0 if it's the default port.
+	Port uint16
+	// IPv4Hint and IPv6Hint are addresses of the endpoint, which can be used before the A and AAAA queries return.
+	IPv4Hint []netip.Addr
+	IPv6Hint []netip.Addr
+	// ECHConfigList is the serialized ECHConfigList for Encrypted Client Hello.
+	ECHConfigList []byte
+}
+
+// ParseServiceBinding parses an SVCB or HTTPS record. It returns an error if the record is malformed, or if it
+// has mandatory parameters that are not supported, in which case the record must be ignored.
+func ParseServiceBinding(rr dnsmessage.Resource) (*ServiceBinding, error) {
+	if rr.Header.Type != TypeSVCB && rr.Header.Type != TypeHTTPS {
+		return nil, fmt.Errorf("record type %v is not SVCB or HTTPS", rr.Header.Type)
+	}
+	data, err := unknownRData(rr)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2 {
+		return nil, errors.New("record is too short")
+	}
+	binding := &ServiceBinding{Priority: binary.BigEndian.Uint16(data)}
+	target, n, err := parseWireName(data[2:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid target name: %w", err)
+	}
+	binding.Target = target
+	params := data[2+n:]
+	var mandatory []uint16
+	lastKey := -1
+	for len(params) > 0 {
+		if len(params) < 4 {
+			return nil, errors.New("service parameter is truncated")
+		}
+		key, length := binary.BigEndian.Uint16(params), int(binary.BigEndian.Uint16(params[2:]))
+		if int(key) <= lastKey {
+			return nil, errors.New("service parameter keys are not in increasing order")
+		}
+		lastKey = int(key)
+		if len(params) < 4+length {
+			return nil, errors.New("service parameter is truncated")
+		}
+		value := params[4 : 4+length]
+		params = params[4+length:]
+		switch key {
+		case svcParamMandatory:
+			if length == 0 || length%2 != 0 {
+				return nil, errors.New("invalid mandatory parameter")
+			}
+			for i := 0; i < length; i += 2 {
+				mandatory = append(mandatory, binary.BigEndian.Uint16(value[i:]))
+			}
+		case svcParamALPN:
+			for len(value) > 0 {
+				idLen := int(value[0])
+				if idLen == 0 || len(value) < 1+idLen {
+					return nil, errors.New("invalid alpn parameter")
+				}
+				binding.ALPN = append(binding.ALPN, string(value[1:1+idLen]))
+				value = value[1+idLen:]
+			}
+		case svcParamNoDefaultALPN:
+			if length != 0 {
+				return nil, errors.New("invalid no-default-alpn parameter")
+			}
+			binding.NoDefaultALPN = true
+		case svcParamPort:
+			if length != 2 {
+				return nil, errors.New("invalid port parameter")
+			}
+			binding.Port = binary.BigEndian.Uint16(value)
+		case svcParamIPv4Hint:
+			if length == 0 || length%4 != 0 {
+				return nil, errors.New("invalid ipv4hint parameter")
+			}
+			for i := 0; i < length; i += 4 {
+				binding.IPv4Hint = append(binding.IPv4Hint, netip.AddrFrom4([4]byte(value[i:i+4])))
+			}
+		case svcParamECH:
+			binding.ECHConfigList = value
+		case svcParamIPv6Hint:
+			if length == 0 || length%16 != 0 {
+				return nil, errors.New("invalid ipv6hint parameter")
+			}
+			for i := 0; i < length; i += 16 {
+				binding.IPv6Hint = append(binding.IPv6Hint, netip.AddrFrom16([16]byte(value[i:i+16])))
+			}
+		}
+	}
+	for _, key := range mandatory {
+		if key > svcParamIPv6Hint || key == svcParamMandatory {
+			return nil, fmt.Errorf("unsupported mandatory parameter key%d", key)
+		}
+	}
+	return binding, nil
+}
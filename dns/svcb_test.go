@@ -0,0 +1,133 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseServiceBinding(t *testing.T) {
+	want := &ServiceBinding{
+		Priority:      1,
+		Target:        "svc.example.com.",
+		ALPN:          []string{"h2", "h3"},
+		NoDefaultALPN: true,
+		Port:          8443,
+		IPv4Hint:      []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")},
+		IPv6Hint:      []netip.Addr{netip.MustParseAddr("2001:db8::1")},
+		ECHConfigList: []byte{0, 3, 1, 2, 3},
+	}
+	got, err := ParseServiceBinding(newHTTPSRecord("example.com.", want))
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+func TestParseServiceBinding_AliasMode(t *testing.T) {
+	got, err := ParseServiceBinding(newHTTPSRecord("example.com.", &ServiceBinding{Target: "."}))
+	require.NoError(t, err)
+	require.Equal(t, &ServiceBinding{Priority: 0, Target: "."}, got)
+}
+
+func TestParseServiceBinding_MandatoryKeys(t *testing.T) {
+	rr := newHTTPSRecord("example.com.", &ServiceBinding{Priority: 1, Target: "."})
+	// Supported mandatory key: port.
+	body := rr.Body.(*dnsmessage.UnknownResource)
+	supported := append(append([]byte{}, body.Data...), 0, svcParamMandatory, 0, 2, 0, svcParamPort, 0, svcParamPort, 0, 2, 0x01, 0xbb)
+	binding, err := ParseServiceBinding(dnsmessage.Resource{Header: rr.Header, Body: &dnsmessage.UnknownResource{Type: TypeHTTPS, Data: supported}})
+	require.NoError(t, err)
+	require.Equal(t, uint16(443), binding.Port)
+
+	// Unsupported mandatory key 65000.
+	unsupported := append(append([]byte{}, body.Data...), 0, svcParamMandatory, 0, 2, 0xfd, 0xe8)
+	_, err = ParseServiceBinding(dnsmessage.Resource{Header: rr.Header, Body: &dnsmessage.UnknownResource{Type: TypeHTTPS, Data: unsupported}})
+	require.Error(t, err)
+}
+
+func TestParseServiceBinding_Malformed(t *testing.T) {
+	header := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: TypeHTTPS, Class: dnsmessage.ClassINET}
+	for name, data := range map[string][]byte{
+		"empty":            {},
+		"truncated target": {0, 1, 3, 's', 'v'},
+		"truncated param":  {0, 1, 0, 0, svcParamPort, 0, 2, 1},
+		"unordered keys":   {0, 1, 0, 0, svcParamPort, 0, 2, 1, 1, 0, svcParamALPN, 0, 3, 2, 'h', '2'},
+		"bad port":         {0, 1, 0, 0, svcParamPort, 0, 1, 1},
+		"bad ipv4hint":     {0, 1, 0, 0, svcParamIPv4Hint, 0, 3, 1, 2, 3},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseServiceBinding(dnsmessage.Resource{Header: header, Body: &dnsmessage.UnknownResource{Type: TypeHTTPS, Data: data}})
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestParseServiceBinding_WrongType(t *testing.T) {
+	_, err := ParseServiceBinding(dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA},
+		Body:   &dnsmessage.AResource{},
+	})
+	require.Error(t, err)
+}
+
+/********** Test Utilities **********/
+
+// newHTTPSRecord encodes the binding as an HTTPS record owned by name.
+func newHTTPSRecord(name string, binding *ServiceBinding) dnsmessage.Resource {
+	data := binary.BigEndian.AppendUint16(nil, binding.Priority)
+	data = appendWireName(data, binding.Target)
+	appendParam := func(key uint16, value []byte) {
+		data = binary.BigEndian.AppendUint16(data, key)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(value)))
+		data = append(data, value...)
+	}
+	if len(binding.ALPN) > 0 {
+		var value []byte
+		for _, id := range binding.ALPN {
+			value = append(append(value, byte(len(id))), id...)
+		}
+		appendParam(svcParamALPN, value)
+	}
+	if binding.NoDefaultALPN {
+		appendParam(svcParamNoDefaultALPN, nil)
+	}
+	if binding.Port != 0 {
+		appendParam(svcParamPort, binary.BigEndian.AppendUint16(nil, binding.Port))
+	}
+	if len(binding.IPv4Hint) > 0 {
+		var value []byte
+		for _, ip := range binding.IPv4Hint {
+			value = append(value, ip.AsSlice()...)
+		}
+		appendParam(svcParamIPv4Hint, value)
+	}
+	if binding.ECHConfigList != nil {
+		appendParam(svcParamECH, binding.ECHConfigList)
+	}
+	if len(binding.IPv6Hint) > 0 {
+		var value []byte
+		for _, ip := range binding.IPv6Hint {
+			value = append(value, ip.AsSlice()...)
+		}
+		appendParam(svcParamIPv6Hint, value)
+	}
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: TypeHTTPS, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.UnknownResource{Type: TypeHTTPS, Data: data},
+	}
+}
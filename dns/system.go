@@ -0,0 +1,517 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultHostsPath      = "/etc/hosts"
+	defaultResolvConfPath = "/etc/resolv.conf"
+	// How often the system resolver checks the files for changes. Same as the Go standard library.
+	systemConfigCheckInterval = 5 * time.Second
+)
+
+// resolvConf is the resolver configuration from a resolv.conf file, as documented in
+// https://man7.org/linux/man-pages/man5/resolv.conf.5.html.
+type resolvConf struct {
+	// Nameserver addresses, as host:port.
+	servers []string
+	// Search domains, fully qualified.
+	search   []string
+	ndots    int
+	timeout  time.Duration
+	attempts int
+	rotate   bool
+	useTCP   bool
+}
+
+// parseResolvConf parses the content of a resolv.conf file. Unknown and invalid entries are ignored, like the
+// system resolvers do.
+func parseResolvConf(data []byte) *resolvConf {
+	conf := &resolvConf{
+		ndots:    1,
+		timeout:  5 * time.Second,
+		attempts: 2,
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) > 0 && (line[0] == ';' || line[0] == '#') {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 1 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			// The system resolvers use at most 3 nameservers.
+			if len(fields) > 1 && len(conf.servers) < 3 {
+				if ip, err := netip.ParseAddr(fields[1]); err == nil {
+					conf.servers = append(conf.servers, net.JoinHostPort(ip.String(), "53"))
+				}
+			}
+		case "domain":
+			if len(fields) > 1 {
+				conf.search = []string{makeFQDN(fields[1])}
+			}
+		case "search":
+			conf.search = make([]string, 0, len(fields)-1)
+			for _, domain := range fields[1:] {
+				if domain != "." {
+					conf.search = append(conf.search, makeFQDN(domain))
+				}
+			}
+		case "options":
+			for _, option := range fields[1:] {
+				name, value, _ := strings.Cut(option, ":")
+				switch name {
+				case "ndots":
+					conf.ndots = clampedAtoi(value, 0, 15, conf.ndots)
+				case "timeout":
+					conf.timeout = time.Duration(clampedAtoi(value, 1, 30, int(conf.timeout/time.Second))) * time.Second
+				case "attempts":
+					conf.attempts = clampedAtoi(value, 1, 5, conf.attempts)
+				case "rotate":
+					conf.rotate = true
+				case "use-vc", "usevc", "tcp":
+					conf.useTCP = true
+				}
+			}
+		}
+	}
+	if len(conf.servers) == 0 {
+		// Same default as the system resolvers.
+		conf.servers = []string{"127.0.0.1:53", "[::1]:53"}
+	}
+	return conf
+}
+
+// clampedAtoi parses value as an integer clamped to [lo, hi], or returns defaultValue if value is not an integer.
+func clampedAtoi(value string, lo, hi, defaultValue int) int {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return defaultValue
+	}
+	if n < lo {
+		return lo
+	}
+	if n > hi {
+		return hi
+	}
+	return n
+}
+
+func makeFQDN(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// nameList returns the names to query for name, in order, applying the search list to relative names, as per
+// https://man7.org/linux/man-pages/man5/resolv.conf.5.html.
+func (conf *resolvConf) nameList(name string) []string {
+	if strings.HasSuffix(name, ".") {
+		return []string{name}
+	}
+	hasNdots := strings.Count(name, ".") >= conf.ndots
+	names := make([]string, 0, len(conf.search)+1)
+	if hasNdots {
+		names = append(names, name+".")
+	}
+	for _, suffix := range conf.search {
+		names = append(names, name+"."+suffix)
+	}
+	if !hasNdots {
+		names = append(names, name+".")
+	}
+	return names
+}
+
+// hostsFile is the content of a hosts file, as documented in https://man7.org/linux/man-pages/man5/hosts.5.html.
+type hostsFile struct {
+	// Addresses by lower case, fully qualified name.
+	addrs map[string][]netip.Addr
+	// Fully qualified names by address.
+	names map[netip.Addr][]string
+}
+
+func parseHosts(data []byte) *hostsFile {
+	hosts := &hostsFile{
+		addrs: make(map[string][]netip.Addr),
+		names: make(map[netip.Addr][]string),
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			continue
+		}
+		addr = addr.Unmap()
+		for _, name := range fields[1:] {
+			name = makeFQDN(name)
+			key := lowerString(name)
+			hosts.addrs[key] = append(hosts.addrs[key], addr)
+			hosts.names[addr.WithZone("")] = append(hosts.names[addr.WithZone("")], name)
+		}
+	}
+	return hosts
+}
+
+// answer returns the response to q from the hosts file, or nil if the hosts file doesn't have the name.
+func (h *hostsFile) answer(q dnsmessage.Question) *dnsmessage.Message {
+	if q.Class != dnsmessage.ClassINET {
+		return nil
+	}
+	var answers []dnsmessage.Resource
+	header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class}
+	switch q.Type {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		addrs, ok := h.addrs[lowerString(makeFQDN(q.Name.String()))]
+		if !ok {
+			return nil
+		}
+		// Names in the hosts file only have the addresses in the file, so the other type gets an empty answer.
+		for _, addr := range addrs {
+			if q.Type == dnsmessage.TypeA && addr.Is4() {
+				answers = append(answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: addr.As4()}})
+			} else if q.Type == dnsmessage.TypeAAAA && addr.Is6() {
+				answers = append(answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+			}
+		}
+	case dnsmessage.TypePTR:
+		addr, ok := reverseAddr(q.Name.String())
+		if !ok {
+			return nil
+		}
+		names, ok := h.names[addr]
+		if !ok {
+			return nil
+		}
+		for _, name := range names {
+			target, err := dnsmessage.NewName(name)
+			if err != nil {
+				continue
+			}
+			answers = append(answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.PTRResource{PTR: target}})
+		}
+	default:
+		return nil
+	}
+	return &dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, Authoritative: true, RecursionDesired: true, RecursionAvailable: true},
+		Questions: []dnsmessage.Question{q},
+		Answers:   answers,
+	}
+}
+
+// reverseAddr returns the address of a reverse lookup name in in-addr.arpa or ip6.arpa, as per
+// https://datatracker.ietf.org/doc/html/rfc1035#section-3.5 and https://datatracker.ietf.org/doc/html/rfc3596#section-2.5.
+func reverseAddr(name string) (netip.Addr, bool) {
+	name = lowerString(makeFQDN(name))
+	if labels, ok := strings.CutSuffix(name, ".in-addr.arpa."); ok {
+		parts := strings.Split(labels, ".")
+		if len(parts) != 4 {
+			return netip.Addr{}, false
+		}
+		var ip [4]byte
+		for i, part := range parts {
+			n, err := strconv.ParseUint(part, 10, 8)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			ip[3-i] = byte(n)
+		}
+		return netip.AddrFrom4(ip), true
+	}
+	if labels, ok := strings.CutSuffix(name, ".ip6.arpa."); ok {
+		nibbles := strings.Split(labels, ".")
+		if len(nibbles) != 32 {
+			return netip.Addr{}, false
+		}
+		var ip [16]byte
+		for i, nibble := range nibbles {
+			n, err := strconv.ParseUint(nibble, 16, 4)
+			if err != nil || len(nibble) != 1 {
+				return netip.Addr{}, false
+			}
+			pos := 31 - i
+			ip[pos/2] |= byte(n) << (4 * (1 - pos%2))
+		}
+		return netip.AddrFrom16(ip), true
+	}
+	return netip.Addr{}, false
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{info.ModTime(), info.Size()}
+}
+
+// systemServer holds the resolvers for a nameserver.
+type systemServer struct {
+	udp Resolver
+	// tcp is nil if there's no stream dialer.
+	tcp Resolver
+}
+
+// systemConfig is a snapshot of the system configuration.
+type systemConfig struct {
+	conf    *resolvConf
+	hosts   *hostsFile
+	servers []systemServer
+}
+
+// SystemResolverOptions configures the resolver created by [NewSystemResolver]. The zero value uses the
+// standard file locations.
+type SystemResolverOptions struct {
+	// HostsPath is the path of the hosts file. Empty means "/etc/hosts". A missing file is treated as empty.
+	HostsPath string
+	// ResolvConfPath is the path of the resolver configuration file. Empty means "/etc/resolv.conf".
+	ResolvConfPath string
+}
+
+type systemResolver struct {
+	pd             transport.PacketDialer
+	sd             transport.StreamDialer
+	hostsPath      string
+	resolvConfPath string
+	now            func() time.Time
+	// nextServer is the index of the first server to try with the rotate option.
+	nextServer atomic.Uint32
+
+	mu              sync.Mutex
+	config          *systemConfig
+	lastCheck       time.Time
+	hostsStamp      fileStamp
+	resolvConfStamp fileStamp
+}
+
+var _ Resolver = (*systemResolver)(nil)
+
+// NewSystemResolver creates a [Resolver] that resolves names like the resolver of Unix-like systems does, but
+// sends the queries through the given dialers. That allows the system configuration to be used with any transport.
+//
+// It answers from the hosts file first, and otherwise queries the nameservers in the resolv.conf file, honoring
+// its search, ndots, timeout, attempts, rotate and use-vc options. The queries use pd, and are retried with sd when
+// the response is truncated. sd can be nil, in which case the resolver only uses UDP. The files are reloaded
+// when they change.
+//
+// Names that don't end in a dot are expanded with the search list. In that case, the response has the
+// original question, and a CNAME record to the name that was found. Note that [NewQuestion] returns fully
+// qualified names, which are never expanded.
+//
+// It returns an error if the resolv.conf file can't be read, as is the case in systems that don't use it,
+// such as Windows and Android.
+func NewSystemResolver(pd transport.PacketDialer, sd transport.StreamDialer, opts SystemResolverOptions) (Resolver, error) {
+	if pd == nil {
+		return nil, errors.New("argument pd must not be nil")
+	}
+	r := &systemResolver{
+		pd:             pd,
+		sd:             sd,
+		hostsPath:      opts.HostsPath,
+		resolvConfPath: opts.ResolvConfPath,
+		now:            time.Now,
+	}
+	if r.hostsPath == "" {
+		r.hostsPath = defaultHostsPath
+	}
+	if r.resolvConfPath == "" {
+		r.resolvConfPath = defaultResolvConfPath
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	r.lastCheck = r.now()
+	return r, nil
+}
+
+// reload reads the files and replaces the current configuration. It keeps the current configuration if the
+// resolv.conf file can't be read.
+func (r *systemResolver) reload() error {
+	r.resolvConfStamp = statFile(r.resolvConfPath)
+	r.hostsStamp = statFile(r.hostsPath)
+	data, err := os.ReadFile(r.resolvConfPath)
+	if err != nil {
+		return fmt.Errorf("failed to read resolver configuration: %w", err)
+	}
+	config := &systemConfig{conf: parseResolvConf(data)}
+	// A missing hosts file is the same as an empty one.
+	hostsData, _ := os.ReadFile(r.hostsPath)
+	config.hosts = parseHosts(hostsData)
+	for _, addr := range config.conf.servers {
+		server := systemServer{udp: NewUDPResolver(r.pd, addr)}
+		if r.sd != nil {
+			server.tcp = NewTCPResolver(r.sd, addr)
+		}
+		config.servers = append(config.servers, server)
+	}
+	r.config = config
+	return nil
+}
+
+// currentConfig returns the configuration to use, reloading it if the files have changed.
+func (r *systemResolver) currentConfig() *systemConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if now.Sub(r.lastCheck) < systemConfigCheckInterval {
+		return r.config
+	}
+	r.lastCheck = now
+	if statFile(r.resolvConfPath) != r.resolvConfStamp || statFile(r.hostsPath) != r.hostsStamp {
+		// Errors are ignored, so that we keep working if the file is temporarily missing while it's rewritten.
+		r.reload()
+	}
+	return r.config
+}
+
+// Query implements [Resolver].
+func (r *systemResolver) Query(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	config := r.currentConfig()
+	if msg := config.hosts.answer(q); msg != nil {
+		return msg, nil
+	}
+	var lastMsg *dnsmessage.Message
+	var lastErr error
+	for _, name := range config.conf.nameList(q.Name.String()) {
+		nameQ := q
+		var err error
+		nameQ.Name, err = dnsmessage.NewName(name)
+		if err != nil {
+			// Expanded names can be too long.
+			lastErr = &nestedError{ErrBadRequest, err}
+			continue
+		}
+		msg, err := r.queryServers(ctx, config, nameQ)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		if msg.RCode == dnsmessage.RCodeNameError {
+			// Try the next name in the search list.
+			lastMsg = msg
+			continue
+		}
+		return withQuestion(msg, q), nil
+	}
+	if lastMsg != nil {
+		return withQuestion(lastMsg, q), nil
+	}
+	return nil, lastErr
+}
+
+// queryServers sends q to the nameservers, as per the attempts, timeout and rotate options, until one of them answers.
+func (r *systemResolver) queryServers(ctx context.Context, config *systemConfig, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	start := 0
+	if config.conf.rotate {
+		start = int(r.nextServer.Add(1)-1) % len(config.servers)
+	}
+	var lastMsg *dnsmessage.Message
+	var lastErr error
+	for attempt := 0; attempt < config.conf.attempts; attempt++ {
+		for i := range config.servers {
+			server := config.servers[(start+i)%len(config.servers)]
+			msg, err := r.queryServer(ctx, config.conf, server, q)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, err
+				}
+				lastErr = err
+				continue
+			}
+			switch msg.RCode {
+			case dnsmessage.RCodeServerFailure, dnsmessage.RCodeRefused, dnsmessage.RCodeNotImplemented:
+				// The server can't answer. Try the next one.
+				lastMsg = msg
+				continue
+			}
+			return msg, nil
+		}
+	}
+	if lastMsg != nil {
+		return lastMsg, nil
+	}
+	return nil, lastErr
+}
+
+// queryServer sends q to a nameserver over UDP, or TCP if the response is truncated or the config says so.
+func (r *systemResolver) queryServer(ctx context.Context, conf *resolvConf, server systemServer, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, conf.timeout)
+	defer cancel()
+	if conf.useTCP && server.tcp != nil {
+		return server.tcp.Query(ctx, q)
+	}
+	msg, err := server.udp.Query(ctx, q)
+	if err != nil || !msg.Truncated || server.tcp == nil {
+		return msg, err
+	}
+	// See https://datatracker.ietf.org/doc/html/rfc1123#page-75.
+	return server.tcp.Query(ctx, q)
+}
+
+// withQuestion returns msg with the question q. If msg answers a different name, which happens with the search
+// list, it adds a CNAME record from the name of q to that name, so the answers can be found from q.
+func withQuestion(msg *dnsmessage.Message, q dnsmessage.Question) *dnsmessage.Message {
+	if len(msg.Questions) == 0 || equalASCIIName(msg.Questions[0].Name, q.Name) {
+		return msg
+	}
+	result := *msg
+	result.Questions = []dnsmessage.Question{q}
+	if msg.RCode == dnsmessage.RCodeSuccess {
+		cname := dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeCNAME, Class: q.Class},
+			Body:   &dnsmessage.CNAMEResource{CNAME: msg.Questions[0].Name},
+		}
+		result.Answers = append([]dnsmessage.Resource{cname}, msg.Answers...)
+	}
+	return &result
+}
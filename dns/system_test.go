@@ -0,0 +1,431 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func Test_parseResolvConf(t *testing.T) {
+	data, err := os.ReadFile("testdata/resolv.conf")
+	require.NoError(t, err)
+	require.Equal(t, &resolvConf{
+		// At most 3 servers.
+		servers:  []string{"192.0.2.53:53", "[2001:db8::53]:53", "[fe80::1%eth0]:53"},
+		search:   []string{"corp.example.", "lab.example."},
+		ndots:    2,
+		timeout:  3 * time.Second,
+		attempts: 5,
+		rotate:   true,
+		useTCP:   true,
+	}, parseResolvConf(data))
+}
+
+func Test_parseResolvConf_Defaults(t *testing.T) {
+	require.Equal(t, &resolvConf{
+		servers:  []string{"127.0.0.1:53", "[::1]:53"},
+		ndots:    1,
+		timeout:  5 * time.Second,
+		attempts: 2,
+	}, parseResolvConf(nil))
+}
+
+func Test_parseResolvConf_InvalidOptions(t *testing.T) {
+	conf := parseResolvConf([]byte("options ndots:x timeout:0 attempts:-1 ndots:99\n"))
+	require.Equal(t, 15, conf.ndots)
+	require.Equal(t, 1*time.Second, conf.timeout)
+	require.Equal(t, 1, conf.attempts)
+}
+
+func Test_nameList(t *testing.T) {
+	conf := &resolvConf{ndots: 1, search: []string{"a.example.", "b.example."}}
+	require.Equal(t, []string{"host."}, conf.nameList("host."))
+	require.Equal(t, []string{"host.a.example.", "host.b.example.", "host."}, conf.nameList("host"))
+	require.Equal(t, []string{"host.sub.", "host.sub.a.example.", "host.sub.b.example."}, conf.nameList("host.sub"))
+	conf.ndots = 2
+	require.Equal(t, []string{"host.sub.a.example.", "host.sub.b.example.", "host.sub."}, conf.nameList("host.sub"))
+}
+
+func Test_parseHosts(t *testing.T) {
+	data, err := os.ReadFile("testdata/hosts")
+	require.NoError(t, err)
+	hosts := parseHosts(data)
+	require.Equal(t, map[string][]netip.Addr{
+		"localhost.":             {netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")},
+		"ip6-localhost.":         {netip.MustParseAddr("::1")},
+		"intranet.corp.example.": {netip.MustParseAddr("192.0.2.10"), netip.MustParseAddr("2001:db8::10")},
+		"intranet.":              {netip.MustParseAddr("192.0.2.10")},
+		"mapped.example.":        {netip.MustParseAddr("192.0.2.11")},
+		"linklocal.example.":     {netip.MustParseAddr("fe80::1%eth0")},
+	}, hosts.addrs)
+	require.Equal(t, []string{"intranet.corp.example.", "intranet."}, hosts.names[netip.MustParseAddr("192.0.2.10")])
+	require.Equal(t, []string{"INTRANET.corp.example."}, hosts.names[netip.MustParseAddr("2001:db8::10")])
+	require.Equal(t, []string{"linklocal.example."}, hosts.names[netip.MustParseAddr("fe80::1")])
+}
+
+func Test_reverseAddr(t *testing.T) {
+	for name, want := range map[string]string{
+		"10.2.0.192.in-addr.arpa.": "192.0.2.10",
+		"10.2.0.192.IN-ADDR.ARPA":  "192.0.2.10",
+		"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.": "2001:db8::10",
+	} {
+		addr, ok := reverseAddr(name)
+		require.True(t, ok, name)
+		require.Equal(t, netip.MustParseAddr(want), addr, name)
+	}
+	for _, name := range []string{"2.0.192.in-addr.arpa.", "300.2.0.192.in-addr.arpa.", "0.1.ip6.arpa.", "example.com."} {
+		_, ok := reverseAddr(name)
+		require.False(t, ok, name)
+	}
+}
+
+func TestSystemResolver_Hosts(t *testing.T) {
+	pd := transport.FuncPacketDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		require.FailNow(t, "unexpected dial", addr)
+		return nil, nil
+	})
+	resolver, err := NewSystemResolver(pd, nil, SystemResolverOptions{
+		HostsPath:      "testdata/hosts",
+		ResolvConfPath: "testdata/resolv.conf",
+	})
+	require.NoError(t, err)
+
+	// Host names are case insensitive, and the hosts file doesn't use the search list.
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("Intranet"), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	resp, err := resolver.Query(context.Background(), q)
+	require.NoError(t, err)
+	require.Equal(t, []dnsmessage.Question{q}, resp.Questions)
+	require.Equal(t, []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 10}},
+	}}, resp.Answers)
+
+	ips, err := resolveIP(context.Background(), resolver, dnsmessage.TypeAAAA, "intranet.corp.example")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("2001:db8::10")}, ips)
+
+	// The name is in the hosts file, so the other address type is empty.
+	ips, err = resolveIP(context.Background(), resolver, dnsmessage.TypeAAAA, "mapped.example")
+	require.NoError(t, err)
+	require.Empty(t, ips)
+
+	ptrQ, err := NewQuestion("10.2.0.192.in-addr.arpa", dnsmessage.TypePTR)
+	require.NoError(t, err)
+	resp, err = resolver.Query(context.Background(), *ptrQ)
+	require.NoError(t, err)
+	require.Len(t, resp.Answers, 2)
+	require.Equal(t, dnsmessage.MustNewName("intranet.corp.example."), resp.Answers[0].Body.(*dnsmessage.PTRResource).PTR)
+}
+
+func TestSystemResolver_Search(t *testing.T) {
+	server := newTestUDPServer(t, func(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.ResourceBody) {
+		if q.Name.String() == "www.lab.example." && q.Type == dnsmessage.TypeA {
+			return dnsmessage.RCodeSuccess, []dnsmessage.ResourceBody{&dnsmessage.AResource{A: [4]byte{192, 0, 2, 80}}}
+		}
+		return dnsmessage.RCodeNameError, nil
+	})
+	var mu sync.Mutex
+	var queried []string
+	server.setOnQuery(func(q dnsmessage.Question) {
+		mu.Lock()
+		defer mu.Unlock()
+		queried = append(queried, q.Name.String())
+	})
+	resolver := newTestSystemResolver(t, "search corp.example lab.example\nnameserver 192.0.2.1\n",
+		map[string]*testUDPServer{"192.0.2.1:53": server}, nil)
+
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("www"), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	resp, err := resolver.Query(context.Background(), q)
+	require.NoError(t, err)
+	mu.Lock()
+	require.Equal(t, []string{"www.corp.example.", "www.lab.example."}, queried)
+	queried = nil
+	mu.Unlock()
+	// The response is for the original question, with a CNAME to the name that was found.
+	require.Equal(t, []dnsmessage.Question{q}, resp.Questions)
+	require.Len(t, resp.Answers, 2)
+	require.Equal(t, q.Name, resp.Answers[0].Header.Name)
+	require.Equal(t, &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("www.lab.example.")}, resp.Answers[0].Body)
+	require.Equal(t, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 80}}, resp.Answers[1].Body)
+
+	// Not found anywhere.
+	q.Name = dnsmessage.MustNewName("missing")
+	resp, err = resolver.Query(context.Background(), q)
+	require.NoError(t, err)
+	require.Equal(t, dnsmessage.RCodeNameError, resp.RCode)
+	require.Equal(t, []dnsmessage.Question{q}, resp.Questions)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"missing.corp.example.", "missing.lab.example.", "missing."}, queried)
+}
+
+func TestSystemResolver_Failover(t *testing.T) {
+	failing := newTestUDPServer(t, func(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.ResourceBody) {
+		return dnsmessage.RCodeServerFailure, nil
+	})
+	working := newTestUDPServer(t, func(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.ResourceBody) {
+		return dnsmessage.RCodeSuccess, []dnsmessage.ResourceBody{&dnsmessage.AResource{A: [4]byte{192, 0, 2, 80}}}
+	})
+	var dialed []string
+	// 192.0.2.1 can't be dialed.
+	resolver := newTestSystemResolver(t, "nameserver 192.0.2.1\nnameserver 192.0.2.2\nnameserver 192.0.2.3\n",
+		map[string]*testUDPServer{"192.0.2.2:53": failing, "192.0.2.3:53": working}, &dialed)
+	ips, err := resolveIP(context.Background(), resolver, dnsmessage.TypeA, "www.example")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.80")}, ips)
+	require.Equal(t, []string{"192.0.2.1:53", "192.0.2.2:53", "192.0.2.3:53"}, dialed)
+}
+
+func TestSystemResolver_Attempts(t *testing.T) {
+	failing := newTestUDPServer(t, func(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.ResourceBody) {
+		return dnsmessage.RCodeServerFailure, nil
+	})
+	var dialed []string
+	resolver := newTestSystemResolver(t, "nameserver 192.0.2.1\nnameserver 192.0.2.2\noptions attempts:3\n",
+		map[string]*testUDPServer{"192.0.2.2:53": failing}, &dialed)
+	q, err := NewQuestion("www.example", dnsmessage.TypeA)
+	require.NoError(t, err)
+	resp, err := resolver.Query(context.Background(), *q)
+	require.NoError(t, err)
+	require.Equal(t, dnsmessage.RCodeServerFailure, resp.RCode)
+	require.Equal(t, []string{"192.0.2.1:53", "192.0.2.2:53", "192.0.2.1:53", "192.0.2.2:53", "192.0.2.1:53", "192.0.2.2:53"}, dialed)
+
+	// Only dial errors.
+	dialed = nil
+	resolver = newTestSystemResolver(t, "nameserver 192.0.2.1\noptions attempts:2\n", nil, &dialed)
+	_, err = resolver.Query(context.Background(), *q)
+	require.ErrorIs(t, err, ErrDial)
+	require.Equal(t, []string{"192.0.2.1:53", "192.0.2.1:53"}, dialed)
+}
+
+func TestSystemResolver_Timeout(t *testing.T) {
+	silent := newTestUDPServer(t, nil)
+	working := newTestUDPServer(t, func(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.ResourceBody) {
+		return dnsmessage.RCodeSuccess, []dnsmessage.ResourceBody{&dnsmessage.AResource{A: [4]byte{192, 0, 2, 80}}}
+	})
+	resolver := newTestSystemResolver(t, "nameserver 192.0.2.1\nnameserver 192.0.2.2\noptions timeout:1 attempts:1\n",
+		map[string]*testUDPServer{"192.0.2.1:53": silent, "192.0.2.2:53": working}, nil)
+	start := time.Now()
+	ips, err := resolveIP(context.Background(), resolver, dnsmessage.TypeA, "www.example")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.80")}, ips)
+	require.InDelta(t, time.Second, time.Since(start), float64(500*time.Millisecond))
+}
+
+func TestSystemResolver_Rotate(t *testing.T) {
+	handler := func(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.ResourceBody) {
+		return dnsmessage.RCodeSuccess, []dnsmessage.ResourceBody{&dnsmessage.AResource{A: [4]byte{192, 0, 2, 80}}}
+	}
+	servers := map[string]*testUDPServer{
+		"192.0.2.1:53": newTestUDPServer(t, handler),
+		"192.0.2.2:53": newTestUDPServer(t, handler),
+	}
+	var dialed []string
+	resolver := newTestSystemResolver(t, "nameserver 192.0.2.1\nnameserver 192.0.2.2\noptions rotate\n", servers, &dialed)
+	for i := 0; i < 3; i++ {
+		_, err := resolveIP(context.Background(), resolver, dnsmessage.TypeA, "www.example")
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"192.0.2.1:53", "192.0.2.2:53", "192.0.2.1:53"}, dialed)
+}
+
+func TestSystemResolver_TCP(t *testing.T) {
+	truncating := newTestUDPServer(t, func(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.ResourceBody) {
+		return dnsmessage.RCodeSuccess, nil
+	})
+	truncating.mu.Lock()
+	truncating.truncate = true
+	truncating.mu.Unlock()
+	tcpServer := newTestTCPServer(t)
+	var mu sync.Mutex
+	var tcpDialed []string
+	sd := transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		mu.Lock()
+		tcpDialed = append(tcpDialed, addr)
+		mu.Unlock()
+		return (&transport.TCPDialer{}).DialStream(ctx, tcpServer.Addr())
+	})
+	resolvConf := filepath.Join(t.TempDir(), "resolv.conf")
+	require.NoError(t, os.WriteFile(resolvConf, []byte("nameserver 192.0.2.1\n"), 0644))
+	resolver, err := NewSystemResolver(newTestPacketDialer(map[string]*testUDPServer{"192.0.2.1:53": truncating}, nil), sd,
+		SystemResolverOptions{HostsPath: "testdata/missing", ResolvConfPath: resolvConf})
+	require.NoError(t, err)
+	// Truncated responses are retried over TCP.
+	ips, err := resolveIP(context.Background(), resolver, dnsmessage.TypeA, "www.example")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("127.0.0.1")}, ips)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"192.0.2.1:53"}, tcpDialed)
+}
+
+func TestSystemResolver_Reload(t *testing.T) {
+	first := newTestUDPServer(t, func(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.ResourceBody) {
+		return dnsmessage.RCodeSuccess, []dnsmessage.ResourceBody{&dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}}
+	})
+	second := newTestUDPServer(t, func(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.ResourceBody) {
+		return dnsmessage.RCodeSuccess, []dnsmessage.ResourceBody{&dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}}}
+	})
+	dir := t.TempDir()
+	resolvConf := filepath.Join(dir, "resolv.conf")
+	require.NoError(t, os.WriteFile(resolvConf, []byte("nameserver 192.0.2.1\n"), 0644))
+	pd := newTestPacketDialer(map[string]*testUDPServer{"192.0.2.1:53": first, "192.0.2.2:53": second}, nil)
+	resolver, err := NewSystemResolver(pd, nil, SystemResolverOptions{HostsPath: filepath.Join(dir, "hosts"), ResolvConfPath: resolvConf})
+	require.NoError(t, err)
+	now := time.Now()
+	resolver.(*systemResolver).now = func() time.Time { return now }
+
+	lookup := func() []netip.Addr {
+		ips, err := resolveIP(context.Background(), resolver, dnsmessage.TypeA, "www.example")
+		require.NoError(t, err)
+		return ips
+	}
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.1")}, lookup())
+
+	require.NoError(t, os.WriteFile(resolvConf, []byte("nameserver 192.0.2.2\nnameserver 192.0.2.1\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "hosts"), []byte("192.0.2.3 hosts.example\n"), 0644))
+	// The files are not checked again right away.
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.1")}, lookup())
+
+	now = now.Add(systemConfigCheckInterval)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.2")}, lookup())
+	ips, err := resolveIP(context.Background(), resolver, dnsmessage.TypeA, "hosts.example")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.3")}, ips)
+
+	// A missing file keeps the last configuration.
+	require.NoError(t, os.Remove(resolvConf))
+	now = now.Add(systemConfigCheckInterval)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.2")}, lookup())
+}
+
+func TestNewSystemResolver_Errors(t *testing.T) {
+	_, err := NewSystemResolver(nil, nil, SystemResolverOptions{ResolvConfPath: "testdata/resolv.conf"})
+	require.Error(t, err)
+	_, err = NewSystemResolver(&transport.UDPDialer{}, nil, SystemResolverOptions{ResolvConfPath: "testdata/missing"})
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+/********** Test Utilities **********/
+
+// testUDPServer is a DNS-over-UDP server that answers with its handler, or never answers if the handler is nil.
+type testUDPServer struct {
+	conn    net.PacketConn
+	handler func(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.ResourceBody)
+	mu      sync.Mutex
+	// truncate sets the TC bit in the responses.
+	truncate bool
+	onQuery  func(q dnsmessage.Question)
+}
+
+// setOnQuery sets a function to call with each question, before answering.
+func (s *testUDPServer) setOnQuery(onQuery func(q dnsmessage.Question)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onQuery = onQuery
+}
+
+func newTestUDPServer(t *testing.T, handler func(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.ResourceBody)) *testUDPServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	s := &testUDPServer{conn: conn, handler: handler}
+	go s.serve()
+	return s
+}
+
+func (s *testUDPServer) serve() {
+	buf := make([]byte, maxUDPMessageSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var req dnsmessage.Message
+		if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) != 1 {
+			continue
+		}
+		q := req.Questions[0]
+		s.mu.Lock()
+		onQuery, truncate := s.onQuery, s.truncate
+		s.mu.Unlock()
+		if onQuery != nil {
+			onQuery(q)
+		}
+		if s.handler == nil {
+			continue
+		}
+		rcode, bodies := s.handler(q)
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: req.ID, Response: true, RCode: rcode, Truncated: truncate},
+			Questions: req.Questions,
+		}
+		for _, body := range bodies {
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 100},
+				Body:   body,
+			})
+		}
+		out, err := resp.Pack()
+		if err != nil {
+			continue
+		}
+		s.conn.WriteTo(out, addr)
+	}
+}
+
+// newTestPacketDialer returns a [transport.PacketDialer] that connects to the server for each address, and fails
+// for other addresses. If dialed is not nil, it records the dialed addresses.
+func newTestPacketDialer(servers map[string]*testUDPServer, dialed *[]string) transport.PacketDialer {
+	var mu sync.Mutex
+	return transport.FuncPacketDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		if dialed != nil {
+			mu.Lock()
+			*dialed = append(*dialed, addr)
+			mu.Unlock()
+		}
+		server, ok := servers[addr]
+		if !ok {
+			return nil, errors.New("no route to host")
+		}
+		return (&transport.UDPDialer{}).DialPacket(ctx, server.conn.LocalAddr().String())
+	})
+}
+
+// newTestSystemResolver creates a system resolver with the given resolv.conf content, and no hosts file,
+// that dials the test servers.
+func newTestSystemResolver(t *testing.T, resolvConfContent string, servers map[string]*testUDPServer, dialed *[]string) Resolver {
+	dir := t.TempDir()
+	resolvConf := filepath.Join(dir, "resolv.conf")
+	require.NoError(t, os.WriteFile(resolvConf, []byte(resolvConfContent), 0644))
+	resolver, err := NewSystemResolver(newTestPacketDialer(servers, dialed), nil, SystemResolverOptions{
+		HostsPath:      filepath.Join(dir, "hosts"),
+		ResolvConfPath: resolvConf,
+	})
+	require.NoError(t, err)
+	return resolver
+}
@@ -3,6 +3,7 @@ module github.com/Jigsaw-Code/outline-sdk
 go 1.20
 
 require (
+	github.com/cloudflare/circl v1.3.7
 	github.com/eycorsican/go-tun2socks v1.16.11
 	github.com/google/go-licenses v1.6.0
 	github.com/google/gopacket v1.1.19
@@ -15,12 +15,14 @@
 package network
 
 import (
+	"container/list"
 	"context"
 	"errors"
 	"io"
 	"net"
 	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Jigsaw-Code/outline-sdk/internal/slicepool"
@@ -30,6 +32,9 @@ import (
 // this was the buffer size used before, we may consider update it in the future
 const packetMaxSize = 2048
 
+// defaultWriteIdleTimeout is the idle timeout for ports without a [PortPolicy].
+const defaultWriteIdleTimeout = 30 * time.Second
+
 // packetBufferPool is used to create buffers to read UDP response packets
 var packetBufferPool = slicepool.MakePool(packetMaxSize)
 
@@ -37,31 +42,98 @@ var packetBufferPool = slicepool.MakePool(packetMaxSize)
 var _ PacketProxy = (*PacketListenerProxy)(nil)
 var _ PacketRequestSender = (*packetListenerRequestSender)(nil)
 
+// PortPolicy configures how a [PacketListenerProxy] handles the sessions that send packets to a destination port.
+type PortPolicy struct {
+	// IdleTimeout is the amount of time without WriteTo operations after which the session is closed. If a session
+	// sends packets to multiple ports, the longest timeout among them is used.
+	IdleTimeout time.Duration
+	// SingleResponse closes the session as soon as every request has received a response. It only applies while
+	// all the destinations of the session have SingleResponse set. This is useful for DNS, where each query gets
+	// one response.
+	SingleResponse bool
+}
+
+// PacketListenerProxy is a [PacketProxy] that creates one [net.PacketConn] per session with a
+// [transport.PacketListener]. It keeps track of the active sessions, so it can limit their number and report
+// statistics. Use [NewPacketProxyFromPacketListener] to create new instances.
 type PacketListenerProxy struct {
 	listener         transport.PacketListener
 	writeIdleTimeout time.Duration
+	maxSessions      int
+	portPolicies     map[uint16]PortPolicy
+
+	mu sync.Mutex // Protects the fields below
+	// Active sessions ordered by last WriteTo, most recent first.
+	sessions        list.List
+	totalSessions   int64
+	evictedSessions int64
+	// Bytes of the sessions that are no longer active.
+	closedBytesSent, closedBytesReceived int64
 }
 
 type packetListenerRequestSender struct {
-	mu     sync.Mutex // Protects closed and timer function calls
+	proxy *PacketListenerProxy
+	// Element of proxy.sessions. Protected by proxy.mu.
+	elem      *list.Element
+	proxyConn net.PacketConn
+	startTime time.Time
+
+	mu     sync.Mutex // Protects closed, timer function calls and the fields below
 	closed bool
 
-	proxyConn        net.PacketConn
 	writeIdleTimeout time.Duration
 	writeIdleTimer   *time.Timer
+	lastWriteTime    time.Time
+	// Whether the session only wrote to destinations with PortPolicy.SingleResponse.
+	singleResponse   bool
+	pendingResponses int
+
+	bytesSent, bytesReceived     atomic.Int64
+	packetsSent, packetsReceived atomic.Int64
+}
+
+// PacketSessionStats is a snapshot of the state of a session in a [PacketListenerProxy].
+type PacketSessionStats struct {
+	// LocalAddr is the local address of the underlying [net.PacketConn].
+	LocalAddr net.Addr
+	// StartTime is when the session was created.
+	StartTime time.Time
+	// LastWriteTime is when the session last sent a packet. It's zero if it never did.
+	LastWriteTime time.Time
+	// IdleTimeout is the current write idle timeout of the session.
+	IdleTimeout time.Duration
+
+	BytesSent, BytesReceived     int64
+	PacketsSent, PacketsReceived int64
+}
+
+// PacketListenerProxyStats is a snapshot of the state of a [PacketListenerProxy].
+type PacketListenerProxyStats struct {
+	// Sessions has the active sessions, ordered by last write, most recent first.
+	Sessions []PacketSessionStats
+	// TotalSessions is the number of sessions created by the proxy.
+	TotalSessions int64
+	// EvictedSessions is the number of sessions closed to make room for new ones.
+	EvictedSessions int64
+	// BytesSent and BytesReceived count the payload bytes of all sessions, including the closed ones.
+	BytesSent, BytesReceived int64
 }
 
 // NewPacketProxyFromPacketListener creates a new [PacketProxy] that uses the existing [transport.PacketListener] to
 // create connections to a proxy. You can also specify additional options.
 // This function is useful if you already have an implementation of [transport.PacketListener] and you want to use it
 // with one of the network stacks (for example, network/lwip2transport) as a UDP traffic handler.
+//
+// By default, there's no limit on the number of sessions, and sessions are closed after 30 seconds without writes.
+// Use [WithPacketListenerPortPolicy] to handle some destination ports differently.
 func NewPacketProxyFromPacketListener(pl transport.PacketListener, options ...func(*PacketListenerProxy) error) (*PacketListenerProxy, error) {
 	if pl == nil {
 		return nil, errors.New("pl must not be nil")
 	}
 	p := &PacketListenerProxy{
 		listener:         pl,
-		writeIdleTimeout: 30 * time.Second,
+		writeIdleTimeout: defaultWriteIdleTimeout,
+		portPolicies:     make(map[uint16]PortPolicy),
 	}
 	for _, opt := range options {
 		if err := opt(p); err != nil {
@@ -73,7 +145,7 @@ func NewPacketProxyFromPacketListener(pl transport.PacketListener, options ...fu
 
 // WithPacketListenerWriteIdleTimeout sets the write idle timeout of the [PacketListenerProxy].
 // This means that if there are no WriteTo operations on the UDP session created by NewSession for the specified amount
-// of time, the proxy will end this session.
+// of time, the proxy will end this session. It applies to destination ports without a [PortPolicy].
 //
 // This should be used together with the [NewPacketProxyFromPacketListenerWithOptions] function.
 func WithPacketListenerWriteIdleTimeout(timeout time.Duration) func(*PacketListenerProxy) error {
@@ -86,6 +158,44 @@ func WithPacketListenerWriteIdleTimeout(timeout time.Duration) func(*PacketListe
 	}
 }
 
+// WithPacketListenerMaxSessions limits the number of active sessions of the [PacketListenerProxy]. When the limit is
+// reached, NewSession closes the session that has gone the longest without a WriteTo. Zero means no limit.
+func WithPacketListenerMaxSessions(maxSessions int) func(*PacketListenerProxy) error {
+	return func(p *PacketListenerProxy) error {
+		if maxSessions < 0 {
+			return errors.New("maxSessions must not be negative")
+		}
+		p.maxSessions = maxSessions
+		return nil
+	}
+}
+
+// WithPacketListenerPortPolicy sets the [PortPolicy] for sessions that send packets to the given destination port,
+// replacing any previous policy for that port.
+//
+// For example, DNS sessions can be closed once all queries are answered, or after 10 seconds without writes,
+// as [RFC 4787] allows shorter timeouts for well-known ports:
+//
+//	WithPacketListenerPortPolicy(53, PortPolicy{IdleTimeout: 10 * time.Second, SingleResponse: true})
+//
+// [RFC 4787]: https://datatracker.ietf.org/doc/html/rfc4787#section-4.3
+func WithPacketListenerPortPolicy(port uint16, policy PortPolicy) func(*PacketListenerProxy) error {
+	return func(p *PacketListenerProxy) error {
+		if policy.IdleTimeout <= 0 {
+			return errors.New("policy.IdleTimeout must be greater than 0")
+		}
+		p.portPolicies[port] = policy
+		return nil
+	}
+}
+
+func (proxy *PacketListenerProxy) policyFor(port uint16) PortPolicy {
+	if policy, ok := proxy.portPolicies[port]; ok {
+		return policy
+	}
+	return PortPolicy{IdleTimeout: proxy.writeIdleTimeout}
+}
+
 // NewSession implements [PacketProxy].NewSession function. It uses [transport.PacketListener].ListenPacket to create
 // a [net.PacketConn], and constructs a new [PacketRequestSender] that is based on this [net.PacketConn].
 func (proxy *PacketListenerProxy) NewSession(respWriter PacketResponseReceiver) (PacketRequestSender, error) {
@@ -97,7 +207,9 @@ func (proxy *PacketListenerProxy) NewSession(respWriter PacketResponseReceiver)
 		return nil, err
 	}
 	reqSender := &packetListenerRequestSender{
+		proxy:            proxy,
 		proxyConn:        proxyConn,
+		startTime:        time.Now(),
 		writeIdleTimeout: proxy.writeIdleTimeout,
 	}
 
@@ -106,6 +218,10 @@ func (proxy *PacketListenerProxy) NewSession(respWriter PacketResponseReceiver)
 		reqSender.Close()
 	})
 
+	if evicted := proxy.addSession(reqSender); evicted != nil {
+		evicted.Close()
+	}
+
 	// Relay incoming UDP responses from the proxy asynchronously until EOF, session expiration or error
 	go func() {
 		defer respWriter.Close()
@@ -127,44 +243,158 @@ func (proxy *PacketListenerProxy) NewSession(respWriter PacketResponseReceiver)
 			if _, err := respWriter.WriteFrom(buf[:n], srcAddr); err != nil {
 				return
 			}
+			reqSender.bytesReceived.Add(int64(n))
+			reqSender.packetsReceived.Add(1)
+			if reqSender.onResponse() {
+				reqSender.Close()
+				return
+			}
 		}
 	}()
 
 	return reqSender, nil
 }
 
+// addSession registers the new session, returning the session to evict, if any.
+func (proxy *PacketListenerProxy) addSession(s *packetListenerRequestSender) *packetListenerRequestSender {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	proxy.totalSessions++
+	var evicted *packetListenerRequestSender
+	if proxy.maxSessions > 0 && proxy.sessions.Len() >= proxy.maxSessions {
+		evicted = proxy.sessions.Remove(proxy.sessions.Back()).(*packetListenerRequestSender)
+		evicted.elem = nil
+		proxy.evictedSessions++
+	}
+	s.elem = proxy.sessions.PushFront(s)
+	return evicted
+}
+
+// touchSession marks the session as the most recently active.
+func (proxy *PacketListenerProxy) touchSession(s *packetListenerRequestSender) {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if s.elem != nil {
+		proxy.sessions.MoveToFront(s.elem)
+	}
+}
+
+// removeSession unregisters the closed session and accounts for its bytes.
+func (proxy *PacketListenerProxy) removeSession(s *packetListenerRequestSender) {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if s.elem != nil {
+		proxy.sessions.Remove(s.elem)
+		s.elem = nil
+	}
+	proxy.closedBytesSent += s.bytesSent.Load()
+	proxy.closedBytesReceived += s.bytesReceived.Load()
+}
+
+// Stats returns a snapshot of the active sessions and traffic of the [PacketListenerProxy].
+func (proxy *PacketListenerProxy) Stats() PacketListenerProxyStats {
+	proxy.mu.Lock()
+	stats := PacketListenerProxyStats{
+		TotalSessions:   proxy.totalSessions,
+		EvictedSessions: proxy.evictedSessions,
+		BytesSent:       proxy.closedBytesSent,
+		BytesReceived:   proxy.closedBytesReceived,
+	}
+	sessions := make([]*packetListenerRequestSender, 0, proxy.sessions.Len())
+	for e := proxy.sessions.Front(); e != nil; e = e.Next() {
+		sessions = append(sessions, e.Value.(*packetListenerRequestSender))
+	}
+	proxy.mu.Unlock()
+
+	stats.Sessions = make([]PacketSessionStats, 0, len(sessions))
+	for _, s := range sessions {
+		sessionStats := s.stats()
+		stats.BytesSent += sessionStats.BytesSent
+		stats.BytesReceived += sessionStats.BytesReceived
+		stats.Sessions = append(stats.Sessions, sessionStats)
+	}
+	return stats
+}
+
+func (s *packetListenerRequestSender) stats() PacketSessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return PacketSessionStats{
+		LocalAddr:       s.proxyConn.LocalAddr(),
+		StartTime:       s.startTime,
+		LastWriteTime:   s.lastWriteTime,
+		IdleTimeout:     s.writeIdleTimeout,
+		BytesSent:       s.bytesSent.Load(),
+		BytesReceived:   s.bytesReceived.Load(),
+		PacketsSent:     s.packetsSent.Load(),
+		PacketsReceived: s.packetsReceived.Load(),
+	}
+}
+
 // WriteTo implements [PacketRequestSender].WriteTo function. It simply forwards the packet to the underlying
 // [net.PacketConn].WriteTo function.
 func (s *packetListenerRequestSender) WriteTo(p []byte, destination netip.AddrPort) (int, error) {
-	if err := s.resetWriteIdleTimer(); err != nil {
+	if err := s.onRequest(s.proxy.policyFor(destination.Port())); err != nil {
 		return 0, err
 	}
-	return s.proxyConn.WriteTo(p, net.UDPAddrFromAddrPort(destination))
+	s.proxy.touchSession(s)
+	n, err := s.proxyConn.WriteTo(p, net.UDPAddrFromAddrPort(destination))
+	s.bytesSent.Add(int64(n))
+	if err == nil {
+		s.packetsSent.Add(1)
+	}
+	return n, err
 }
 
 // Close implements [PacketRequestSender].Close function. It closes the underlying [net.PacketConn]. This will also
 // terminate the goroutine created in NewSession because s.conn.ReadFrom will return [io.EOF].
 func (s *packetListenerRequestSender) Close() error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	if s.closed {
+		s.mu.Unlock()
 		return ErrClosed
 	}
 	s.closed = true
 	s.writeIdleTimer.Stop()
-	return s.proxyConn.Close()
+	err := s.proxyConn.Close()
+	s.mu.Unlock()
+
+	s.proxy.removeSession(s)
+	return err
 }
 
-// resetWriteIdleTimer extends the writeIdleTimer's timeout to now() + writeIdleTimeout. If `s` is closed, it will
-// return ErrClosed.
-func (s *packetListenerRequestSender) resetWriteIdleTimer() error {
+// onRequest applies the policy of the request destination and extends the writeIdleTimer's timeout to
+// now() + writeIdleTimeout. If `s` is closed, it will return ErrClosed.
+func (s *packetListenerRequestSender) onRequest(policy PortPolicy) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.closed {
 		return ErrClosed
 	}
+	if s.lastWriteTime.IsZero() {
+		s.writeIdleTimeout = policy.IdleTimeout
+		s.singleResponse = policy.SingleResponse
+	} else {
+		if policy.IdleTimeout > s.writeIdleTimeout {
+			s.writeIdleTimeout = policy.IdleTimeout
+		}
+		s.singleResponse = s.singleResponse && policy.SingleResponse
+	}
+	s.pendingResponses++
+	s.lastWriteTime = time.Now()
 	s.writeIdleTimer.Reset(s.writeIdleTimeout)
 	return nil
 }
+
+// onResponse accounts for a received response, and returns whether the session is done and should be closed.
+func (s *packetListenerRequestSender) onResponse() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.singleResponse || s.pendingResponses == 0 {
+		return false
+	}
+	s.pendingResponses--
+	return s.pendingResponses == 0
+}
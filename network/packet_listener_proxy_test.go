@@ -15,6 +15,10 @@
 package network
 
 import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
 	"testing"
 	"time"
 
@@ -34,4 +38,297 @@ func TestWithWriteTimeoutOptionWorks(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, altProxy)
 	require.Equal(t, 5*time.Minute, altProxy.writeIdleTimeout)
+
+	_, err = NewPacketProxyFromPacketListener(pl, WithPacketListenerWriteIdleTimeout(0))
+	require.Error(t, err)
+}
+
+func TestInvalidOptions(t *testing.T) {
+	pl := &transport.UDPListener{}
+	_, err := NewPacketProxyFromPacketListener(pl, WithPacketListenerMaxSessions(-1))
+	require.Error(t, err)
+	_, err = NewPacketProxyFromPacketListener(pl, WithPacketListenerPortPolicy(123, PortPolicy{}))
+	require.Error(t, err)
+}
+
+func TestMaxSessionsEvictsLeastRecentlyUsed(t *testing.T) {
+	pl := &fakePacketListener{}
+	proxy, err := NewPacketProxyFromPacketListener(pl, WithPacketListenerMaxSessions(2))
+	require.NoError(t, err)
+
+	dst := netip.MustParseAddrPort("192.0.2.1:443")
+	recv1, recv2, recv3 := newFakeResponseReceiver(), newFakeResponseReceiver(), newFakeResponseReceiver()
+	s1, err := proxy.NewSession(recv1)
+	require.NoError(t, err)
+	s2, err := proxy.NewSession(recv2)
+	require.NoError(t, err)
+	// Writing to the first session makes the second one the least recently used.
+	_, err = s1.WriteTo([]byte("a"), dst)
+	require.NoError(t, err)
+	_, err = s2.WriteTo([]byte("b"), dst)
+	require.NoError(t, err)
+	_, err = s1.WriteTo([]byte("c"), dst)
+	require.NoError(t, err)
+
+	s3, err := proxy.NewSession(recv3)
+	require.NoError(t, err)
+	defer s3.Close()
+	defer s1.Close()
+
+	recv2.waitClosed(t)
+	require.True(t, pl.conns[1].isClosed())
+	require.False(t, pl.conns[0].isClosed())
+	_, err = s2.WriteTo([]byte("d"), dst)
+	require.ErrorIs(t, err, ErrClosed)
+
+	stats := proxy.Stats()
+	require.Equal(t, int64(3), stats.TotalSessions)
+	require.Equal(t, int64(1), stats.EvictedSessions)
+	require.Len(t, stats.Sessions, 2)
+	require.Equal(t, pl.conns[2].LocalAddr(), stats.Sessions[0].LocalAddr)
+	require.Equal(t, pl.conns[0].LocalAddr(), stats.Sessions[1].LocalAddr)
+}
+
+func TestDNSSessionClosesAfterResponse(t *testing.T) {
+	pl := &fakePacketListener{}
+	proxy, err := NewPacketProxyFromPacketListener(pl, WithPacketListenerPortPolicy(53, testDNSPolicy))
+	require.NoError(t, err)
+
+	recv := newFakeResponseReceiver()
+	s, err := proxy.NewSession(recv)
+	require.NoError(t, err)
+	resolver := netip.MustParseAddrPort("192.0.2.53:53")
+	_, err = s.WriteTo([]byte("query1"), resolver)
+	require.NoError(t, err)
+	_, err = s.WriteTo([]byte("query2"), resolver)
+	require.NoError(t, err)
+	require.Equal(t, testDNSPolicy.IdleTimeout, proxy.Stats().Sessions[0].IdleTimeout)
+
+	conn := pl.conns[0]
+	conn.respond([]byte("response1"), resolver)
+	require.Equal(t, []byte("response1"), recv.read(t))
+	require.False(t, conn.isClosed())
+
+	conn.respond([]byte("response2"), resolver)
+	require.Equal(t, []byte("response2"), recv.read(t))
+	recv.waitClosed(t)
+	require.True(t, conn.isClosed())
+	require.Empty(t, proxy.Stats().Sessions)
+}
+
+func TestDNSSessionWithoutPolicy(t *testing.T) {
+	pl := &fakePacketListener{}
+	proxy, err := NewPacketProxyFromPacketListener(pl)
+	require.NoError(t, err)
+
+	recv := newFakeResponseReceiver()
+	s, err := proxy.NewSession(recv)
+	require.NoError(t, err)
+	defer s.Close()
+	resolver := netip.MustParseAddrPort("192.0.2.53:53")
+	_, err = s.WriteTo([]byte("query"), resolver)
+	require.NoError(t, err)
+	require.Equal(t, defaultWriteIdleTimeout, proxy.Stats().Sessions[0].IdleTimeout)
+
+	// Without a policy, the session stays open for more queries after the response.
+	pl.conns[0].respond([]byte("response"), resolver)
+	require.Equal(t, []byte("response"), recv.read(t))
+	require.False(t, pl.conns[0].isClosed())
+}
+
+func TestMixedSessionIsNotSingleResponse(t *testing.T) {
+	pl := &fakePacketListener{}
+	proxy, err := NewPacketProxyFromPacketListener(pl, WithPacketListenerPortPolicy(53, testDNSPolicy))
+	require.NoError(t, err)
+
+	recv := newFakeResponseReceiver()
+	s, err := proxy.NewSession(recv)
+	require.NoError(t, err)
+	defer s.Close()
+	resolver := netip.MustParseAddrPort("192.0.2.53:53")
+	_, err = s.WriteTo([]byte("query"), resolver)
+	require.NoError(t, err)
+	_, err = s.WriteTo([]byte("data"), netip.MustParseAddrPort("192.0.2.1:443"))
+	require.NoError(t, err)
+	require.Equal(t, defaultWriteIdleTimeout, proxy.Stats().Sessions[0].IdleTimeout)
+
+	pl.conns[0].respond([]byte("response"), resolver)
+	require.Equal(t, []byte("response"), recv.read(t))
+	require.False(t, pl.conns[0].isClosed())
+}
+
+// testDNSPolicy is the policy suggested for DNS in the WithPacketListenerPortPolicy docs.
+var testDNSPolicy = PortPolicy{IdleTimeout: 10 * time.Second, SingleResponse: true}
+
+func TestPortPolicyIdleTimeout(t *testing.T) {
+	pl := &fakePacketListener{}
+	proxy, err := NewPacketProxyFromPacketListener(pl,
+		WithPacketListenerPortPolicy(123, PortPolicy{IdleTimeout: 10 * time.Millisecond}))
+	require.NoError(t, err)
+
+	recvNTP, recvOther := newFakeResponseReceiver(), newFakeResponseReceiver()
+	ntpSession, err := proxy.NewSession(recvNTP)
+	require.NoError(t, err)
+	otherSession, err := proxy.NewSession(recvOther)
+	require.NoError(t, err)
+	defer otherSession.Close()
+
+	_, err = ntpSession.WriteTo([]byte("ntp"), netip.MustParseAddrPort("192.0.2.123:123"))
+	require.NoError(t, err)
+	_, err = otherSession.WriteTo([]byte("data"), netip.MustParseAddrPort("192.0.2.1:443"))
+	require.NoError(t, err)
+
+	recvNTP.waitClosed(t)
+	require.True(t, pl.conns[0].isClosed())
+	require.False(t, pl.conns[1].isClosed())
+}
+
+func TestStats(t *testing.T) {
+	pl := &fakePacketListener{}
+	proxy, err := NewPacketProxyFromPacketListener(pl)
+	require.NoError(t, err)
+
+	recv := newFakeResponseReceiver()
+	s, err := proxy.NewSession(recv)
+	require.NoError(t, err)
+	dst := netip.MustParseAddrPort("192.0.2.1:443")
+	_, err = s.WriteTo([]byte("12345"), dst)
+	require.NoError(t, err)
+	_, err = s.WriteTo([]byte("678"), dst)
+	require.NoError(t, err)
+	pl.conns[0].respond([]byte("abcd"), dst)
+	recv.read(t)
+
+	stats := proxy.Stats()
+	require.Len(t, stats.Sessions, 1)
+	session := stats.Sessions[0]
+	require.Equal(t, int64(8), session.BytesSent)
+	require.Equal(t, int64(2), session.PacketsSent)
+	require.Equal(t, int64(4), session.BytesReceived)
+	require.Equal(t, int64(1), session.PacketsReceived)
+	require.Equal(t, defaultWriteIdleTimeout, session.IdleTimeout)
+	require.False(t, session.LastWriteTime.Before(session.StartTime))
+	require.Equal(t, int64(8), stats.BytesSent)
+	require.Equal(t, int64(4), stats.BytesReceived)
+
+	// Closed sessions still count towards the totals.
+	require.NoError(t, s.Close())
+	recv.waitClosed(t)
+	stats = proxy.Stats()
+	require.Empty(t, stats.Sessions)
+	require.Equal(t, int64(1), stats.TotalSessions)
+	require.Equal(t, int64(8), stats.BytesSent)
+	require.Equal(t, int64(4), stats.BytesReceived)
+}
+
+/********** Test Utilities **********/
+
+type fakePacketListener struct {
+	conns []*fakePacketConn
+}
+
+var _ transport.PacketListener = (*fakePacketListener)(nil)
+
+func (pl *fakePacketListener) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	conn := &fakePacketConn{
+		localAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000 + len(pl.conns)},
+		responses: make(chan fakePacket, 10),
+		closed:    make(chan struct{}),
+	}
+	pl.conns = append(pl.conns, conn)
+	return conn, nil
+}
+
+type fakePacket struct {
+	payload []byte
+	addr    net.Addr
+}
+
+type fakePacketConn struct {
+	net.PacketConn // Panics for unimplemented methods
+	localAddr      net.Addr
+	responses      chan fakePacket
+	closeOnce      sync.Once
+	closed         chan struct{}
+}
+
+func (c *fakePacketConn) respond(payload []byte, src netip.AddrPort) {
+	c.responses <- fakePacket{payload, net.UDPAddrFromAddrPort(src)}
+}
+
+func (c *fakePacketConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *fakePacketConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *fakePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.responses:
+		return copy(p, pkt.payload), pkt.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *fakePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	return len(p), nil
+}
+
+func (c *fakePacketConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = nil
+	})
+	return err
+}
+
+type fakeResponseReceiver struct {
+	packets chan []byte
+	closed  chan struct{}
+}
+
+var _ PacketResponseReceiver = (*fakeResponseReceiver)(nil)
+
+func newFakeResponseReceiver() *fakeResponseReceiver {
+	return &fakeResponseReceiver{packets: make(chan []byte, 10), closed: make(chan struct{})}
+}
+
+func (r *fakeResponseReceiver) WriteFrom(p []byte, source net.Addr) (int, error) {
+	r.packets <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (r *fakeResponseReceiver) Close() error {
+	close(r.closed)
+	return nil
+}
+
+func (r *fakeResponseReceiver) read(t *testing.T) []byte {
+	select {
+	case p := <-r.packets:
+		return p
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "timed out waiting for response")
+		return nil
+	}
+}
+
+func (r *fakeResponseReceiver) waitClosed(t *testing.T) {
+	select {
+	case <-r.closed:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "timed out waiting for receiver to close")
+	}
 }
@@ -0,0 +1,44 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.23
+
+package tls
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithECHConfigList(t *testing.T) {
+	var cfg ClientConfig
+	WithECHConfigList([]byte{1, 2, 3})("", &cfg)
+	require.Equal(t, []byte{1, 2, 3}, cfg.ECHConfigList)
+	require.Equal(t, uint16(tls.VersionTLS13), cfg.toStdConfig().MinVersion)
+}
+
+func TestServiceHints_ECH(t *testing.T) {
+	hellos := listenClientHellos(t)
+	sd, err := NewStreamDialer(&transport.TCPDialer{})
+	require.NoError(t, err)
+
+	// The ECH configuration is used.
+	ctx := ContextWithServiceHints(context.Background(), ServiceHints{Address: hellos.addr, ECHConfigList: []byte{0, 1, 2}})
+	_, err = sd.DialStream(ctx, hellos.addr)
+	require.ErrorContains(t, err, "ECHConfig")
+}
@@ -0,0 +1,75 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tls
+
+import "context"
+
+// ServiceHints are parameters of a TLS server learned outside of TLS, for example from the DNS [HTTPS records]
+// of the server. Dialers that resolve host names add them to the context of the connections they dial,
+// so that a [StreamDialer] dialing the resolved IP address can still use the original host name, and the
+// protocols and Encrypted Client Hello configuration the server advertises.
+//
+// [HTTPS records]: https://datatracker.ietf.org/doc/html/rfc9460
+type ServiceHints struct {
+	// Address is the address being dialed. The hints only apply to connections to that address, not to
+	// connections that a proxy dialer makes with the same context.
+	Address string
+	// ServerName is the host name for the SNI and the certificate validation. Empty means the dialed host.
+	ServerName string
+	// ALPN is the list of protocols the server supports. If the StreamDialer has ALPN configured, it only offers
+	// the configured protocols that the server supports. It doesn't add protocols the application may not speak.
+	ALPN []string
+	// ECHConfigList is the serialized ECHConfigList of the server. It's used if the StreamDialer has none configured,
+	// and ECH is supported.
+	ECHConfigList []byte
+}
+
+type serviceHintsKey struct{}
+
+// ContextWithServiceHints returns a copy of ctx that carries the hints.
+func ContextWithServiceHints(ctx context.Context, hints ServiceHints) context.Context {
+	return context.WithValue(ctx, serviceHintsKey{}, hints)
+}
+
+// ServiceHintsFromContext returns the hints carried by ctx, if any.
+func ServiceHintsFromContext(ctx context.Context) (ServiceHints, bool) {
+	hints, ok := ctx.Value(serviceHintsKey{}).(ServiceHints)
+	return hints, ok
+}
+
+// withServiceHints applies the hints to the configuration. It must go after the other options.
+func withServiceHints(hints ServiceHints) ClientOption {
+	return func(_ string, config *ClientConfig) {
+		if len(config.NextProtos) > 0 && len(hints.ALPN) > 0 {
+			var supported []string
+			for _, proto := range config.NextProtos {
+				for _, hint := range hints.ALPN {
+					if hint == proto {
+						supported = append(supported, proto)
+						break
+					}
+				}
+			}
+			// If the server supports none, let the handshake fail with the configured protocols.
+			if len(supported) > 0 {
+				config.NextProtos = supported
+			}
+		}
+		// Without ECH support, connect without it, rather than fail the connections the server accepts otherwise.
+		if config.ECHConfigList == nil && echSupported {
+			config.ECHConfigList = hints.ECHConfigList
+		}
+	}
+}
@@ -68,11 +68,18 @@ func (d *StreamDialer) DialStream(ctx context.Context, remoteAddr string) (trans
 	if err != nil {
 		return nil, fmt.Errorf("invalid address: %w", err)
 	}
+	options := d.options
+	if hints, ok := ServiceHintsFromContext(ctx); ok && hints.Address == remoteAddr {
+		if hints.ServerName != "" {
+			host = hints.ServerName
+		}
+		options = append(d.options[:len(d.options):len(d.options)], withServiceHints(hints))
+	}
 	innerConn, err := d.dialer.DialStream(ctx, remoteAddr)
 	if err != nil {
 		return nil, err
 	}
-	conn, err := WrapConn(ctx, innerConn, host, d.options...)
+	conn, err := WrapConn(ctx, innerConn, host, options...)
 	if err != nil {
 		innerConn.Close()
 		return nil, err
@@ -94,11 +101,14 @@ type ClientConfig struct {
 	NextProtos []string
 	// The cache for sessin resumption.
 	SessionCache tls.ClientSessionCache
+	// The serialized ECHConfigList for Encrypted Client Hello (ECH). If set, the connection requires TLS 1.3.
+	// ECH needs Go 1.23 or later. With earlier versions, connections with an ECHConfigList fail.
+	ECHConfigList []byte
 }
 
 // toStdConfig creates a [tls.Config] based on the configured parameters.
 func (cfg *ClientConfig) toStdConfig() *tls.Config {
-	return &tls.Config{
+	stdConfig := &tls.Config{
 		ServerName:         cfg.ServerName,
 		NextProtos:         cfg.NextProtos,
 		ClientSessionCache: cfg.SessionCache,
@@ -121,6 +131,10 @@ func (cfg *ClientConfig) toStdConfig() *tls.Config {
 			return err
 		},
 	}
+	if cfg.ECHConfigList != nil {
+		setECHConfigList(stdConfig, cfg.ECHConfigList)
+	}
+	return stdConfig
 }
 
 // ClientOption allows configuring the parameters to be used for a client TLS connection.
@@ -133,6 +147,9 @@ func WrapConn(ctx context.Context, conn transport.StreamConn, serverName string,
 	for _, option := range options {
 		option(normName, &cfg)
 	}
+	if cfg.ECHConfigList != nil && !echSupported {
+		return nil, errors.New("Encrypted Client Hello requires Go 1.23 or later")
+	}
 	tlsConn := tls.Client(conn, cfg.toStdConfig())
 	err := tlsConn.HandshakeContext(ctx)
 	if err != nil {
@@ -188,3 +205,13 @@ func WithCertificateName(hostname string) ClientOption {
 		config.CertificateName = hostname
 	}
 }
+
+// WithECHConfigList sets the serialized ECHConfigList to use [Encrypted Client Hello] (ECH), which encrypts the
+// SNI and the rest of the ClientHello. Servers publish their list in DNS HTTPS records. It needs Go 1.23 or later.
+//
+// [Encrypted Client Hello]: https://datatracker.ietf.org/doc/draft-ietf-tls-esni/
+func WithECHConfigList(echConfigList []byte) ClientOption {
+	return func(_ string, config *ClientConfig) {
+		config.ECHConfigList = echConfigList
+	}
+}
@@ -16,7 +16,10 @@ package tls
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"net"
 	"testing"
 
 	"github.com/Jigsaw-Code/outline-sdk/transport"
@@ -140,6 +143,38 @@ func TestWithALPN(t *testing.T) {
 	require.Equal(t, []string{"h2", "http/1.1"}, cfg.NextProtos)
 }
 
+func TestServiceHints(t *testing.T) {
+	hellos := listenClientHellos(t)
+	addr := hellos.addr
+	sd, err := NewStreamDialer(&transport.TCPDialer{}, WithALPN([]string{"h2", "http/1.1"}))
+	require.NoError(t, err)
+
+	// The hints apply to the address they are for.
+	ctx := ContextWithServiceHints(context.Background(), ServiceHints{Address: addr, ServerName: "example.com", ALPN: []string{"h3", "h2"}})
+	_, err = sd.DialStream(ctx, addr)
+	require.Error(t, err)
+	hello := <-hellos.ch
+	require.Equal(t, "example.com", hello.ServerName)
+	require.Equal(t, []string{"h2"}, hello.SupportedProtos)
+
+	// The hints don't apply to other addresses, such as a proxy.
+	ctx = ContextWithServiceHints(context.Background(), ServiceHints{Address: "192.0.2.1:443", ServerName: "example.com", ALPN: []string{"h2"}})
+	_, err = sd.DialStream(ctx, addr)
+	require.Error(t, err)
+	hello = <-hellos.ch
+	require.Equal(t, "", hello.ServerName)
+	require.Equal(t, []string{"h2", "http/1.1"}, hello.SupportedProtos)
+
+	// The hints don't add protocols that are not configured.
+	sd, err = NewStreamDialer(&transport.TCPDialer{})
+	require.NoError(t, err)
+	ctx = ContextWithServiceHints(context.Background(), ServiceHints{Address: addr, ServerName: "example.com", ALPN: []string{"h2"}})
+	_, err = sd.DialStream(ctx, addr)
+	require.Error(t, err)
+	hello = <-hellos.ch
+	require.Empty(t, hello.SupportedProtos)
+}
+
 // Make sure there are no connection leakage in DialStream
 func TestDialStreamCloseInnerConnOnError(t *testing.T) {
 	inner := &connCounterDialer{base: &transport.TCPDialer{}}
@@ -153,6 +188,38 @@ func TestDialStreamCloseInnerConnOnError(t *testing.T) {
 
 // Private test helpers
 
+// clientHelloListener is a TLS server that records the ClientHellos it receives, and then aborts the handshake.
+type clientHelloListener struct {
+	addr string
+	ch   chan *tls.ClientHelloInfo
+}
+
+func listenClientHellos(t *testing.T) *clientHelloListener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	hellos := &clientHelloListener{addr: listener.Addr().String(), ch: make(chan *tls.ClientHelloInfo, 1)}
+	config := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			hellos.ch <- hello
+			return nil, errors.New("handshake aborted")
+		},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tls.Server(conn, config).Handshake()
+			}()
+		}
+	}()
+	return hellos
+}
+
 // connCounterDialer is a StreamDialer that counts the number of active StreamConns.
 type connCounterDialer struct {
 	base        transport.StreamDialer
@@ -16,15 +16,18 @@ package configurl
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/Jigsaw-Code/outline-sdk/dns"
 	"github.com/Jigsaw-Code/outline-sdk/transport"
-	"golang.org/x/net/dns/dnsmessage"
+	"github.com/Jigsaw-Code/outline-sdk/x/dnsquic"
 )
 
 func registerDO53StreamDialer(r TypeRegistry[transport.StreamDialer], typeID string, newSD BuildFunc[transport.StreamDialer], newPD BuildFunc[transport.PacketDialer]) {
@@ -48,7 +51,7 @@ func registerDO53StreamDialer(r TypeRegistry[transport.StreamDialer], typeID str
 	})
 }
 
-func registerDOHStreamDialer(r TypeRegistry[transport.StreamDialer], typeID string, newSD BuildFunc[transport.StreamDialer]) {
+func registerDOHStreamDialer(r TypeRegistry[transport.StreamDialer], typeID string, newSD BuildFunc[transport.StreamDialer], newPD BuildFunc[transport.PacketDialer]) {
 	r.RegisterType(typeID, func(ctx context.Context, config *Config) (transport.StreamDialer, error) {
 		if config == nil {
 			return nil, fmt.Errorf("emtpy doh config")
@@ -57,7 +60,48 @@ func registerDOHStreamDialer(r TypeRegistry[transport.StreamDialer], typeID stri
 		if err != nil {
 			return nil, err
 		}
-		resolver, err := newDOHResolver(config.URL, sd)
+		newPacketDialer := func() (transport.PacketDialer, error) {
+			return newPD(ctx, config.BaseConfig)
+		}
+		resolver, err := newDOHResolver(config.URL, sd, newPacketDialer)
+		if err != nil {
+			return nil, err
+		}
+		return dns.NewStreamDialer(resolver, sd)
+	})
+}
+
+func registerODOHStreamDialer(r TypeRegistry[transport.StreamDialer], typeID string, newSD BuildFunc[transport.StreamDialer]) {
+	r.RegisterType(typeID, func(ctx context.Context, config *Config) (transport.StreamDialer, error) {
+		if config == nil {
+			return nil, fmt.Errorf("empty odoh config")
+		}
+		sd, err := newSD(ctx, config.BaseConfig)
+		if err != nil {
+			return nil, err
+		}
+		resolver, err := newODOHResolver(config.URL, sd)
+		if err != nil {
+			return nil, err
+		}
+		return dns.NewStreamDialer(resolver, sd)
+	})
+}
+
+func registerDOQStreamDialer(r TypeRegistry[transport.StreamDialer], typeID string, newSD BuildFunc[transport.StreamDialer], newPD BuildFunc[transport.PacketDialer]) {
+	r.RegisterType(typeID, func(ctx context.Context, config *Config) (transport.StreamDialer, error) {
+		if config == nil {
+			return nil, fmt.Errorf("empty doq config")
+		}
+		sd, err := newSD(ctx, config.BaseConfig)
+		if err != nil {
+			return nil, err
+		}
+		pd, err := newPD(ctx, config.BaseConfig)
+		if err != nil {
+			return nil, err
+		}
+		resolver, err := newDOQResolver(config.URL, pd)
 		if err != nil {
 			return nil, err
 		}
@@ -71,79 +115,334 @@ func newDO53Resolver(config url.URL, sd transport.StreamDialer, pd transport.Pac
 	if err != nil {
 		return nil, err
 	}
-	var address string
+	var addresses []string
+	var combine resolverCombination
+	var ednsOpts dns.EDNS0Options
 	for key, values := range values {
 		switch strings.ToLower(key) {
 		case "address":
-			if len(values) != 1 {
-				return nil, fmt.Errorf("address option must has one value, found %v", len(values))
-			}
-			address = values[0]
+			addresses = append(addresses, values...)
 		default:
-			return nil, fmt.Errorf("unsupported option %v", key)
-
+			ok, err := combine.parseOption(strings.ToLower(key), values)
+			if !ok && err == nil {
+				ok, err = parseEDNS0Option(&ednsOpts, strings.ToLower(key), values)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, fmt.Errorf("unsupported option %v", key)
+			}
 		}
 	}
-	if address == "" {
+	if len(addresses) == 0 {
 		return nil, errors.New("must set an address")
 	}
-	_, _, err = net.SplitHostPort(address)
+	newResolver := func(address string) (dns.Resolver, error) {
+		return newDO53ServerResolver(address, sd, pd, ednsOpts)
+	}
+	resolvers := make([]dns.Resolver, 0, len(addresses))
+	for _, address := range addresses {
+		resolver, err := newResolver(address)
+		if err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, resolver)
+	}
+	return combine.apply(resolvers, newResolver)
+}
+
+// newDO53ServerResolver creates a resolver that queries the address over UDP, and retries over TCP if the
+// response is truncated. The EDNS(0) options apply to both.
+func newDO53ServerResolver(address string, sd transport.StreamDialer, pd transport.PacketDialer, ednsOpts dns.EDNS0Options) (dns.Resolver, error) {
+	_, _, err := net.SplitHostPort(address)
 	if err != nil {
 		address = net.JoinHostPort(address, "53")
 	}
-	udpResolver := dns.NewUDPResolver(pd, address)
-	tcpResolver := dns.NewTCPResolver(sd, address)
-	resolver := dns.FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
-		msg, err := udpResolver.Query(ctx, q)
+	// A single resolver for both transports, so they share the DNS cookies.
+	return wrapEDNS0Resolver(dns.NewDO53Resolver(pd, sd, address), ednsOpts)
+}
+
+// parseEDNS0Option parses the EDNS(0) options shared by the do53 and doh configs into opts.
+// It returns false if key is not one of them.
+func parseEDNS0Option(opts *dns.EDNS0Options, key string, values []string) (bool, error) {
+	switch key {
+	case "padding", "ecs", "cookies":
+	default:
+		return false, nil
+	}
+	if len(values) != 1 {
+		return true, fmt.Errorf("%v option must has one value, found %v", key, len(values))
+	}
+	value := values[0]
+	switch key {
+	case "padding":
+		// Either the block size, or a boolean for the recommended block size.
+		if enabled, err := strconv.ParseBool(value); err == nil {
+			opts.PaddingBlockSize = 0
+			if enabled {
+				opts.PaddingBlockSize = dns.RecommendedPaddingBlockSize
+			}
+			return true, nil
+		}
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			return true, fmt.Errorf("invalid padding option %v", value)
+		}
+		opts.PaddingBlockSize = size
+	case "ecs":
+		if strings.ToLower(value) == "off" {
+			// A zero-length prefix asks the resolver not to send the client subnet.
+			opts.ClientSubnet = netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+			return true, nil
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return true, fmt.Errorf("invalid ecs option: %w", err)
+		}
+		opts.ClientSubnet = prefix
+	case "cookies":
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return true, fmt.Errorf("invalid cookies option: %w", err)
+		}
+		opts.Cookies = enabled
+	}
+	return true, nil
+}
+
+// wrapEDNS0Resolver applies opts to resolver, unless they are the default ones.
+func wrapEDNS0Resolver(resolver dns.Resolver, opts dns.EDNS0Options) (dns.Resolver, error) {
+	if opts == (dns.EDNS0Options{}) {
+		return resolver, nil
+	}
+	return dns.NewEDNS0Resolver(resolver, opts)
+}
+
+// resolverCombination holds the options that combine the resolvers of the do53 and doh configs.
+type resolverCombination struct {
+	// race makes the resolvers race, instead of being tried in order.
+	race bool
+	// routes are the domains to send to other resolvers, as DOMAIN:ADDRESS.
+	routes []string
+}
+
+// parseOption parses key into c. It returns false if key is not one of the options.
+func (c *resolverCombination) parseOption(key string, values []string) (bool, error) {
+	switch key {
+	case "race":
+		if len(values) != 1 {
+			return true, fmt.Errorf("race option must has one value, found %v", len(values))
+		}
+		race, err := strconv.ParseBool(values[0])
+		if err != nil {
+			return true, fmt.Errorf("invalid race option: %w", err)
+		}
+		c.race = race
+		return true, nil
+	case "route":
+		c.routes = append(c.routes, values...)
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// apply combines the resolvers, and adds the routes, with resolvers created by newRouteResolver.
+func (c *resolverCombination) apply(resolvers []dns.Resolver, newRouteResolver func(address string) (dns.Resolver, error)) (dns.Resolver, error) {
+	resolver := resolvers[0]
+	if len(resolvers) > 1 {
+		var err error
+		if c.race {
+			resolver, err = dns.NewRaceResolver(resolvers...)
+		} else {
+			resolver, err = dns.NewFallbackResolver(resolvers...)
+		}
 		if err != nil {
 			return nil, err
 		}
-		if !msg.Header.Truncated {
-			return msg, nil
+	}
+	if len(c.routes) == 0 {
+		return resolver, nil
+	}
+	routes := []dns.DomainRoute{{Domain: ".", Resolver: resolver}}
+	for _, route := range c.routes {
+		domain, address, ok := strings.Cut(route, ":")
+		if !ok || domain == "" || address == "" {
+			return nil, fmt.Errorf("route option must be DOMAIN:ADDRESS, found %v", route)
 		}
-		// If the message is truncated, retry over TCP.
-		// See https://datatracker.ietf.org/doc/html/rfc1123#page-75.
-		return tcpResolver.Query(ctx, q)
-	})
-	return resolver, nil
+		routeResolver, err := newRouteResolver(address)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, dns.DomainRoute{Domain: domain, Resolver: routeResolver})
+	}
+	return dns.NewDomainRoutedResolver(routes)
 }
 
-func newDOHResolver(config url.URL, sd transport.StreamDialer) (dns.Resolver, error) {
-	query := config.Opaque
-	values, err := url.ParseQuery(query)
+// parseNameAndAddress parses the name and address options shared by the encrypted DNS configs.
+// The address defaults to the name. Other options are passed to extraOption, if not nil.
+func parseNameAndAddress(values url.Values, extraOption func(key string, values []string) error) (name string, address string, err error) {
+	names, addresses, err := parseNamesAndAddresses(values, extraOption)
 	if err != nil {
-		return nil, err
+		return "", "", err
+	}
+	if len(names) != 1 {
+		return "", "", fmt.Errorf("name option must has one value, found %v", len(names))
 	}
+	return names[0], addresses[0], nil
+}
 
-	var name, address string
+// parseNamesAndAddresses is like parseNameAndAddress, but allows multiple names. If set, there must be one
+// address for each name, in the same order.
+func parseNamesAndAddresses(values url.Values, extraOption func(key string, values []string) error) (names []string, addresses []string, err error) {
 	for key, values := range values {
 		switch strings.ToLower(key) {
 		case "address":
-			if len(values) != 1 {
-				return nil, fmt.Errorf("address option must has one value, found %v", len(values))
-			}
-			address = values[0]
+			addresses = append(addresses, values...)
 		case "name":
-			if len(values) != 1 {
-				return nil, fmt.Errorf("name option must has one value, found %v", len(values))
-			}
-			name = values[0]
+			names = append(names, values...)
 		default:
-			return nil, fmt.Errorf("unsupported option %v", key)
+			if extraOption == nil {
+				return nil, nil, fmt.Errorf("unsupported option %v", key)
+			}
+			if err := extraOption(strings.ToLower(key), values); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil, errors.New("must set a name")
+	}
+	if len(addresses) == 0 {
+		addresses = names
+	}
+	if len(addresses) != len(names) {
+		return nil, nil, fmt.Errorf("must set one address for each name, found %v names and %v addresses", len(names), len(addresses))
+	}
+	return names, addresses, nil
+}
+
+func newDOHResolver(config url.URL, sd transport.StreamDialer, newPD func() (transport.PacketDialer, error)) (dns.Resolver, error) {
+	query := config.Opaque
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
 
+	var h3 bool
+	var combine resolverCombination
+	var ednsOpts dns.EDNS0Options
+	names, addresses, err := parseNamesAndAddresses(values, func(key string, values []string) error {
+		if ok, err := combine.parseOption(key, values); ok {
+			return err
 		}
+		if ok, err := parseEDNS0Option(&ednsOpts, key, values); ok {
+			return err
+		}
+		if key != "h3" {
+			return fmt.Errorf("unsupported option %v", key)
+		}
+		if len(values) != 1 {
+			return fmt.Errorf("h3 option must has one value, found %v", len(values))
+		}
+		h3, err = strconv.ParseBool(values[0])
+		if err != nil {
+			return fmt.Errorf("invalid h3 option: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	if name == "" {
-		return nil, errors.New("must set a name")
+	var pd transport.PacketDialer
+	if h3 {
+		pd, err = newPD()
+		if err != nil {
+			return nil, err
+		}
+	}
+	resolvers := make([]dns.Resolver, 0, len(names))
+	for i, name := range names {
+		address := addresses[i]
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			address = net.JoinHostPort(address, "443")
+			port = "443"
+		}
+		dohURL := url.URL{Scheme: "https", Host: net.JoinHostPort(name, port), Path: "/dns-query"}
+		var resolver dns.Resolver
+		if h3 {
+			resolver = dnsquic.NewHTTP3Resolver(pd, address, dohURL.String())
+		} else {
+			resolver = dns.NewHTTPSResolver(sd, address, dohURL.String())
+		}
+		resolver, err = wrapEDNS0Resolver(resolver, ednsOpts)
+		if err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, resolver)
+	}
+	return combine.apply(resolvers, func(address string) (dns.Resolver, error) {
+		// Routes use plain DNS, since they are meant for internal resolvers.
+		pd, err := newPD()
+		if err != nil {
+			return nil, err
+		}
+		return newDO53ServerResolver(address, sd, pd, ednsOpts)
+	})
+}
+
+func newDOQResolver(config url.URL, pd transport.PacketDialer) (dns.Resolver, error) {
+	values, err := url.ParseQuery(config.Opaque)
+	if err != nil {
+		return nil, err
 	}
-	if address == "" {
-		address = name
+	name, address, err := parseNameAndAddress(values, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "853")
 	}
-	_, port, err := net.SplitHostPort(address)
+	return dnsquic.NewQUICResolver(pd, address, name), nil
+}
+
+// odohURL returns value as a URL, or, if value is a host name, the URL with the host name and the default path.
+func odohURL(value string, defaultPath string) string {
+	if strings.Contains(value, "://") {
+		return value
+	}
+	return (&url.URL{Scheme: "https", Host: value, Path: defaultPath}).String()
+}
+
+func newODOHResolver(config url.URL, sd transport.StreamDialer) (dns.Resolver, error) {
+	values, err := url.ParseQuery(config.Opaque)
 	if err != nil {
-		address = net.JoinHostPort(address, "443")
-		port = "443"
+		return nil, err
+	}
+	var proxyURL, targetURL string
+	var targetConfig []byte
+	for key, values := range values {
+		if len(values) != 1 {
+			return nil, fmt.Errorf("%v option must has one value, found %v", key, len(values))
+		}
+		switch strings.ToLower(key) {
+		case "proxy":
+			proxyURL = odohURL(values[0], "/proxy")
+		case "target":
+			targetURL = odohURL(values[0], "/dns-query")
+		case "config":
+			targetConfig, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(values[0], "="))
+			if err != nil {
+				return nil, fmt.Errorf("invalid config option: %w", err)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported option %v", key)
+		}
+	}
+	if proxyURL == "" || targetURL == "" {
+		return nil, errors.New("must set a proxy and a target")
 	}
-	dohURL := url.URL{Scheme: "https", Host: net.JoinHostPort(name, port), Path: "/dns-query"}
-	return dns.NewHTTPSResolver(sd, address, dohURL.String()), nil
+	return dns.NewObliviousHTTPSResolver(sd, proxyURL, targetURL, targetConfig)
 }
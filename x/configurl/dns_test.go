@@ -0,0 +1,231 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configurl
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// requireQUICInitial dials through the config and checks that the resolver sends a QUIC Initial packet
+// to the local UDP address.
+func requireQUICInitial(t *testing.T, config func(addr string) string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	dialer, err := NewDefaultProviders().NewStreamDialer(context.Background(), config(conn.LocalAddr().String()))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	go dialer.DialStream(ctx, "example.com:443")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	// QUIC Initial packets have the long header form, and are padded to at least 1200 bytes.
+	// See https://datatracker.ietf.org/doc/html/rfc9000#section-17.2.2 and
+	// https://datatracker.ietf.org/doc/html/rfc9000#section-14.1.
+	require.NotZero(t, buf[0]&0x80)
+	require.GreaterOrEqual(t, n, 1200)
+}
+
+func TestDOQConfig(t *testing.T) {
+	requireQUICInitial(t, func(addr string) string {
+		return "doq:name=dns.example&address=" + addr
+	})
+}
+
+func TestDOHConfig_H3(t *testing.T) {
+	requireQUICInitial(t, func(addr string) string {
+		return "doh:name=dns.example&address=" + addr + "&h3=true"
+	})
+}
+
+func TestDNSConfig_Errors(t *testing.T) {
+	providers := NewDefaultProviders()
+	for _, config := range []string{
+		"doq:address=127.0.0.1",
+		"doq:name=dns.example&h3=true",
+		"doh:name=dns.example&h3=maybe",
+		"doh:address=127.0.0.1",
+		"doh:name=dns.example&padding=-1",
+		"doh:name=dns.example&ecs=192.0.2.1",
+		"do53:address=127.0.0.1&cookies=maybe",
+		"do53:address=127.0.0.1&padding=1&padding=2",
+		"do53:address=127.0.0.1&foo=bar",
+		"do53:address=127.0.0.1&race=maybe",
+		"do53:address=127.0.0.1&route=corp",
+		"do53:address=127.0.0.1&route=*..:127.0.0.2",
+		"do53:race=true",
+		"doh:name=a.example&name=b.example&address=127.0.0.1",
+		"doq:name=a.example&name=b.example",
+	} {
+		_, err := providers.NewStreamDialer(context.Background(), config)
+		require.Error(t, err, config)
+	}
+}
+
+func TestDO53Config_EDNS0(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	config := "do53:address=" + conn.LocalAddr().String() + "&ecs=off&cookies=true&padding=64"
+	dialer, err := NewDefaultProviders().NewStreamDialer(context.Background(), config)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	go dialer.DialStream(ctx, "example.com:443")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Zero(t, n%64)
+	var request dnsmessage.Message
+	require.NoError(t, request.Unpack(buf[:n]))
+	require.Len(t, request.Additionals, 1)
+	var codes []uint16
+	for _, option := range request.Additionals[0].Body.(*dnsmessage.OPTResource).Options {
+		codes = append(codes, option.Code)
+	}
+	// Client Subnet, Cookie and Padding.
+	require.Equal(t, []uint16{8, 10, 12}, codes)
+}
+
+func TestDOHConfig_EDNS0(t *testing.T) {
+	_, err := NewDefaultProviders().NewStreamDialer(context.Background(), "doh:name=dns.example&padding=true&ecs=2001:db8::/56")
+	require.NoError(t, err)
+}
+
+func TestDO53Config_Fallback(t *testing.T) {
+	servfail := dnsmessage.RCodeServerFailure
+	firstAddr, firstNames := listenDNSQueries(t, &servfail)
+	secondAddr, secondNames := listenDNSQueries(t, nil)
+	dialAndDiscard(t, "do53:address="+firstAddr+"&address="+secondAddr, "example.com:443")
+	require.Equal(t, "example.com.", receiveName(t, firstNames))
+	require.Equal(t, "example.com.", receiveName(t, secondNames))
+}
+
+func TestDO53Config_Race(t *testing.T) {
+	firstAddr, firstNames := listenDNSQueries(t, nil)
+	secondAddr, secondNames := listenDNSQueries(t, nil)
+	dialAndDiscard(t, "do53:address="+firstAddr+"&address="+secondAddr+"&race=true", "example.com:443")
+	// Both servers get the query, without waiting for the first one to fail.
+	require.Equal(t, "example.com.", receiveName(t, firstNames))
+	require.Equal(t, "example.com.", receiveName(t, secondNames))
+}
+
+func TestDO53Config_Route(t *testing.T) {
+	publicAddr, publicNames := listenDNSQueries(t, nil)
+	corpAddr, corpNames := listenDNSQueries(t, nil)
+	config := "do53:address=" + publicAddr + "&route=corp:" + corpAddr
+	dialAndDiscard(t, config, "host.corp:443")
+	require.Equal(t, "host.corp.", receiveName(t, corpNames))
+	dialAndDiscard(t, config, "example.com:443")
+	require.Equal(t, "example.com.", receiveName(t, publicNames))
+	select {
+	case name := <-corpNames:
+		require.FailNow(t, "unexpected query to the route resolver", name)
+	default:
+	}
+}
+
+func TestDOHConfig_Multiple(t *testing.T) {
+	providers := NewDefaultProviders()
+	_, err := providers.NewStreamDialer(context.Background(), "doh:name=a.example&name=b.example&race=true&route=corp:10.0.0.53")
+	require.NoError(t, err)
+	_, err = providers.NewStreamDialer(context.Background(), "doh:name=a.example&address=192.0.2.1&name=b.example&address=192.0.2.2")
+	require.NoError(t, err)
+}
+
+func TestODOHConfig(t *testing.T) {
+	providers := NewDefaultProviders()
+	_, err := providers.NewStreamDialer(context.Background(), "odoh:proxy=odoh-proxy.example&target=https://odoh-target.example/dns-query")
+	require.NoError(t, err)
+	for _, config := range []string{
+		"odoh:target=odoh-target.example",
+		"odoh:proxy=http://odoh-proxy.example&target=odoh-target.example",
+		"odoh:proxy=odoh-proxy.example&target=odoh-target.example&config=AAE",
+		"odoh:proxy=odoh-proxy.example&target=odoh-target.example&foo=bar",
+	} {
+		_, err := providers.NewStreamDialer(context.Background(), config)
+		require.Error(t, err, config)
+	}
+}
+
+// listenDNSQueries starts a DNS-over-UDP server that sends the names it's queried for to the returned channel.
+// It answers with the rcode, if not nil, and doesn't answer otherwise.
+func listenDNSQueries(t *testing.T, rcode *dnsmessage.RCode) (string, <-chan string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	names := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var request dnsmessage.Message
+			if request.Unpack(buf[:n]) != nil || len(request.Questions) != 1 {
+				continue
+			}
+			if request.Questions[0].Type != dnsmessage.TypeA {
+				// Only report one of the Happy Eyeballs queries.
+				continue
+			}
+			names <- request.Questions[0].Name.String()
+			if rcode == nil {
+				continue
+			}
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: request.ID, Response: true, RCode: *rcode},
+				Questions: request.Questions,
+			}
+			if out, err := response.Pack(); err == nil {
+				conn.WriteTo(out, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), names
+}
+
+// dialAndDiscard dials addr through the config in the background, giving up after a short time.
+func dialAndDiscard(t *testing.T, config string, addr string) {
+	dialer, err := NewDefaultProviders().NewStreamDialer(context.Background(), config)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	t.Cleanup(cancel)
+	go dialer.DialStream(ctx, addr)
+}
+
+func receiveName(t *testing.T, names <-chan string) string {
+	select {
+	case name := <-names:
+		return name
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no query received")
+		return ""
+	}
+}
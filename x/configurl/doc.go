@@ -68,6 +68,24 @@ Happy Eyeballs to connect to the destination.
 
 	do53:address=[ADDRESS]
 
+The do53 and doh configs take optional EDNS(0) parameters. Set padding=true to pad the queries to a multiple of 128 bytes,
+so that their length doesn't reveal the names they query, or set padding to a block size. This is only useful with doh.
+Set ecs to a subnet, such as 192.0.2.0/24, to send it as the EDNS Client Subnet, or set ecs=off to ask the resolver not
+to send the client subnet to the authoritative servers. Set cookies=true to use DNS Cookies, which protect do53 queries
+from off-path injection.
+
+	do53:address=[ADDRESS]&ecs=off&cookies=true
+	doh:name=[NAME]&address=[ADDRESS]&padding=true
+
+The do53 and doh configs also take multiple resolvers, with repeated address options for do53, and repeated name
+options for doh, each with its address option in the same order, if any. The resolvers are tried in order, moving on
+to the next one when a resolver can't be reached or fails. Set race=true to query them in parallel instead, and use
+the first answer. The route option sends the names under a domain to the DNS-over-UDP resolver at an address, which is
+useful for internal domains. It can be repeated, and "*.[DOMAIN]" only matches the subdomains.
+
+	do53:address=[ADDRESS]&address=[ADDRESS]&race=true
+	doh:name=[NAME]&name=[NAME]&route=[DOMAIN]:[ADDRESS]
+
 DNS-over-HTTPS resolution (streams only, package [github.com/Jigsaw-Code/outline-sdk/dns])
 
 It takes a host name and a host:port address. The name will be used in the SNI and Host header, while the address is used to connect
@@ -76,6 +94,29 @@ Happy Eyeballs to connect to the destination.
 
 	doh:name=[NAME]&address=[ADDRESS]
 
+Set h3=true to use HTTP/3 over QUIC instead, with the input packet dialer (package [github.com/Jigsaw-Code/outline-sdk/x/dnsquic]).
+This helps in networks that throttle TCP to resolvers, but not UDP.
+
+	doh:name=[NAME]&address=[ADDRESS]&h3=true
+
+DNS-over-QUIC resolution (streams only, package [github.com/Jigsaw-Code/outline-sdk/x/dnsquic])
+
+It takes a host name and a host:port address, like the DoH config. The address defaults to "[NAME]:853".
+The resolver connects with the input packet dialer, while the resulting dialer uses the input stream dialer
+with Happy Eyeballs to connect to the destination.
+
+	doq:name=[NAME]&address=[ADDRESS]
+
+Oblivious DNS-over-HTTPS resolution (streams only, package [github.com/Jigsaw-Code/outline-sdk/dns])
+
+It takes the DoH URLs of the proxy and the target. The queries are encrypted to the target and sent through the proxy,
+so that the proxy can't see the queries, and the target can't see the client IP. A host name can be used instead of a URL,
+in which case the path defaults to "/proxy" for the proxy and "/dns-query" for the target. URLs with a query must be escaped.
+The optional config is the target's ObliviousDoHConfigs in base64url. If missing, it's fetched from the target through the proxy,
+which must then forward GET requests too.
+
+	odoh:proxy=[PROXY_URL]&target=[TARGET_URL]&config=[CONFIG]
+
 Address override.
 
 This dialer configuration is helpful for testing and development or if you need to fix the domain
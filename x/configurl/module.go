@@ -43,7 +43,9 @@ func NewProviderContainer() *ProviderContainer {
 func RegisterDefaultProviders(c *ProviderContainer) *ProviderContainer {
 	// Please keep the list in alphabetical order.
 	registerDO53StreamDialer(&c.StreamDialers, "do53", c.StreamDialers.NewInstance, c.PacketDialers.NewInstance)
-	registerDOHStreamDialer(&c.StreamDialers, "doh", c.StreamDialers.NewInstance)
+	registerDOHStreamDialer(&c.StreamDialers, "doh", c.StreamDialers.NewInstance, c.PacketDialers.NewInstance)
+	registerDOQStreamDialer(&c.StreamDialers, "doq", c.StreamDialers.NewInstance, c.PacketDialers.NewInstance)
+	registerODOHStreamDialer(&c.StreamDialers, "odoh", c.StreamDialers.NewInstance)
 
 	registerOverrideStreamDialer(&c.StreamDialers, "override", c.StreamDialers.NewInstance)
 	registerOverridePacketDialer(&c.PacketDialers, "override", c.PacketDialers.NewInstance)
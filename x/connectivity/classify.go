@@ -0,0 +1,460 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connectivity
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/dns"
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Interference is a kind of network interference identified by [Classify].
+type Interference string
+
+const (
+	// DNSInjection means a resolver returned forged answers for the domain.
+	DNSInjection Interference = "dns_injection"
+	// SNIReset means the connection was reset when the domain was sent in the TLS Server Name Indication,
+	// while the same server was reachable with a different name.
+	SNIReset Interference = "sni_reset"
+	// SNIBlackhole means the traffic was dropped after the domain was sent in the TLS Server Name Indication,
+	// while the same server was reachable with a different name.
+	SNIBlackhole Interference = "sni_blackhole"
+	// IPBlackhole means the traffic to the server IP was dropped, regardless of the content.
+	IPBlackhole Interference = "ip_blackhole"
+	// TLSInterception means the TLS connection was terminated by a host with a certificate that is not valid for the domain.
+	TLSInterception Interference = "tls_interception"
+	// Throttling means the connection to the domain works, but is much slower than to the same server with a different name.
+	Throttling Interference = "throttling"
+	// UnknownInterference means there was a failure that doesn't match any of the known kinds of interference.
+	UnknownInterference Interference = "unknown"
+)
+
+// Verdict is a kind of interference found by [Classify], with the evidence supporting it.
+type Verdict struct {
+	Interference Interference
+	// Evidence has human-readable descriptions of the observations that led to the verdict.
+	Evidence []string
+}
+
+func (v Verdict) String() string {
+	return fmt.Sprintf("%v (%v)", v.Interference, strings.Join(v.Evidence, "; "))
+}
+
+// DNSObservation is the result of resolving the domain with one resolver.
+type DNSObservation struct {
+	// Resolver is the name of the resolver.
+	Resolver string
+	// Trusted indicates the resolver answers can't be tampered with by the network, as is the case for
+	// encrypted DNS.
+	Trusted bool
+	// Addrs are the IPv4 addresses in the answer.
+	Addrs []netip.Addr
+	// Err is the error resolving the domain, if any.
+	Err error
+	// TLS is the result of the TLS test to the first of the Addrs, when none of them are in the trusted answers.
+	TLS *StreamTestResult
+}
+
+// Observations are the results of the probes for a domain, as collected by [Probe].
+// Results are nil for the probes that didn't run.
+type Observations struct {
+	Domain        string
+	ControlDomain string
+	DNS           []DNSObservation
+	// Address is the host:port the stream probes connected to.
+	Address string
+	// TCP is the result of connecting to Address.
+	TCP *StreamTestResult
+	// TLS is the result of the TLS handshake to Address using Domain as the server name.
+	TLS *StreamTestResult
+	// ControlTLS is the result of the TLS handshake to Address using ControlDomain as the server name,
+	// without verifying the certificate.
+	ControlTLS *StreamTestResult
+	// HTTP is the result of fetching the root page of Domain from Address.
+	HTTP *StreamTestResult
+}
+
+// ClassifyOptions are the options for [Classify].
+type ClassifyOptions struct {
+	// ThrottlingFactor is how many times slower than the control the TLS handshake with the domain must be
+	// to be considered throttled. Defaults to 4.
+	ThrottlingFactor float64
+	// MinThrottlingDelay is the minimum extra time over the control for the TLS handshake with the domain
+	// to be considered throttled. It prevents flagging jitter on fast networks. Defaults to 100ms.
+	MinThrottlingDelay time.Duration
+}
+
+// Classify analyzes the observations and returns the kinds of interference found, with their evidence.
+// It returns nil if no interference was found.
+func Classify(obs *Observations, opts ClassifyOptions) []Verdict {
+	if opts.ThrottlingFactor == 0 {
+		opts.ThrottlingFactor = 4
+	}
+	if opts.MinThrottlingDelay == 0 {
+		opts.MinThrottlingDelay = 100 * time.Millisecond
+	}
+	verdicts := classifyDNS(obs)
+	if verdict := classifyStream(obs, opts); verdict != nil {
+		verdicts = append(verdicts, *verdict)
+	}
+	return verdicts
+}
+
+func classifyDNS(obs *Observations) []Verdict {
+	trustedAddrs := make(map[netip.Addr]bool)
+	for _, dnsObs := range obs.DNS {
+		if dnsObs.Trusted {
+			for _, addr := range dnsObs.Addrs {
+				trustedAddrs[addr] = true
+			}
+		}
+	}
+	var injection []string
+	for _, dnsObs := range obs.DNS {
+		// A failed resolution is not evidence of interference by itself, since the resolver may just be down.
+		// The error is still available in the observations.
+		if dnsObs.Err != nil || dnsObs.Trusted {
+			continue
+		}
+		for _, addr := range dnsObs.Addrs {
+			if isBogon(addr) {
+				injection = append(injection, fmt.Sprintf("resolver %v returned non-public address %v", dnsObs.Resolver, addr))
+			}
+		}
+		if len(dnsObs.Addrs) == 0 && len(trustedAddrs) > 0 {
+			injection = append(injection, fmt.Sprintf("resolver %v returned no addresses, but the trusted resolvers did", dnsObs.Resolver))
+		}
+		if dnsObs.TLS == nil || dnsObs.TLS.Err == nil {
+			// Answers that serve the domain are fine, even if they differ from the trusted ones, as is common with CDNs.
+			continue
+		}
+		if obs.TLS != nil && obs.TLS.Err == nil {
+			injection = append(injection, fmt.Sprintf("resolver %v returned %v, not in the trusted answers, and the TLS test to it failed (%v), but the TLS test to %v succeeded",
+				dnsObs.Resolver, dnsObs.Addrs[0], dnsObs.TLS.Err, obs.Address))
+		} else if isCertificateError(dnsObs.TLS.Err) {
+			injection = append(injection, fmt.Sprintf("resolver %v returned %v, not in the trusted answers, and it presented an invalid certificate: %v",
+				dnsObs.Resolver, dnsObs.Addrs[0], dnsObs.TLS.Err))
+		}
+	}
+	if len(injection) == 0 {
+		return nil
+	}
+	return []Verdict{{DNSInjection, injection}}
+}
+
+func classifyStream(obs *Observations, opts ClassifyOptions) *Verdict {
+	if obs.TCP != nil && obs.TCP.Err != nil {
+		return classifyConnect(obs.Address, obs.TCP)
+	}
+	if obs.TLS == nil {
+		return nil
+	}
+	if obs.TLS.Err != nil {
+		if obs.TLS.Err.Op == "connect" {
+			return classifyConnect(obs.Address, obs.TLS)
+		}
+		return classifyHandshake(obs)
+	}
+	control := obs.ControlTLS
+	if control != nil && control.Err == nil {
+		handshake := obs.TLS.Timings.Handshake
+		controlHandshake := control.Timings.Handshake
+		if float64(handshake) > opts.ThrottlingFactor*float64(controlHandshake) && handshake-controlHandshake > opts.MinThrottlingDelay {
+			return &Verdict{Throttling, []string{fmt.Sprintf("TLS handshake with %v took %v, but with %v took %v",
+				obs.Domain, handshake, obs.ControlDomain, controlHandshake)}}
+		}
+	}
+	if obs.HTTP != nil && obs.HTTP.Err != nil {
+		if obs.HTTP.Err.PosixError == "ETIMEDOUT" {
+			return &Verdict{Throttling, []string{fmt.Sprintf("TLS handshake with %v succeeded, but the HTTP %v timed out after %v",
+				obs.Domain, obs.HTTP.Err.Op, obs.HTTP.Timings.Total)}}
+		}
+		return &Verdict{UnknownInterference, []string{fmt.Sprintf("TLS handshake with %v succeeded, but the HTTP test failed: %v", obs.Domain, obs.HTTP.Err)}}
+	}
+	return nil
+}
+
+func classifyConnect(address string, result *StreamTestResult) *Verdict {
+	if result.Err.PosixError == "ETIMEDOUT" {
+		return &Verdict{IPBlackhole, []string{fmt.Sprintf("TCP connection to %v timed out after %v", address, result.Timings.Connect)}}
+	}
+	return &Verdict{UnknownInterference, []string{fmt.Sprintf("TCP connection to %v failed: %v", address, result.Err)}}
+}
+
+func classifyHandshake(obs *Observations) *Verdict {
+	err := obs.TLS.Err
+	if isCertificateError(err) {
+		evidence := []string{fmt.Sprintf("TLS handshake with %v at %v presented an invalid certificate: %v", obs.Domain, obs.Address, err)}
+		var certErr *tls.CertificateVerificationError
+		if errors.As(err, &certErr) && len(certErr.UnverifiedCertificates) > 0 {
+			evidence = append(evidence, fmt.Sprintf("certificate issuer is %q", certErr.UnverifiedCertificates[0].Issuer))
+		}
+		return &Verdict{TLSInterception, evidence}
+	}
+	control := obs.ControlTLS
+	domainEvidence := fmt.Sprintf("TLS handshake with %v at %v failed after %v: %v", obs.Domain, obs.Address, obs.TLS.Timings.Handshake, err)
+	var controlEvidence string
+	switch {
+	case control == nil:
+		controlEvidence = "there's no control handshake to compare"
+	case control.Err == nil:
+		controlEvidence = fmt.Sprintf("TLS handshake with %v at the same address succeeded", obs.ControlDomain)
+	default:
+		controlEvidence = fmt.Sprintf("TLS handshake with %v at the same address also failed: %v", obs.ControlDomain, control.Err)
+	}
+	evidence := []string{domainEvidence, controlEvidence}
+	controlOK := control != nil && control.Err == nil
+	switch {
+	case isReset(err) && controlOK:
+		return &Verdict{SNIReset, evidence}
+	case err.PosixError == "ETIMEDOUT" && controlOK:
+		return &Verdict{SNIBlackhole, evidence}
+	case err.PosixError == "ETIMEDOUT" && control != nil && control.Err.PosixError == "ETIMEDOUT":
+		return &Verdict{IPBlackhole, evidence}
+	default:
+		return &Verdict{UnknownInterference, evidence}
+	}
+}
+
+func isCertificateError(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	return errors.As(err, &certErr)
+}
+
+// isReset returns whether the error is from the peer closing or aborting the connection.
+func isReset(err *ConnectivityError) bool {
+	switch err.PosixError {
+	case "ECONNRESET", "ECONNABORTED", "EPIPE":
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isBogon returns whether the address can't be used to reach a public server.
+func isBogon(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return !addr.IsGlobalUnicast() || addr.IsPrivate()
+}
+
+// ProbeResolver is a resolver used by [Probe].
+type ProbeResolver struct {
+	// Name identifies the resolver in the observations.
+	Name     string
+	Resolver dns.Resolver
+	// Trusted indicates the resolver answers can't be tampered with by the network, as is the case for
+	// encrypted DNS.
+	Trusted bool
+}
+
+// ProbeConfig is the configuration for [Probe].
+type ProbeConfig struct {
+	// Domain is the domain to test.
+	Domain string
+	// ControlDomain is the server name used to test whether the server is reachable with a different name.
+	// It should be a domain that is not blocked. Defaults to "example.com".
+	ControlDomain string
+	// Resolvers are used to resolve the Domain. Include at least one trusted resolver to detect DNS
+	// injection with public addresses.
+	Resolvers []ProbeResolver
+	// Dialer is used for the stream probes. It must connect directly to the address, so that the probes
+	// observe the network, rather than a proxy.
+	Dialer transport.StreamDialer
+	// Port is the port to connect to. Defaults to "443".
+	Port string
+	// TLSConfig is used for the handshakes with Domain. Defaults to the system configuration.
+	TLSConfig *tls.Config
+	// Timeout is the timeout for each probe. Defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+// Probe resolves the domain with all the resolvers, and tests TCP, TLS and HTTP connectivity to the
+// resolved address, plus the TLS connectivity to the same address with the control domain.
+// The returned observations can be passed to [Classify].
+//
+// It returns an error if the config is invalid or the context is canceled.
+func Probe(ctx context.Context, config ProbeConfig) (*Observations, error) {
+	if config.Domain == "" {
+		return nil, errors.New("domain must not be empty")
+	}
+	if config.Dialer == nil {
+		return nil, errors.New("argument Dialer must not be nil")
+	}
+	if len(config.Resolvers) == 0 {
+		return nil, errors.New("must have at least one resolver")
+	}
+	if config.ControlDomain == "" {
+		config.ControlDomain = "example.com"
+	}
+	if config.Port == "" {
+		config.Port = "443"
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+	domain := strings.TrimSuffix(config.Domain, ".")
+	obs := &Observations{Domain: domain, ControlDomain: config.ControlDomain}
+	probeCtx := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(ctx, config.Timeout)
+	}
+
+	obs.DNS = make([]DNSObservation, len(config.Resolvers))
+	var wg sync.WaitGroup
+	for ri, resolver := range config.Resolvers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := probeCtx()
+			defer cancel()
+			addrs, err := resolveIPv4(ctx, resolver.Resolver, domain)
+			obs.DNS[ri] = DNSObservation{Resolver: resolver.Name, Trusted: resolver.Trusted, Addrs: addrs, Err: err}
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	addr, ok := selectAddress(obs.DNS)
+	if !ok {
+		return obs, nil
+	}
+	obs.Address = net.JoinHostPort(addr.String(), config.Port)
+	domainAddress := net.JoinHostPort(domain, config.Port)
+	runTest := func(test func(ctx context.Context) (*StreamTestResult, error)) (*StreamTestResult, error) {
+		ctx, cancel := probeCtx()
+		defer cancel()
+		return test(ctx)
+	}
+	var err error
+	if obs.TCP, err = runTest(func(ctx context.Context) (*StreamTestResult, error) {
+		return TestStreamConnectivity(ctx, config.Dialer, obs.Address)
+	}); err != nil {
+		return nil, err
+	}
+	if obs.TCP.Err != nil {
+		return obs, nil
+	}
+	// The fixed dialer connects to the selected address regardless of the domain, so the server name
+	// and HTTP host are the domain.
+	fixedDialer := newFixedAddressDialer(config.Dialer, obs.Address)
+	if obs.TLS, err = runTest(func(ctx context.Context) (*StreamTestResult, error) {
+		return TestTLSConnectivity(ctx, fixedDialer, domainAddress, config.TLSConfig)
+	}); err != nil {
+		return nil, err
+	}
+	if obs.ControlTLS, err = runTest(func(ctx context.Context) (*StreamTestResult, error) {
+		controlConfig := &tls.Config{ServerName: config.ControlDomain, InsecureSkipVerify: true}
+		return TestTLSConnectivity(ctx, fixedDialer, domainAddress, controlConfig)
+	}); err != nil {
+		return nil, err
+	}
+	if obs.TLS.Err == nil {
+		if obs.HTTP, err = runTest(func(ctx context.Context) (*StreamTestResult, error) {
+			return TestHTTPConnectivity(ctx, fixedDialer, "https://"+domainAddress+"/", config.TLSConfig)
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	trustedAddrs := make(map[netip.Addr]bool)
+	for _, dnsObs := range obs.DNS {
+		if dnsObs.Trusted {
+			for _, addr := range dnsObs.Addrs {
+				trustedAddrs[addr] = true
+			}
+		}
+	}
+	if len(trustedAddrs) == 0 {
+		return obs, nil
+	}
+	for di := range obs.DNS {
+		dnsObs := &obs.DNS[di]
+		if dnsObs.Trusted || len(dnsObs.Addrs) == 0 || isBogon(dnsObs.Addrs[0]) || containsAny(trustedAddrs, dnsObs.Addrs) {
+			continue
+		}
+		untrustedDialer := newFixedAddressDialer(config.Dialer, net.JoinHostPort(dnsObs.Addrs[0].String(), config.Port))
+		if dnsObs.TLS, err = runTest(func(ctx context.Context) (*StreamTestResult, error) {
+			return TestTLSConnectivity(ctx, untrustedDialer, domainAddress, config.TLSConfig)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return obs, nil
+}
+
+func resolveIPv4(ctx context.Context, resolver dns.Resolver, domain string) ([]netip.Addr, error) {
+	q, err := dns.NewQuestion(domain, dnsmessage.TypeA)
+	if err != nil {
+		return nil, err
+	}
+	response, err := resolver.Query(ctx, *q)
+	if err != nil {
+		return nil, err
+	}
+	if response.RCode != dnsmessage.RCodeSuccess && response.RCode != dnsmessage.RCodeNameError {
+		return nil, fmt.Errorf("got %v response", response.RCode)
+	}
+	var addrs []netip.Addr
+	for _, answer := range response.Answers {
+		if a, ok := answer.Body.(*dnsmessage.AResource); ok {
+			addrs = append(addrs, netip.AddrFrom4(a.A))
+		}
+	}
+	return addrs, nil
+}
+
+// selectAddress returns the first public address from the trusted resolvers or, if there's none, from any resolver.
+func selectAddress(observations []DNSObservation) (netip.Addr, bool) {
+	for _, trusted := range []bool{true, false} {
+		for _, dnsObs := range observations {
+			if dnsObs.Trusted != trusted {
+				continue
+			}
+			for _, addr := range dnsObs.Addrs {
+				if !isBogon(addr) {
+					return addr, true
+				}
+			}
+		}
+	}
+	return netip.Addr{}, false
+}
+
+func containsAny(set map[netip.Addr]bool, addrs []netip.Addr) bool {
+	for _, addr := range addrs {
+		if set[addr] {
+			return true
+		}
+	}
+	return false
+}
+
+func newFixedAddressDialer(dialer transport.StreamDialer, address string) transport.StreamDialer {
+	return transport.FuncStreamDialer(func(ctx context.Context, _ string) (transport.StreamConn, error) {
+		return dialer.DialStream(ctx, address)
+	})
+}
@@ -0,0 +1,402 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connectivity
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/dns"
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// testServerIP is the address of the test server, behind the censor.
+	testServerIP = "203.0.113.1"
+	// testInterceptorIP is the address of a server with a certificate that is not trusted.
+	testInterceptorIP = "198.51.100.2"
+	// testBlackholeIP is an address where all the traffic is dropped.
+	testBlackholeIP = "192.0.2.1"
+)
+
+func TestProbeNoInterference(t *testing.T) {
+	network := newTestCensoredNetwork(t)
+	obs, err := Probe(context.Background(), network.probeConfig(testServerIP, testServerIP))
+	require.NoError(t, err)
+	require.Equal(t, "example.com", obs.Domain)
+	require.Equal(t, testServerIP+":443", obs.Address)
+	require.Len(t, obs.DNS, 2)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr(testServerIP)}, obs.DNS[1].Addrs)
+	require.Nil(t, obs.DNS[1].TLS)
+	require.Nil(t, obs.TCP.Err)
+	require.Nil(t, obs.TLS.Err)
+	require.Nil(t, obs.ControlTLS.Err)
+	require.Nil(t, obs.HTTP.Err)
+	require.Equal(t, http.StatusNotFound, obs.HTTP.StatusCode)
+
+	require.Nil(t, Classify(obs, ClassifyOptions{}))
+}
+
+func TestProbeAndClassify(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		mode         censorMode
+		trustedIP    string
+		untrustedIP  string
+		interference Interference
+		evidence     string
+	}{
+		{"DNSInjectionBogon", censorPass, testServerIP, "10.10.34.35", DNSInjection, "non-public address 10.10.34.35"},
+		{"DNSInjectionPublic", censorPass, testServerIP, testInterceptorIP, DNSInjection, "not in the trusted answers"},
+		{"SNIReset", censorReset, testServerIP, testServerIP, SNIReset, "succeeded"},
+		{"SNIBlackhole", censorDrop, testServerIP, testServerIP, SNIBlackhole, "succeeded"},
+		{"IPBlackhole", censorPass, testBlackholeIP, testBlackholeIP, IPBlackhole, "timed out"},
+		{"TLSInterception", censorIntercept, testServerIP, testServerIP, TLSInterception, `issuer is "O=Censor"`},
+		{"Throttling", censorThrottle, testServerIP, testServerIP, Throttling, "TLS handshake with example.com took"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			network := newTestCensoredNetwork(t)
+			network.setMode("example.com", tc.mode)
+			obs, err := Probe(context.Background(), network.probeConfig(tc.trustedIP, tc.untrustedIP))
+			require.NoError(t, err)
+
+			verdicts := Classify(obs, ClassifyOptions{})
+			require.Lenf(t, verdicts, 1, "Verdicts: %v", verdicts)
+			require.Equal(t, tc.interference, verdicts[0].Interference)
+			require.Contains(t, verdicts[0].String(), tc.evidence)
+		})
+	}
+}
+
+func TestProbeSkipsInjectedAddress(t *testing.T) {
+	network := newTestCensoredNetwork(t)
+	// Without a trusted resolver, the probes must not use the bogon address.
+	config := network.probeConfig(testServerIP, "127.0.0.1")
+	config.Resolvers = config.Resolvers[1:]
+	obs, err := Probe(context.Background(), config)
+	require.NoError(t, err)
+	require.Equal(t, "", obs.Address)
+	require.Nil(t, obs.TCP)
+
+	verdicts := Classify(obs, ClassifyOptions{})
+	require.Len(t, verdicts, 1)
+	require.Equal(t, DNSInjection, verdicts[0].Interference)
+}
+
+func TestProbeResolverFailure(t *testing.T) {
+	network := newTestCensoredNetwork(t)
+	config := network.probeConfig(testServerIP, testServerIP)
+	config.Resolvers[1].Resolver = dns.FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		return nil, errors.New("resolver is down")
+	})
+	obs, err := Probe(context.Background(), config)
+	require.NoError(t, err)
+	require.Nil(t, obs.TLS.Err)
+
+	require.ErrorContains(t, obs.DNS[1].Err, "resolver is down")
+
+	// A resolver failure is an observation, not a verdict.
+	require.Nil(t, Classify(obs, ClassifyOptions{}))
+}
+
+func TestProbeCanceled(t *testing.T) {
+	network := newTestCensoredNetwork(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	obs, err := Probe(ctx, network.probeConfig(testServerIP, testServerIP))
+	require.ErrorIs(t, err, context.Canceled)
+	require.Nil(t, obs)
+}
+
+func TestProbeInvalidConfig(t *testing.T) {
+	network := newTestCensoredNetwork(t)
+	config := network.probeConfig(testServerIP, testServerIP)
+	config.Domain = ""
+	_, err := Probe(context.Background(), config)
+	require.Error(t, err)
+
+	config = network.probeConfig(testServerIP, testServerIP)
+	config.Dialer = nil
+	_, err = Probe(context.Background(), config)
+	require.Error(t, err)
+
+	config = network.probeConfig(testServerIP, testServerIP)
+	config.Resolvers = nil
+	_, err = Probe(context.Background(), config)
+	require.Error(t, err)
+}
+
+func TestClassifyResetWithControlReset(t *testing.T) {
+	reset := &StreamTestResult{Err: makeConnectivityError("handshake", syscall.ECONNRESET)}
+	verdicts := Classify(&Observations{
+		Domain:        "example.com",
+		ControlDomain: "control.test",
+		TCP:           &StreamTestResult{},
+		TLS:           reset,
+		ControlTLS:    reset,
+	}, ClassifyOptions{})
+	require.Len(t, verdicts, 1)
+	require.Equal(t, UnknownInterference, verdicts[0].Interference)
+	require.Contains(t, verdicts[0].String(), "also failed")
+}
+
+func TestClassifyResetWithoutControl(t *testing.T) {
+	verdicts := Classify(&Observations{
+		Domain: "example.com",
+		TLS:    &StreamTestResult{Err: makeConnectivityError("handshake", io.EOF)},
+	}, ClassifyOptions{})
+	require.Len(t, verdicts, 1)
+	// Without the control, the reset can't be attributed to the SNI.
+	require.Equal(t, UnknownInterference, verdicts[0].Interference)
+	require.Contains(t, verdicts[0].String(), "no control")
+}
+
+func TestClassifyThrottlingOptions(t *testing.T) {
+	obs := &Observations{
+		TCP:        &StreamTestResult{},
+		TLS:        &StreamTestResult{Timings: Timings{Handshake: 300 * time.Millisecond}},
+		ControlTLS: &StreamTestResult{Timings: Timings{Handshake: 100 * time.Millisecond}},
+	}
+	require.Nil(t, Classify(obs, ClassifyOptions{}))
+
+	verdicts := Classify(obs, ClassifyOptions{ThrottlingFactor: 2})
+	require.Len(t, verdicts, 1)
+	require.Equal(t, Throttling, verdicts[0].Interference)
+
+	require.Nil(t, Classify(obs, ClassifyOptions{ThrottlingFactor: 2, MinThrottlingDelay: time.Second}))
+}
+
+func TestClassifyHTTPTimeout(t *testing.T) {
+	verdicts := Classify(&Observations{
+		TCP:        &StreamTestResult{},
+		TLS:        &StreamTestResult{},
+		ControlTLS: &StreamTestResult{},
+		HTTP:       &StreamTestResult{Err: makeConnectivityError("read", context.DeadlineExceeded)},
+	}, ClassifyOptions{})
+	require.Len(t, verdicts, 1)
+	require.Equal(t, Throttling, verdicts[0].Interference)
+}
+
+/********** Test Utilities **********/
+
+type censorMode int
+
+const (
+	censorPass censorMode = iota
+	// censorReset resets the connection after the ClientHello.
+	censorReset
+	// censorDrop drops all the traffic after the ClientHello.
+	censorDrop
+	// censorThrottle delays each chunk of data relayed.
+	censorThrottle
+	// censorIntercept relays the connection to the interceptor server.
+	censorIntercept
+)
+
+// testCensoredNetwork simulates a network with a censor in front of the test server, which acts
+// on the TLS connections that have a configured domain in the ClientHello.
+type testCensoredNetwork struct {
+	t           *testing.T
+	server      *httptest.Server
+	interceptor *httptest.Server
+	censor      net.Listener
+	mu          sync.Mutex
+	modes       map[string]censorMode
+}
+
+func newTestCensoredNetwork(t *testing.T) *testCensoredNetwork {
+	n := &testCensoredNetwork{t: t, modes: make(map[string]censorMode)}
+	n.server = httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(n.server.Close)
+	n.interceptor = httptest.NewUnstartedServer(http.NotFoundHandler())
+	n.interceptor.TLS = &tls.Config{Certificates: []tls.Certificate{newTestCensorCertificate(t)}}
+	n.interceptor.StartTLS()
+	t.Cleanup(n.interceptor.Close)
+
+	var err error
+	n.censor, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { n.censor.Close() })
+	go func() {
+		for {
+			conn, err := n.censor.Accept()
+			if err != nil {
+				return
+			}
+			go n.handle(conn.(*net.TCPConn))
+		}
+	}()
+	return n
+}
+
+func (n *testCensoredNetwork) setMode(domain string, mode censorMode) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.modes[domain] = mode
+}
+
+func (n *testCensoredNetwork) modeFor(clientHello []byte) censorMode {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for domain, mode := range n.modes {
+		if bytes.Contains(clientHello, []byte(domain)) {
+			return mode
+		}
+	}
+	return censorPass
+}
+
+func (n *testCensoredNetwork) handle(clientConn *net.TCPConn) {
+	defer clientConn.Close()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(clientConn, header); err != nil {
+		return
+	}
+	record := make([]byte, 5+int(header[3])<<8+int(header[4]))
+	copy(record, header)
+	if _, err := io.ReadFull(clientConn, record[5:]); err != nil {
+		return
+	}
+	upstream := n.server.Listener.Addr().String()
+	var delay time.Duration
+	switch n.modeFor(record) {
+	case censorReset:
+		clientConn.SetLinger(0)
+		return
+	case censorDrop:
+		io.Copy(io.Discard, clientConn)
+		return
+	case censorThrottle:
+		delay = 100 * time.Millisecond
+	case censorIntercept:
+		upstream = n.interceptor.Listener.Addr().String()
+	}
+	serverConn, err := net.Dial("tcp", upstream)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+	time.Sleep(delay)
+	if _, err := serverConn.Write(record); err != nil {
+		return
+	}
+	go func() {
+		relayWithDelay(serverConn, clientConn, delay)
+		serverConn.(*net.TCPConn).CloseWrite()
+	}()
+	relayWithDelay(clientConn, serverConn, delay)
+}
+
+func relayWithDelay(dst io.Writer, src io.Reader, delay time.Duration) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			time.Sleep(delay)
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// dialer connects the test IPs to their simulated hosts.
+func (n *testCensoredNetwork) dialer() transport.StreamDialer {
+	tcpDialer := &transport.TCPDialer{}
+	return transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		switch addr {
+		case net.JoinHostPort(testServerIP, "443"):
+			return tcpDialer.DialStream(ctx, n.censor.Addr().String())
+		case net.JoinHostPort(testInterceptorIP, "443"):
+			return tcpDialer.DialStream(ctx, n.interceptor.Listener.Addr().String())
+		case net.JoinHostPort(testBlackholeIP, "443"):
+			<-ctx.Done()
+			return nil, ctx.Err()
+		default:
+			return nil, syscall.ECONNREFUSED
+		}
+	})
+}
+
+// probeConfig returns a config with a trusted and an untrusted resolver that answer with the given IPs.
+func (n *testCensoredNetwork) probeConfig(trustedIP string, untrustedIP string) ProbeConfig {
+	roots := x509.NewCertPool()
+	roots.AddCert(n.server.Certificate())
+	return ProbeConfig{
+		Domain:        "example.com.",
+		ControlDomain: "control.test",
+		Resolvers: []ProbeResolver{
+			{Name: "trusted", Resolver: newTestResolver(trustedIP), Trusted: true},
+			{Name: "untrusted", Resolver: newTestResolver(untrustedIP)},
+		},
+		Dialer:    n.dialer(),
+		TLSConfig: &tls.Config{RootCAs: roots},
+		Timeout:   time.Second,
+	}
+}
+
+func newTestResolver(ip string) dns.Resolver {
+	addr := netip.MustParseAddr(ip).As4()
+	return dns.FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		return &dnsmessage.Message{
+			Header:    dnsmessage.Header{Response: true},
+			Questions: []dnsmessage.Question{q},
+			Answers: []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+				Body:   &dnsmessage.AResource{A: addr},
+			}},
+		}, nil
+	})
+}
+
+// newTestCensorCertificate returns a self-signed certificate for example.com, as used by intercepting middleboxes.
+func newTestCensorCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"Censor"}},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
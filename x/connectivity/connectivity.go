@@ -27,7 +27,8 @@ import (
 
 // ConnectivityError captures the observed error of the connectivity test.
 type ConnectivityError struct {
-	// Which operation in the test that failed: "connect", "send" or "receive"
+	// Which operation in the test that failed: "connect", "send" or "receive" for resolver tests,
+	// and "connect", "handshake", "write" or "read" for stream tests.
 	Op string
 	// The POSIX error, when available
 	PosixError string
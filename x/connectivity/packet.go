@@ -0,0 +1,401 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connectivity
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/dns"
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// PacketTestConfig is the configuration of the packet quality tests.
+type PacketTestConfig struct {
+	// Count is the number of probes sent to measure the round-trip time and loss. Defaults to 10.
+	Count int
+	// Interval is the time between probes. Defaults to 100ms.
+	Interval time.Duration
+	// Timeout is how long to wait for the response to a probe. Defaults to 1 second.
+	Timeout time.Duration
+	// DatagramSizes are the datagram sizes to try, in increasing order, to find the largest that gets through.
+	// Each size is tried up to 3 times. Defaults to 512, 1024, 1232, 1400 and 1472 bytes.
+	DatagramSizes []int
+	// SkipDatagramSize disables the datagram size test, leaving MaxDatagramSize as zero.
+	SkipDatagramSize bool
+}
+
+// PacketTestResult is the result of a packet quality test.
+type PacketTestResult struct {
+	// Sent is the number of probes sent to measure the round-trip time and loss.
+	Sent int
+	// Received is the number of those probes that got a response.
+	Received int
+	// LossRate is the fraction of the probes that didn't get a response.
+	LossRate float64
+	// MinRTT, AvgRTT and MaxRTT are the statistics of the round-trip time of the probes that got a response.
+	MinRTT time.Duration
+	AvgRTT time.Duration
+	MaxRTT time.Duration
+	// Jitter is the mean difference between the round-trip times of consecutive responses.
+	Jitter time.Duration
+	// MaxDatagramSize is the size of the largest datagram that got a response, or zero if none did.
+	MaxDatagramSize int
+	// Err is nil if there's connectivity, or the details of the error found.
+	// Its Op is "connect", "send" or "receive".
+	Err *ConnectivityError
+}
+
+// packetTarget creates the probes for a server, and parses its responses.
+type packetTarget struct {
+	// newProbe returns a probe with the id, padded to the size if possible.
+	newProbe func(id uint16, size int) ([]byte, error)
+	// parseResponse returns the id of the probe the response is for.
+	parseResponse func(response []byte) (uint16, bool)
+}
+
+// TestPacketQualityWithEcho measures the quality of the datagram connectivity to an echo server through
+// the [transport.PacketDialer]. The echo server must send back each datagram it receives.
+// To test a [transport.PacketListener], use a [transport.PacketListenerDialer].
+//
+// Invalid tests that cannot assert connectivity will return (nil, error). Valid tests will return
+// (*PacketTestResult, nil), with the error details in the result, if any.
+func TestPacketQualityWithEcho(ctx context.Context, dialer transport.PacketDialer, address string, config PacketTestConfig) (*PacketTestResult, error) {
+	target := packetTarget{
+		newProbe: func(id uint16, size int) ([]byte, error) {
+			probe := make([]byte, max(size, 64))
+			binary.BigEndian.PutUint16(probe, id)
+			return probe, nil
+		},
+		parseResponse: func(response []byte) (uint16, bool) {
+			if len(response) < 2 {
+				return 0, false
+			}
+			return binary.BigEndian.Uint16(response), true
+		},
+	}
+	return testPacketQuality(ctx, dialer, address, target, config)
+}
+
+// TestPacketQualityWithResolver measures the quality of the datagram connectivity to the DNS resolver through
+// the [transport.PacketDialer], using queries for testDomain. The queries are padded to the datagram sizes being
+// tested, so MaxDatagramSize only applies to the outgoing direction.
+// To test a [transport.PacketListener], use a [transport.PacketListenerDialer].
+//
+// Invalid tests that cannot assert connectivity will return (nil, error). Valid tests will return
+// (*PacketTestResult, nil), with the error details in the result, if any.
+func TestPacketQualityWithResolver(ctx context.Context, dialer transport.PacketDialer, resolverAddress string, testDomain string, config PacketTestConfig) (*PacketTestResult, error) {
+	q, err := dns.NewQuestion(testDomain, dnsmessage.TypeA)
+	if err != nil {
+		return nil, err
+	}
+	target := packetTarget{
+		newProbe: func(id uint16, size int) ([]byte, error) {
+			return newDNSProbe(*q, id, size)
+		},
+		parseResponse: func(response []byte) (uint16, bool) {
+			var parser dnsmessage.Parser
+			header, err := parser.Start(response)
+			if err != nil || !header.Response {
+				return 0, false
+			}
+			return header.ID, true
+		},
+	}
+	return testPacketQuality(ctx, dialer, resolverAddress, target, config)
+}
+
+// newDNSProbe returns a query with the EDNS(0) padding option, so it has the given size if possible.
+func newDNSProbe(q dnsmessage.Question, id uint16, size int) ([]byte, error) {
+	pack := func(padding []dnsmessage.Option) ([]byte, error) {
+		var opt dnsmessage.ResourceHeader
+		if err := opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, false); err != nil {
+			return nil, err
+		}
+		msg := dnsmessage.Message{
+			Header:      dnsmessage.Header{ID: id, RecursionDesired: true},
+			Questions:   []dnsmessage.Question{q},
+			Additionals: []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{Options: padding}}},
+		}
+		return msg.Pack()
+	}
+	probe, err := pack(nil)
+	if err != nil {
+		return nil, err
+	}
+	// The padding option has a 4-byte header.
+	if paddingSize := size - len(probe) - 4; paddingSize >= 0 {
+		return pack([]dnsmessage.Option{dns.PaddingOption(paddingSize)})
+	}
+	return probe, nil
+}
+
+// packetProber sends the probes and matches the responses.
+type packetProber struct {
+	conn   net.Conn
+	target packetTarget
+	nextID uint16
+	// received is signaled on each response.
+	received chan struct{}
+	// readDone is closed when the read loop stops.
+	readDone chan struct{}
+
+	mu      sync.Mutex
+	sent    map[uint16]time.Time
+	rtts    map[uint16]time.Duration
+	readErr error
+}
+
+func (p *packetProber) readLoop() {
+	defer close(p.readDone)
+	buf := make([]byte, 65535)
+	for {
+		n, err := p.conn.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		receiveTime := time.Now()
+		p.mu.Lock()
+		if err != nil {
+			if p.readErr == nil {
+				p.readErr = err
+			}
+			if !isICMPError(err) {
+				// The connection is no longer usable.
+				p.mu.Unlock()
+				return
+			}
+			// Errors such as ECONNREFUSED are caused by a single datagram, so we keep reading.
+		} else if id, ok := p.target.parseResponse(buf[:n]); ok {
+			if sendTime, ok := p.sent[id]; ok {
+				if _, ok := p.rtts[id]; !ok {
+					p.rtts[id] = receiveTime.Sub(sendTime)
+				}
+			}
+		}
+		p.mu.Unlock()
+		select {
+		case p.received <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// isICMPError returns whether the read error was caused by an ICMP message in response to a previous datagram.
+func isICMPError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errnoName(errno) {
+	case "ECONNREFUSED", "EHOSTUNREACH", "ENETUNREACH":
+		return true
+	case "ECONNRESET":
+		// Windows reports the ICMP port unreachable on UDP sockets as WSAECONNRESET.
+		return runtime.GOOS == "windows"
+	}
+	return false
+}
+
+// send sends a probe with the size and returns its id.
+func (p *packetProber) send(size int) (uint16, int, error) {
+	id := p.nextID
+	p.nextID++
+	probe, err := p.target.newProbe(id, size)
+	if err != nil {
+		return 0, 0, err
+	}
+	p.mu.Lock()
+	p.sent[id] = time.Now()
+	p.mu.Unlock()
+	_, err = p.conn.Write(probe)
+	return id, len(probe), err
+}
+
+// wait waits until all the ids have responses, or the deadline.
+func (p *packetProber) wait(ctx context.Context, deadline time.Time, ids ...uint16) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		p.mu.Lock()
+		missing := 0
+		for _, id := range ids {
+			if _, ok := p.rtts[id]; !ok {
+				missing++
+			}
+		}
+		p.mu.Unlock()
+		if missing == 0 {
+			return
+		}
+		select {
+		case <-p.received:
+		case <-p.readDone:
+			return
+		case <-timer.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *packetProber) rtt(id uint16) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rtt, ok := p.rtts[id]
+	return rtt, ok
+}
+
+func testPacketQuality(ctx context.Context, dialer transport.PacketDialer, address string, target packetTarget, config PacketTestConfig) (*PacketTestResult, error) {
+	if config.Count < 0 {
+		return nil, fmt.Errorf("Count must not be negative: %v", config.Count)
+	}
+	if config.Interval < 0 || config.Timeout < 0 {
+		return nil, errors.New("Interval and Timeout must not be negative")
+	}
+	if config.Count == 0 {
+		config.Count = 10
+	}
+	if config.Interval == 0 {
+		config.Interval = 100 * time.Millisecond
+	}
+	if config.Timeout == 0 {
+		config.Timeout = time.Second
+	}
+	if len(config.DatagramSizes) == 0 {
+		config.DatagramSizes = []int{512, 1024, 1232, 1400, 1472}
+	}
+
+	result := &PacketTestResult{}
+	conn, err := dialer.DialPacket(ctx, address)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return nil, ctx.Err()
+		}
+		result.Err = makeConnectivityError("connect", err)
+		return result, nil
+	}
+	prober := &packetProber{
+		conn:     conn,
+		target:   target,
+		nextID:   uint16(rand.N(1 << 16)),
+		received: make(chan struct{}, 1),
+		readDone: make(chan struct{}),
+		sent:     make(map[uint16]time.Time),
+		rtts:     make(map[uint16]time.Duration),
+	}
+	var readDone sync.WaitGroup
+	readDone.Add(1)
+	go func() {
+		defer readDone.Done()
+		prober.readLoop()
+	}()
+	defer readDone.Wait()
+	defer conn.Close()
+
+	// Measure the round-trip time and loss.
+	ids := make([]uint16, 0, config.Count)
+	for i := 0; i < config.Count; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(config.Interval):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		id, _, err := prober.send(0)
+		if err != nil {
+			result.Err = makeConnectivityError("send", err)
+			return result, nil
+		}
+		ids = append(ids, id)
+	}
+	result.Sent = len(ids)
+	prober.wait(ctx, time.Now().Add(config.Timeout), ids...)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var total, totalDiff time.Duration
+	var lastRTT time.Duration
+	for _, id := range ids {
+		rtt, ok := prober.rtt(id)
+		if !ok {
+			continue
+		}
+		if result.Received == 0 || rtt < result.MinRTT {
+			result.MinRTT = rtt
+		}
+		result.MaxRTT = max(result.MaxRTT, rtt)
+		if result.Received > 0 {
+			totalDiff += (rtt - lastRTT).Abs()
+		}
+		lastRTT = rtt
+		total += rtt
+		result.Received++
+	}
+	result.LossRate = float64(result.Sent-result.Received) / float64(result.Sent)
+	if result.Received == 0 {
+		prober.mu.Lock()
+		readErr := prober.readErr
+		prober.mu.Unlock()
+		if readErr == nil {
+			readErr = os.ErrDeadlineExceeded
+		}
+		result.Err = makeConnectivityError("receive", readErr)
+		return result, nil
+	}
+	result.AvgRTT = total / time.Duration(result.Received)
+	if result.Received > 1 {
+		result.Jitter = totalDiff / time.Duration(result.Received-1)
+	}
+
+	if config.SkipDatagramSize {
+		return result, nil
+	}
+	// Find the largest datagram size that gets through.
+	for _, size := range config.DatagramSizes {
+		got := false
+		for attempt := 0; attempt < 3 && !got; attempt++ {
+			id, probeSize, err := prober.send(size)
+			if err != nil {
+				// Datagrams that are too large may fail to send with EMSGSIZE.
+				break
+			}
+			prober.wait(ctx, time.Now().Add(config.Timeout), id)
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if _, ok := prober.rtt(id); ok {
+				result.MaxDatagramSize = probeSize
+				got = true
+			}
+		}
+		if !got {
+			break
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,262 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connectivity
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var testPacketConfig = PacketTestConfig{Count: 9, Interval: 5 * time.Millisecond, Timeout: 200 * time.Millisecond}
+
+func TestTestPacketQualityWithEchoOk(t *testing.T) {
+	echo := newTestUDPEcho(t, testUDPEchoOptions{})
+	result, err := TestPacketQualityWithEcho(context.Background(), &transport.UDPDialer{}, echo.addr(), testPacketConfig)
+	require.NoError(t, err)
+	require.Nil(t, result.Err)
+	require.Equal(t, 9, result.Sent)
+	require.Equal(t, 9, result.Received)
+	require.Zero(t, result.LossRate)
+	require.NotZero(t, result.MinRTT)
+	require.LessOrEqual(t, result.MinRTT, result.AvgRTT)
+	require.LessOrEqual(t, result.AvgRTT, result.MaxRTT)
+	require.Equal(t, 1472, result.MaxDatagramSize)
+}
+
+func TestTestPacketQualityWithEchoLossy(t *testing.T) {
+	echo := newTestUDPEcho(t, testUDPEchoOptions{dropEvery: 3, maxSize: 1000})
+	result, err := TestPacketQualityWithEcho(context.Background(), &transport.UDPDialer{}, echo.addr(), testPacketConfig)
+	require.NoError(t, err)
+	require.Nil(t, result.Err)
+	require.Equal(t, 9, result.Sent)
+	require.Equal(t, 6, result.Received)
+	require.InDelta(t, 1.0/3, result.LossRate, 0.001)
+	require.Equal(t, 512, result.MaxDatagramSize)
+}
+
+func TestTestPacketQualityWithEchoJitter(t *testing.T) {
+	echo := newTestUDPEcho(t, testUDPEchoOptions{delays: []time.Duration{0, 30 * time.Millisecond}})
+	result, err := TestPacketQualityWithEcho(context.Background(), &transport.UDPDialer{}, echo.addr(), testPacketConfig)
+	require.NoError(t, err)
+	require.Nil(t, result.Err)
+	require.Equal(t, 9, result.Received)
+	require.GreaterOrEqual(t, result.Jitter, 20*time.Millisecond)
+	require.GreaterOrEqual(t, result.MaxRTT-result.MinRTT, 20*time.Millisecond)
+}
+
+func TestTestPacketQualityWithEchoAllLost(t *testing.T) {
+	echo := newTestUDPEcho(t, testUDPEchoOptions{dropEvery: 1})
+	result, err := TestPacketQualityWithEcho(context.Background(), &transport.UDPDialer{}, echo.addr(), testPacketConfig)
+	require.NoError(t, err)
+	require.NotNil(t, result.Err)
+	require.Equal(t, "receive", result.Err.Op)
+	require.Equal(t, "ETIMEDOUT", result.Err.PosixError)
+	require.Equal(t, 1.0, result.LossRate)
+	require.Zero(t, result.MaxDatagramSize)
+}
+
+func TestTestPacketQualityWithEchoRefused(t *testing.T) {
+	echo := newTestUDPEcho(t, testUDPEchoOptions{})
+	addr := echo.addr()
+	echo.conn.Close()
+	result, err := TestPacketQualityWithEcho(context.Background(), &transport.UDPDialer{}, addr, testPacketConfig)
+	require.NoError(t, err)
+	require.NotNil(t, result.Err)
+	require.Equal(t, "ECONNREFUSED", result.Err.PosixError)
+}
+
+func TestTestPacketQualityWithEchoReadFails(t *testing.T) {
+	echo := newTestUDPEcho(t, testUDPEchoOptions{})
+	dialer := transport.FuncPacketDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := (&transport.UDPDialer{}).DialPacket(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &eofReadConn{Conn: conn}, nil
+	})
+	config := testPacketConfig
+	config.Timeout = 5 * time.Second
+	start := time.Now()
+	result, err := TestPacketQualityWithEcho(context.Background(), dialer, echo.addr(), config)
+	require.NoError(t, err)
+	// The test must not wait for the timeout once the connection can no longer be read.
+	require.Less(t, time.Since(start), config.Timeout)
+	require.NotNil(t, result.Err)
+	require.Equal(t, "receive", result.Err.Op)
+	require.ErrorIs(t, result.Err, io.EOF)
+	require.Zero(t, result.Received)
+}
+
+func TestTestPacketQualityWithEchoSkipDatagramSize(t *testing.T) {
+	echo := newTestUDPEcho(t, testUDPEchoOptions{})
+	config := testPacketConfig
+	config.SkipDatagramSize = true
+	result, err := TestPacketQualityWithEcho(context.Background(), &transport.UDPDialer{}, echo.addr(), config)
+	require.NoError(t, err)
+	require.Nil(t, result.Err)
+	require.Equal(t, 9, result.Received)
+	require.Zero(t, result.MaxDatagramSize)
+}
+
+func TestTestPacketQualityWithEchoInvalidConfig(t *testing.T) {
+	echo := newTestUDPEcho(t, testUDPEchoOptions{})
+	for _, config := range []PacketTestConfig{{Count: -1}, {Interval: -time.Second}, {Timeout: -time.Second}} {
+		result, err := TestPacketQualityWithEcho(context.Background(), &transport.UDPDialer{}, echo.addr(), config)
+		require.Error(t, err)
+		require.Nil(t, result)
+	}
+}
+
+func TestTestPacketQualityWithEchoCanceled(t *testing.T) {
+	echo := newTestUDPEcho(t, testUDPEchoOptions{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	config := testPacketConfig
+	config.Interval = 100 * time.Millisecond
+	result, err := TestPacketQualityWithEcho(ctx, &transport.UDPDialer{}, echo.addr(), config)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Nil(t, result)
+}
+
+func TestTestPacketQualityWithEchoPacketListener(t *testing.T) {
+	echo := newTestUDPEcho(t, testUDPEchoOptions{})
+	dialer := transport.PacketListenerDialer{Listener: &transport.UDPListener{Address: "127.0.0.1:0"}}
+	result, err := TestPacketQualityWithEcho(context.Background(), dialer, echo.addr(), testPacketConfig)
+	require.NoError(t, err)
+	require.Nil(t, result.Err)
+	require.Equal(t, 9, result.Received)
+}
+
+func TestTestPacketQualityWithResolver(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer server.Close()
+	var sizes []int
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		buf := make([]byte, 2048)
+		for {
+			n, clientAddr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			sizes = append(sizes, n)
+			var request dnsmessage.Message
+			if err := request.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			request.Response = true
+			request.Additionals = nil
+			response, err := request.Pack()
+			if err != nil {
+				continue
+			}
+			server.WriteTo(response, clientAddr)
+		}
+	}()
+
+	result, err := TestPacketQualityWithResolver(context.Background(), &transport.UDPDialer{}, server.LocalAddr().String(), "example.com", testPacketConfig)
+	require.NoError(t, err)
+	require.Nil(t, result.Err)
+	require.Equal(t, 9, result.Received)
+	require.Equal(t, 1472, result.MaxDatagramSize)
+	server.Close()
+	<-serverDone
+	require.Equal(t, []int{512, 1024, 1232, 1400, 1472}, sizes[len(sizes)-5:])
+}
+
+/********** Test Utilities **********/
+
+// testUDPEcho is a UDP echo server that simulates loss, size limits and delays.
+type testUDPEcho struct {
+	conn *net.UDPConn
+	wg   sync.WaitGroup
+}
+
+type testUDPEchoOptions struct {
+	// dropEvery drops every nth datagram, if not zero.
+	dropEvery int
+	// maxSize drops the datagrams larger than it, if not zero.
+	maxSize int
+	// delays are the delays applied to the responses, in rotation.
+	delays []time.Duration
+}
+
+func newTestUDPEcho(t *testing.T, options testUDPEchoOptions) *testUDPEcho {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	echo := &testUDPEcho{conn: conn}
+	t.Cleanup(func() {
+		conn.Close()
+		echo.wg.Wait()
+	})
+	echo.wg.Add(1)
+	go func() {
+		defer echo.wg.Done()
+		buf := make([]byte, 65535)
+		for count := 1; ; count++ {
+			n, clientAddr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if (options.dropEvery > 0 && count%options.dropEvery == 0) || (options.maxSize > 0 && n > options.maxSize) {
+				continue
+			}
+			response := append([]byte(nil), buf[:n]...)
+			var delay time.Duration
+			if len(options.delays) > 0 {
+				delay = options.delays[count%len(options.delays)]
+			}
+			echo.wg.Add(1)
+			time.AfterFunc(delay, func() {
+				defer echo.wg.Done()
+				conn.WriteTo(response, clientAddr)
+			})
+		}
+	}()
+	return echo
+}
+
+func (e *testUDPEcho) addr() string {
+	return e.conn.LocalAddr().String()
+}
+
+// eofReadConn is a connection that can send, but fails all reads with [io.EOF] until closed.
+type eofReadConn struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+func (c *eofReadConn) Read(b []byte) (int, error) {
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	return 0, io.EOF
+}
+
+func (c *eofReadConn) Close() error {
+	c.closed.Store(true)
+	return c.Conn.Close()
+}
@@ -0,0 +1,236 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connectivity
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+)
+
+// Timings has the duration of each phase of a stream connectivity test. Phases that didn't run are zero.
+// The duration of the phase that failed is included.
+type Timings struct {
+	// Connect is the time to establish the connection with the dialer.
+	Connect time.Duration
+	// Handshake is the time of the TLS handshake.
+	Handshake time.Duration
+	// Write is the time to send the HTTP request.
+	Write time.Duration
+	// Read is the time from the request being sent to receiving the HTTP response headers.
+	Read time.Duration
+	// Total is the duration of the whole test.
+	Total time.Duration
+}
+
+// StreamTestResult is the result of a stream connectivity test.
+type StreamTestResult struct {
+	Timings Timings
+	// StatusCode is the status of the HTTP response, for HTTP tests that got one.
+	StatusCode int
+	// Err is nil if there's connectivity, or the details of the error found.
+	// Its Op is one of "connect", "handshake", "write" or "read".
+	Err *ConnectivityError
+}
+
+// streamTest runs the phases of a stream test, recording their timings and errors.
+type streamTest struct {
+	ctx    context.Context
+	start  time.Time
+	result StreamTestResult
+}
+
+func newStreamTest(ctx context.Context) (*streamTest, context.CancelFunc) {
+	cancel := context.CancelFunc(func() {})
+	if _, ok := ctx.Deadline(); !ok {
+		// Default deadline is 5 seconds.
+		ctx, cancel = context.WithTimeout(ctx, 5*time.Second)
+	}
+	return &streamTest{ctx: ctx, start: time.Now()}, cancel
+}
+
+// run runs the phase, recording its duration in timing. It returns false if the phase failed.
+func (t *streamTest) run(op string, timing *time.Duration, phase func() error) bool {
+	phaseStart := time.Now()
+	err := phase()
+	*timing = time.Since(phaseStart)
+	t.result.Timings.Total = time.Since(t.start)
+	if err != nil {
+		t.result.Err = makeConnectivityError(op, err)
+		return false
+	}
+	return true
+}
+
+// finish returns the result, or the context error if the test was canceled, since it can't assert connectivity then.
+func (t *streamTest) finish() (*StreamTestResult, error) {
+	if t.result.Err != nil && errors.Is(t.ctx.Err(), context.Canceled) {
+		return nil, t.ctx.Err()
+	}
+	return &t.result, nil
+}
+
+// bindToContext makes the connection operations fail when the context is done.
+func bindToContext(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+}
+
+// TestStreamConnectivity tests whether the [transport.StreamDialer] can establish a connection to address.
+// Note that dialers for some proxy protocols, such as Shadowsocks, succeed without contacting the destination.
+// Use [TestTLSConnectivity] or [TestHTTPConnectivity] to test end-to-end connectivity through them.
+//
+// Invalid tests that cannot assert connectivity will return (nil, error). Valid tests will return
+// (*StreamTestResult, nil), with the error details in the result, if any.
+func TestStreamConnectivity(ctx context.Context, dialer transport.StreamDialer, address string) (*StreamTestResult, error) {
+	test, cancel := newStreamTest(ctx)
+	defer cancel()
+	var conn transport.StreamConn
+	test.run("connect", &test.result.Timings.Connect, func() (err error) {
+		conn, err = dialer.DialStream(test.ctx, address)
+		return err
+	})
+	if conn != nil {
+		conn.Close()
+	}
+	return test.finish()
+}
+
+// TestTLSConnectivity tests whether the [transport.StreamDialer] can establish a TLS connection to address.
+// If tlsConfig is nil, the default config is used, with the host of address as the server name.
+//
+// Invalid tests that cannot assert connectivity will return (nil, error). Valid tests will return
+// (*StreamTestResult, nil), with the error details in the result, if any.
+func TestTLSConnectivity(ctx context.Context, dialer transport.StreamDialer, address string, tlsConfig *tls.Config) (*StreamTestResult, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %w", err)
+	}
+	test, cancel := newStreamTest(ctx)
+	defer cancel()
+	conn, ok := test.connectTLS(dialer, address, host, tlsConfig)
+	if ok {
+		conn.Close()
+	}
+	return test.finish()
+}
+
+func (t *streamTest) connectTLS(dialer transport.StreamDialer, address string, host string, tlsConfig *tls.Config) (*tls.Conn, bool) {
+	var conn transport.StreamConn
+	if !t.run("connect", &t.result.Timings.Connect, func() (err error) {
+		conn, err = dialer.DialStream(t.ctx, address)
+		return err
+	}) {
+		return nil, false
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if !t.run("handshake", &t.result.Timings.Handshake, func() error {
+		return tlsConn.HandshakeContext(t.ctx)
+	}) {
+		conn.Close()
+		return nil, false
+	}
+	return tlsConn, true
+}
+
+// TestHTTPConnectivity tests whether the [transport.StreamDialer] can fetch the HTTP or HTTPS URL with a GET request.
+// Any HTTP response means there's connectivity, regardless of the status code. For HTTPS URLs, tlsConfig is
+// used as in [TestTLSConnectivity].
+//
+// Invalid tests that cannot assert connectivity will return (nil, error). Valid tests will return
+// (*StreamTestResult, nil), with the error details in the result, if any.
+func TestHTTPConnectivity(ctx context.Context, dialer transport.StreamDialer, testURL string, tlsConfig *tls.Config) (*StreamTestResult, error) {
+	parsedURL, err := url.Parse(testURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	var defaultPort string
+	switch parsedURL.Scheme {
+	case "http":
+		defaultPort = "80"
+	case "https":
+		defaultPort = "443"
+	default:
+		return nil, fmt.Errorf("unsupported URL scheme %q", parsedURL.Scheme)
+	}
+	host := parsedURL.Hostname()
+	if host == "" {
+		return nil, errors.New("URL must have a host")
+	}
+	port := parsedURL.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	address := net.JoinHostPort(host, port)
+
+	test, cancel := newStreamTest(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(test.ctx, http.MethodGet, testURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	var conn net.Conn
+	if parsedURL.Scheme == "https" {
+		tlsConn, ok := test.connectTLS(dialer, address, host, tlsConfig)
+		if !ok {
+			return test.finish()
+		}
+		conn = tlsConn
+	} else if !test.run("connect", &test.result.Timings.Connect, func() (err error) {
+		conn, err = dialer.DialStream(test.ctx, address)
+		return err
+	}) {
+		return test.finish()
+	}
+	defer conn.Close()
+	stop := bindToContext(test.ctx, conn)
+	defer stop()
+
+	if !test.run("write", &test.result.Timings.Write, func() error {
+		return req.Write(conn)
+	}) {
+		return test.finish()
+	}
+	test.run("read", &test.result.Timings.Read, func() error {
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		test.result.StatusCode = resp.StatusCode
+		return nil
+	})
+	return test.finish()
+}
@@ -0,0 +1,233 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connectivity
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTestStreamConnectivityOk(t *testing.T) {
+	var running sync.WaitGroup
+	listener := runTestTCPServer(t, func(conn *net.TCPConn) {}, &running)
+	defer listener.Close()
+
+	result, err := TestStreamConnectivity(context.Background(), &transport.TCPDialer{}, listener.Addr().String())
+	require.NoError(t, err)
+	require.Nil(t, result.Err)
+	require.NotZero(t, result.Timings.Connect)
+	require.GreaterOrEqual(t, result.Timings.Total, result.Timings.Connect)
+}
+
+func TestTestStreamConnectivityRefused(t *testing.T) {
+	result, err := TestStreamConnectivity(context.Background(), &transport.TCPDialer{}, newClosedAddress(t))
+	require.NoError(t, err)
+	require.NotNil(t, result.Err)
+	require.Equal(t, "connect", result.Err.Op)
+	require.Equal(t, "ECONNREFUSED", result.Err.PosixError)
+	require.NotZero(t, result.Timings.Connect)
+}
+
+func TestTestStreamConnectivityCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := TestStreamConnectivity(ctx, &transport.TCPDialer{}, newClosedAddress(t))
+	require.ErrorIs(t, err, context.Canceled)
+	require.Nil(t, result)
+}
+
+func TestTestTLSConnectivityOk(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	result, err := TestTLSConnectivity(context.Background(), &transport.TCPDialer{}, server.Listener.Addr().String(), newTestTLSConfig(server))
+	require.NoError(t, err)
+	require.Nil(t, result.Err)
+	require.NotZero(t, result.Timings.Connect)
+	require.NotZero(t, result.Timings.Handshake)
+	require.Zero(t, result.Timings.Read)
+}
+
+func TestTestTLSConnectivityReset(t *testing.T) {
+	var running sync.WaitGroup
+	listener := runTestTCPServer(t, func(conn *net.TCPConn) {
+		// Read the ClientHello and reset the connection, as SNI-based blocking does.
+		_, err := conn.Read(make([]byte, 1))
+		require.NoError(t, err)
+		conn.SetLinger(0)
+		conn.Close()
+	}, &running)
+	defer listener.Close()
+
+	result, err := TestTLSConnectivity(context.Background(), &transport.TCPDialer{}, listener.Addr().String(), &tls.Config{ServerName: "example.com"})
+	require.NoError(t, err)
+	require.NotNil(t, result.Err)
+	require.Equalf(t, "handshake", result.Err.Op, "Wrong test operation. Error: %v", result.Err)
+	require.Equal(t, "ECONNRESET", result.Err.PosixError)
+	require.NotZero(t, result.Timings.Connect)
+	require.NotZero(t, result.Timings.Handshake)
+}
+
+func TestTestTLSConnectivityTimeout(t *testing.T) {
+	var running sync.WaitGroup
+	done := make(chan struct{})
+	listener := runTestTCPServer(t, func(conn *net.TCPConn) {
+		go func() {
+			defer conn.Close()
+			<-done
+		}()
+	}, &running)
+	defer listener.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	result, err := TestTLSConnectivity(ctx, &transport.TCPDialer{}, listener.Addr().String(), nil)
+	require.NoError(t, err)
+	require.NotNil(t, result.Err)
+	require.Equal(t, "handshake", result.Err.Op)
+	require.Equal(t, "ETIMEDOUT", result.Err.PosixError)
+	require.GreaterOrEqual(t, result.Timings.Handshake, 100*time.Millisecond)
+}
+
+func TestTestTLSConnectivityBadCertificate(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	result, err := TestTLSConnectivity(context.Background(), &transport.TCPDialer{}, server.Listener.Addr().String(), &tls.Config{ServerName: "example.com"})
+	require.NoError(t, err)
+	require.NotNil(t, result.Err)
+	require.Equal(t, "handshake", result.Err.Op)
+	require.Equal(t, "", result.Err.PosixError)
+	var certErr *tls.CertificateVerificationError
+	require.ErrorAs(t, result.Err, &certErr)
+}
+
+func TestTestHTTPConnectivityOk(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	result, err := TestHTTPConnectivity(context.Background(), &transport.TCPDialer{}, server.URL+"/path", nil)
+	require.NoError(t, err)
+	require.Nil(t, result.Err)
+	require.Equal(t, http.StatusNotFound, result.StatusCode)
+	require.NotZero(t, result.Timings.Connect)
+	require.Zero(t, result.Timings.Handshake)
+	require.NotZero(t, result.Timings.Write)
+	require.NotZero(t, result.Timings.Read)
+}
+
+func TestTestHTTPConnectivityHTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	result, err := TestHTTPConnectivity(context.Background(), &transport.TCPDialer{}, server.URL, newTestTLSConfig(server))
+	require.NoError(t, err)
+	require.Nil(t, result.Err)
+	require.Equal(t, http.StatusNoContent, result.StatusCode)
+	require.NotZero(t, result.Timings.Handshake)
+}
+
+func TestTestHTTPConnectivityReset(t *testing.T) {
+	var running sync.WaitGroup
+	listener := runTestTCPServer(t, func(conn *net.TCPConn) {
+		// Reset after getting the request.
+		_, err := conn.Read(make([]byte, 1))
+		require.NoError(t, err)
+		conn.SetLinger(0)
+		conn.Close()
+	}, &running)
+	defer listener.Close()
+
+	result, err := TestHTTPConnectivity(context.Background(), &transport.TCPDialer{}, "http://"+listener.Addr().String(), nil)
+	require.NoError(t, err)
+	require.NotNil(t, result.Err)
+	require.Equalf(t, "read", result.Err.Op, "Wrong test operation. Error: %v", result.Err)
+	require.Equal(t, "ECONNRESET", result.Err.PosixError)
+}
+
+func TestTestHTTPConnectivityTimeout(t *testing.T) {
+	var running sync.WaitGroup
+	listener := runTestTCPServer(t, func(conn *net.TCPConn) {
+		go func() {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}()
+	}, &running)
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	result, err := TestHTTPConnectivity(ctx, &transport.TCPDialer{}, "http://"+listener.Addr().String(), nil)
+	require.NoError(t, err)
+	require.NotNil(t, result.Err)
+	require.Equal(t, "read", result.Err.Op)
+	require.Equal(t, "ETIMEDOUT", result.Err.PosixError)
+}
+
+func TestTestHTTPConnectivityEarlyClose(t *testing.T) {
+	var running sync.WaitGroup
+	listener := runTestTCPServer(t, func(conn *net.TCPConn) {
+		conn.CloseWrite()
+		io.Copy(io.Discard, conn)
+	}, &running)
+	defer listener.Close()
+
+	result, err := TestHTTPConnectivity(context.Background(), &transport.TCPDialer{}, "http://"+listener.Addr().String(), nil)
+	require.NoError(t, err)
+	require.NotNil(t, result.Err)
+	require.Equal(t, "read", result.Err.Op)
+	require.Equal(t, "", result.Err.PosixError)
+	require.ErrorIs(t, result.Err, io.ErrUnexpectedEOF)
+}
+
+func TestTestHTTPConnectivityInvalidURL(t *testing.T) {
+	for _, testURL := range []string{"ftp://example.com", "http://", "://"} {
+		result, err := TestHTTPConnectivity(context.Background(), &transport.TCPDialer{}, testURL, nil)
+		require.Error(t, err, testURL)
+		require.Nil(t, result)
+	}
+}
+
+/********** Test Utilities **********/
+
+// newTestTLSConfig returns a TLS config that trusts the httptest server.
+func newTestTLSConfig(server *httptest.Server) *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	return &tls.Config{ServerName: "example.com", RootCAs: roots}
+}
+
+// newClosedAddress returns a local address with no listener.
+func newClosedAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
@@ -0,0 +1,198 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connectivity
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-sdk/x/sockopt"
+)
+
+// HopResponse is what a probe with a limited hop count got back.
+type HopResponse string
+
+const (
+	// HopNoResponse means nothing was received before the timeout, as when the packets expire before
+	// reaching the server.
+	HopNoResponse HopResponse = "none"
+	// HopReset means the connection was reset.
+	HopReset HopResponse = "reset"
+	// HopClosed means the connection was closed without data.
+	HopClosed HopResponse = "closed"
+	// HopBlockpage means non-TLS data was received, such as an HTTP blockpage.
+	HopBlockpage HopResponse = "blockpage"
+	// HopTLS means a TLS response was received, as sent by the server.
+	HopTLS HopResponse = "tls"
+)
+
+// HopProbe has the responses for the domain and control ClientHellos sent with a hop limit.
+type HopProbe struct {
+	HopLimit int
+	Domain   HopResponse
+	Control  HopResponse
+}
+
+// TraceConfig is the configuration for [TraceInterference].
+type TraceConfig struct {
+	// Address is the host:port of the server. The host should be an IP address, so that all the probes
+	// go to the same server.
+	Address string
+	// Domain is the server name that is blocked.
+	Domain string
+	// ControlDomain is the server name used to find where the server is. It should be a domain that is not blocked.
+	// Defaults to "example.com".
+	ControlDomain string
+	// Dialer must return connections that are [*net.TCPConn] or implement [sockopt.HasHopLimit].
+	// Defaults to [transport.TCPDialer].
+	Dialer transport.StreamDialer
+	// MaxHops is the largest hop limit to probe. Defaults to 30.
+	MaxHops int
+	// Timeout is how long to wait for a response to each probe. Defaults to 2 seconds.
+	Timeout time.Duration
+}
+
+// TraceResult is the result of [TraceInterference].
+type TraceResult struct {
+	// Hops has the probes for each hop limit, starting at 1.
+	Hops []HopProbe
+	// ServerHop is the smallest hop limit at which the control got a response from the server, or zero if it never did.
+	ServerHop int
+	// CensorHop is the smallest hop limit at which the domain got a response that the control didn't get, or zero if
+	// there was no interference.
+	CensorHop int
+	// Interference is the response to the domain at the CensorHop.
+	Interference HopResponse
+}
+
+// TraceInterference finds the hop at which the TLS connections with the domain are interfered with, traceroute-style.
+// For each hop limit from 1, it connects to the server and sends a ClientHello with the domain and another with the
+// control domain, with that hop limit. The connection is established with the default hop limit. The first hop limit
+// at which the domain gets a reset, close or blockpage that the control doesn't is where the censor is.
+//
+// The trace stops when the control reaches the server, or at the MaxHops. A CensorHop smaller than the ServerHop
+// indicates the censor is on the path, rather than at the server. Packets with a hop limit in [CensorHop, ServerHop)
+// reach the censor but not the server, as needed by decoy strategies.
+func TraceInterference(ctx context.Context, config TraceConfig) (*TraceResult, error) {
+	if config.Address == "" {
+		return nil, errors.New("address must not be empty")
+	}
+	if config.Domain == "" {
+		return nil, errors.New("domain must not be empty")
+	}
+	if config.ControlDomain == "" {
+		config.ControlDomain = "example.com"
+	}
+	if config.Dialer == nil {
+		config.Dialer = &transport.TCPDialer{}
+	}
+	if config.MaxHops == 0 {
+		config.MaxHops = 30
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 2 * time.Second
+	}
+
+	result := &TraceResult{}
+	for hopLimit := 1; hopLimit <= config.MaxHops; hopLimit++ {
+		probe := HopProbe{HopLimit: hopLimit}
+		controlDone := make(chan error, 1)
+		go func() {
+			var err error
+			probe.Control, err = probeHop(ctx, config, config.ControlDomain, hopLimit)
+			controlDone <- err
+		}()
+		domainResponse, domainErr := probeHop(ctx, config, config.Domain, hopLimit)
+		controlErr := <-controlDone
+		if err := errors.Join(domainErr, controlErr); err != nil {
+			return nil, fmt.Errorf("probe with hop limit %v failed: %w", hopLimit, err)
+		}
+		probe.Domain = domainResponse
+		result.Hops = append(result.Hops, probe)
+
+		if result.CensorHop == 0 && probe.Domain != HopNoResponse && probe.Domain != HopTLS && probe.Domain != probe.Control {
+			result.CensorHop = hopLimit
+			result.Interference = probe.Domain
+		}
+		if probe.Control == HopTLS {
+			result.ServerHop = hopLimit
+			break
+		}
+	}
+	return result, nil
+}
+
+// probeHop sends a ClientHello with the serverName and the hop limit, and reports the response.
+func probeHop(ctx context.Context, config TraceConfig, serverName string, hopLimit int) (HopResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.Timeout)
+	defer cancel()
+	conn, err := config.Dialer.DialStream(ctx, config.Address)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+	hopLimitOption, err := newHopLimitOption(conn)
+	if err != nil {
+		return "", err
+	}
+	defaultHopLimit, err := hopLimitOption.HopLimit()
+	if err != nil {
+		return "", fmt.Errorf("failed to get hop limit: %w", err)
+	}
+	if err := hopLimitOption.SetHopLimit(hopLimit); err != nil {
+		return "", fmt.Errorf("failed to set hop limit: %w", err)
+	}
+	// Restore the hop limit so the server sees the connection close.
+	defer hopLimitOption.SetHopLimit(defaultHopLimit)
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	err = tlsConn.HandshakeContext(ctx)
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	switch {
+	case err == nil, errors.As(err, &alertErr):
+		return HopTLS, nil
+	case errors.Is(ctx.Err(), context.Canceled):
+		return "", ctx.Err()
+	case isTimeout(err):
+		return HopNoResponse, nil
+	case errors.As(err, &recordErr):
+		return HopBlockpage, nil
+	case errors.Is(err, syscall.ECONNRESET):
+		return HopReset, nil
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return HopClosed, nil
+	default:
+		return "", fmt.Errorf("TLS handshake failed: %w", err)
+	}
+}
+
+func newHopLimitOption(conn net.Conn) (sockopt.HasHopLimit, error) {
+	if hopLimitOption, ok := conn.(sockopt.HasHopLimit); ok {
+		return hopLimitOption, nil
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("cannot set the hop limit on connection of type %T", conn)
+	}
+	return sockopt.NewTCPOptions(tcpConn)
+}
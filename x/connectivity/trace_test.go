@@ -0,0 +1,207 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connectivity
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceInterferenceReset(t *testing.T) {
+	path := newTestPath(t, 3, 7, HopReset)
+	result, err := TraceInterference(context.Background(), path.traceConfig())
+	require.NoError(t, err)
+	require.Equal(t, 3, result.CensorHop)
+	require.Equal(t, HopReset, result.Interference)
+	require.Equal(t, 7, result.ServerHop)
+	require.Len(t, result.Hops, 7)
+	require.Equal(t, HopProbe{HopLimit: 2, Domain: HopNoResponse, Control: HopNoResponse}, result.Hops[1])
+	require.Equal(t, HopProbe{HopLimit: 3, Domain: HopReset, Control: HopNoResponse}, result.Hops[2])
+	require.Equal(t, HopProbe{HopLimit: 7, Domain: HopReset, Control: HopTLS}, result.Hops[6])
+}
+
+func TestTraceInterferenceBlockpage(t *testing.T) {
+	path := newTestPath(t, 1, 2, HopBlockpage)
+	result, err := TraceInterference(context.Background(), path.traceConfig())
+	require.NoError(t, err)
+	require.Equal(t, 1, result.CensorHop)
+	require.Equal(t, HopBlockpage, result.Interference)
+	require.Equal(t, 2, result.ServerHop)
+}
+
+func TestTraceInterferenceClosed(t *testing.T) {
+	path := newTestPath(t, 2, 2, HopClosed)
+	result, err := TraceInterference(context.Background(), path.traceConfig())
+	require.NoError(t, err)
+	require.Equal(t, 2, result.CensorHop)
+	require.Equal(t, HopClosed, result.Interference)
+	require.Equal(t, 2, result.ServerHop)
+}
+
+func TestTraceInterferenceNoCensor(t *testing.T) {
+	path := newTestPath(t, 0, 3, HopReset)
+	result, err := TraceInterference(context.Background(), path.traceConfig())
+	require.NoError(t, err)
+	require.Zero(t, result.CensorHop)
+	require.Equal(t, 3, result.ServerHop)
+	require.Equal(t, HopProbe{HopLimit: 3, Domain: HopTLS, Control: HopTLS}, result.Hops[2])
+}
+
+func TestTraceInterferenceMaxHops(t *testing.T) {
+	path := newTestPath(t, 2, 10, HopReset)
+	config := path.traceConfig()
+	config.MaxHops = 4
+	result, err := TraceInterference(context.Background(), config)
+	require.NoError(t, err)
+	require.Equal(t, 2, result.CensorHop)
+	require.Zero(t, result.ServerHop)
+	require.Len(t, result.Hops, 4)
+}
+
+func TestTraceInterferenceLoopback(t *testing.T) {
+	// Use the system stack, where the server is one hop away.
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	result, err := TraceInterference(context.Background(), TraceConfig{
+		Address: server.Listener.Addr().String(),
+		Domain:  "blocked.test",
+		MaxHops: 3,
+	})
+	require.NoError(t, err)
+	require.Zero(t, result.CensorHop)
+	require.Equal(t, 1, result.ServerHop)
+}
+
+func TestTraceInterferenceConnectFailure(t *testing.T) {
+	_, err := TraceInterference(context.Background(), TraceConfig{Address: newClosedAddress(t), Domain: "blocked.test"})
+	require.ErrorIs(t, err, syscall.ECONNREFUSED)
+}
+
+func TestTraceInterferenceCanceled(t *testing.T) {
+	path := newTestPath(t, 3, 7, HopReset)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	config := path.traceConfig()
+	config.Timeout = time.Second
+	_, err := TraceInterference(ctx, config)
+	require.Error(t, err)
+}
+
+/********** Test Utilities **********/
+
+// testPath simulates the network path to a TLS server, with a censor that reacts to the ClientHellos
+// with the blocked domain that reach its hop.
+type testPath struct {
+	server    *httptest.Server
+	censorHop int
+	serverHop int
+	response  HopResponse
+}
+
+func newTestPath(t *testing.T, censorHop int, serverHop int, response HopResponse) *testPath {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(server.Close)
+	return &testPath{server: server, censorHop: censorHop, serverHop: serverHop, response: response}
+}
+
+func (p *testPath) traceConfig() TraceConfig {
+	return TraceConfig{
+		Address:       "203.0.113.1:443",
+		Domain:        "blocked.test",
+		ControlDomain: "control.test",
+		Dialer: transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+			conn, err := (&transport.TCPDialer{}).DialStream(ctx, p.server.Listener.Addr().String())
+			if err != nil {
+				return nil, err
+			}
+			return &testPathConn{StreamConn: conn, path: p, hopLimit: 64}, nil
+		}),
+		Timeout: 100 * time.Millisecond,
+	}
+}
+
+// testPathConn forwards the writes to the server only if their hop limit reaches it, and
+// injects the censor response if the hop limit reaches the censor.
+type testPathConn struct {
+	transport.StreamConn
+	path     *testPath
+	mu       sync.Mutex
+	hopLimit int
+	injected io.Reader
+}
+
+func (c *testPathConn) HopLimit() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hopLimit, nil
+}
+
+func (c *testPathConn) SetHopLimit(hopLimit int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hopLimit = hopLimit
+	return nil
+}
+
+func (c *testPathConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.path.censorHop > 0 && c.hopLimit >= c.path.censorHop && bytes.Contains(b, []byte("blocked.test")) {
+		switch c.path.response {
+		case HopReset:
+			c.injected = &errorReader{syscall.ECONNRESET}
+		case HopClosed:
+			c.injected = bytes.NewReader(nil)
+		case HopBlockpage:
+			c.injected = bytes.NewReader([]byte("HTTP/1.1 403 Forbidden\r\n\r\nBlocked"))
+		}
+		// The censor drops the packet.
+		return len(b), nil
+	}
+	if c.hopLimit < c.path.serverHop {
+		// The packet expires on the way.
+		return len(b), nil
+	}
+	return c.StreamConn.Write(b)
+}
+
+func (c *testPathConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	injected := c.injected
+	c.mu.Unlock()
+	if injected != nil {
+		return injected.Read(b)
+	}
+	return c.StreamConn.Read(b)
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read([]byte) (int, error) {
+	return 0, &net.OpError{Op: "read", Net: "tcp", Err: r.err}
+}
@@ -0,0 +1,210 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dnsquic
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/dns"
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// defaultQUICIdleTimeout is how long a QUIC connection is kept open without activity.
+const defaultQUICIdleTimeout = 30 * time.Second
+
+// maxUDPMessageSize is the payload size advertised in the OPT record, same as the resolvers in package dns.
+const maxUDPMessageSize = 1232
+
+type quicResolver struct {
+	dial func(context.Context) (quic.Connection, error)
+
+	mu   sync.Mutex // Protects conn
+	conn quic.Connection
+}
+
+var _ dns.Resolver = (*quicResolver)(nil)
+
+// NewQUICResolver creates a [dns.Resolver] that implements the [DNS-over-QUIC] protocol, using a
+// [transport.PacketDialer] to connect to the resolverAddr, and the resolverName as the TLS server name.
+// It keeps a persistent QUIC connection to the resolver, sends each query on its own stream, and transparently
+// reconnects if the connection is closed.
+//
+// [DNS-over-QUIC]: https://datatracker.ietf.org/doc/html/rfc9250
+func NewQUICResolver(pd transport.PacketDialer, resolverAddr string, resolverName string) dns.Resolver {
+	return newQUICResolver(pd, resolverAddr, &tls.Config{ServerName: resolverName})
+}
+
+func newQUICResolver(pd transport.PacketDialer, resolverAddr string, tlsConf *tls.Config) *quicResolver {
+	resolverAddr = ensurePort(resolverAddr, "853")
+	tlsConf = tlsConf.Clone()
+	// See https://datatracker.ietf.org/doc/html/rfc9250#section-4.1.1.
+	tlsConf.NextProtos = []string{"doq"}
+	tlsConf.MinVersion = tls.VersionTLS13
+	quicConf := &quic.Config{MaxIdleTimeout: defaultQUICIdleTimeout}
+	return &quicResolver{
+		dial: func(ctx context.Context) (quic.Connection, error) {
+			return dialQUIC(ctx, pd, resolverAddr, tlsConf, quicConf)
+		},
+	}
+}
+
+// getConn returns the current connection, or dials a new one if there's no usable connection.
+// The returned bool indicates whether the connection was reused.
+func (r *quicResolver) getConn(ctx context.Context) (quic.Connection, bool, error) {
+	r.mu.Lock()
+	if r.conn != nil && r.conn.Context().Err() == nil {
+		conn := r.conn
+		r.mu.Unlock()
+		return conn, true, nil
+	}
+	r.mu.Unlock()
+
+	conn, err := r.dial(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != nil && r.conn.Context().Err() == nil {
+		// Another query established a connection first.
+		conn.CloseWithError(0, "")
+		return r.conn, true, nil
+	}
+	r.conn = conn
+	return conn, false, nil
+}
+
+func (r *quicResolver) Query(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	conn, reused, err := r.getConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", dns.ErrDial, err)
+	}
+	msg, err := queryQUIC(ctx, conn, q)
+	// The connection may have been closed by the server after being idle, in which case we retry once.
+	if err != nil && reused && ctx.Err() == nil && conn.Context().Err() != nil {
+		conn, _, err = r.getConn(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", dns.ErrDial, err)
+		}
+		return queryQUIC(ctx, conn, q)
+	}
+	return msg, err
+}
+
+// queryQUIC sends the query on a new stream of conn, as per https://datatracker.ietf.org/doc/html/rfc9250#section-4.2.
+func queryQUIC(ctx context.Context, conn quic.Connection, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", dns.ErrSend, err)
+	}
+	// Unblock the reads and writes if the context is done.
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+	})
+	defer stop()
+
+	buf, err := appendRequest(q, make([]byte, 2, 514))
+	if err != nil {
+		stream.CancelWrite(0)
+		stream.CancelRead(0)
+		return nil, fmt.Errorf("%w: append request failed: %w", dns.ErrBadRequest, err)
+	}
+	binary.BigEndian.PutUint16(buf[:2], uint16(len(buf)-2))
+	if _, err := stream.Write(buf); err != nil {
+		return nil, fmt.Errorf("%w: %w", dns.ErrSend, wrapContextError(ctx, err))
+	}
+	// Closing the stream only closes the send direction, which signals the end of the query.
+	if err := stream.Close(); err != nil {
+		return nil, fmt.Errorf("%w: %w", dns.ErrSend, wrapContextError(ctx, err))
+	}
+
+	var msgLen uint16
+	if err := binary.Read(stream, binary.BigEndian, &msgLen); err != nil {
+		return nil, fmt.Errorf("%w: %w", dns.ErrReceive, wrapContextError(ctx, fmt.Errorf("read message length failed: %w", err)))
+	}
+	response := make([]byte, msgLen)
+	if _, err := io.ReadFull(stream, response); err != nil {
+		return nil, fmt.Errorf("%w: %w", dns.ErrReceive, wrapContextError(ctx, fmt.Errorf("read message failed: %w", err)))
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		return nil, fmt.Errorf("%w: response failed to unpack: %w", dns.ErrBadResponse, err)
+	}
+	if err := checkResponse(q, &msg); err != nil {
+		return nil, fmt.Errorf("%w: %w", dns.ErrBadResponse, err)
+	}
+	return &msg, nil
+}
+
+// appendRequest appends a DNS request for q to buf. The message ID must be 0, as per
+// https://datatracker.ietf.org/doc/html/rfc9250#section-4.2.1.
+func appendRequest(q dnsmessage.Question, buf []byte) ([]byte, error) {
+	b := dnsmessage.NewBuilder(buf, dnsmessage.Header{ID: 0, RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		return nil, fmt.Errorf("start questions failed: %w", err)
+	}
+	if err := b.Question(q); err != nil {
+		return nil, fmt.Errorf("add question failed: %w", err)
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, fmt.Errorf("start additionals failed: %w", err)
+	}
+	var rh dnsmessage.ResourceHeader
+	if err := rh.SetEDNS0(maxUDPMessageSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, fmt.Errorf("set EDNS(0) failed: %w", err)
+	}
+	if err := b.OPTResource(rh, dnsmessage.OPTResource{}); err != nil {
+		return nil, fmt.Errorf("add OPT RR failed: %w", err)
+	}
+	return b.Finish()
+}
+
+// checkResponse verifies that msg is a response to q with ID 0.
+func checkResponse(q dnsmessage.Question, msg *dnsmessage.Message) error {
+	if !msg.Response {
+		return errors.New("response bit not set")
+	}
+	if msg.ID != 0 {
+		return fmt.Errorf("message id does not match. Expected 0, got %v", msg.ID)
+	}
+	if len(msg.Questions) == 0 {
+		return errors.New("response had no questions")
+	}
+	respQ := msg.Questions[0]
+	// Names are compared case-insensitively, as per https://datatracker.ietf.org/doc/html/rfc4343#section-3.
+	if q.Type != respQ.Type || q.Class != respQ.Class || !strings.EqualFold(q.Name.String(), respQ.Name.String()) {
+		return errors.New("response question doesn't match request")
+	}
+	return nil
+}
+
+// wrapContextError adds the context error to err if the context is done, since it's the reason for the failure.
+func wrapContextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("%w: %w", ctxErr, err)
+	}
+	return err
+}
@@ -0,0 +1,267 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dnsquic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/dns"
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestQUICResolver_ReusesConnection(t *testing.T) {
+	server := newTestQUICServer(t)
+	resolver := newQUICResolver(&transport.UDPDialer{}, server.Addr(), server.clientTLSConfig)
+	for i := 0; i < 3; i++ {
+		resp, err := resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+		require.NoError(t, err)
+		require.Equal(t, uint16(0), resp.ID)
+		require.Len(t, resp.Answers, 1)
+	}
+	require.Equal(t, int32(1), server.accepted.Load())
+}
+
+func TestQUICResolver_ConcurrentQueries(t *testing.T) {
+	server := newTestQUICServer(t)
+	resolver := newQUICResolver(&transport.UDPDialer{}, server.Addr(), server.clientTLSConfig)
+	_, err := resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"a.example.", "b.example.", "c.example.", "d.example.", "e.example."} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := resolver.Query(context.Background(), mustNewQuestion(t, name, dnsmessage.TypeA))
+			require.NoError(t, err)
+			require.Equal(t, name, resp.Questions[0].Name.String())
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), server.accepted.Load())
+}
+
+func TestQUICResolver_ReconnectsAfterServerClose(t *testing.T) {
+	server := newTestQUICServer(t)
+	server.closeAfterResponse = true
+	resolver := newQUICResolver(&transport.UDPDialer{}, server.Addr(), server.clientTLSConfig)
+	for i := 0; i < 3; i++ {
+		_, err := resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+		require.NoError(t, err)
+		// Wait for the server to close the connection.
+		require.Eventually(t, func() bool {
+			resolver.mu.Lock()
+			defer resolver.mu.Unlock()
+			return resolver.conn.Context().Err() != nil
+		}, time.Second, 10*time.Millisecond)
+	}
+	require.Equal(t, int32(3), server.accepted.Load())
+}
+
+func TestQUICResolver_Timeout(t *testing.T) {
+	server := newTestQUICServer(t)
+	server.ignoreName = "ignored.example."
+	resolver := newQUICResolver(&transport.UDPDialer{}, server.Addr(), server.clientTLSConfig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := resolver.Query(ctx, mustNewQuestion(t, "ignored.example.", dnsmessage.TypeA))
+	require.ErrorIs(t, err, dns.ErrReceive)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The connection is still usable.
+	_, err = resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, int32(1), server.accepted.Load())
+}
+
+func TestQUICResolver_UntrustedCertificate(t *testing.T) {
+	server := newTestQUICServer(t)
+	resolver := NewQUICResolver(&transport.UDPDialer{}, server.Addr(), testServerName)
+	_, err := resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.ErrorIs(t, err, dns.ErrDial)
+}
+
+func TestQUICResolver_DialError(t *testing.T) {
+	pd := transport.FuncPacketDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return nil, errors.New("dial failed")
+	})
+	resolver := NewQUICResolver(pd, "127.0.0.1", testServerName)
+	_, err := resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.ErrorIs(t, err, dns.ErrDial)
+}
+
+func Test_checkResponse(t *testing.T) {
+	q := mustNewQuestion(t, "example.com.", dnsmessage.TypeA)
+	resp := &dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true},
+		Questions: []dnsmessage.Question{mustNewQuestion(t, "EXAMPLE.com.", dnsmessage.TypeA)},
+	}
+	require.NoError(t, checkResponse(q, resp))
+
+	resp.ID = 1
+	require.Error(t, checkResponse(q, resp))
+	resp.ID = 0
+	resp.Questions[0].Type = dnsmessage.TypeAAAA
+	require.Error(t, checkResponse(q, resp))
+}
+
+/********** Test Utilities **********/
+
+const testServerName = "dns.test"
+
+func mustNewQuestion(t *testing.T, domain string, qtype dnsmessage.Type) dnsmessage.Question {
+	q, err := dns.NewQuestion(domain, qtype)
+	require.NoError(t, err)
+	return *q
+}
+
+// newTestCertificate creates a self-signed certificate for name, and a pool that trusts it.
+func newTestCertificate(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
+
+// answerResolver answers every question with one A record.
+var answerResolver = dns.FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	return &dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RecursionAvailable: true},
+		Questions: []dnsmessage.Question{q},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}},
+	}, nil
+})
+
+// testQUICServer is a DNS-over-QUIC server that counts the accepted connections.
+type testQUICServer struct {
+	listener        *quic.Listener
+	clientTLSConfig *tls.Config
+	accepted        atomic.Int32
+
+	// closeAfterResponse makes the server close the connection after each response.
+	closeAfterResponse bool
+	// ignoreName makes the server never answer queries for that name.
+	ignoreName string
+}
+
+func newTestQUICServer(t *testing.T) *testQUICServer {
+	cert, roots := newTestCertificate(t, testServerName)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"doq"}}
+	listener, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	s := &testQUICServer{
+		listener:        listener,
+		clientTLSConfig: &tls.Config{ServerName: testServerName, RootCAs: roots},
+	}
+	go s.serve()
+	return s
+}
+
+func (s *testQUICServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testQUICServer) serve() {
+	for {
+		conn, err := s.listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		s.accepted.Add(1)
+		go func() {
+			for {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				go s.handleStream(conn, stream)
+			}
+		}()
+	}
+}
+
+func (s *testQUICServer) handleStream(conn quic.Connection, stream quic.Stream) {
+	defer stream.Close()
+	var msgLen uint16
+	if err := binary.Read(stream, binary.BigEndian, &msgLen); err != nil {
+		return
+	}
+	request := make([]byte, msgLen)
+	if _, err := io.ReadFull(stream, request); err != nil {
+		return
+	}
+	var req dnsmessage.Message
+	if err := req.Unpack(request); err != nil || req.ID != 0 || len(req.Questions) != 1 {
+		stream.CancelWrite(0)
+		return
+	}
+	if req.Questions[0].Name.String() == s.ignoreName {
+		<-conn.Context().Done()
+		return
+	}
+	resp, err := answerResolver.Query(context.Background(), req.Questions[0])
+	if err != nil {
+		return
+	}
+	out, err := resp.AppendPack(make([]byte, 2, 514))
+	if err != nil {
+		return
+	}
+	binary.BigEndian.PutUint16(out, uint16(len(out)-2))
+	stream.Write(out)
+	if s.closeAfterResponse {
+		stream.Close()
+		// Give the client time to receive the response before closing.
+		time.Sleep(10 * time.Millisecond)
+		conn.CloseWithError(0, "")
+	}
+}
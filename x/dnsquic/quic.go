@@ -0,0 +1,129 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dnsquic provides DNS resolvers that run over QUIC: [DNS-over-QUIC] and [DNS-over-HTTPS] with HTTP/3.
+// They complement the resolvers in package [github.com/Jigsaw-Code/outline-sdk/dns], and help in networks that
+// throttle or block TCP connections to resolvers, but not UDP.
+//
+// [DNS-over-QUIC]: https://datatracker.ietf.org/doc/html/rfc9250
+// [DNS-over-HTTPS]: https://datatracker.ietf.org/doc/html/rfc8484
+package dnsquic
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/Jigsaw-Code/outline-sdk/dns"
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// connectedPacketConn adapts a connected [net.Conn], as returned by a [transport.PacketDialer], to the
+// [net.PacketConn] interface used by QUIC. All packets are exchanged with the connected address.
+type connectedPacketConn struct {
+	net.Conn
+}
+
+var _ net.PacketConn = (*connectedPacketConn)(nil)
+
+func (c *connectedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.Read(p)
+	return n, c.RemoteAddr(), err
+}
+
+func (c *connectedPacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	return c.Write(p)
+}
+
+// SetReadBuffer sets the receive buffer size if the connection supports it. QUIC uses it to increase the buffer,
+// and logs a warning if the method is missing.
+func (c *connectedPacketConn) SetReadBuffer(bytes int) error {
+	if conn, ok := c.Conn.(interface{ SetReadBuffer(int) error }); ok {
+		return conn.SetReadBuffer(bytes)
+	}
+	return nil
+}
+
+// SetWriteBuffer sets the send buffer size if the connection supports it.
+func (c *connectedPacketConn) SetWriteBuffer(bytes int) error {
+	if conn, ok := c.Conn.(interface{ SetWriteBuffer(int) error }); ok {
+		return conn.SetWriteBuffer(bytes)
+	}
+	return nil
+}
+
+// dialQUIC establishes a QUIC connection to addr over a connection created by pd.
+// The packet connection is closed when the QUIC connection is closed.
+func dialQUIC(ctx context.Context, pd transport.PacketDialer, addr string, tlsConf *tls.Config, quicConf *quic.Config) (quic.EarlyConnection, error) {
+	conn, err := pd.DialPacket(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	remoteAddr := conn.RemoteAddr()
+	if remoteAddr == nil {
+		remoteAddr = &net.UDPAddr{}
+	}
+	qconn, err := quic.DialEarly(ctx, &connectedPacketConn{conn}, remoteAddr, tlsConf, quicConf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go func() {
+		<-qconn.Context().Done()
+		conn.Close()
+	}()
+	return qconn, nil
+}
+
+// ensurePort adds defaultPort to address if it has no port.
+func ensurePort(address string, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(address, defaultPort)
+	}
+	return address
+}
+
+// NewHTTP3Resolver creates a [dns.Resolver] that implements the [DNS-over-HTTPS] protocol over [HTTP/3], using a
+// [transport.PacketDialer] to connect to the resolverAddr, and the url as the DoH template URI.
+// It's like [dns.NewHTTPSResolver], but uses QUIC instead of TCP, which is useful in networks that throttle
+// TCP to resolvers, but not UDP.
+//
+// [DNS-over-HTTPS]: https://datatracker.ietf.org/doc/html/rfc8484
+// [HTTP/3]: https://datatracker.ietf.org/doc/html/rfc9114
+func NewHTTP3Resolver(pd transport.PacketDialer, resolverAddr string, url string) dns.Resolver {
+	return newHTTP3Resolver(pd, resolverAddr, url, nil)
+}
+
+func newHTTP3Resolver(pd transport.PacketDialer, resolverAddr string, url string, tlsConf *tls.Config) dns.Resolver {
+	resolverAddr = ensurePort(resolverAddr, "443")
+	httpClient := &http.Client{
+		Transport: &http3.Transport{
+			TLSClientConfig: tlsConf,
+			// Connect to the resolver address, regardless of the host in the URL.
+			Dial: func(ctx context.Context, _ string, tlsConf *tls.Config, quicConf *quic.Config) (quic.EarlyConnection, error) {
+				conn, err := dialQUIC(ctx, pd, resolverAddr, tlsConf, quicConf)
+				if err != nil {
+					return nil, fmt.Errorf("%w: %w", dns.ErrDial, err)
+				}
+				return conn, nil
+			},
+		},
+	}
+	// The StreamDialer is not used, since the client makes the connections.
+	return dns.NewHTTPSResolver(nil, resolverAddr, url, dns.WithHTTPClient(httpClient))
+}
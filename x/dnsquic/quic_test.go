@@ -0,0 +1,77 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dnsquic
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-sdk/dns"
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestHTTP3Resolver(t *testing.T) {
+	cert, roots := newTestCertificate(t, testServerName)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	var requests atomic.Int32
+	dnsServer, err := dns.NewServer(answerResolver, dns.ServerOptions{})
+	require.NoError(t, err)
+	defer dnsServer.Close()
+	h3Server := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			require.Equal(t, 3, r.ProtoMajor)
+			dnsServer.ServeHTTP(w, r)
+		}),
+	}
+	go h3Server.Serve(conn)
+	defer h3Server.Close()
+
+	url := "https://" + testServerName + "/dns-query"
+	resolver := newHTTP3Resolver(&transport.UDPDialer{}, conn.LocalAddr().String(), url, &tls.Config{RootCAs: roots})
+	for i := 0; i < 2; i++ {
+		resp, err := resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+		require.NoError(t, err)
+		require.Len(t, resp.Answers, 1)
+	}
+	require.Equal(t, int32(2), requests.Load())
+}
+
+func TestHTTP3Resolver_UntrustedCertificate(t *testing.T) {
+	cert, _ := newTestCertificate(t, testServerName)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	h3Server := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		Handler:   http.NotFoundHandler(),
+	}
+	go h3Server.Serve(conn)
+	defer h3Server.Close()
+
+	resolver := NewHTTP3Resolver(&transport.UDPDialer{}, conn.LocalAddr().String(), "https://"+testServerName+"/dns-query")
+	_, err = resolver.Query(context.Background(), mustNewQuestion(t, "example.com.", dnsmessage.TypeA))
+	require.ErrorIs(t, err, dns.ErrReceive)
+}
@@ -0,0 +1,156 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+
+	"github.com/Jigsaw-Code/outline-sdk/dns"
+	"github.com/Jigsaw-Code/outline-sdk/x/configurl"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var debugLog log.Logger = *log.New(io.Discard, "", 0)
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags...]\n", path.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+}
+
+// newUpstreamResolver creates the resolver for an upstream URL of the form udp://host[:port], tcp://host[:port],
+// tls://host[:port] or https://host[:port]/path.
+func newUpstreamResolver(providers *configurl.ProviderContainer, transportConfig string, upstream string) (dns.Resolver, error) {
+	upstreamURL, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream URL: %w", err)
+	}
+	if upstreamURL.Host == "" {
+		return nil, fmt.Errorf("missing host in upstream URL %q", upstream)
+	}
+	switch upstreamURL.Scheme {
+	case "udp":
+		pd, err := providers.NewPacketDialer(context.Background(), transportConfig)
+		if err != nil {
+			return nil, fmt.Errorf("could not create packet dialer: %w", err)
+		}
+		return dns.NewUDPResolver(pd, upstreamURL.Host), nil
+	case "tcp", "tls", "https":
+		sd, err := providers.NewStreamDialer(context.Background(), transportConfig)
+		if err != nil {
+			return nil, fmt.Errorf("could not create stream dialer: %w", err)
+		}
+		switch upstreamURL.Scheme {
+		case "tcp":
+			return dns.NewTCPResolver(sd, upstreamURL.Host), nil
+		case "tls":
+			return dns.NewTLSResolver(sd, upstreamURL.Host, upstreamURL.Hostname()), nil
+		default:
+			return dns.NewHTTPSResolver(sd, upstreamURL.Host, upstreamURL.String()), nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme %q", upstreamURL.Scheme)
+	}
+}
+
+func main() {
+	verboseFlag := flag.Bool("v", false, "Enable debug output")
+	listenFlag := flag.String("listen", "127.0.0.1:53", "The address to serve DNS over UDP and TCP on")
+	httpFlag := flag.String("http", "", "If set, the address to serve DNS-over-HTTPS on, without TLS, at path /dns-query")
+	upstreamFlag := flag.String("upstream", "https://8.8.8.8/dns-query", "The upstream resolver, as udp://host[:port], tcp://host[:port], tls://host[:port] or https://host[:port]/path")
+	transportFlag := flag.String("transport", "", "The transport for the connection to the upstream resolver")
+	cacheFlag := flag.Int("cache", 1000, "Maximum number of cached responses. Use 0 to disable the cache")
+	qpsFlag := flag.Float64("qps", 100, "Maximum queries per second per client IP. Use 0 to disable rate limiting")
+
+	flag.Parse()
+	if *verboseFlag {
+		debugLog = *log.New(os.Stderr, "[DEBUG] ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+	}
+
+	resolver, err := newUpstreamResolver(configurl.NewDefaultProviders(), *transportFlag, *upstreamFlag)
+	if err != nil {
+		log.Fatalf("Could not create upstream resolver: %v", err)
+	}
+	if *cacheFlag > 0 {
+		resolver, err = dns.NewCachingResolver(resolver, dns.CachingResolverOptions{MaxEntries: *cacheFlag})
+		if err != nil {
+			log.Fatalf("Could not create cache: %v", err)
+		}
+	}
+	upstream := resolver
+	resolver = dns.FuncResolver(func(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
+		resp, err := upstream.Query(ctx, q)
+		if err != nil {
+			debugLog.Printf("Query %v %v failed: %v", q.Name, q.Type, err)
+		} else {
+			debugLog.Printf("Query %v %v: %v, %v answers", q.Name, q.Type, resp.RCode, len(resp.Answers))
+		}
+		return resp, err
+	})
+
+	server, err := dns.NewServer(resolver, dns.ServerOptions{QueriesPerSecond: *qpsFlag})
+	if err != nil {
+		log.Fatalf("Could not create server: %v", err)
+	}
+
+	packetConn, err := net.ListenPacket("udp", *listenFlag)
+	if err != nil {
+		log.Fatalf("Could not listen on UDP: %v", err)
+	}
+	listener, err := net.Listen("tcp", *listenFlag)
+	if err != nil {
+		log.Fatalf("Could not listen on TCP: %v", err)
+	}
+	serveErrs := make(chan error, 3)
+	go func() { serveErrs <- server.ServeUDP(packetConn) }()
+	go func() { serveErrs <- server.ServeTCP(listener) }()
+	log.Printf("Serving DNS on %v (UDP and TCP), forwarding to %v", *listenFlag, *upstreamFlag)
+
+	var httpServer *http.Server
+	if *httpFlag != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/dns-query", server)
+		httpServer = &http.Server{Addr: *httpFlag, Handler: mux}
+		go func() { serveErrs <- httpServer.ListenAndServe() }()
+		log.Printf("Serving DNS-over-HTTPS on http://%v/dns-query", *httpFlag)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-sig:
+	case err := <-serveErrs:
+		if !errors.Is(err, dns.ErrServerClosed) {
+			log.Printf("Server failed: %v", err)
+		}
+	}
+	if httpServer != nil {
+		httpServer.Close()
+	}
+	server.Close()
+}
@@ -30,7 +30,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Jigsaw-Code/outline-sdk/transport"
 	"github.com/Jigsaw-Code/outline-sdk/x/configurl"
+	"github.com/Jigsaw-Code/outline-sdk/x/pcap"
 	"github.com/lmittmann/tint"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
@@ -72,6 +74,7 @@ func overrideAddress(original string, newHost string, newPort string) (string, e
 func main() {
 	verboseFlag := flag.Bool("v", false, "Enable debug output")
 	tlsKeyLogFlag := flag.String("tls-key-log", "", "Filename to write the TLS key log to allow for decryption on Wireshark")
+	pcapFlag := flag.String("pcap", "", "Filename to write a pcapng capture of the TCP streams to open in Wireshark")
 	protoFlag := flag.String("proto", "h1", "HTTP version to use (h1, h2, h3)")
 	transportFlag := flag.String("transport", "", "Transport config")
 	addressFlag := flag.String("address", "", "Address to connect to. If empty, use the URL authority")
@@ -128,6 +131,27 @@ func main() {
 		tlsConfig.KeyLogWriter = f
 	}
 	providers := configurl.NewDefaultProviders()
+	if *pcapFlag != "" {
+		f, err := os.Create(*pcapFlag)
+		if err != nil {
+			slog.Error("Failed to create pcap file", "error", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		pcapWriter, err := pcap.NewWriter(f)
+		if err != nil {
+			slog.Error("Failed to write pcap header", "error", err)
+			os.Exit(1)
+		}
+		providers.StreamDialers.BaseInstance, err = pcap.NewStreamDialer(&transport.TCPDialer{}, pcapWriter)
+		if err != nil {
+			slog.Error("Failed to create pcap dialer", "error", err)
+			os.Exit(1)
+		}
+		if *protoFlag == "h3" {
+			slog.Warn("The pcap capture only records TCP streams, so it will be empty for h3")
+		}
+	}
 	if *protoFlag == "h1" || *protoFlag == "h2" {
 		dialer, err := providers.NewStreamDialer(context.Background(), *transportFlag)
 		if err != nil {
@@ -22,9 +22,17 @@ type App struct {
 type RoutingConfig struct {
 	TunDeviceName        string
 	TunDeviceIP          string
+	TunDeviceIPv6        string
 	TunDeviceMTU         int
-	TunGatewayCIDR       string
 	RoutingTableID       int
 	RoutingTablePriority int
 	DNSServerIP          string
+	// JournalDir holds the journals of the system changes, used to revert them after a crash.
+	JournalDir string
+	// KillSwitchTable is the nftables table of the kill switch.
+	KillSwitchTable string
+	// BlockIPv6 makes IPv6 destinations unreachable instead of routing them through the proxy.
+	BlockIPv6 bool
+	// KillSwitch blocks all the traffic that doesn't go through the proxy, even if the CLI crashes.
+	KillSwitch bool
 }
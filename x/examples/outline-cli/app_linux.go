@@ -15,32 +15,79 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
+	"net/netip"
 	"os"
 	"os/signal"
-	"sync"
+	"path/filepath"
 
+	"github.com/Jigsaw-Code/outline-sdk/x/tun"
 	"golang.org/x/sys/unix"
 )
 
+func (c *RoutingConfig) routingJournalPath() string {
+	return filepath.Join(c.JournalDir, "routing.json")
+}
+
+func (c *RoutingConfig) killSwitchJournalPath() string {
+	return filepath.Join(c.JournalDir, "killswitch.json")
+}
+
+// Recover reverts the system changes left behind if a previous run crashed.
+func (app App) Recover() error {
+	err := errors.Join(
+		tun.RecoverKillSwitch(app.RoutingConfig.killSwitchJournalPath()),
+		tun.RecoverRouting(app.RoutingConfig.routingJournalPath()),
+		recoverSystemDNSServer(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to recover system settings: %w", err)
+	}
+	return nil
+}
+
 func (app App) Run() error {
-	// this WaitGroup must Wait() after tun is closed
-	trafficCopyWg := &sync.WaitGroup{}
-	defer trafficCopyWg.Wait()
+	// Revert the changes left behind if the previous run crashed, before they affect the server IP resolution
+	if err := app.Recover(); err != nil {
+		return err
+	}
 
-	tun, err := newTunDevice(app.RoutingConfig.TunDeviceName, app.RoutingConfig.TunDeviceIP)
+	tunIP, err := netip.ParseAddr(app.RoutingConfig.TunDeviceIP)
 	if err != nil {
-		return fmt.Errorf("failed to create tun device: %w", err)
+		return fmt.Errorf("invalid tun device IP: %w", err)
+	}
+	addresses := []netip.Prefix{netip.PrefixFrom(tunIP, tunIP.BitLen())}
+	destinations := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}
+	var blocked []netip.Prefix
+
+	// IPv6 is either routed through the proxy or blocked, so that it never bypasses the proxy
+	ipv6Enabled, err := isIPv6Enabled()
+	if err != nil {
+		logging.Warn.Printf("failed to detect IPv6 support, assuming it's enabled: %v\n", err)
+		ipv6Enabled = true
+	}
+	if ipv6Enabled && app.RoutingConfig.BlockIPv6 {
+		blocked = append(blocked, netip.MustParsePrefix("::/0"))
+	} else if ipv6Enabled {
+		tunIPv6, err := netip.ParseAddr(app.RoutingConfig.TunDeviceIPv6)
+		if err != nil {
+			return fmt.Errorf("invalid tun device IPv6: %w", err)
+		}
+		addresses = append(addresses, netip.PrefixFrom(tunIPv6, tunIPv6.BitLen()))
+		destinations = append(destinations, netip.MustParsePrefix("::/0"))
 	}
-	defer tun.Close()
 
-	// disable IPv6 before resolving Shadowsocks server IP
-	prevIPv6, err := enableIPv6(false)
+	tunDevice, err := tun.New(tun.Config{
+		Name:      app.RoutingConfig.TunDeviceName,
+		Addresses: addresses,
+		MTU:       app.RoutingConfig.TunDeviceMTU,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to disable IPv6: %w", err)
+		return fmt.Errorf("failed to create tun device: %w", err)
 	}
-	defer enableIPv6(prevIPv6)
+	defer tunDevice.Close()
 
 	ss, err := NewOutlineDevice(*app.TransportConfig)
 	if err != nil {
@@ -48,20 +95,34 @@ func (app App) Run() error {
 	}
 	defer ss.Close()
 
-	ss.Refresh()
+	svrIP, ok := netip.AddrFromSlice(ss.GetServerIP())
+	if !ok {
+		return fmt.Errorf("invalid server IP %v", ss.GetServerIP())
+	}
+	svrIP = svrIP.Unmap()
 
-	// Copy the traffic from tun device to OutlineDevice bidirectionally
-	trafficCopyWg.Add(2)
-	go func() {
-		defer trafficCopyWg.Done()
-		written, err := io.Copy(ss, tun)
-		logging.Info.Printf("tun -> OutlineDevice stopped: %v %v\n", written, err)
-	}()
-	go func() {
-		defer trafficCopyWg.Done()
-		written, err := io.Copy(tun, ss)
-		logging.Info.Printf("OutlineDevice -> tun stopped: %v %v\n", written, err)
-	}()
+	// The kill switch must be in place before the routing, so that no traffic leaks while the routing changes
+	if app.RoutingConfig.KillSwitch {
+		killSwitch, err := tun.SetUpKillSwitch(tun.KillSwitchConfig{
+			TableName:   app.RoutingConfig.KillSwitchTable,
+			DeviceName:  tunDevice.Name(),
+			Allowed:     []netip.Prefix{netip.PrefixFrom(svrIP, svrIP.BitLen())},
+			JournalPath: app.RoutingConfig.killSwitchJournalPath(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set up kill switch: %w", err)
+		}
+		defer func() {
+			if err := killSwitch.Close(); err != nil {
+				logging.Err.Printf("failed to remove kill switch: %v\n", err)
+			} else {
+				logging.Info.Println("kill switch removed")
+			}
+		}()
+		logging.Info.Printf("kill switch enabled, only %v and %v can be reached\n", svrIP, tunDevice.Name())
+	}
+
+	ss.Refresh()
 
 	err = setSystemDNSServer(app.RoutingConfig.DNSServerIP)
 	if err != nil {
@@ -69,14 +130,35 @@ func (app App) Run() error {
 	}
 	defer restoreSystemDNSServer()
 
-	if err := startRouting(ss.GetServerIP().String(), app.RoutingConfig); err != nil {
+	routing, err := tun.SetUpRouting(tun.RoutingConfig{
+		DeviceName:   tunDevice.Name(),
+		Destinations: destinations,
+		// todo: excluding the server IP will cause issues when accessing services on the same server,
+		//       use fwmark to protect the shadowsocks socket instead
+		Bypass:       []netip.Prefix{netip.PrefixFrom(svrIP, svrIP.BitLen())},
+		Blocked:      blocked,
+		TableID:      app.RoutingConfig.RoutingTableID,
+		RulePriority: app.RoutingConfig.RoutingTablePriority,
+		JournalPath:  app.RoutingConfig.routingJournalPath(),
+	})
+	if err != nil {
 		return fmt.Errorf("failed to configure routing: %w", err)
 	}
-	defer stopRouting(app.RoutingConfig.RoutingTableID)
+	defer func() {
+		if err := routing.Close(); err != nil {
+			logging.Err.Printf("failed to clean up routing: %v\n", err)
+		} else {
+			logging.Info.Printf("routing table '%v' has been cleaned up\n", app.RoutingConfig.RoutingTableID)
+		}
+	}()
+	logging.Info.Printf("routing %v except %v through %v, blocking %v\n", destinations, svrIP, tunDevice.Name(), blocked)
 
-	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, os.Interrupt, unix.SIGTERM, unix.SIGHUP)
-	s := <-sigc
-	logging.Info.Printf("received %v, terminating...\n", s)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, unix.SIGTERM, unix.SIGHUP)
+	defer stop()
+	// Copy the traffic between tun device and OutlineDevice bidirectionally until terminated
+	if err := tun.Run(ctx, ss, tunDevice); err != nil {
+		return fmt.Errorf("traffic copy stopped: %w", err)
+	}
+	logging.Info.Printf("received termination signal, terminating...\n")
 	return nil
 }
@@ -21,3 +21,7 @@ import "errors"
 func (App) Run() error {
 	return errors.New("platform not supported")
 }
+
+func (App) Recover() error {
+	return errors.New("platform not supported")
+}
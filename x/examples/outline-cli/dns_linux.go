@@ -15,6 +15,7 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
@@ -34,9 +35,10 @@ type systemDNSBackup struct {
 
 var systemDNSBackups = make([]systemDNSBackup, 0, 2)
 
+const dnsSettingHeader = "# Outline CLI DNS Setting\n"
+
 func setSystemDNSServer(serverHost string) error {
-	setting := []byte(`# Outline CLI DNS Setting
-# The original file has been renamed as resolv[.head].outlinecli.backup
+	setting := []byte(dnsSettingHeader + `# The original file has been renamed as resolv[.head].outlinecli.backup
 nameserver ` + serverHost + "\n")
 
 	err := backupAndWriteFile(resolvConfFile, resolvConfBackupFile, setting)
@@ -101,3 +103,38 @@ func restoreSystemDNSServer() {
 		}
 	}
 }
+
+// recoverSystemDNSServer restores the DNS config files changed by a previous run that didn't exit cleanly.
+// It relies on the backup files and the setting header, because the backup list of that run is lost.
+func recoverSystemDNSServer() error {
+	var recoverErr error
+	for _, backup := range []systemDNSBackup{
+		{original: resolvConfFile, backup: resolvConfBackupFile},
+		{original: resolvConfHeadFile, backup: resolvConfHeadBackupFile},
+	} {
+		_, err := os.Stat(backup.backup)
+		if err == nil {
+			if err := os.Rename(backup.backup, backup.original); err != nil {
+				recoverErr = errors.Join(recoverErr, fmt.Errorf("failed to restore DNS config from backup '%s': %w", backup.backup, err))
+				continue
+			}
+			logging.Info.Printf("DNS config restored from '%s' to '%s'\n", backup.backup, backup.original)
+			continue
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			recoverErr = errors.Join(recoverErr, fmt.Errorf("failed to check the existence of DNS config backup file '%s': %w", backup.backup, err))
+			continue
+		}
+		// no backup - remove the original only if it was created by us
+		data, err := os.ReadFile(backup.original)
+		if err != nil || !bytes.HasPrefix(data, []byte(dnsSettingHeader)) {
+			continue
+		}
+		if err := os.Remove(backup.original); err != nil {
+			recoverErr = errors.Join(recoverErr, fmt.Errorf("failed to remove Outline DNS config file '%s': %w", backup.original, err))
+			continue
+		}
+		logging.Info.Printf("Outline DNS config '%s' has been removed\n", backup.original)
+	}
+	return recoverErr
+}
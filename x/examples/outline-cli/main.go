@@ -40,15 +40,29 @@ func main() {
 		RoutingConfig: &RoutingConfig{
 			TunDeviceName:        "outline233",
 			TunDeviceIP:          "10.233.233.1",
-			TunDeviceMTU:         1500, // todo: read this from netlink
-			TunGatewayCIDR:       "10.233.233.2/32",
+			TunDeviceIPv6:        "fd00:233:233::1",
+			TunDeviceMTU:         1500,
 			RoutingTableID:       233,
 			RoutingTablePriority: 23333,
 			DNSServerIP:          "9.9.9.9",
+			JournalDir:           "/run/outline-cli",
+			KillSwitchTable:      "outline_cli",
 		},
 	}
+	flag.StringVar(&app.RoutingConfig.DNSServerIP, "dns", app.RoutingConfig.DNSServerIP, "The DNS server to configure as the system resolver, such as a local dns-server")
+	flag.BoolVar(&app.RoutingConfig.BlockIPv6, "block-ipv6", false, "Block IPv6 traffic instead of sending it through the proxy")
+	flag.BoolVar(&app.RoutingConfig.KillSwitch, "kill-switch", false, "Block all traffic outside of the proxy, until the CLI exits cleanly or -recover is used")
+	recoverFlag := flag.Bool("recover", false, "Restore the system settings left behind by a crash, and exit")
 	flag.Parse()
 
+	if *recoverFlag {
+		if err := app.Recover(); err != nil {
+			logging.Err.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		logging.Info.Println("system settings recovered")
+		return
+	}
 	if err := app.Run(); err != nil {
 		logging.Err.Printf("%v\n", err)
 	}
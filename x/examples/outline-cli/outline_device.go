@@ -95,11 +95,14 @@ func resolveShadowsocksServerIPFromConfig(transportConfig string) (net.IP, error
 		return nil, fmt.Errorf("invalid server hostname: %w", err)
 	}
 
-	// todo: we only tested IPv4 routing table, need to test IPv6 in the future
+	// prefer IPv4, because IPv6 might be blocked or unavailable on the local network
 	for _, ip := range ipList {
-		if ip = ip.To4(); ip != nil {
-			return ip, nil
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4, nil
 		}
 	}
-	return nil, errors.New("IPv6 only Shadowsocks server is not supported yet")
+	if len(ipList) == 0 {
+		return nil, errors.New("server hostname has no IP address")
+	}
+	return ipList[0], nil
 }
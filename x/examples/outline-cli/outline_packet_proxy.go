@@ -17,8 +17,8 @@ package main
 import (
 	"context"
 	"fmt"
+	"time"
 
-	"github.com/Jigsaw-Code/outline-sdk/dns"
 	"github.com/Jigsaw-Code/outline-sdk/network"
 	"github.com/Jigsaw-Code/outline-sdk/network/dnstruncate"
 	"github.com/Jigsaw-Code/outline-sdk/transport"
@@ -52,19 +52,25 @@ func newOutlinePacketProxy(transportConfig string) (opp *outlinePacketProxy, err
 	return
 }
 
+// maxUDPLossRate is the largest loss rate at which the remote UDP is still preferred over DNS truncation.
+const maxUDPLossRate = 0.5
+
 func (proxy *outlinePacketProxy) testConnectivityAndRefresh(resolverAddr, domain string) error {
 	dialer := transport.PacketListenerDialer{Listener: proxy.remotePl}
-	dnsResolver := dns.NewUDPResolver(dialer, resolverAddr)
-	result, err := connectivity.TestConnectivityWithResolver(context.Background(), dnsResolver, domain)
+	result, err := connectivity.TestPacketQualityWithResolver(context.Background(), dialer, resolverAddr, domain, connectivity.PacketTestConfig{
+		Count:            5,
+		Interval:         50 * time.Millisecond,
+		SkipDatagramSize: true,
+	})
 	if err != nil {
 		logging.Info.Printf("connectivity test failed. Refresh skipped. Error: %v\n", err)
 		return err
 	}
-	if result != nil {
-		logging.Info.Println("remote server cannot handle UDP traffic, switch to DNS truncate mode.")
+	if result.Err != nil || result.LossRate > maxUDPLossRate {
+		logging.Info.Printf("remote server cannot handle UDP traffic (loss=%.0f%%, error=%v), switch to DNS truncate mode.\n", result.LossRate*100, result.Err)
 		return proxy.SetProxy(proxy.fallback)
 	} else {
-		logging.Info.Println("remote server supports UDP, we will delegate all UDP packets to it")
+		logging.Info.Printf("remote server supports UDP (loss=%.0f%%, rtt=%v, jitter=%v), we will delegate all UDP packets to it\n", result.LossRate*100, result.AvgRTT, result.Jitter)
 		return proxy.SetProxy(proxy.remote)
 	}
 }
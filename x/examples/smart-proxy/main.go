@@ -65,6 +65,7 @@ func main() {
 	addrFlag := flag.String("localAddr", "localhost:1080", "Local proxy address")
 	configFlag := flag.String("config", "config.json", "Address of the config file")
 	transportFlag := flag.String("transport", "", "The base transport for the connections")
+	cacheFlag := flag.String("cache", "", "File to persist the found strategy across runs (disabled if empty)")
 	var domainsFlag stringArrayFlagValue
 	flag.Var(&domainsFlag, "domain", "The test domains to find strategies.")
 
@@ -115,6 +116,14 @@ func main() {
 		TestTimeout:  5 * time.Second,
 		StreamDialer: streamDialer,
 		PacketDialer: packetDialer,
+		Diagnose:     *verboseFlag,
+	}
+	if *cacheFlag != "" {
+		cache, err := smart.NewFileStrategyCache(*cacheFlag)
+		if err != nil {
+			log.Fatalf("Could not create strategy cache: %v", err)
+		}
+		finder.Cache = cache
 	}
 
 	fmt.Println("Finding strategy")
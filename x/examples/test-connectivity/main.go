@@ -44,6 +44,10 @@ type connectivityReport struct {
 	Test           testReport  `json:"test"`
 	DNSQueries     []dnsReport `json:"dns_queries,omitempty"`
 	TCPConnections []tcpReport `json:"tcp_connections,omitempty"`
+	// Stream is the result of connecting to the resolver through the transport, for the "tcp" proto.
+	Stream *streamReport `json:"stream,omitempty"`
+	// TLS is the result of the TLS handshake with the domain through the transport, for the "tcp" proto.
+	TLS *streamReport `json:"tls,omitempty"`
 }
 
 type testReport struct {
@@ -74,6 +78,43 @@ type tcpReport struct {
 	Error    string `json:"error"`
 }
 
+// makeTCPReport reports the connection of a stream test to address. The IP and port are from remoteAddr,
+// the address the dialer connected to, if the connection was established.
+func makeTCPReport(address string, remoteAddr net.Addr, result *connectivity.StreamTestResult) tcpReport {
+	hostname, port, _ := net.SplitHostPort(address)
+	report := tcpReport{Hostname: hostname, Port: port}
+	if ip := net.ParseIP(hostname); ip != nil {
+		report.IP = ip.String()
+	}
+	if remoteAddr != nil {
+		if ip, port, err := net.SplitHostPort(remoteAddr.String()); err == nil {
+			report.IP, report.Port = ip, port
+		}
+	}
+	if result.Err != nil && result.Err.Op == "connect" {
+		report.Error = result.Err.Err.Error()
+	}
+	return report
+}
+
+type streamReport struct {
+	Address     string     `json:"address"`
+	DurationMs  int64      `json:"duration_ms"`
+	ConnectMs   int64      `json:"connect_ms"`
+	HandshakeMs int64      `json:"handshake_ms,omitempty"`
+	Error       *errorJSON `json:"error"`
+}
+
+func makeStreamReport(address string, result *connectivity.StreamTestResult) *streamReport {
+	return &streamReport{
+		Address:     address,
+		DurationMs:  result.Timings.Total.Milliseconds(),
+		ConnectMs:   result.Timings.Connect.Milliseconds(),
+		HandshakeMs: result.Timings.Handshake.Milliseconds(),
+		Error:       makeErrorRecord(result.Err),
+	}
+}
+
 type errorJSON struct {
 	// TODO: add Shadowsocks/Transport error
 	Op string `json:"op,omitempty"`
@@ -104,6 +145,75 @@ func unwrapAll(err error) error {
 	}
 }
 
+type classificationReport struct {
+	Domain    string        `json:"domain"`
+	Address   string        `json:"address,omitempty"`
+	Time      time.Time     `json:"time"`
+	DNSErrors []string      `json:"dns_errors,omitempty"`
+	Verdicts  []verdictJSON `json:"verdicts"`
+}
+
+type verdictJSON struct {
+	Interference string   `json:"interference"`
+	Evidence     []string `json:"evidence"`
+}
+
+func (r classificationReport) IsSuccess() bool {
+	return len(r.Verdicts) == 0
+}
+
+// classify probes the domain directly, resolving it with the resolvers over UDP and, if transportConfig is set,
+// with a trusted resolver over TCP through the transport, and classifies the interference found.
+func classify(ctx context.Context, domain string, resolverHosts []string, transportConfig string) (*classificationReport, error) {
+	var resolvers []connectivity.ProbeResolver
+	if transportConfig != "" {
+		streamDialer, err := configurl.NewDefaultProviders().NewStreamDialer(ctx, transportConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create StreamDialer: %w", err)
+		}
+		resolverAddress := net.JoinHostPort(resolverHosts[0], "53")
+		resolvers = append(resolvers, connectivity.ProbeResolver{
+			Name:     "tcp:" + resolverAddress + " over transport",
+			Resolver: dns.NewTCPResolver(streamDialer, resolverAddress),
+			Trusted:  true,
+		})
+	}
+	for _, resolverHost := range resolverHosts {
+		resolverAddress := net.JoinHostPort(resolverHost, "53")
+		resolvers = append(resolvers, connectivity.ProbeResolver{
+			Name:     "udp:" + resolverAddress,
+			Resolver: dns.NewUDPResolver(&transport.UDPDialer{}, resolverAddress),
+		})
+	}
+	startTime := time.Now()
+	obs, err := connectivity.Probe(ctx, connectivity.ProbeConfig{
+		Domain:    domain,
+		Resolvers: resolvers,
+		Dialer:    &transport.TCPDialer{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	report := &classificationReport{
+		Domain:   obs.Domain,
+		Address:  obs.Address,
+		Time:     startTime.UTC().Truncate(time.Second),
+		Verdicts: make([]verdictJSON, 0),
+	}
+	for _, dnsObs := range obs.DNS {
+		if dnsObs.Err != nil {
+			report.DNSErrors = append(report.DNSErrors, fmt.Sprintf("%v: %v", dnsObs.Resolver, dnsObs.Err))
+		}
+	}
+	for _, verdict := range connectivity.Classify(obs, connectivity.ClassifyOptions{}) {
+		report.Verdicts = append(report.Verdicts, verdictJSON{
+			Interference: string(verdict.Interference),
+			Evidence:     verdict.Evidence,
+		})
+	}
+	return report, nil
+}
+
 func (r connectivityReport) IsSuccess() bool {
 	if r.Test.Error == nil {
 		return true
@@ -119,8 +229,7 @@ func init() {
 	}
 }
 func newTCPTraceDialer(
-	onDNS func(ctx context.Context, domain string) func(di httptrace.DNSDoneInfo),
-	onDial func(ctx context.Context, network, addr string, connErr error)) transport.StreamDialer {
+	onDNS func(ctx context.Context, domain string) func(di httptrace.DNSDoneInfo)) transport.StreamDialer {
 	dialer := &transport.TCPDialer{}
 	var onDNSDone func(di httptrace.DNSDoneInfo)
 	return transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
@@ -134,9 +243,6 @@ func newTCPTraceDialer(
 					onDNSDone = nil
 				}
 			},
-			ConnectDone: func(network, addr string, connErr error) {
-				onDial(ctx, network, addr, connErr)
-			},
 		})
 		return dialer.DialStream(ctx, addr)
 	})
@@ -171,6 +277,7 @@ func main() {
 	reportToFlag := flag.String("report-to", "", "URL to send JSON error reports to")
 	reportSuccessFlag := flag.Float64("report-success-rate", 0.1, "Report success to collector with this probability - must be between 0 and 1")
 	reportFailureFlag := flag.Float64("report-failure-rate", 1, "Report failure to collector with this probability - must be between 0 and 1")
+	classifyFlag := flag.Bool("classify", false, "Probe the domain directly and classify the network interference, instead of testing the transport. The transport, if set, is used to reach a trusted resolver")
 
 	flag.Parse()
 
@@ -221,6 +328,25 @@ func main() {
 		reportCollector = &report.WriteCollector{Writer: os.Stdout}
 	}
 
+	if *classifyFlag {
+		var resolverHosts []string
+		for _, resolverHost := range strings.Split(*resolverFlag, ",") {
+			resolverHosts = append(resolverHosts, strings.TrimSpace(resolverHost))
+		}
+		r, err := classify(context.Background(), *domainFlag, resolverHosts, *transportFlag)
+		if err != nil {
+			slog.Error("Classification failed to run", "error", err)
+			os.Exit(1)
+		}
+		if err := reportCollector.Collect(context.Background(), r); err != nil {
+			slog.Warn("Failed to collect report", "error", err)
+		}
+		if !r.IsSuccess() {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Things to test:
 	// - TCP working. Where's the error?
 	// - UDP working
@@ -237,9 +363,9 @@ func main() {
 		for _, proto := range strings.Split(*protoFlag, ",") {
 			proto = strings.TrimSpace(proto)
 			var resolver dns.Resolver
+			var streamDialer transport.StreamDialer
 			var mu sync.Mutex
 			dnsReports := make([]dnsReport, 0)
-			tcpReports := make([]tcpReport, 0)
 			providers := configurl.NewDefaultProviders()
 			onDNS := func(ctx context.Context, domain string) func(di httptrace.DNSDoneInfo) {
 				dnsStart := time.Now()
@@ -260,37 +386,15 @@ func main() {
 					mu.Unlock()
 				}
 			}
-			providers.StreamDialers.BaseInstance = transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
-				hostname, _, err := net.SplitHostPort(addr)
-				if err != nil {
-					return nil, err
-				}
-				onDial := func(ctx context.Context, network, addr string, connErr error) {
-					ip, port, err := net.SplitHostPort(addr)
-					if err != nil {
-						return
-					}
-					report := tcpReport{
-						Hostname: hostname,
-						IP:       ip,
-						Port:     port,
-					}
-					if connErr != nil {
-						report.Error = connErr.Error()
-					}
-					mu.Lock()
-					tcpReports = append(tcpReports, report)
-					mu.Unlock()
-				}
-				return newTCPTraceDialer(onDNS, onDial).DialStream(ctx, addr)
-			})
+			providers.StreamDialers.BaseInstance = newTCPTraceDialer(onDNS)
 			providers.PacketDialers.BaseInstance = transport.FuncPacketDialer(func(ctx context.Context, addr string) (net.Conn, error) {
 				return newUDPTraceDialer(onDNS).DialPacket(ctx, addr)
 			})
 
 			switch proto {
 			case "tcp":
-				streamDialer, err := providers.NewStreamDialer(context.Background(), *transportFlag)
+				var err error
+				streamDialer, err = providers.NewStreamDialer(context.Background(), *transportFlag)
 				if err != nil {
 					slog.Error("Failed to create StreamDialer", "error", err)
 					os.Exit(1)
@@ -315,16 +419,44 @@ func main() {
 				os.Exit(1)
 			}
 			testDuration := time.Since(startTime)
-			if result == nil {
-				success = true
-			}
 			slog.Debug("Test done", "proto", proto, "resolver", resolverAddress, "result", result)
+			var streamResult, tlsResult *streamReport
+			tcpReports := make([]tcpReport, 0)
+			if streamDialer != nil {
+				// Record the address each test connected to, for the TCP connections report.
+				var remoteAddr net.Addr
+				recordingDialer := transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+					remoteAddr = nil
+					conn, err := streamDialer.DialStream(ctx, addr)
+					if err == nil {
+						remoteAddr = conn.RemoteAddr()
+					}
+					return conn, err
+				})
+				// Tell connection failures apart from DNS failures, and check that TLS is not blocked.
+				streamTest, err := connectivity.TestStreamConnectivity(context.Background(), recordingDialer, resolverAddress)
+				if err != nil {
+					slog.Error("Stream test failed to run", "error", err)
+					os.Exit(1)
+				}
+				streamResult = makeStreamReport(resolverAddress, streamTest)
+				tcpReports = append(tcpReports, makeTCPReport(resolverAddress, remoteAddr, streamTest))
+				tlsAddress := net.JoinHostPort(strings.TrimSuffix(*domainFlag, "."), "443")
+				tlsTest, err := connectivity.TestTLSConnectivity(context.Background(), recordingDialer, tlsAddress, nil)
+				if err != nil {
+					slog.Error("TLS test failed to run", "error", err)
+					os.Exit(1)
+				}
+				tlsResult = makeStreamReport(tlsAddress, tlsTest)
+				tcpReports = append(tcpReports, makeTCPReport(tlsAddress, remoteAddr, tlsTest))
+				slog.Debug("Stream tests done", "stream", streamTest.Err, "tls", tlsTest.Err)
+			}
 			sanitizedConfig, err := configurl.SanitizeConfig(*transportFlag)
 			if err != nil {
 				slog.Error("Failed to sanitize config", "error", err)
 				os.Exit(1)
 			}
-			var r report.Report = connectivityReport{
+			r := connectivityReport{
 				Test: testReport{
 					Resolver: resolverAddress,
 					Proto:    proto,
@@ -336,6 +468,11 @@ func main() {
 				},
 				DNSQueries:     dnsReports,
 				TCPConnections: tcpReports,
+				Stream:         streamResult,
+				TLS:            tlsResult,
+			}
+			if r.IsSuccess() {
+				success = true
 			}
 			if reportCollector != nil {
 				err = reportCollector.Collect(context.Background(), r)
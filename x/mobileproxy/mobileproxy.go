@@ -208,6 +208,21 @@ func toWriter(logWriter LogWriter) io.Writer {
 // The strategies to search are given in the searchConfig. An example can be found in
 // https://github.com/Jigsaw-Code/outline-sdk/x/examples/smart-proxy/config.json
 func NewSmartStreamDialer(testDomains *StringList, searchConfig string, logWriter LogWriter) (*StreamDialer, error) {
+	return newSmartStreamDialer(testDomains, searchConfig, logWriter, nil, "")
+}
+
+// NewSmartStreamDialerWithCache is like [NewSmartStreamDialer], but it saves the selected strategy in the file
+// at cachePath for the network identified by networkID (e.g. a hash of the default gateway and Wi-Fi SSID),
+// and tries it first the next time the dialer is created on that network.
+func NewSmartStreamDialerWithCache(testDomains *StringList, searchConfig string, logWriter LogWriter, cachePath string, networkID string) (*StreamDialer, error) {
+	cache, err := smart.NewFileStrategyCache(cachePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create strategy cache: %w", err)
+	}
+	return newSmartStreamDialer(testDomains, searchConfig, logWriter, cache, networkID)
+}
+
+func newSmartStreamDialer(testDomains *StringList, searchConfig string, logWriter LogWriter, cache smart.StrategyCache, networkID string) (*StreamDialer, error) {
 	logBytesWriter := toWriter(logWriter)
 	// TODO: inject the base dialer for tests.
 	finder := smart.StrategyFinder{
@@ -215,6 +230,8 @@ func NewSmartStreamDialer(testDomains *StringList, searchConfig string, logWrite
 		TestTimeout:  5 * time.Second,
 		StreamDialer: &transport.TCPDialer{},
 		PacketDialer: &transport.UDPDialer{},
+		Cache:        cache,
+		NetworkID:    networkID,
 	}
 	dialer, err := finder.NewDialer(context.Background(), testDomains.list, []byte(searchConfig))
 	if err != nil {
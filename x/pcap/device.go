@@ -0,0 +1,64 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcap
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/network"
+)
+
+// ipDevice is a [network.IPDevice] that records the packets going through it.
+type ipDevice struct {
+	network.IPDevice
+	w *Writer
+}
+
+var _ network.IPDevice = (*ipDevice)(nil)
+
+// NewIPDevice creates a [network.IPDevice] that forwards all calls to device, and records the packets to w.
+// Packets passed to Write are recorded as outbound, and packets returned by Read are recorded as inbound.
+//
+// Failures to record a packet are not reported to the caller, so that the capture never disrupts the traffic.
+// The returned device doesn't implement [io.ReaderFrom] or [io.WriterTo], so that [io.Copy] goes through
+// Read and Write.
+func NewIPDevice(device network.IPDevice, w *Writer) (network.IPDevice, error) {
+	if device == nil {
+		return nil, errors.New("argument device must not be nil")
+	}
+	if w == nil {
+		return nil, errors.New("argument w must not be nil")
+	}
+	return &ipDevice{IPDevice: device, w: w}, nil
+}
+
+// Read implements [network.IPDevice].Read.
+func (d *ipDevice) Read(p []byte) (int, error) {
+	n, err := d.IPDevice.Read(p)
+	if n > 0 {
+		d.w.WritePacket(time.Now(), DirectionInbound, p[:n])
+	}
+	return n, err
+}
+
+// Write implements [network.IPDevice].Write.
+func (d *ipDevice) Write(b []byte) (int, error) {
+	n, err := d.IPDevice.Write(b)
+	if err == nil {
+		d.w.WritePacket(time.Now(), DirectionOutbound, b)
+	}
+	return n, err
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcap
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/require"
+)
+
+type loopbackDevice struct {
+	packets [][]byte
+}
+
+func (d *loopbackDevice) Close() error { return nil }
+func (d *loopbackDevice) MTU() int     { return 1500 }
+
+func (d *loopbackDevice) Read(p []byte) (int, error) {
+	if len(d.packets) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, d.packets[0])
+	d.packets = d.packets[1:]
+	return n, nil
+}
+
+func (d *loopbackDevice) Write(b []byte) (int, error) {
+	d.packets = append(d.packets, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func TestIPDevice(t *testing.T) {
+	var capture bytes.Buffer
+	w, err := NewWriter(&capture)
+	require.NoError(t, err)
+	device, err := NewIPDevice(&loopbackDevice{}, w)
+	require.NoError(t, err)
+
+	_, err = device.Write([]byte{0x45, 1, 2})
+	require.NoError(t, err)
+	buf := make([]byte, device.MTU())
+	n, err := device.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	_, err = device.Read(buf)
+	require.ErrorIs(t, err, io.EOF)
+
+	reader, err := pcapgo.NewNgReader(&capture, pcapgo.DefaultNgReaderOptions)
+	require.NoError(t, err)
+	require.Equal(t, 1, reader.NInterfaces())
+	for range 2 {
+		data, ci, err := reader.ReadPacketData()
+		require.NoError(t, err)
+		require.Equal(t, []byte{0x45, 1, 2}, data)
+		require.Equal(t, 3, ci.Length)
+	}
+	_, _, err = reader.ReadPacketData()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestNewIPDevice_NilArguments(t *testing.T) {
+	w, err := NewWriter(io.Discard)
+	require.NoError(t, err)
+	_, err = NewIPDevice(nil, w)
+	require.Error(t, err)
+	_, err = NewIPDevice(&loopbackDevice{}, nil)
+	require.Error(t, err)
+}
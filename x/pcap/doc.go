@@ -0,0 +1,34 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package pcap records traffic in the [pcapng] format, so it can be inspected with tools like [Wireshark],
+without the need for a privileged capture with tcpdump.
+
+There are two ways to record traffic:
+
+  - [NewIPDevice] wraps a [network.IPDevice] and records every IP packet that is read from or written to it.
+  - [NewStreamDialer] wraps a [transport.StreamDialer] and records the application bytes of each
+    [transport.StreamConn] as a synthesized TCP flow. Each Write and Read becomes its own TCP segment, so the
+    segment boundaries created by strategies like [split] or [tlsfrag] are visible in the capture.
+
+Both write to a [Writer], which can be shared by multiple wrappers. All packets are stored as raw IP packets
+(LINKTYPE_RAW), so IPv4 and IPv6 packets can be mixed in the same file.
+
+[pcapng]: https://datatracker.ietf.org/doc/draft-ietf-opsawg-pcapng/
+[Wireshark]: https://www.wireshark.org/
+[split]: https://pkg.go.dev/github.com/Jigsaw-Code/outline-sdk/transport/split
+[tlsfrag]: https://pkg.go.dev/github.com/Jigsaw-Code/outline-sdk/transport/tlsfrag
+*/
+package pcap
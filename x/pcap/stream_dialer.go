@@ -0,0 +1,226 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+)
+
+// Placeholder addresses used when the connection addresses are not IP addresses, as it happens
+// with some proxy transports.
+var (
+	placeholderLocalIP  = netip.MustParseAddr("192.0.2.1")
+	placeholderRemoteIP = netip.MustParseAddr("192.0.2.2")
+)
+
+type streamDialer struct {
+	dialer transport.StreamDialer
+	w      *Writer
+}
+
+var _ transport.StreamDialer = (*streamDialer)(nil)
+
+// NewStreamDialer creates a [transport.StreamDialer] that records the application bytes of the connections
+// created by dialer as TCP flows in w. The flow uses the local and remote addresses of the connection if they are
+// IP addresses, or placeholder addresses otherwise.
+//
+// The handshake is synthesized when the dial succeeds, each Write and Read with data becomes one TCP segment,
+// and CloseWrite, Close and the end of the read stream become FIN segments. Failures to record are not
+// reported to the caller, so that the capture never disrupts the traffic.
+func NewStreamDialer(dialer transport.StreamDialer, w *Writer) (transport.StreamDialer, error) {
+	if dialer == nil {
+		return nil, errors.New("argument dialer must not be nil")
+	}
+	if w == nil {
+		return nil, errors.New("argument w must not be nil")
+	}
+	return &streamDialer{dialer: dialer, w: w}, nil
+}
+
+// DialStream implements [transport.StreamDialer].DialStream.
+func (d *streamDialer) DialStream(ctx context.Context, remoteAddr string) (transport.StreamConn, error) {
+	conn, err := d.dialer.DialStream(ctx, remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	local, remote := flowAddresses(conn.LocalAddr(), conn.RemoteAddr(), remoteAddr)
+	c := &streamConn{
+		StreamConn: conn,
+		w:          d.w,
+		local:      local,
+		remote:     remote,
+		localSeq:   rand.Uint32(),
+		remoteSeq:  rand.Uint32(),
+	}
+	c.recordHandshake()
+	return c, nil
+}
+
+func toAddrPort(addr net.Addr) (netip.AddrPort, bool) {
+	if addr == nil {
+		return netip.AddrPort{}, false
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
+
+// flowAddresses selects the addresses to use in the synthesized flow.
+func flowAddresses(localAddr, remoteAddr net.Addr, dialedAddr string) (netip.AddrPort, netip.AddrPort) {
+	local, localOK := toAddrPort(localAddr)
+	remote, remoteOK := toAddrPort(remoteAddr)
+	if localOK && remoteOK && local.Addr().Is4() == remote.Addr().Is4() {
+		return local, remote
+	}
+	var remotePort uint16
+	if remoteOK {
+		remotePort = remote.Port()
+	} else if dialed, err := netip.ParseAddrPort(dialedAddr); err == nil {
+		remotePort = dialed.Port()
+	} else if _, portStr, err := net.SplitHostPort(dialedAddr); err == nil {
+		if port, err := net.LookupPort("tcp", portStr); err == nil {
+			remotePort = uint16(port)
+		}
+	}
+	localPort := uint16(1024 + rand.Intn(1<<16-1024))
+	if localOK {
+		localPort = local.Port()
+	}
+	return netip.AddrPortFrom(placeholderLocalIP, localPort), netip.AddrPortFrom(placeholderRemoteIP, remotePort)
+}
+
+// streamConn records the traffic of the wrapped [transport.StreamConn].
+type streamConn struct {
+	transport.StreamConn
+	w             *Writer
+	local, remote netip.AddrPort
+
+	mu sync.Mutex // Protects the fields below.
+	// Next sequence number for each side.
+	localSeq, remoteSeq uint32
+	localFIN, remoteFIN bool
+}
+
+var _ transport.StreamConn = (*streamConn)(nil)
+
+// record writes a segment sent by the local side if outbound is true, or by the remote side otherwise.
+// It must be called with mu held.
+func (c *streamConn) record(outbound bool, flags uint8, payload []byte) {
+	seg := tcpSegment{Src: c.local, Dst: c.remote, Seq: c.localSeq, Ack: c.remoteSeq, Flags: flags, Payload: payload}
+	dir := DirectionOutbound
+	if !outbound {
+		seg.Src, seg.Dst = seg.Dst, seg.Src
+		seg.Seq, seg.Ack = seg.Ack, seg.Seq
+		dir = DirectionInbound
+	}
+	if flags&tcpFlagACK == 0 {
+		seg.Ack = 0
+	}
+	advance := uint32(len(payload))
+	if flags&(tcpFlagSYN|tcpFlagFIN) != 0 {
+		advance++
+	}
+	if outbound {
+		c.localSeq += advance
+	} else {
+		c.remoteSeq += advance
+	}
+	c.w.WritePacket(time.Now(), dir, seg.appendPacket(nil))
+}
+
+// recordData records the payload, splitting it in multiple segments if it doesn't fit in one packet.
+func (c *streamConn) recordData(outbound bool, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > maxSegmentPayload {
+			n = maxSegmentPayload
+		}
+		c.record(outbound, tcpFlagPSH|tcpFlagACK, payload[:n])
+		payload = payload[n:]
+	}
+}
+
+func (c *streamConn) recordHandshake() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.record(true, tcpFlagSYN, nil)
+	c.record(false, tcpFlagSYN|tcpFlagACK, nil)
+	c.record(true, tcpFlagACK, nil)
+}
+
+func (c *streamConn) recordFIN(outbound bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if outbound {
+		if c.localFIN {
+			return
+		}
+		c.localFIN = true
+	} else {
+		if c.remoteFIN {
+			return
+		}
+		c.remoteFIN = true
+	}
+	c.record(outbound, tcpFlagFIN|tcpFlagACK, nil)
+}
+
+// Read implements [transport.StreamConn].Read.
+func (c *streamConn) Read(b []byte) (int, error) {
+	n, err := c.StreamConn.Read(b)
+	if n > 0 {
+		c.recordData(false, b[:n])
+	}
+	if errors.Is(err, io.EOF) {
+		c.recordFIN(false)
+	}
+	return n, err
+}
+
+// Write implements [transport.StreamConn].Write.
+func (c *streamConn) Write(b []byte) (int, error) {
+	n, err := c.StreamConn.Write(b)
+	if n > 0 {
+		c.recordData(true, b[:n])
+	}
+	return n, err
+}
+
+// CloseWrite implements [transport.StreamConn].CloseWrite.
+func (c *streamConn) CloseWrite() error {
+	err := c.StreamConn.CloseWrite()
+	c.recordFIN(true)
+	return err
+}
+
+// Close implements [transport.StreamConn].Close.
+func (c *streamConn) Close() error {
+	err := c.StreamConn.Close()
+	c.recordFIN(true)
+	return err
+}
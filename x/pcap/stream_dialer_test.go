@@ -0,0 +1,145 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcap
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-sdk/transport/split"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/require"
+)
+
+func readTCPSegments(t *testing.T, capture []byte) []*layers.TCP {
+	reader, err := pcapgo.NewNgReader(bytes.NewReader(capture), pcapgo.DefaultNgReaderOptions)
+	require.NoError(t, err)
+	require.Equal(t, layers.LinkTypeRaw, reader.LinkType())
+	var segments []*layers.TCP
+	for {
+		data, _, err := reader.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+		require.Nil(t, packet.ErrorLayer())
+		tcp, ok := packet.TransportLayer().(*layers.TCP)
+		require.True(t, ok)
+		segments = append(segments, tcp)
+	}
+	return segments
+}
+
+func TestStreamDialer(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.AcceptTCP()
+		require.NoError(t, err)
+		defer conn.Close()
+		buf := make([]byte, 6)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("response"))
+		require.NoError(t, err)
+	}()
+
+	var capture bytes.Buffer
+	w, err := NewWriter(&capture)
+	require.NoError(t, err)
+	tapDialer, err := NewStreamDialer(&transport.TCPDialer{}, w)
+	require.NoError(t, err)
+	// The split happens above the capture, so its segments must be visible.
+	dialer, err := split.NewStreamDialer(tapDialer, split.NewFixedSplitIterator(2))
+	require.NoError(t, err)
+
+	conn, err := dialer.DialStream(context.Background(), listener.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("abcdef"))
+	require.NoError(t, err)
+	response, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "response", string(response))
+	require.NoError(t, conn.Close())
+
+	segments := readTCPSegments(t, capture.Bytes())
+	require.GreaterOrEqual(t, len(segments), 7)
+	// Handshake.
+	require.True(t, segments[0].SYN && !segments[0].ACK)
+	require.True(t, segments[1].SYN && segments[1].ACK)
+	require.True(t, !segments[2].SYN && segments[2].ACK)
+	require.Equal(t, segments[0].Seq+1, segments[1].Ack)
+	require.Equal(t, segments[1].Seq+1, segments[2].Ack)
+	// Split data.
+	require.Equal(t, []byte("ab"), segments[3].Payload)
+	require.Equal(t, []byte("cdef"), segments[4].Payload)
+	require.Equal(t, segments[3].Seq+2, segments[4].Seq)
+	clientPort := layers.TCPPort(conn.LocalAddr().(*net.TCPAddr).Port)
+	require.Equal(t, clientPort, segments[3].SrcPort)
+
+	var received []byte
+	var finCount int
+	for _, seg := range segments[5:] {
+		if seg.DstPort == clientPort {
+			received = append(received, seg.Payload...)
+		}
+		if seg.FIN {
+			finCount++
+		}
+	}
+	require.Equal(t, "response", string(received))
+	require.Equal(t, 2, finCount)
+}
+
+func TestStreamDialer_NilArguments(t *testing.T) {
+	w, err := NewWriter(io.Discard)
+	require.NoError(t, err)
+	_, err = NewStreamDialer(nil, w)
+	require.Error(t, err)
+	_, err = NewStreamDialer(&transport.TCPDialer{}, nil)
+	require.Error(t, err)
+}
+
+func TestSegmentChecksum(t *testing.T) {
+	local := net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	remote := net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443}
+	src, dst := flowAddresses(&local, &remote, "example.com:443")
+	seg := tcpSegment{Src: src, Dst: dst, Seq: 100, Ack: 200, Flags: tcpFlagACK | tcpFlagPSH, Payload: []byte("odd")}
+	packet := gopacket.NewPacket(seg.appendPacket(nil), layers.LayerTypeIPv4, gopacket.Default)
+	ip := packet.NetworkLayer().(*layers.IPv4)
+	tcp := packet.TransportLayer().(*layers.TCP)
+
+	// Recompute the checksums with gopacket and compare.
+	expected := gopacket.NewSerializeBuffer()
+	ipCopy, tcpCopy := *ip, *tcp
+	require.NoError(t, tcpCopy.SetNetworkLayerForChecksum(&ipCopy))
+	require.NoError(t, gopacket.SerializeLayers(expected, gopacket.SerializeOptions{ComputeChecksums: true}, &ipCopy, &tcpCopy, gopacket.Payload(tcp.Payload)))
+	require.Equal(t, expected.Bytes(), packet.Data())
+}
+
+func TestFlowAddresses_Placeholder(t *testing.T) {
+	local, remote := flowAddresses(nil, nil, "example.com:443")
+	require.Equal(t, placeholderLocalIP, local.Addr())
+	require.Equal(t, placeholderRemoteIP, remote.Addr())
+	require.Equal(t, uint16(443), remote.Port())
+}
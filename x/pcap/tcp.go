@@ -0,0 +1,116 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcap
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// TCP flags, as per https://datatracker.ietf.org/doc/html/rfc9293#section-3.1.
+const (
+	tcpFlagFIN uint8 = 0x01
+	tcpFlagSYN uint8 = 0x02
+	tcpFlagPSH uint8 = 0x08
+	tcpFlagACK uint8 = 0x10
+)
+
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	tcpHeaderLen  = 20
+	protocolTCP   = 6
+	defaultTTL    = 64
+)
+
+// maxSegmentPayload is the largest payload that fits in an IPv4 packet with the TCP header.
+const maxSegmentPayload = maxPacketSize - ipv4HeaderLen - tcpHeaderLen
+
+// tcpSegment describes a TCP segment to be serialized as an IP packet.
+type tcpSegment struct {
+	Src, Dst netip.AddrPort
+	Seq, Ack uint32
+	Flags    uint8
+	Payload  []byte
+}
+
+// checksumAdd adds the bytes to the one's complement sum, as per https://datatracker.ietf.org/doc/html/rfc1071.
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// appendPacket serializes the segment as an IPv4 or IPv6 packet, depending on the address family.
+// Src and Dst must be of the same family.
+func (s *tcpSegment) appendPacket(buf []byte) []byte {
+	tcpLen := tcpHeaderLen + len(s.Payload)
+	start := len(buf)
+	src, dst := s.Src.Addr(), s.Dst.Addr()
+	// Pseudo-header sum for the TCP checksum.
+	var pseudoSum uint32
+	if src.Is4() {
+		buf = append(buf,
+			0x45, 0, // Version 4, IHL 5, DSCP/ECN 0.
+			byte((ipv4HeaderLen+tcpLen)>>8), byte(ipv4HeaderLen+tcpLen),
+			0, 0, // Identification.
+			0x40, 0, // Don't fragment.
+			defaultTTL, protocolTCP,
+			0, 0, // Header checksum, set below.
+		)
+		src4, dst4 := src.As4(), dst.As4()
+		buf = append(buf, src4[:]...)
+		buf = append(buf, dst4[:]...)
+		binary.BigEndian.PutUint16(buf[start+10:], checksumFold(checksumAdd(0, buf[start:])))
+		pseudoSum = checksumAdd(pseudoSum, src4[:])
+		pseudoSum = checksumAdd(pseudoSum, dst4[:])
+	} else {
+		buf = append(buf,
+			0x60, 0, 0, 0, // Version 6, traffic class and flow label 0.
+			byte(tcpLen>>8), byte(tcpLen),
+			protocolTCP, defaultTTL,
+		)
+		src16, dst16 := src.As16(), dst.As16()
+		buf = append(buf, src16[:]...)
+		buf = append(buf, dst16[:]...)
+		pseudoSum = checksumAdd(pseudoSum, src16[:])
+		pseudoSum = checksumAdd(pseudoSum, dst16[:])
+	}
+	pseudoSum += protocolTCP + uint32(tcpLen)
+
+	tcpStart := len(buf)
+	buf = binary.BigEndian.AppendUint16(buf, s.Src.Port())
+	buf = binary.BigEndian.AppendUint16(buf, s.Dst.Port())
+	buf = binary.BigEndian.AppendUint32(buf, s.Seq)
+	buf = binary.BigEndian.AppendUint32(buf, s.Ack)
+	buf = append(buf, (tcpHeaderLen/4)<<4, s.Flags)
+	buf = binary.BigEndian.AppendUint16(buf, 0xffff) // Window.
+	buf = append(buf, 0, 0, 0, 0)                    // Checksum and urgent pointer.
+	buf = append(buf, s.Payload...)
+	binary.BigEndian.PutUint16(buf[tcpStart+16:], checksumFold(checksumAdd(pseudoSum, buf[tcpStart:])))
+	return buf
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Direction is the direction of a recorded packet, from the point of view of the code using the wrapped object.
+type Direction uint32
+
+const (
+	// DirectionUnknown means the direction is not recorded.
+	DirectionUnknown Direction = 0
+	// DirectionInbound is used for packets received by the local side.
+	DirectionInbound Direction = 1
+	// DirectionOutbound is used for packets sent by the local side.
+	DirectionOutbound Direction = 2
+)
+
+// Block types and options, as per https://datatracker.ietf.org/doc/html/draft-ietf-opsawg-pcapng#section-11.1.
+const (
+	blockTypeSectionHeader      uint32 = 0x0A0D0D0A
+	blockTypeInterfaceDesc      uint32 = 0x00000001
+	blockTypeEnhancedPacket     uint32 = 0x00000006
+	byteOrderMagic              uint32 = 0x1A2B3C4D
+	optionEndOfOpt              uint16 = 0
+	optionInterfaceName         uint16 = 2
+	optionEnhancedPacketFlags   uint16 = 2
+	linkTypeRaw                 uint16 = 101
+	maxPacketSize                      = 1<<16 - 1
+	interfaceName                      = "outline-sdk"
+	blockHeaderAndTrailerLength        = 12
+)
+
+var byteOrder = binary.LittleEndian
+
+// Writer writes packets to an [io.Writer] in the pcapng format.
+//
+// Multiple goroutines can simultaneously invoke methods on a Writer.
+type Writer struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+	err error
+}
+
+// NewWriter creates a [Writer] that outputs to w. It writes the pcapng section header and the
+// interface description right away, returning an error if that fails.
+func NewWriter(w io.Writer) (*Writer, error) {
+	if w == nil {
+		return nil, errors.New("argument w must not be nil")
+	}
+	pw := &Writer{w: w}
+	// Section Header Block, with an unspecified section length.
+	body := byteOrder.AppendUint32(nil, byteOrderMagic)
+	body = byteOrder.AppendUint16(body, 1)
+	body = byteOrder.AppendUint16(body, 0)
+	body = byteOrder.AppendUint64(body, ^uint64(0))
+	if err := pw.writeBlock(blockTypeSectionHeader, body); err != nil {
+		return nil, fmt.Errorf("failed to write section header: %w", err)
+	}
+	// Interface Description Block. We use the default microsecond timestamp resolution.
+	body = byteOrder.AppendUint16(body[:0], linkTypeRaw)
+	body = byteOrder.AppendUint16(body, 0)
+	body = byteOrder.AppendUint32(body, 0)
+	body = appendOption(body, optionInterfaceName, []byte(interfaceName))
+	body = appendOption(body, optionEndOfOpt, nil)
+	if err := pw.writeBlock(blockTypeInterfaceDesc, body); err != nil {
+		return nil, fmt.Errorf("failed to write interface description: %w", err)
+	}
+	return pw, nil
+}
+
+// padLen returns the number of bytes needed to align n to 32 bits.
+func padLen(n int) int {
+	return (4 - n%4) % 4
+}
+
+func appendOption(buf []byte, code uint16, value []byte) []byte {
+	buf = byteOrder.AppendUint16(buf, code)
+	buf = byteOrder.AppendUint16(buf, uint16(len(value)))
+	buf = append(buf, value...)
+	return append(buf, make([]byte, padLen(len(value)))...)
+}
+
+// writeBlock writes a block with the given type and body. The body must already be 32-bit aligned.
+// It must be called with mu held, or before the Writer is shared.
+func (w *Writer) writeBlock(blockType uint32, body []byte) error {
+	totalLen := uint32(blockHeaderAndTrailerLength + len(body))
+	w.buf = byteOrder.AppendUint32(w.buf[:0], blockType)
+	w.buf = byteOrder.AppendUint32(w.buf, totalLen)
+	w.buf = append(w.buf, body...)
+	w.buf = byteOrder.AppendUint32(w.buf, totalLen)
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+// WritePacket records the raw IP packet with the given timestamp and direction.
+// Once a write to the underlying [io.Writer] fails, all following calls return that same error.
+func (w *Writer) WritePacket(ts time.Time, dir Direction, packet []byte) error {
+	if len(packet) > maxPacketSize {
+		return fmt.Errorf("packet too large: %v bytes", len(packet))
+	}
+	micros := uint64(ts.UnixMicro())
+	body := make([]byte, 0, 20+len(packet)+padLen(len(packet))+16)
+	body = byteOrder.AppendUint32(body, 0) // Interface ID.
+	body = byteOrder.AppendUint32(body, uint32(micros>>32))
+	body = byteOrder.AppendUint32(body, uint32(micros))
+	body = byteOrder.AppendUint32(body, uint32(len(packet))) // Captured length.
+	body = byteOrder.AppendUint32(body, uint32(len(packet))) // Original length.
+	body = append(body, packet...)
+	body = append(body, make([]byte, padLen(len(packet)))...)
+	if dir != DirectionUnknown {
+		body = appendOption(body, optionEnhancedPacketFlags, byteOrder.AppendUint32(nil, uint32(dir)))
+		body = appendOption(body, optionEndOfOpt, nil)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.writeBlock(blockTypeEnhancedPacket, body)
+	return w.err
+}
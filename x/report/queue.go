@@ -0,0 +1,396 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// QueueCollectorOptions are the options for [NewQueueCollector].
+type QueueCollectorOptions struct {
+	// HttpClient is used to upload the reports. Defaults to [http.DefaultClient].
+	HttpClient *http.Client
+	// CollectorURL is where the batches are posted, as a JSON array of reports.
+	CollectorURL *url.URL
+	// MaxReports is the maximum number of reports in the journal. The oldest reports are dropped
+	// when it's full. Defaults to 1000.
+	MaxReports int
+	// BatchSize is the maximum number of reports per upload. Defaults to 100.
+	BatchSize int
+	// InitialDelay is the delay before retrying a failed upload. It doubles with each failure,
+	// up to MaxDelay. Defaults to 1 second.
+	InitialDelay time.Duration
+	// MaxDelay is the maximum delay between upload attempts. Defaults to 10 minutes.
+	MaxDelay time.Duration
+}
+
+// QueueCollector is a [Collector] that persists the reports to an on-disk journal and uploads them in
+// batches in the background. Failed uploads are retried with exponential backoff, honoring the Retry-After
+// header, so reports collected while offline are sent later, including after a restart.
+// Batches rejected with a 4xx status other than 408 and 429 are dropped, since retrying won't help.
+type QueueCollector struct {
+	path   string
+	opts   QueueCollectorOptions
+	wake   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// uploadMu serializes the uploads from the background and Flush.
+	uploadMu sync.Mutex
+
+	mu      sync.Mutex
+	pending []queueEntry
+	nextSeq uint64
+}
+
+var _ Collector = (*QueueCollector)(nil)
+
+type queueEntry struct {
+	seq  uint64
+	data json.RawMessage
+}
+
+// retryAfterError is an upload failure that can be retried.
+type retryAfterError struct {
+	err error
+	// retryAfter is the delay requested by the server, or zero.
+	retryAfter time.Duration
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// NewQueueCollector creates a [QueueCollector] with the journal at journalPath, and starts uploading
+// the reports already in it. Call [QueueCollector.Close] to stop the uploads.
+func NewQueueCollector(journalPath string, opts QueueCollectorOptions) (*QueueCollector, error) {
+	if journalPath == "" {
+		return nil, errors.New("journal path must not be empty")
+	}
+	if opts.CollectorURL == nil {
+		return nil, errors.New("argument CollectorURL must not be nil")
+	}
+	if opts.MaxReports < 0 {
+		return nil, fmt.Errorf("MaxReports must not be negative: %v", opts.MaxReports)
+	}
+	if opts.BatchSize < 0 {
+		return nil, fmt.Errorf("BatchSize must not be negative: %v", opts.BatchSize)
+	}
+	if opts.InitialDelay < 0 || opts.MaxDelay < 0 {
+		return nil, errors.New("delays must not be negative")
+	}
+	if opts.HttpClient == nil {
+		opts.HttpClient = http.DefaultClient
+	}
+	if opts.MaxReports == 0 {
+		opts.MaxReports = 1000
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = 100
+	}
+	if opts.InitialDelay == 0 {
+		opts.InitialDelay = time.Second
+	}
+	if opts.MaxDelay == 0 {
+		opts.MaxDelay = 10 * time.Minute
+	}
+	c := &QueueCollector{
+		path: journalPath,
+		opts: opts,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	go c.run(ctx)
+	return c, nil
+}
+
+// load reads the journal, skipping the entries that were partially written.
+func (c *QueueCollector) load() error {
+	file, err := os.Open(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	skipped := false
+	for scanner.Scan() {
+		if line := scanner.Bytes(); json.Valid(line) {
+			c.pending = append(c.pending, queueEntry{seq: c.nextSeq, data: bytes.Clone(line)})
+			c.nextSeq++
+		} else {
+			skipped = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read journal: %w", err)
+	}
+	if len(c.pending) > c.opts.MaxReports {
+		c.pending = c.pending[len(c.pending)-c.opts.MaxReports:]
+		return c.rewriteLocked()
+	}
+	if skipped {
+		// Drop the invalid lines, like a partial write from a crash. Otherwise the next report would be
+		// appended to a partial line, and both would be lost.
+		return c.rewriteLocked()
+	}
+	return nil
+}
+
+// Collect implements [Collector]. It returns once the report is persisted in the journal.
+func (c *QueueCollector) Collect(ctx context.Context, report Report) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, queueEntry{seq: c.nextSeq, data: data})
+	c.nextSeq++
+	if len(c.pending) > c.opts.MaxReports {
+		c.pending = c.pending[len(c.pending)-c.opts.MaxReports:]
+		err = c.rewriteLocked()
+	} else {
+		err = c.appendLocked(data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Len returns the number of reports waiting to be uploaded.
+func (c *QueueCollector) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+// Flush uploads all the pending reports, without waiting for the backoff. It returns the first upload error.
+func (c *QueueCollector) Flush(ctx context.Context) error {
+	for {
+		uploaded, err := c.uploadBatch(ctx)
+		if err != nil {
+			return err
+		}
+		if uploaded == 0 {
+			return nil
+		}
+	}
+}
+
+// Close stops the background uploads. The pending reports stay in the journal.
+func (c *QueueCollector) Close() error {
+	c.cancel()
+	<-c.done
+	return nil
+}
+
+func (c *QueueCollector) run(ctx context.Context) {
+	defer close(c.done)
+	var retryDelay, backoff time.Duration
+	for {
+		if retryDelay > 0 {
+			if err := sleepContext(ctx, retryDelay); err != nil {
+				return
+			}
+		} else if c.Len() == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.wake:
+			}
+		}
+		_, err := c.uploadBatch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		var badRequest *BadRequestError
+		if err == nil || errors.As(err, &badRequest) {
+			retryDelay, backoff = 0, 0
+			continue
+		}
+		if backoff == 0 {
+			backoff = c.opts.InitialDelay
+		} else {
+			backoff = min(2*backoff, c.opts.MaxDelay)
+		}
+		retryDelay = backoff
+		var retryErr *retryAfterError
+		if errors.As(err, &retryErr) && retryErr.retryAfter > 0 {
+			retryDelay = min(retryErr.retryAfter, c.opts.MaxDelay)
+		}
+	}
+}
+
+// uploadBatch uploads the oldest pending reports, and returns how many it uploaded.
+func (c *QueueCollector) uploadBatch(ctx context.Context) (int, error) {
+	c.uploadMu.Lock()
+	defer c.uploadMu.Unlock()
+	c.mu.Lock()
+	batch := c.pending[:min(len(c.pending), c.opts.BatchSize)]
+	batch = batch[:len(batch):len(batch)]
+	c.mu.Unlock()
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	var body bytes.Buffer
+	body.WriteByte('[')
+	for i, entry := range batch {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+		body.Write(entry.data)
+	}
+	body.WriteByte(']')
+	err := c.post(ctx, body.Bytes())
+	var badRequest *BadRequestError
+	if err != nil && !errors.As(err, &badRequest) {
+		return 0, err
+	}
+
+	// Remove the batch, unless it was already dropped to make room for new reports.
+	lastSeq := batch[len(batch)-1].seq
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for removed < len(c.pending) && c.pending[removed].seq <= lastSeq {
+		removed++
+	}
+	c.pending = c.pending[removed:]
+	if writeErr := c.rewriteLocked(); writeErr != nil {
+		return len(batch), fmt.Errorf("failed to write journal: %w", writeErr)
+	}
+	if err != nil {
+		return len(batch), fmt.Errorf("batch was rejected: %w", err)
+	}
+	return len(batch), nil
+}
+
+func (c *QueueCollector) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.opts.CollectorURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	resp, err := c.opts.HttpClient.Do(req)
+	if err != nil {
+		return &retryAfterError{err: err}
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	switch {
+	case 200 <= resp.StatusCode && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return &retryAfterError{
+			err:        fmt.Errorf("http request failed with status code %d", resp.StatusCode),
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	default:
+		return &BadRequestError{Err: fmt.Errorf("http request failed with status code %d", resp.StatusCode)}
+	}
+}
+
+// parseRetryAfter returns the delay in the Retry-After header value, which can be in seconds or an HTTP date.
+// It returns zero if the value is missing or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+func (c *QueueCollector) appendLocked(data []byte) error {
+	file, err := os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (c *QueueCollector) rewriteLocked() error {
+	var data bytes.Buffer
+	for _, entry := range c.pending {
+		data.Write(entry.data)
+		data.WriteByte('\n')
+	}
+	// Write to a temporary file and rename it, so a crash never leaves a partially written journal.
+	tmpFile, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data.Bytes()); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), c.path)
+}
+
+// sleepContext waits for the duration, or until the context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
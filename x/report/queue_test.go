@@ -0,0 +1,304 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type queueTestReport struct {
+	ID int `json:"id"`
+}
+
+func TestQueueCollectorIntermittentFailures(t *testing.T) {
+	collector := newTestCollectorServer(t, testCollectorOptions{failEvery: 2})
+	c, err := NewQueueCollector(filepath.Join(t.TempDir(), "journal"), QueueCollectorOptions{
+		CollectorURL: collector.url,
+		BatchSize:    10,
+		InitialDelay: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 25; i++ {
+		require.NoError(t, c.Collect(context.Background(), queueTestReport{ID: i}))
+	}
+	require.Eventually(t, func() bool { return len(collector.received()) == 25 }, 5*time.Second, 10*time.Millisecond)
+	for i, report := range collector.received() {
+		require.Equal(t, i, report.ID)
+	}
+	require.Zero(t, c.Len())
+	require.Greater(t, collector.failures(), 0)
+}
+
+func TestQueueCollectorRetryAfter(t *testing.T) {
+	collector := newTestCollectorServer(t, testCollectorOptions{failEvery: 2, retryAfter: "1"})
+	c, err := NewQueueCollector(filepath.Join(t.TempDir(), "journal"), QueueCollectorOptions{
+		CollectorURL: collector.url,
+		InitialDelay: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	start := time.Now()
+	require.NoError(t, c.Collect(context.Background(), queueTestReport{ID: 1}))
+	require.Eventually(t, func() bool { return len(collector.received()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.GreaterOrEqual(t, time.Since(start), time.Second)
+	require.Equal(t, 1, collector.failures())
+}
+
+func TestQueueCollectorSurvivesRestart(t *testing.T) {
+	journalPath := filepath.Join(t.TempDir(), "journal")
+	offline := newTestCollectorServer(t, testCollectorOptions{failEvery: 1})
+	c, err := NewQueueCollector(journalPath, QueueCollectorOptions{CollectorURL: offline.url, InitialDelay: time.Hour})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, c.Collect(context.Background(), queueTestReport{ID: i}))
+	}
+	require.Error(t, c.Flush(context.Background()))
+	require.NoError(t, c.Close())
+	require.Equal(t, 3, c.Len())
+
+	online := newTestCollectorServer(t, testCollectorOptions{})
+	c, err = NewQueueCollector(journalPath, QueueCollectorOptions{CollectorURL: online.url})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Eventually(t, func() bool { return len(online.received()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []queueTestReport{{0}, {1}, {2}}, online.received())
+}
+
+func TestQueueCollectorFlush(t *testing.T) {
+	collector := newTestCollectorServer(t, testCollectorOptions{failEvery: 1})
+	c, err := NewQueueCollector(filepath.Join(t.TempDir(), "journal"), QueueCollectorOptions{
+		CollectorURL: collector.url,
+		BatchSize:    2,
+		InitialDelay: time.Hour,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, c.Collect(context.Background(), queueTestReport{ID: i}))
+	}
+	require.ErrorContains(t, c.Flush(context.Background()), "503")
+	require.Equal(t, 5, c.Len())
+
+	collector.setFailEvery(0)
+	require.NoError(t, c.Flush(context.Background()))
+	require.Zero(t, c.Len())
+	require.Len(t, collector.received(), 5)
+}
+
+func TestQueueCollectorCanceled(t *testing.T) {
+	collector := newTestCollectorServer(t, testCollectorOptions{failEvery: 1})
+	c, err := NewQueueCollector(filepath.Join(t.TempDir(), "journal"), QueueCollectorOptions{
+		CollectorURL: collector.url,
+		InitialDelay: time.Hour,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, c.Collect(ctx, queueTestReport{}), context.Canceled)
+	require.NoError(t, c.Collect(context.Background(), queueTestReport{}))
+	require.ErrorIs(t, c.Flush(ctx), context.Canceled)
+	require.Equal(t, 1, c.Len())
+}
+
+func TestQueueCollectorBadRequest(t *testing.T) {
+	collector := newTestCollectorServer(t, testCollectorOptions{status: http.StatusBadRequest})
+	c, err := NewQueueCollector(filepath.Join(t.TempDir(), "journal"), QueueCollectorOptions{
+		CollectorURL: collector.url,
+		InitialDelay: time.Hour,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.Collect(context.Background(), queueTestReport{ID: 1}))
+	// The rejected batch is dropped rather than retried.
+	require.Eventually(t, func() bool { return c.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestQueueCollectorMaxReports(t *testing.T) {
+	journalPath := filepath.Join(t.TempDir(), "journal")
+	collector := newTestCollectorServer(t, testCollectorOptions{failEvery: 1})
+	c, err := NewQueueCollector(journalPath, QueueCollectorOptions{
+		CollectorURL: collector.url,
+		MaxReports:   3,
+		InitialDelay: time.Hour,
+	})
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, c.Collect(context.Background(), queueTestReport{ID: i}))
+	}
+	require.NoError(t, c.Close())
+	require.Equal(t, 3, c.Len())
+
+	collector.setFailEvery(0)
+	c, err = NewQueueCollector(journalPath, QueueCollectorOptions{CollectorURL: collector.url, MaxReports: 3})
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Flush(context.Background()))
+	require.Equal(t, []queueTestReport{{2}, {3}, {4}}, collector.received())
+}
+
+func TestQueueCollectorPartialJournal(t *testing.T) {
+	journalPath := filepath.Join(t.TempDir(), "journal")
+	require.NoError(t, os.WriteFile(journalPath, []byte("{\"id\":7}\n{\"id\":"), 0o600))
+	collector := newTestCollectorServer(t, testCollectorOptions{failEvery: 1})
+	c, err := NewQueueCollector(journalPath, QueueCollectorOptions{CollectorURL: collector.url, InitialDelay: time.Hour})
+	require.NoError(t, err)
+	require.Equal(t, 1, c.Len())
+	require.NoError(t, c.Collect(context.Background(), queueTestReport{ID: 8}))
+	require.NoError(t, c.Close())
+
+	// The new report was not appended to the partial line, so it survives a restart.
+	online := newTestCollectorServer(t, testCollectorOptions{})
+	c, err = NewQueueCollector(journalPath, QueueCollectorOptions{CollectorURL: online.url})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Eventually(t, func() bool { return len(online.received()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []queueTestReport{{7}, {8}}, online.received())
+}
+
+func TestNewQueueCollectorInvalid(t *testing.T) {
+	_, err := NewQueueCollector("", QueueCollectorOptions{CollectorURL: &url.URL{}})
+	require.Error(t, err)
+	_, err = NewQueueCollector(filepath.Join(t.TempDir(), "journal"), QueueCollectorOptions{})
+	require.Error(t, err)
+	for _, opts := range []QueueCollectorOptions{
+		{MaxReports: -1},
+		{BatchSize: -1},
+		{InitialDelay: -time.Second},
+		{MaxDelay: -time.Second},
+	} {
+		opts.CollectorURL = &url.URL{}
+		_, err = NewQueueCollector(filepath.Join(t.TempDir(), "journal"), opts)
+		require.Error(t, err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	require.Zero(t, parseRetryAfter(""))
+	require.Zero(t, parseRetryAfter("invalid"))
+	require.Equal(t, 120*time.Second, parseRetryAfter("120"))
+	delay := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	require.Greater(t, delay, 59*time.Minute)
+	require.Zero(t, parseRetryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)))
+}
+
+func TestRetryCollectorCanceled(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	c := RetryCollector{
+		Collector:    &RemoteCollector{CollectorURL: serverURL, HttpClient: http.DefaultClient},
+		MaxRetry:     3,
+		InitialDelay: time.Hour,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = c.Collect(ctx, queueTestReport{})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+/********** Test Utilities **********/
+
+// testCollectorServer is a collector endpoint that fails intermittently.
+type testCollectorServer struct {
+	url        *url.URL
+	status     int
+	retryAfter string
+
+	mu        sync.Mutex
+	failEvery int
+	requests  int
+	failed    int
+	reports   []queueTestReport
+}
+
+type testCollectorOptions struct {
+	// failEvery makes every nth request fail with 503, starting with the first.
+	failEvery int
+	// status, if set, is the status of all the responses.
+	status int
+	// retryAfter is the Retry-After header of the failed responses.
+	retryAfter string
+}
+
+func newTestCollectorServer(t *testing.T, options testCollectorOptions) *testCollectorServer {
+	s := &testCollectorServer{failEvery: options.failEvery, status: options.status, retryAfter: options.retryAfter}
+	server := httptest.NewServer(http.HandlerFunc(s.ServeHTTP))
+	t.Cleanup(server.Close)
+	var err error
+	s.url, err = url.Parse(server.URL)
+	require.NoError(t, err)
+	return s
+}
+
+func (s *testCollectorServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	if s.failEvery > 0 && s.requests%s.failEvery == 1%s.failEvery {
+		s.failed++
+		if s.retryAfter != "" {
+			w.Header().Set("Retry-After", s.retryAfter)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var batch []queueTestReport
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.reports = append(s.reports, batch...)
+}
+
+func (s *testCollectorServer) setFailEvery(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failEvery = n
+}
+
+func (s *testCollectorServer) received() []queueTestReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]queueTestReport(nil), s.reports...)
+}
+
+func (s *testCollectorServer) failures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failed
+}
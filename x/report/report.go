@@ -119,7 +119,7 @@ type RetryCollector struct {
 // Collect collects the report by making multiple attempts with retries.
 // It uses the provided context and report to call the underlying collector's [Collect] method.
 // If a [BadRequestError] is encountered during the collection, it breaks the retry loop.
-// It sleeps for a specified duration between retries.
+// It waits for a specified duration between retries, and returns early if the context is done.
 // Returns an error if the maximum number of retries is exceeded.
 func (c *RetryCollector) Collect(ctx context.Context, report Report) error {
 	var e *BadRequestError
@@ -128,8 +128,8 @@ func (c *RetryCollector) Collect(ctx context.Context, report Report) error {
 		if err != nil {
 			if errors.As(err, &e) {
 				break
-			} else {
-				time.Sleep(time.Duration(math.Pow(2, float64(i))) * c.InitialDelay)
+			} else if err := sleepContext(ctx, time.Duration(math.Pow(2, float64(i)))*c.InitialDelay); err != nil {
+				return err
 			}
 		} else {
 			return nil
@@ -15,114 +15,114 @@
 package smart
 
 import (
-	"context"
-	"strings"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
-
-	"github.com/Jigsaw-Code/outline-sdk/dns"
-	"golang.org/x/net/dns/dnsmessage"
 )
 
-// canonicalName returns the domain name in canonical form. A name in canonical
-// form is lowercase and fully qualified. Only US-ASCII letters are affected. See
-// Section 6.2 in RFC 4034.
-func canonicalName(s string) string {
-	return strings.Map(func(r rune) rune {
-		if r >= 'A' && r <= 'Z' {
-			r += 'a' - 'A'
-		}
-		return r
-	}, s)
+// Strategy is a strategy found by the [StrategyFinder], in a form that can be persisted in a [StrategyCache].
+type Strategy struct {
+	// DNS is the entry of the "dns" config that was selected.
+	DNS json.RawMessage `json:"dns"`
+	// TLS is the entry of the "tls" config that was selected. It's empty if the config had no "tls" section.
+	TLS string `json:"tls,omitempty"`
+	// Expiration is the time after which the strategy must not be reused.
+	Expiration time.Time `json:"expiration"`
 }
 
-type cacheEntry struct {
-	key    string
-	msg    *dnsmessage.Message
-	expire time.Time
+// StrategyCache stores the strategies found by the [StrategyFinder], keyed by a network fingerprint.
+// Implementations must be safe for concurrent use.
+type StrategyCache interface {
+	// Load returns the strategy stored for the network, or nil if there's none.
+	Load(networkID string) (*Strategy, error)
+	// Store saves the strategy for the network, replacing any previous one.
+	Store(networkID string, strategy *Strategy) error
 }
 
-// simpleLRUCacheResolver is a very simple caching [dns.Resolver].
-// It doesn't use the response TTL.
-// It also doesn't dedup duplicate in-flight requests.
-type simpleLRUCacheResolver struct {
-	resolver dns.Resolver
-	cache    []cacheEntry
-	mux      sync.Mutex
+// FileStrategyCache is a [StrategyCache] that keeps the strategies in a JSON file.
+// Expired strategies are removed from the file whenever it's written.
+type FileStrategyCache struct {
+	path string
+	mu   sync.Mutex
 }
 
-var _ dns.Resolver = (*simpleLRUCacheResolver)(nil)
-
-func newSimpleLRUCacheResolver(resolver dns.Resolver, numEntries int) dns.Resolver {
-	return &simpleLRUCacheResolver{resolver: resolver, cache: make([]cacheEntry, numEntries)}
-}
+var _ StrategyCache = (*FileStrategyCache)(nil)
 
-func (r *simpleLRUCacheResolver) RemoveExpired() {
-	now := time.Now()
-	last := 0
-	r.mux.Lock()
-	defer r.mux.Unlock()
-	for _, entry := range r.cache {
-		if entry.expire.After(now) {
-			r.cache[last] = entry
-			last++
-		}
+// NewFileStrategyCache creates a [FileStrategyCache] backed by the file at path.
+// The file doesn't need to exist. It's created on the first [FileStrategyCache.Store].
+func NewFileStrategyCache(path string) (*FileStrategyCache, error) {
+	if path == "" {
+		return nil, errors.New("cache path must not be empty")
 	}
-	r.cache = r.cache[:last]
+	return &FileStrategyCache{path: path}, nil
 }
 
-func (r *simpleLRUCacheResolver) moveToFront(index int) {
-	entry := r.cache[index]
-	copy(r.cache[1:], r.cache[:index])
-	r.cache[0] = entry
-}
-
-func makeCacheKey(q dnsmessage.Question) string {
-	domainKey := canonicalName(q.Name.String())
-	return strings.Join([]string{domainKey, q.Type.String(), q.Class.String()}, "|")
-}
-
-func (r *simpleLRUCacheResolver) SearchCache(key string) *dnsmessage.Message {
-	r.mux.Lock()
-	defer r.mux.Unlock()
-	for ei, entry := range r.cache {
-		if entry.key == key {
-			r.moveToFront(ei)
-			// TODO: update TTLs
-			// TODO: make names match
-			return entry.msg
-		}
+func (c *FileStrategyCache) readLocked() (map[string]*Strategy, error) {
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]*Strategy{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string]*Strategy{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse cache file %v: %w", c.path, err)
 	}
-	return nil
+	return entries, nil
 }
 
-func (r *simpleLRUCacheResolver) AddToCache(key string, msg *dnsmessage.Message) {
-	r.mux.Lock()
-	defer r.mux.Unlock()
-	newSize := len(r.cache) + 1
-	if newSize > cap(r.cache) {
-		newSize = cap(r.cache)
+// Load implements [StrategyCache].
+func (c *FileStrategyCache) Load(networkID string) (*Strategy, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries, err := c.readLocked()
+	if err != nil {
+		return nil, err
 	}
-	r.cache = r.cache[:newSize]
-	copy(r.cache[1:], r.cache[:newSize-1])
-	// TODO: copy and normalize names
-	r.cache[0] = cacheEntry{key: key, msg: msg, expire: time.Now().Add(60 * time.Second)}
+	return entries[networkID], nil
 }
 
-// Query implements [dns.Resolver].
-func (r *simpleLRUCacheResolver) Query(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, error) {
-	r.RemoveExpired()
-	cacheKey := makeCacheKey(q)
-	if msg := r.SearchCache(cacheKey); msg != nil {
-		return msg, nil
+// Store implements [StrategyCache].
+func (c *FileStrategyCache) Store(networkID string, strategy *Strategy) error {
+	if strategy == nil {
+		return errors.New("argument strategy must not be nil")
 	}
-	msg, err := r.resolver.Query(ctx, q)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries, err := c.readLocked()
 	if err != nil {
-		// TODO: cache server failures. See https://datatracker.ietf.org/doc/html/rfc2308.
-		return nil, err
+		// Don't let a corrupted file prevent new strategies from being saved.
+		entries = map[string]*Strategy{}
+	}
+	now := time.Now()
+	for id, entry := range entries {
+		if entry == nil || !now.Before(entry.Expiration) {
+			delete(entries, id)
+		}
+	}
+	entries[networkID] = strategy
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it, so readers never see a partially written file.
+	tmpFile, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
 	}
-	if msg.RCode == dnsmessage.RCodeSuccess || msg.RCode == dnsmessage.RCodeNameError {
-		r.AddToCache(cacheKey, msg)
+	if err := tmpFile.Close(); err != nil {
+		return err
 	}
-	return msg, nil
+	return os.Rename(tmpFile.Name(), c.path)
 }
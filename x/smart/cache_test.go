@@ -0,0 +1,264 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smart
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFileStrategyCache_EmptyPath(t *testing.T) {
+	_, err := NewFileStrategyCache("")
+	require.Error(t, err)
+}
+
+func TestFileStrategyCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "strategies.json")
+	cache, err := NewFileStrategyCache(path)
+	require.NoError(t, err)
+
+	// The file doesn't exist yet.
+	strategy, err := cache.Load("network")
+	require.NoError(t, err)
+	require.Nil(t, strategy)
+
+	expiration := time.Now().Add(time.Hour).Truncate(time.Second)
+	stored := &Strategy{DNS: json.RawMessage(`{"system":{}}`), TLS: "split:2", Expiration: expiration}
+	require.NoError(t, cache.Store("network", stored))
+	require.Error(t, cache.Store("network", nil))
+
+	// A new cache reads the strategies from the same file.
+	cache, err = NewFileStrategyCache(path)
+	require.NoError(t, err)
+	strategy, err = cache.Load("network")
+	require.NoError(t, err)
+	require.Equal(t, "split:2", strategy.TLS)
+	require.JSONEq(t, `{"system":{}}`, string(strategy.DNS))
+	require.True(t, expiration.Equal(strategy.Expiration))
+
+	strategy, err = cache.Load("other")
+	require.NoError(t, err)
+	require.Nil(t, strategy)
+}
+
+func TestFileStrategyCache_RemovesExpired(t *testing.T) {
+	cache, err := NewFileStrategyCache(filepath.Join(t.TempDir(), "strategies.json"))
+	require.NoError(t, err)
+
+	require.NoError(t, cache.Store("expired", &Strategy{DNS: json.RawMessage(`{}`), Expiration: time.Now().Add(-time.Minute)}))
+	// Expired strategies are only removed when the file is written.
+	strategy, err := cache.Load("expired")
+	require.NoError(t, err)
+	require.NotNil(t, strategy)
+
+	require.NoError(t, cache.Store("network", &Strategy{DNS: json.RawMessage(`{}`), Expiration: time.Now().Add(time.Hour)}))
+	strategy, err = cache.Load("expired")
+	require.NoError(t, err)
+	require.Nil(t, strategy)
+	strategy, err = cache.Load("network")
+	require.NoError(t, err)
+	require.NotNil(t, strategy)
+}
+
+func TestFileStrategyCache_CorruptedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "strategies.json")
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0o600))
+	cache, err := NewFileStrategyCache(path)
+	require.NoError(t, err)
+
+	_, err = cache.Load("network")
+	require.Error(t, err)
+
+	// Storing replaces the corrupted file.
+	require.NoError(t, cache.Store("network", &Strategy{DNS: json.RawMessage(`{}`), Expiration: time.Now().Add(time.Hour)}))
+	strategy, err := cache.Load("network")
+	require.NoError(t, err)
+	require.NotNil(t, strategy)
+}
+
+func Test_cachedConfig(t *testing.T) {
+	udpEntry := dnsEntryJSON{UDP: &udpEntryJSON{Address: "192.0.2.1:53"}}
+	tcpEntry := dnsEntryJSON{TCP: &tcpEntryJSON{Address: "192.0.2.1:53"}}
+	config := configJSON{DNS: []dnsEntryJSON{udpEntry, tcpEntry}, TLS: []string{"", "split:2"}}
+	valid := time.Now().Add(time.Hour)
+
+	testCases := []struct {
+		name     string
+		config   configJSON
+		strategy *Strategy
+		want     configJSON
+		wantErr  string
+	}{
+		{
+			name:     "match",
+			config:   config,
+			strategy: &Strategy{DNS: mustMarshal(t, tcpEntry), TLS: "split:2", Expiration: valid},
+			want:     configJSON{DNS: []dnsEntryJSON{tcpEntry}, TLS: []string{"split:2"}},
+		},
+		{
+			name:     "no TLS config",
+			config:   configJSON{DNS: config.DNS},
+			strategy: &Strategy{DNS: mustMarshal(t, udpEntry), Expiration: valid},
+			want:     configJSON{DNS: []dnsEntryJSON{udpEntry}},
+		},
+		{
+			name:    "missing",
+			config:  config,
+			wantErr: "no cached strategy",
+		},
+		{
+			name:     "expired",
+			config:   config,
+			strategy: &Strategy{DNS: mustMarshal(t, udpEntry), TLS: "", Expiration: time.Now().Add(-time.Second)},
+			wantErr:  "expired",
+		},
+		{
+			name:     "DNS not in config",
+			config:   config,
+			strategy: &Strategy{DNS: mustMarshal(t, dnsEntryJSON{UDP: &udpEntryJSON{Address: "192.0.2.2:53"}}), Expiration: valid},
+			wantErr:  "cached DNS entry is not in the config",
+		},
+		{
+			name:     "TLS not in config",
+			config:   config,
+			strategy: &Strategy{DNS: mustMarshal(t, udpEntry), TLS: "tlsfrag:1", Expiration: valid},
+			wantErr:  "cached TLS strategy is not in the config",
+		},
+		{
+			name:     "TLS removed from config",
+			config:   configJSON{DNS: config.DNS},
+			strategy: &Strategy{DNS: mustMarshal(t, udpEntry), TLS: "split:2", Expiration: valid},
+			wantErr:  "cached TLS strategy is not in the config",
+		},
+		{
+			name:     "invalid DNS",
+			config:   config,
+			strategy: &Strategy{DNS: json.RawMessage(`[]`), Expiration: valid},
+			wantErr:  "invalid cached DNS entry",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cache, err := NewFileStrategyCache(filepath.Join(t.TempDir(), "strategies.json"))
+			require.NoError(t, err)
+			if tc.strategy != nil {
+				require.NoError(t, cache.Store("network", tc.strategy))
+			}
+			finder := &StrategyFinder{Cache: cache, NetworkID: "network"}
+			got, err := finder.cachedConfig(tc.config)
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestNewDialer_StoresAndUsesCachedStrategy(t *testing.T) {
+	network := newTestNetwork(t)
+	cache, err := NewFileStrategyCache(filepath.Join(t.TempDir(), "strategies.json"))
+	require.NoError(t, err)
+	config := network.config([]string{"", "split:2"})
+
+	finder, logs := network.newFinder()
+	finder.Cache = cache
+	finder.NetworkID = "network"
+	finder.CacheTTL = time.Hour
+	_, err = finder.NewDialer(context.Background(), []string{"open.example"}, config)
+	require.NoError(t, err)
+	require.Contains(t, logs.String(), "cached strategy not usable: no cached strategy")
+
+	strategy, err := cache.Load("network")
+	require.NoError(t, err)
+	require.NotNil(t, strategy)
+	require.WithinDuration(t, time.Now().Add(time.Hour), strategy.Expiration, time.Minute)
+
+	// Point the cache to the TLS strategy the search didn't select, so we can tell it was used.
+	if strategy.TLS == "" {
+		strategy.TLS = "split:2"
+	} else {
+		strategy.TLS = ""
+	}
+	require.NoError(t, cache.Store("network", strategy))
+
+	finder, logs = network.newFinder()
+	finder.Cache = cache
+	finder.NetworkID = "network"
+	dialer, err := finder.NewDialer(context.Background(), []string{"open.example"}, config)
+	require.NoError(t, err)
+	require.Contains(t, logs.String(), `trying cached strategy for network "network"`)
+	require.Contains(t, logs.String(), fmt.Sprintf("selected TLS strategy '%v'", strategy.TLS))
+	require.NotContains(t, logs.String(), "not usable")
+	require.NoError(t, testHandshake(dialer, network.roots, "open.example"))
+}
+
+func TestNewDialer_CachedStrategyFailsFallsBackToSearch(t *testing.T) {
+	network := newTestNetwork(t)
+	cache, err := NewFileStrategyCache(filepath.Join(t.TempDir(), "strategies.json"))
+	require.NoError(t, err)
+
+	brokenEntry := dnsEntryJSON{UDP: &udpEntryJSON{Address: newClosedAddress(t)}}
+	workingEntry := dnsEntryJSON{UDP: &udpEntryJSON{Address: network.dnsAddr}}
+	config := mustMarshal(t, configJSON{DNS: []dnsEntryJSON{brokenEntry, workingEntry}})
+	require.NoError(t, cache.Store("network", &Strategy{DNS: mustMarshal(t, brokenEntry), Expiration: time.Now().Add(time.Hour)}))
+
+	finder, logs := network.newFinder()
+	finder.Cache = cache
+	finder.NetworkID = "network"
+	dialer, err := finder.NewDialer(context.Background(), []string{"open.example"}, config)
+	require.NoError(t, err)
+	require.Contains(t, logs.String(), "trying cached strategy")
+	require.Contains(t, logs.String(), "cached strategy not usable")
+	require.NoError(t, testHandshake(dialer, network.roots, "open.example"))
+
+	// The strategy found in the full search replaces the one that failed.
+	strategy, err := cache.Load("network")
+	require.NoError(t, err)
+	require.JSONEq(t, string(mustMarshal(t, workingEntry)), string(strategy.DNS))
+}
+
+func TestNewDialer_CachedStrategyNotInConfig(t *testing.T) {
+	network := newTestNetwork(t)
+	cache, err := NewFileStrategyCache(filepath.Join(t.TempDir(), "strategies.json"))
+	require.NoError(t, err)
+	removedEntry := dnsEntryJSON{UDP: &udpEntryJSON{Address: "192.0.2.1:53"}}
+	require.NoError(t, cache.Store("network", &Strategy{DNS: mustMarshal(t, removedEntry), Expiration: time.Now().Add(time.Hour)}))
+
+	finder, logs := network.newFinder()
+	finder.Cache = cache
+	finder.NetworkID = "network"
+	dialer, err := finder.NewDialer(context.Background(), []string{"open.example"}, network.config(nil))
+	require.NoError(t, err)
+	require.NotContains(t, logs.String(), "trying cached strategy")
+	require.Contains(t, logs.String(), "cached strategy not usable: cached DNS entry is not in the config")
+	require.NoError(t, testHandshake(dialer, network.roots, "open.example"))
+}
+
+/********** Test Utilities **********/
+
+func mustMarshal(t *testing.T, v any) []byte {
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return data
+}
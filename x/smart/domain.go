@@ -0,0 +1,301 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smart
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-sdk/x/configurl"
+	"golang.org/x/net/publicsuffix"
+)
+
+// DomainStrategies holds the TLS strategy learned for each domain, keyed by the registrable domain
+// (eTLD+1, e.g. "example.co.uk" for "www.example.co.uk").
+//
+// The dialer returned by [StrategyFinder.NewDialer] uses the strategy selected for the test domains on all
+// domains first. When it fails for a domain, the dialer races the other TLS strategies of the config for that
+// domain only, and records the winner here. It marshals to a JSON object from domain to TLS config,
+// so apps can persist it. Strategies that are not in the config are ignored.
+//
+// The zero value is an empty map, ready to use. It's safe for concurrent use.
+type DomainStrategies struct {
+	mu         sync.Mutex
+	strategies map[string]string
+}
+
+// domainKey returns the key for the host in [DomainStrategies], or "" if the host is an IP address.
+func domainKey(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" || net.ParseIP(host) != nil {
+		return ""
+	}
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return domain
+	}
+	return host
+}
+
+// Get returns the strategy learned for the domain of host.
+func (s *DomainStrategies) Get(host string) (string, bool) {
+	key := domainKey(host)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tlsConfig, ok := s.strategies[key]
+	return tlsConfig, ok
+}
+
+// Set records the strategy for the domain of host. It does nothing if host is an IP address.
+func (s *DomainStrategies) Set(host string, tlsConfig string) {
+	key := domainKey(host)
+	if key == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.strategies == nil {
+		s.strategies = make(map[string]string)
+	}
+	s.strategies[key] = tlsConfig
+}
+
+// Delete removes the strategy for the domain of host.
+func (s *DomainStrategies) Delete(host string) {
+	key := domainKey(host)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.strategies, key)
+}
+
+// All returns a copy of the strategies, keyed by domain.
+func (s *DomainStrategies) All() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.strategies)
+}
+
+// MarshalJSON implements [json.Marshaler].
+func (s *DomainStrategies) MarshalJSON() ([]byte, error) {
+	strategies := s.All()
+	if strategies == nil {
+		strategies = map[string]string{}
+	}
+	return json.Marshal(strategies)
+}
+
+// UnmarshalJSON implements [json.Unmarshaler]. It replaces the current strategies.
+func (s *DomainStrategies) UnmarshalJSON(data []byte) error {
+	var strategies map[string]string
+	if err := json.Unmarshal(data, &strategies); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.strategies = make(map[string]string, len(strategies))
+	for host, tlsConfig := range strategies {
+		if key := domainKey(host); key != "" {
+			s.strategies[key] = tlsConfig
+		}
+	}
+	return nil
+}
+
+// domainDialer is the [transport.StreamDialer] for the TLS strategies. It applies the strategy learned for
+// the destination domain to connections to ports 443 and 853, and uses the base dialer for other ports.
+type domainDialer struct {
+	finder       *StrategyFinder
+	ctx          context.Context
+	configModule *configurl.ProviderContainer
+	baseDialer   transport.StreamDialer
+	// The strategy selected for the test domains, which is tried first.
+	global       string
+	alternatives []string
+	strategies   *DomainStrategies
+
+	mu      sync.Mutex
+	dialers map[string]transport.StreamDialer
+	// Searches in progress by domain.
+	searches map[string]*domainSearch
+}
+
+var _ transport.StreamDialer = (*domainDialer)(nil)
+
+// domainSearch is a search for the TLS strategy of a domain. The result and err are set before done is closed.
+type domainSearch struct {
+	done   chan struct{}
+	result string
+	err    error
+}
+
+func (f *StrategyFinder) newDomainDialer(ctx context.Context, configModule *configurl.ProviderContainer, baseDialer transport.StreamDialer, global string, globalDialer transport.StreamDialer, alternatives []string) *domainDialer {
+	strategies := f.DomainStrategies
+	if strategies == nil {
+		strategies = &DomainStrategies{}
+	}
+	return &domainDialer{
+		finder: f,
+		// The searches for a domain must outlive the context used to create the dialer.
+		ctx:          context.WithoutCancel(ctx),
+		configModule: configModule,
+		baseDialer:   baseDialer,
+		global:       global,
+		alternatives: alternatives,
+		strategies:   strategies,
+		dialers:      map[string]transport.StreamDialer{global: globalDialer},
+		searches:     make(map[string]*domainSearch),
+	}
+}
+
+// dialerFor returns the dialer for the TLS config, creating it if needed.
+func (d *domainDialer) dialerFor(ctx context.Context, tlsConfig string) (transport.StreamDialer, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if dialer, ok := d.dialers[tlsConfig]; ok {
+		return dialer, nil
+	}
+	dialer, err := d.configModule.NewStreamDialer(ctx, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	d.dialers[tlsConfig] = dialer
+	return dialer, nil
+}
+
+// strategyFor returns the TLS config to use for the host.
+func (d *domainDialer) strategyFor(host string) string {
+	if tlsConfig, ok := d.strategies.Get(host); ok && (tlsConfig == d.global || slices.Contains(d.alternatives, tlsConfig)) {
+		return tlsConfig
+	}
+	return d.global
+}
+
+// DialStream implements [transport.StreamDialer].
+func (d *domainDialer) DialStream(ctx context.Context, raddr string) (transport.StreamConn, error) {
+	host, portStr, err := net.SplitHostPort(raddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse address: %w", err)
+	}
+	portNum, err := net.DefaultResolver.LookupPort(ctx, "tcp", portStr)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve port: %w", err)
+	}
+	if portNum != 443 && portNum != 853 {
+		return d.baseDialer.DialStream(ctx, raddr)
+	}
+
+	tlsConfig := d.strategyFor(host)
+	conn, err := d.dialWith(ctx, tlsConfig, raddr)
+	if domainKey(host) == "" {
+		// We can't learn strategies for IP addresses.
+		return conn, err
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		// Find a strategy for this domain and retry.
+		newConfig, searchErr := d.learn(ctx, host, tlsConfig)
+		if searchErr != nil {
+			return nil, err
+		}
+		return d.dialWith(ctx, newConfig, raddr)
+	}
+	return &healthConn{StreamConn: conn, onResult: func(ok bool) {
+		if !ok {
+			// The handshake likely failed. Find a strategy for the next connections.
+			go d.learn(d.ctx, host, tlsConfig)
+		}
+	}}, nil
+}
+
+func (d *domainDialer) dialWith(ctx context.Context, tlsConfig string, raddr string) (transport.StreamConn, error) {
+	dialer, err := d.dialerFor(ctx, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.DialStream(ctx, raddr)
+}
+
+// learn races the TLS strategies for the domain of host, excluding the failed one, and records the winner.
+// If a search for the domain is in progress, it waits for it instead, and returns its result.
+func (d *domainDialer) learn(ctx context.Context, host string, failed string) (string, error) {
+	key := domainKey(host)
+	d.mu.Lock()
+	if search, ok := d.searches[key]; ok {
+		d.mu.Unlock()
+		select {
+		case <-search.done:
+			return search.result, search.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	search := &domainSearch{done: make(chan struct{})}
+	d.searches[key] = search
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.searches, key)
+		d.mu.Unlock()
+		close(search.done)
+	}()
+	search.result, search.err = d.search(ctx, host, key, failed)
+	return search.result, search.err
+}
+
+// search runs the race for learn.
+func (d *domainDialer) search(ctx context.Context, host string, key string, failed string) (string, error) {
+	// Try the global strategy first, then the alternatives in the config order.
+	candidates := make([]string, 0, len(d.alternatives)+1)
+	for _, tlsConfig := range append([]string{d.global}, d.alternatives...) {
+		if tlsConfig != failed && !slices.Contains(candidates, tlsConfig) {
+			candidates = append(candidates, tlsConfig)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", errors.New("no alternative TLS strategy")
+	}
+
+	searchCtx, searchDone := context.WithCancel(ctx)
+	defer searchDone()
+	raceStart := time.Now()
+	testDomains := []string{host}
+	result, err := raceTests(searchCtx, 250*time.Millisecond, maxRunningTLSTests, candidates, func(tlsConfig string) (string, error) {
+		dialer, err := d.dialerFor(searchCtx, tlsConfig)
+		if err != nil {
+			return "", err
+		}
+		if err := d.finder.testDialer(searchCtx, dialer, testDomains, "TLS", tlsConfig); err != nil {
+			return "", err
+		}
+		return tlsConfig, nil
+	})
+	if err != nil {
+		d.finder.log("❌ could not find TLS strategy for %v: %v\n\n", key, err)
+		return "", fmt.Errorf("could not find TLS strategy for %v: %w", key, err)
+	}
+	d.finder.log("🏆 selected TLS strategy '%v' for %v in %0.2fs\n\n", result, key, time.Since(raceStart).Seconds())
+	d.strategies.Set(host, result)
+	return result, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smart
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainDialer_LearnsAfterHandshakeFailure(t *testing.T) {
+	network := newTestNetwork(t, "blocked.example")
+	finder, logs := network.newFinder()
+	finder.DomainStrategies = &DomainStrategies{}
+
+	dialer, err := finder.NewDialer(context.Background(), []string{"open.example"}, network.config([]string{"", "tlsfrag:5"}))
+	require.NoError(t, err)
+	require.NoError(t, testHandshake(dialer, network.roots, "open.example"))
+
+	// The global strategy fails for the blocked domain, which triggers the search for that domain.
+	require.Error(t, testHandshake(dialer, network.roots, "www.blocked.example"))
+	require.Eventually(t, func() bool {
+		_, ok := finder.DomainStrategies.Get("blocked.example")
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, map[string]string{"blocked.example": "tlsfrag:5"}, finder.DomainStrategies.All())
+	require.Contains(t, logs.String(), "selected TLS strategy 'tlsfrag:5' for blocked.example")
+
+	require.NoError(t, testHandshake(dialer, network.roots, "www.blocked.example"))
+	require.NoError(t, testHandshake(dialer, network.roots, "blocked.example"))
+	// Other domains keep using the global strategy.
+	require.NoError(t, testHandshake(dialer, network.roots, "open.example"))
+	_, ok := finder.DomainStrategies.Get("open.example")
+	require.False(t, ok)
+}
+
+func TestDomainDialer_LearnsAfterDialFailure(t *testing.T) {
+	network := newTestNetwork(t, "blocked.example")
+	finder, _ := network.newFinder()
+	// A previously learned strategy that no longer works. The test network refuses connections to port 444.
+	finder.DomainStrategies = &DomainStrategies{}
+	finder.DomainStrategies.Set("blocked.example", "override:port=444")
+
+	config := network.config([]string{"", "override:port=444", "tlsfrag:5"})
+	dialer, err := finder.NewDialer(context.Background(), []string{"open.example"}, config)
+	require.NoError(t, err)
+
+	// The dial fails, so the search for the domain runs right away, and the dial is retried with the winner.
+	require.NoError(t, testHandshake(dialer, network.roots, "blocked.example"))
+	tlsConfig, ok := finder.DomainStrategies.Get("blocked.example")
+	require.True(t, ok)
+	require.Equal(t, "tlsfrag:5", tlsConfig)
+}
+
+func TestDomainDialer_IgnoresStrategiesNotInConfig(t *testing.T) {
+	network := newTestNetwork(t)
+	finder, _ := network.newFinder()
+	finder.DomainStrategies = &DomainStrategies{}
+	finder.DomainStrategies.Set("open.example", "override:port=444")
+
+	dialer, err := finder.NewDialer(context.Background(), []string{"open.example"}, network.config([]string{""}))
+	require.NoError(t, err)
+	require.NoError(t, testHandshake(dialer, network.roots, "open.example"))
+	tlsConfig, _ := finder.DomainStrategies.Get("open.example")
+	require.Equal(t, "override:port=444", tlsConfig)
+}
+
+func TestDomainDialer_WaitersGetSearchError(t *testing.T) {
+	finder := &StrategyFinder{}
+	dialer := finder.newDomainDialer(context.Background(), nil, nil, "", nil, nil)
+	search := &domainSearch{done: make(chan struct{})}
+	dialer.searches["blocked.example"] = search
+
+	type learnResult struct {
+		tlsConfig string
+		err       error
+	}
+	waiter := make(chan learnResult)
+	go func() {
+		tlsConfig, err := dialer.learn(context.Background(), "www.blocked.example", "")
+		waiter <- learnResult{tlsConfig, err}
+	}()
+
+	// The waiter must get the failure of the search in progress, not the current strategy for the domain.
+	searchErr := errors.New("could not find TLS strategy")
+	search.err = searchErr
+	close(search.done)
+	result := <-waiter
+	require.ErrorIs(t, result.err, searchErr)
+	require.Empty(t, result.tlsConfig)
+}
+
+func TestDomainStrategies(t *testing.T) {
+	var strategies DomainStrategies
+	_, ok := strategies.Get("www.example.co.uk")
+	require.False(t, ok)
+	require.Nil(t, strategies.All())
+
+	strategies.Set("www.Example.co.uk.", "split:2")
+	strategies.Set("192.0.2.1", "tlsfrag:1")
+	tlsConfig, ok := strategies.Get("example.co.uk")
+	require.True(t, ok)
+	require.Equal(t, "split:2", tlsConfig)
+	require.Equal(t, map[string]string{"example.co.uk": "split:2"}, strategies.All())
+
+	data, err := json.Marshal(&strategies)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"example.co.uk": "split:2"}`, string(data))
+
+	var restored DomainStrategies
+	require.NoError(t, json.Unmarshal([]byte(`{"cdn.example.com": "tlsfrag:1", "example.co.uk": "split:2"}`), &restored))
+	require.Equal(t, map[string]string{"example.com": "tlsfrag:1", "example.co.uk": "split:2"}, restored.All())
+
+	restored.Delete("www.example.com")
+	require.Equal(t, map[string]string{"example.co.uk": "split:2"}, restored.All())
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smart
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-sdk/x/configurl"
+)
+
+// fallbackEntryJSON is an entry of the "fallback" config. In JSON, it's either a config string
+// for a transport, as accepted by [configurl], or an object with a "psiphon" field holding the Psiphon config.
+type fallbackEntryJSON struct {
+	Config  string
+	Psiphon json.RawMessage
+}
+
+func (e *fallbackEntryJSON) UnmarshalJSON(data []byte) error {
+	var config string
+	if err := json.Unmarshal(data, &config); err == nil {
+		*e = fallbackEntryJSON{Config: config}
+		return nil
+	}
+	var entry struct {
+		Psiphon json.RawMessage `json:"psiphon,omitempty"`
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return fmt.Errorf("fallback entry must be a config string or an object: %w", err)
+	}
+	if len(entry.Psiphon) == 0 || string(entry.Psiphon) == "null" {
+		return errors.New("fallback entry object must have a psiphon field")
+	}
+	*e = fallbackEntryJSON{Psiphon: entry.Psiphon}
+	return nil
+}
+
+func (e fallbackEntryJSON) MarshalJSON() ([]byte, error) {
+	if e.Psiphon != nil {
+		return json.Marshal(struct {
+			Psiphon json.RawMessage `json:"psiphon"`
+		}{e.Psiphon})
+	}
+	return json.Marshal(e.Config)
+}
+
+// id returns a short identifier of the entry for the logs.
+func (e fallbackEntryJSON) id() string {
+	if e.Psiphon != nil {
+		return "psiphon"
+	}
+	return e.Config
+}
+
+// findFallback searches for a fallback transport that can reach all of the testDomains.
+// Unlike the DNS and TLS strategies, the selected fallback is used for all connections.
+func (f *StrategyFinder) findFallback(ctx context.Context, testDomains []string, fallbackConfig []fallbackEntryJSON) (transport.StreamDialer, *selectedStrategy, error) {
+	if len(fallbackConfig) == 0 {
+		return nil, nil, errors.New("no fallback config entry")
+	}
+	var configModule = configurl.NewDefaultProviders()
+	configModule.StreamDialers.BaseInstance = f.StreamDialer
+	configModule.PacketDialers.BaseInstance = f.PacketDialer
+
+	ctx, searchDone := context.WithCancel(ctx)
+	defer searchDone()
+	raceStart := time.Now()
+	type SearchResult struct {
+		Dialer transport.StreamDialer
+		Entry  fallbackEntryJSON
+		ID     string
+		Stop   func()
+	}
+	// Psiphon keeps a tunnel running in the background, which must be stopped if it's not selected.
+	// We track the started ones so we can stop them even if they finish their test after the race is over.
+	var stopsMu sync.Mutex
+	var stops []*SearchResult
+	var raceDone bool
+	result, err := raceTests(ctx, 250*time.Millisecond, 0, fallbackConfig, func(entry fallbackEntryJSON) (*SearchResult, error) {
+		result := &SearchResult{Entry: entry, ID: entry.id()}
+		var err error
+		if entry.Psiphon != nil {
+			f.logCtx(ctx, "🏃 start fallback: '%v'\n", result.ID)
+			result.Dialer, result.Stop, err = startPsiphon(ctx, entry.Psiphon)
+		} else {
+			result.Dialer, err = configModule.NewStreamDialer(ctx, entry.Config)
+		}
+		if err != nil {
+			f.logCtx(ctx, "🏁 got fallback: '%v', error=%v ❌\n", result.ID, err)
+			return nil, err
+		}
+		if result.Stop != nil {
+			stopsMu.Lock()
+			if raceDone {
+				stopsMu.Unlock()
+				result.Stop()
+				return nil, errors.New("search is done")
+			}
+			stops = append(stops, result)
+			stopsMu.Unlock()
+		}
+		if err := f.testDialer(ctx, result.Dialer, testDomains, "fallback", result.ID); err != nil {
+			return nil, err
+		}
+		return result, nil
+	})
+	stopsMu.Lock()
+	raceDone = true
+	for _, started := range stops {
+		if started != result {
+			started.Stop()
+		}
+	}
+	stopsMu.Unlock()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not find fallback: %w", err)
+	}
+	f.log("🏆 selected fallback '%v' in %0.2fs\n\n", result.ID, time.Since(raceStart).Seconds())
+	return result.Dialer, &selectedStrategy{fallback: &result.Entry, stop: result.Stop}, nil
+}
@@ -0,0 +1,300 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smart
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+)
+
+// HealthOptions configures the health monitoring of the dialers returned by [StrategyFinder.NewDialer].
+//
+// The dialer records whether each connection succeeds: a connection fails if the dial or the first read fails
+// with an error that points at the strategy, as happens when a censor resets the TLS handshake. Errors that
+// any strategy would get, like a domain that doesn't exist or a destination that is down, are not counted.
+// When the failure rate of the recent connections reaches the FailureThreshold, the current strategy is
+// demoted to the end of the config and a new search runs in the background. Meanwhile, the current strategy
+// remains in use. If the search succeeds, the new strategy atomically replaces it.
+type HealthOptions struct {
+	// Window is the number of recent connections used to compute the failure rate. Defaults to 20.
+	Window int
+	// MinSamples is the minimum number of connections in the window before a new search can be triggered.
+	// Defaults to 5.
+	MinSamples int
+	// FailureThreshold is the failure rate, from 0 to 1, that triggers a new search. Defaults to 0.5.
+	FailureThreshold float64
+	// OnEvent, if not nil, is called when a new search starts and finishes, so apps can report it.
+	// It's called from a background goroutine and must not block.
+	OnEvent func(event StrategyEvent)
+}
+
+// StrategyEventType is the type of a [StrategyEvent].
+type StrategyEventType int
+
+const (
+	// StrategySearchStarted means the current strategy is failing and a new search started.
+	StrategySearchStarted StrategyEventType = iota
+	// StrategySelected means a new strategy was found and is now in use.
+	StrategySelected
+	// StrategySearchFailed means the search failed. The current strategy remains in use.
+	StrategySearchFailed
+)
+
+func (t StrategyEventType) String() string {
+	switch t {
+	case StrategySearchStarted:
+		return "search started"
+	case StrategySelected:
+		return "selected"
+	case StrategySearchFailed:
+		return "search failed"
+	default:
+		return "unknown"
+	}
+}
+
+// StrategyEvent reports a change in the strategy selection of a monitored dialer.
+type StrategyEvent struct {
+	Type StrategyEventType
+	// Strategy describes the demoted strategy for StrategySearchStarted, and the new strategy for StrategySelected.
+	Strategy string
+	// FailureRate is the failure rate that triggered the search, for StrategySearchStarted.
+	FailureRate float64
+	// Err is the search error, for StrategySearchFailed.
+	Err error
+}
+
+// healthStats tracks the outcome of the recent connections in a ring buffer.
+type healthStats struct {
+	mu       sync.Mutex
+	outcomes []bool
+	next     int
+	count    int
+	failures int
+}
+
+func newHealthStats(window int) *healthStats {
+	return &healthStats{outcomes: make([]bool, window)}
+}
+
+// record adds the connection outcome and returns the failure rate and number of samples in the window.
+func (s *healthStats) record(ok bool) (float64, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == len(s.outcomes) {
+		if !s.outcomes[s.next] {
+			s.failures--
+		}
+	} else {
+		s.count++
+	}
+	s.outcomes[s.next] = ok
+	if !ok {
+		s.failures++
+	}
+	s.next = (s.next + 1) % len(s.outcomes)
+	return float64(s.failures) / float64(s.count), s.count
+}
+
+func (s *healthStats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next, s.count, s.failures = 0, 0, 0
+}
+
+// activeStrategy is a strategy in use by a [healthDialer], with its health stats.
+type activeStrategy struct {
+	dialer   transport.StreamDialer
+	selected *selectedStrategy
+	stats    *healthStats
+}
+
+// healthDialer is a [transport.StreamDialer] that monitors the health of the active strategy,
+// and replaces it when it starts failing.
+type healthDialer struct {
+	finder      *StrategyFinder
+	options     HealthOptions
+	ctx         context.Context
+	testDomains []string
+	active      atomic.Pointer[activeStrategy]
+	searching   atomic.Bool
+	// Only accessed by the search goroutine.
+	config configJSON
+}
+
+var _ transport.StreamDialer = (*healthDialer)(nil)
+
+func (f *StrategyFinder) newHealthDialer(ctx context.Context, testDomains []string, config configJSON, dialer transport.StreamDialer, selected *selectedStrategy) *healthDialer {
+	options := *f.Health
+	if options.Window <= 0 {
+		options.Window = 20
+	}
+	if options.MinSamples <= 0 {
+		options.MinSamples = 5
+	}
+	options.MinSamples = min(options.MinSamples, options.Window)
+	if options.FailureThreshold <= 0 {
+		options.FailureThreshold = 0.5
+	}
+	d := &healthDialer{
+		finder:  f,
+		options: options,
+		// The background searches must outlive the context used to create the dialer.
+		ctx:         context.WithoutCancel(ctx),
+		testDomains: testDomains,
+		config:      config,
+	}
+	d.active.Store(&activeStrategy{dialer: dialer, selected: selected, stats: newHealthStats(options.Window)})
+	return d
+}
+
+// DialStream implements [transport.StreamDialer].
+func (d *healthDialer) DialStream(ctx context.Context, raddr string) (transport.StreamConn, error) {
+	active := d.active.Load()
+	conn, err := active.dialer.DialStream(ctx, raddr)
+	if err != nil {
+		// Cancellations are not a sign of the strategy health.
+		if ctx.Err() == nil && isStrategyFailure(err) {
+			d.record(active, false)
+		}
+		return nil, err
+	}
+	return &healthConn{StreamConn: conn, onResult: func(ok bool) { d.record(active, ok) }}, nil
+}
+
+func (d *healthDialer) record(active *activeStrategy, ok bool) {
+	failureRate, samples := active.stats.record(ok)
+	if samples < d.options.MinSamples || failureRate < d.options.FailureThreshold {
+		return
+	}
+	// Only demote the strategy in use, and run a single search at a time.
+	if d.active.Load() != active || !d.searching.CompareAndSwap(false, true) {
+		return
+	}
+	go d.reselect(active, failureRate)
+}
+
+func (d *healthDialer) notify(event StrategyEvent) {
+	if d.options.OnEvent != nil {
+		d.options.OnEvent(event)
+	}
+}
+
+// reselect demotes the failing strategy and searches for a new one.
+func (d *healthDialer) reselect(demoted *activeStrategy, failureRate float64) {
+	defer d.searching.Store(false)
+	d.finder.log("🩺 strategy %v is failing (failure rate %0.2f), searching for a new one\n\n", demoted.selected, failureRate)
+	d.notify(StrategyEvent{Type: StrategySearchStarted, Strategy: demoted.selected.String(), FailureRate: failureRate})
+
+	d.config = demoteStrategy(d.config, demoted.selected)
+	dialer, selected, err := d.finder.search(d.ctx, d.testDomains, d.config, false)
+	if err != nil {
+		d.finder.log("🩺 could not find a new strategy: %v\n\n", err)
+		// Require a new window of failures before searching again.
+		demoted.stats.reset()
+		d.notify(StrategyEvent{Type: StrategySearchFailed, Err: err})
+		return
+	}
+	d.active.Store(&activeStrategy{dialer: dialer, selected: selected, stats: newHealthStats(d.options.Window)})
+	if demoted.selected.stop != nil {
+		// Only stop the demoted fallback once it's replaced, since it remains in use if the search fails.
+		demoted.selected.stop()
+	}
+	d.finder.log("🩺 switched to strategy %v\n\n", selected)
+	d.notify(StrategyEvent{Type: StrategySelected, Strategy: selected.String()})
+}
+
+// demoteStrategy returns a copy of config with the entries of the selected strategy moved to the end,
+// so they are tested last.
+func demoteStrategy(config configJSON, selected *selectedStrategy) configJSON {
+	if selected.local != nil {
+		config.DNS = moveToEnd(config.DNS, func(entry dnsEntryJSON) bool {
+			id, err := json.Marshal(entry)
+			return err == nil && string(id) == string(selected.local.DNS)
+		})
+		config.TLS = moveToEnd(config.TLS, func(entry string) bool {
+			return entry == selected.local.TLS
+		})
+	}
+	if selected.fallback != nil {
+		config.Fallback = moveToEnd(config.Fallback, func(entry fallbackEntryJSON) bool {
+			return entry.id() == selected.fallback.id()
+		})
+	}
+	return config
+}
+
+// moveToEnd returns a copy of entries with the ones that match moved to the end.
+func moveToEnd[E any](entries []E, match func(E) bool) []E {
+	result := make([]E, 0, len(entries))
+	var matched []E
+	for _, entry := range entries {
+		if match(entry) {
+			matched = append(matched, entry)
+		} else {
+			result = append(result, entry)
+		}
+	}
+	return append(result, matched...)
+}
+
+// isStrategyFailure returns whether err is a sign that the strategy is blocked, like a connection reset or a
+// failed handshake. Other errors, like a destination that is down or a domain that doesn't exist, would happen
+// with any strategy, so they don't count.
+func isStrategyFailure(err error) bool {
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	// The connection was closed in the middle of the handshake.
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var certErr *tls.CertificateVerificationError
+	return errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &certErr)
+}
+
+// healthConn reports whether the connection works, based on its first read: receiving data means
+// success, and an error that [isStrategyFailure] accepts means failure.
+type healthConn struct {
+	transport.StreamConn
+	onResult func(ok bool)
+	once     sync.Once
+	closed   atomic.Bool
+}
+
+func (c *healthConn) Read(b []byte) (int, error) {
+	n, err := c.StreamConn.Read(b)
+	if n > 0 {
+		c.once.Do(func() { c.onResult(true) })
+	} else if err != nil && !c.closed.Load() && isStrategyFailure(err) {
+		c.once.Do(func() { c.onResult(false) })
+	}
+	return n, err
+}
+
+func (c *healthConn) Close() error {
+	c.closed.Store(true)
+	return c.StreamConn.Close()
+}
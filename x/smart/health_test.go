@@ -0,0 +1,204 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smart
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthDialer_ReselectsWhenBlocked(t *testing.T) {
+	network := newTestNetwork(t)
+	finder, logs := network.newFinder()
+	events := make(chan StrategyEvent, 10)
+	finder.Health = &HealthOptions{Window: 4, MinSamples: 2, FailureThreshold: 0.6, OnEvent: func(event StrategyEvent) { events <- event }}
+
+	// The censor only inspects the first TLS record, so fragmenting the ClientHello evades it.
+	dialer, err := finder.NewDialer(context.Background(), []string{"blocked.example"}, network.config([]string{"", "tlsfrag:5"}))
+	require.NoError(t, err)
+	require.NoError(t, testHandshake(dialer, network.roots, "blocked.example"))
+
+	network.Block("blocked.example")
+	require.Error(t, testHandshake(dialer, network.roots, "blocked.example"))
+	require.Empty(t, events)
+	require.Error(t, testHandshake(dialer, network.roots, "blocked.example"))
+
+	event := receiveEvent(t, events)
+	require.Equal(t, StrategySearchStarted, event.Type)
+	require.NotContains(t, event.Strategy, "tlsfrag")
+	// One success and two failures.
+	require.InDelta(t, 2.0/3, event.FailureRate, 0.001)
+
+	event = receiveEvent(t, events)
+	require.Equal(t, StrategySelected, event.Type, event.Err)
+	require.Contains(t, event.Strategy, "TLS 'tlsfrag:5'")
+	require.Contains(t, logs.String(), "switched to strategy")
+
+	require.NoError(t, testHandshake(dialer, network.roots, "blocked.example"))
+}
+
+func TestHealthDialer_KeepsStrategyIfSearchFails(t *testing.T) {
+	network := newTestNetwork(t)
+	finder, _ := network.newFinder()
+	events := make(chan StrategyEvent, 10)
+	finder.Health = &HealthOptions{Window: 4, MinSamples: 2, OnEvent: func(event StrategyEvent) { events <- event }}
+
+	dialer, err := finder.NewDialer(context.Background(), []string{"blocked.example"}, network.config([]string{""}))
+	require.NoError(t, err)
+
+	network.Block("blocked.example")
+	require.Error(t, testHandshake(dialer, network.roots, "blocked.example"))
+	require.Error(t, testHandshake(dialer, network.roots, "blocked.example"))
+	require.Equal(t, StrategySearchStarted, receiveEvent(t, events).Type)
+	event := receiveEvent(t, events)
+	require.Equal(t, StrategySearchFailed, event.Type)
+	require.Error(t, event.Err)
+
+	// The stats were reset, so a single failure doesn't trigger a new search.
+	require.Error(t, testHandshake(dialer, network.roots, "blocked.example"))
+	network.Unblock("blocked.example")
+	require.NoError(t, testHandshake(dialer, network.roots, "blocked.example"))
+	require.Empty(t, events)
+}
+
+func TestHealthDialer_IgnoresCanceledDials(t *testing.T) {
+	network := newTestNetwork(t)
+	finder, _ := network.newFinder()
+	events := make(chan StrategyEvent, 10)
+	finder.Health = &HealthOptions{Window: 2, MinSamples: 1, OnEvent: func(event StrategyEvent) { events <- event }}
+
+	dialer, err := finder.NewDialer(context.Background(), []string{"open.example"}, network.config([]string{""}))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = dialer.DialStream(ctx, "open.example:443")
+	require.Error(t, err)
+	require.Empty(t, events)
+}
+
+func TestHealthDialer_IgnoresDestinationErrors(t *testing.T) {
+	network := newTestNetwork(t)
+	finder, _ := network.newFinder()
+	events := make(chan StrategyEvent, 10)
+	finder.Health = &HealthOptions{Window: 2, MinSamples: 1, OnEvent: func(event StrategyEvent) { events <- event }}
+
+	dialer, err := finder.NewDialer(context.Background(), []string{"open.example"}, network.config([]string{""}))
+	require.NoError(t, err)
+	// The test network refuses connections to other ports, which any strategy would get.
+	for i := 0; i < 3; i++ {
+		_, err = dialer.DialStream(context.Background(), "open.example:8443")
+		require.Error(t, err)
+	}
+	require.Never(t, func() bool { return len(events) > 0 }, 100*time.Millisecond, 10*time.Millisecond)
+}
+
+func TestHealthDialer_StopsFallbackOnlyWhenReplaced(t *testing.T) {
+	network := newTestNetwork(t, "blocked.example")
+	finder, _ := network.newFinder()
+	finder.Health = &HealthOptions{}
+	var stopped atomic.Bool
+	fallback := &selectedStrategy{
+		fallback: &fallbackEntryJSON{Config: "socks5://fallback.example:1080"},
+		stop:     func() { stopped.Store(true) },
+	}
+
+	// The search fails, so the fallback remains in use.
+	var config configJSON
+	require.NoError(t, json.Unmarshal(network.config([]string{""}), &config))
+	d := finder.newHealthDialer(context.Background(), []string{"blocked.example."}, config, &transport.TCPDialer{}, fallback)
+	d.reselect(d.active.Load(), 1)
+	require.Same(t, fallback, d.active.Load().selected)
+	require.False(t, stopped.Load())
+
+	// The search succeeds, so the fallback is replaced and stopped.
+	require.NoError(t, json.Unmarshal(network.config([]string{"tlsfrag:5"}), &config))
+	d = finder.newHealthDialer(context.Background(), []string{"blocked.example."}, config, &transport.TCPDialer{}, fallback)
+	d.reselect(d.active.Load(), 1)
+	require.NotSame(t, fallback, d.active.Load().selected)
+	require.True(t, stopped.Load())
+}
+
+func Test_isStrategyFailure(t *testing.T) {
+	require.True(t, isStrategyFailure(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}))
+	require.True(t, isStrategyFailure(fmt.Errorf("socks handshake failed: %w", io.EOF)))
+	require.True(t, isStrategyFailure(tls.AlertError(40)))
+	require.False(t, isStrategyFailure(&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}))
+	require.False(t, isStrategyFailure(&net.DNSError{Err: "no such host", Name: "nx.example", IsNotFound: true}))
+	require.False(t, isStrategyFailure(context.DeadlineExceeded))
+}
+
+func TestHealthStats(t *testing.T) {
+	stats := newHealthStats(3)
+	rate, samples := stats.record(false)
+	require.Equal(t, 1.0, rate)
+	require.Equal(t, 1, samples)
+	stats.record(true)
+	rate, samples = stats.record(true)
+	require.InDelta(t, 1.0/3, rate, 0.001)
+	require.Equal(t, 3, samples)
+	// The first failure leaves the window.
+	rate, samples = stats.record(true)
+	require.Equal(t, 0.0, rate)
+	require.Equal(t, 3, samples)
+
+	stats.reset()
+	rate, samples = stats.record(false)
+	require.Equal(t, 1.0, rate)
+	require.Equal(t, 1, samples)
+}
+
+func TestDemoteStrategy(t *testing.T) {
+	var config configJSON
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"dns": [{"system": {}}, {"udp": {"address": "8.8.8.8"}}, {"tcp": {"address": "8.8.8.8"}}],
+		"tls": ["", "split:2", "tlsfrag:1"],
+		"fallback": ["socks5://a:1080", "socks5://b:1080"]
+	}`), &config))
+
+	demoted := demoteStrategy(config, &selectedStrategy{local: &Strategy{DNS: json.RawMessage(`{"system":{}}`), TLS: "split:2"}})
+	require.Equal(t, []dnsEntryJSON{config.DNS[1], config.DNS[2], config.DNS[0]}, demoted.DNS)
+	require.Equal(t, []string{"", "tlsfrag:1", "split:2"}, demoted.TLS)
+	require.Equal(t, config.Fallback, demoted.Fallback)
+	// The original config is not modified.
+	require.Equal(t, []string{"", "split:2", "tlsfrag:1"}, config.TLS)
+
+	demoted = demoteStrategy(config, &selectedStrategy{fallback: &config.Fallback[0]})
+	require.Equal(t, config.DNS, demoted.DNS)
+	require.Equal(t, []fallbackEntryJSON{{Config: "socks5://b:1080"}, {Config: "socks5://a:1080"}}, demoted.Fallback)
+}
+
+/********** Test Utilities **********/
+
+func receiveEvent(t *testing.T, events <-chan StrategyEvent) StrategyEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for strategy event")
+		return StrategyEvent{}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build psiphon
+
+package smart
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-sdk/x/psiphon"
+)
+
+// startPsiphon starts the Psiphon dialer with the given Psiphon config, returning when the tunnel is ready.
+// The start is aborted if ctx is done before that. Once started, the tunnel runs until stop is called.
+func startPsiphon(ctx context.Context, psiphonJSON json.RawMessage) (dialer transport.StreamDialer, stop func(), err error) {
+	config := &psiphon.DialerConfig{ProviderConfig: psiphonJSON}
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		config.DataRootDirectory = filepath.Join(cacheDir, "psiphon")
+		if err := os.MkdirAll(config.DataRootDirectory, 0700); err != nil {
+			config.DataRootDirectory = ""
+		}
+	}
+	psiphonDialer := psiphon.GetSingletonDialer()
+	// The tunnel runs until tunnelCtx is done, so it must not be tied to the search.
+	tunnelCtx, stopTunnel := context.WithCancel(context.WithoutCancel(ctx))
+	abortStart := context.AfterFunc(ctx, stopTunnel)
+	err = psiphonDialer.Start(tunnelCtx, config)
+	if !abortStart() || err != nil {
+		stopTunnel()
+		if err == nil {
+			err = context.Cause(ctx)
+		}
+		return nil, nil, err
+	}
+	return psiphonDialer, stopTunnel, nil
+}
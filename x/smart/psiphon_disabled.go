@@ -0,0 +1,31 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !psiphon
+
+package smart
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+)
+
+// startPsiphon always fails, since Psiphon requires the "psiphon" build tag.
+// See the [github.com/Jigsaw-Code/outline-sdk/x/psiphon] package for why.
+func startPsiphon(ctx context.Context, psiphonJSON json.RawMessage) (dialer transport.StreamDialer, stop func(), err error) {
+	return nil, nil, errors.New("psiphon is not supported in this build. Build with -tags psiphon to enable it")
+}
@@ -30,8 +30,9 @@ func newClosedChanel() <-chan struct{} {
 // raceTests will call the test function on each entry until it finds an entry for which the test returns nil error.
 // That entry is returned. A test is only started after the previous test finished or maxWait is done, whichever
 // happens first. That way you bound the wait for a test, and they may overlap.
+// If maxRunning is positive, no more than maxRunning tests run at the same time.
 // The test function should make use of the context to stop doing work when the race is done and it is no longer needed.
-func raceTests[E any, R any](ctx context.Context, maxWait time.Duration, entries []E, test func(entry E) (R, error)) (R, error) {
+func raceTests[E any, R any](ctx context.Context, maxWait time.Duration, maxRunning int, entries []E, test func(entry E) (R, error)) (R, error) {
 	type testResult struct {
 		Result R
 		Err    error
@@ -41,6 +42,7 @@ func raceTests[E any, R any](ctx context.Context, maxWait time.Duration, entries
 	waitCh := newClosedChanel()
 
 	next := 0
+	running := 0
 	for toTest := len(entries); toTest > 0; {
 		select {
 		// Search cancelled, quit.
@@ -52,10 +54,11 @@ func raceTests[E any, R any](ctx context.Context, maxWait time.Duration, entries
 		case <-waitCh:
 			entry := entries[next]
 			next++
+			running++
 
 			waitCtx, waitDone := context.WithTimeout(ctx, maxWait)
-			if next == len(entries) {
-				// Done with entries. No longer trigger on waitCh.
+			if next == len(entries) || (maxRunning > 0 && running >= maxRunning) {
+				// Done with entries or at the limit of running tests. No longer trigger on waitCh.
 				waitCh = nil
 			} else {
 				waitCh = waitCtx.Done()
@@ -70,7 +73,12 @@ func raceTests[E any, R any](ctx context.Context, maxWait time.Duration, entries
 		// Got a test result.
 		case result := <-resultChan:
 			toTest--
+			running--
 			if result.Err != nil {
+				if waitCh == nil && next < len(entries) {
+					// A slot is free to start the next test right away.
+					waitCh = newClosedChanel()
+				}
 				continue
 			}
 			return result.Result, nil
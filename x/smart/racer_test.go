@@ -0,0 +1,60 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smart
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRaceTests_MaxRunning(t *testing.T) {
+	entries := make([]int, 20)
+	for i := range entries {
+		entries[i] = i
+	}
+	var running, maxRunning, numTested atomic.Int32
+	result, err := raceTests(context.Background(), time.Millisecond, 3, entries, func(entry int) (int, error) {
+		current := running.Add(1)
+		defer running.Add(-1)
+		for {
+			seen := maxRunning.Load()
+			if current <= seen || maxRunning.CompareAndSwap(seen, current) {
+				break
+			}
+		}
+		numTested.Add(1)
+		time.Sleep(10 * time.Millisecond)
+		if entry == len(entries)-1 {
+			return entry, nil
+		}
+		return 0, errors.New("failed")
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(entries)-1, result)
+	require.Equal(t, int32(len(entries)), numTested.Load())
+	require.Equal(t, int32(3), maxRunning.Load())
+}
+
+func TestRaceTests_AllFail(t *testing.T) {
+	_, err := raceTests(context.Background(), time.Millisecond, 2, []int{1, 2, 3}, func(entry int) (int, error) {
+		return 0, errors.New("failed")
+	})
+	require.Error(t, err)
+}
@@ -17,29 +17,53 @@ package smart
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/url"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/Jigsaw-Code/outline-sdk/dns"
 	"github.com/Jigsaw-Code/outline-sdk/transport"
 	"github.com/Jigsaw-Code/outline-sdk/x/configurl"
+	"github.com/Jigsaw-Code/outline-sdk/x/connectivity"
 )
 
 // To test one strategy:
 // go run ./x/examples/smart-proxy -v -localAddr=localhost:1080 --transport="" --domain www.rferl.org  --config=<(echo '{"dns": [{"https": {"name": "doh.sb"}}]}')
 
+// DefaultStrategyTTL is how long a cached strategy is reused when [StrategyFinder.CacheTTL] is not set.
+const DefaultStrategyTTL = 7 * 24 * time.Hour
+
 type StrategyFinder struct {
 	TestTimeout  time.Duration
 	LogWriter    io.Writer
 	StreamDialer transport.StreamDialer
 	PacketDialer transport.PacketDialer
-	logMu        sync.Mutex
+	// Cache, if not nil, persists the strategy found for the network identified by NetworkID,
+	// so it can be tried first on the next call to NewDialer.
+	Cache StrategyCache
+	// NetworkID is the fingerprint of the current network (e.g. a hash of the default gateway and SSID),
+	// used as the key for the Cache.
+	NetworkID string
+	// CacheTTL is how long a found strategy can be reused. Defaults to DefaultStrategyTTL.
+	CacheTTL time.Duration
+	// Diagnose, if true, probes the first test domain when no TLS strategy works, and logs the interference
+	// found to the LogWriter. The probes make the search slower, so it's meant for debugging.
+	Diagnose bool
+	// Health, if not nil, enables the health monitoring of the dialers returned by NewDialer.
+	Health *HealthOptions
+	// DomainStrategies, if not nil, holds the TLS strategies learned for each domain. Set it to
+	// persist them, or to restore previously learned ones.
+	DomainStrategies *DomainStrategies
+	logMu            sync.Mutex
+	// Overrides the system roots to verify the test connections. Used in tests.
+	rootCAs *x509.CertPool
 }
 
 func (f *StrategyFinder) log(format string, a ...any) {
@@ -95,15 +119,22 @@ type dnsEntryJSON struct {
 }
 
 type configJSON struct {
-	DNS []dnsEntryJSON `json:"dns,omitempty"`
-	TLS []string       `json:"tls,omitempty"`
+	DNS      []dnsEntryJSON      `json:"dns,omitempty"`
+	TLS      []string            `json:"tls,omitempty"`
+	Fallback []fallbackEntryJSON `json:"fallback,omitempty"`
 }
 
 // newDNSResolverFromEntry creates a [dns.Resolver] based on the config, returning the resolver and
 // a boolean indicating whether the resolver is secure (TLS, HTTPS) and a possible error.
 func (f *StrategyFinder) newDNSResolverFromEntry(entry dnsEntryJSON) (dns.Resolver, bool, error) {
 	if entry.System != nil {
-		return nil, false, nil
+		resolver, err := dns.NewSystemResolver(f.PacketDialer, f.StreamDialer, dns.SystemResolverOptions{})
+		if err != nil {
+			// Systems without a resolv.conf file, such as Windows and Android, can only use the Go resolver,
+			// which is represented by a nil resolver.
+			return nil, false, nil
+		}
+		return resolver, false, nil
 	} else if cfg := entry.HTTPS; cfg != nil {
 		if cfg.Name == "" {
 			return nil, true, errors.New("https entry has empty server name")
@@ -185,7 +216,7 @@ func (f *StrategyFinder) dnsConfigToResolver(dnsConfig []dnsEntryJSON) ([]*smart
 	return rts, nil
 }
 
-func (f *StrategyFinder) findDNS(ctx context.Context, testDomains []string, dnsConfig []dnsEntryJSON) (dns.Resolver, error) {
+func (f *StrategyFinder) findDNS(ctx context.Context, testDomains []string, dnsConfig []dnsEntryJSON) (*smartResolver, error) {
 	resolvers, err := f.dnsConfigToResolver(dnsConfig)
 	if err != nil {
 		return nil, err
@@ -194,7 +225,7 @@ func (f *StrategyFinder) findDNS(ctx context.Context, testDomains []string, dnsC
 	ctx, searchDone := context.WithCancel(ctx)
 	defer searchDone()
 	raceStart := time.Now()
-	resolver, err := raceTests(ctx, 250*time.Millisecond, resolvers, func(resolver *smartResolver) (*smartResolver, error) {
+	resolver, err := raceTests(ctx, 250*time.Millisecond, 0, resolvers, func(resolver *smartResolver) (*smartResolver, error) {
 		for _, testDomain := range testDomains {
 			select {
 			case <-ctx.Done():
@@ -224,12 +255,48 @@ func (f *StrategyFinder) findDNS(ctx context.Context, testDomains []string, dnsC
 		return nil, fmt.Errorf("could not find working resolver: %w", err)
 	}
 	f.log("🏆 selected DNS resolver %v in %0.2fs\n\n", resolver.ID, time.Since(raceStart).Seconds())
-	return resolver.Resolver, nil
+	return resolver, nil
+}
+
+// testDialer checks that the dialer can establish a TLS connection to port 443 of all of the testDomains.
+// The kind and id are only used for logging.
+func (f *StrategyFinder) testDialer(ctx context.Context, dialer transport.StreamDialer, testDomains []string, kind string, id string) error {
+	for _, testDomain := range testDomains {
+		startTime := time.Now()
+
+		testAddr := net.JoinHostPort(testDomain, "443")
+		f.logCtx(ctx, "🏃 run %v: '%v' (domain: %v)\n", kind, id, testDomain)
+
+		err := func() error {
+			ctx, cancel := context.WithTimeout(ctx, f.TestTimeout)
+			defer cancel()
+			testConn, err := dialer.DialStream(ctx, testAddr)
+			if err != nil {
+				f.logCtx(ctx, "🏁 got %v: '%v' (domain: %v), duration=%v, dial_error=%v ❌\n", kind, id, testDomain, time.Since(startTime), err)
+				return err
+			}
+			tlsConn := tls.Client(testConn, &tls.Config{ServerName: testDomain, RootCAs: f.rootCAs})
+			err = tlsConn.HandshakeContext(ctx)
+			tlsConn.Close()
+			if err != nil {
+				f.logCtx(ctx, "🏁 got %v: '%v' (domain: %v), duration=%v, handshake=%v ❌\n", kind, id, testDomain, time.Since(startTime), err)
+				return err
+			}
+			return nil
+		}()
+		if err != nil {
+			return err
+		}
+		f.logCtx(ctx, "🏁 got %v: '%v' (domain: %v), duration=%v, status=ok ✅\n", kind, id, testDomain, time.Since(startTime))
+	}
+	return nil
 }
 
-func (f *StrategyFinder) findTLS(ctx context.Context, testDomains []string, baseDialer transport.StreamDialer, tlsConfig []string) (transport.StreamDialer, error) {
+// findTLS searches for the TLS strategy in tlsConfig that works for all the testDomains.
+// The returned dialer learns the strategy to use for each domain from the alternatives. See [DomainStrategies].
+func (f *StrategyFinder) findTLS(ctx context.Context, testDomains []string, baseDialer transport.StreamDialer, tlsConfig []string, alternatives []string) (transport.StreamDialer, string, error) {
 	if len(tlsConfig) == 0 {
-		return nil, errors.New("config for TLS is empty. Please specify at least one transport")
+		return nil, "", errors.New("config for TLS is empty. Please specify at least one transport")
 	}
 	var configModule = configurl.NewDefaultProviders()
 	configModule.StreamDialers.BaseInstance = baseDialer
@@ -241,63 +308,227 @@ func (f *StrategyFinder) findTLS(ctx context.Context, testDomains []string, base
 		Dialer transport.StreamDialer
 		Config string
 	}
-	result, err := raceTests(ctx, 250*time.Millisecond, tlsConfig, func(transportCfg string) (*SearchResult, error) {
+	result, err := raceTests(ctx, 250*time.Millisecond, maxRunningTLSTests, tlsConfig, func(transportCfg string) (*SearchResult, error) {
 		tlsDialer, err := configModule.NewStreamDialer(ctx, transportCfg)
 		if err != nil {
 			return nil, fmt.Errorf("WrapStreamDialer failed: %w", err)
 		}
-		for _, testDomain := range testDomains {
-			startTime := time.Now()
-
-			testAddr := net.JoinHostPort(testDomain, "443")
-			f.logCtx(ctx, "🏃 run TLS: '%v' (domain: %v)\n", transportCfg, testDomain)
-
-			ctx, cancel := context.WithTimeout(ctx, f.TestTimeout)
-			defer cancel()
-			testConn, err := tlsDialer.DialStream(ctx, testAddr)
-			if err != nil {
-				f.logCtx(ctx, "🏁 got TLS: '%v' (domain: %v), duration=%v, dial_error=%v ❌\n", transportCfg, testDomain, time.Since(startTime), err)
-				return nil, err
-			}
-			tlsConn := tls.Client(testConn, &tls.Config{ServerName: testDomain})
-			err = tlsConn.HandshakeContext(ctx)
-			tlsConn.Close()
-			if err != nil {
-				f.logCtx(ctx, "🏁 got TLS: '%v' (domain: %v), duration=%v, handshake=%v ❌\n", transportCfg, testDomain, time.Since(startTime), err)
-				return nil, err
-			}
-			f.logCtx(ctx, "🏁 got TLS: '%v' (domain: %v), duration=%v, status=ok ✅\n", transportCfg, testDomain, time.Since(startTime))
+		if err := f.testDialer(ctx, tlsDialer, testDomains, "TLS", transportCfg); err != nil {
+			return nil, err
 		}
 		return &SearchResult{tlsDialer, transportCfg}, nil
 	})
 	if err != nil {
-		return nil, fmt.Errorf("could not find TLS strategy: %w", err)
+		return nil, "", fmt.Errorf("could not find TLS strategy: %w", err)
 	}
 	f.log("🏆 selected TLS strategy '%v' in %0.2fs\n\n", result.Config, time.Since(raceStart).Seconds())
-	tlsDialer := result.Dialer
-	return transport.FuncStreamDialer(func(ctx context.Context, raddr string) (transport.StreamConn, error) {
-		_, portStr, err := net.SplitHostPort(raddr)
+	return f.newDomainDialer(ctx, configModule, baseDialer, result.Config, result.Dialer, alternatives), result.Config, nil
+}
+
+// diagnose logs the interference that blocks the direct connections to the domain, to help understand
+// why no TLS strategy worked.
+func (f *StrategyFinder) diagnose(ctx context.Context, domain string, dnsConfig []dnsEntryJSON) {
+	resolvers, err := f.dnsConfigToResolver(dnsConfig)
+	if err != nil {
+		f.log("🔍 could not diagnose %v: %v\n", domain, err)
+		return
+	}
+	var probeResolvers []connectivity.ProbeResolver
+	for _, resolver := range resolvers {
+		// The system resolver doesn't support the queries needed for the probe.
+		if resolver.Resolver == nil {
+			continue
+		}
+		probeResolvers = append(probeResolvers, connectivity.ProbeResolver{Name: resolver.ID, Resolver: resolver.Resolver, Trusted: resolver.Secure})
+	}
+	if len(probeResolvers) == 0 {
+		return
+	}
+	obs, err := connectivity.Probe(ctx, connectivity.ProbeConfig{
+		Domain:    domain,
+		Resolvers: probeResolvers,
+		Dialer:    f.StreamDialer,
+		TLSConfig: &tls.Config{RootCAs: f.rootCAs},
+		Timeout:   f.TestTimeout,
+	})
+	if err != nil {
+		f.log("🔍 could not diagnose %v: %v\n", domain, err)
+		return
+	}
+	for _, dnsObs := range obs.DNS {
+		if dnsObs.Err != nil {
+			f.log("🔍 resolver %v failed for %v: %v\n", dnsObs.Resolver, domain, dnsObs.Err)
+		}
+	}
+	verdicts := connectivity.Classify(obs, connectivity.ClassifyOptions{})
+	if len(verdicts) == 0 {
+		f.log("🔍 diagnosis for %v: no interference found\n", domain)
+	}
+	for _, verdict := range verdicts {
+		f.log("🔍 diagnosis for %v: %v\n", domain, verdict)
+	}
+}
+
+// findStrategy searches for a DNS and TLS strategy in config that unblocks all of the testDomains.
+// The TLS entries in allTLS are the alternatives for the domains where the selected TLS strategy doesn't work.
+func (f *StrategyFinder) findStrategy(ctx context.Context, testDomains []string, config configJSON, allTLS []string) (transport.StreamDialer, *Strategy, error) {
+	resolver, err := f.findDNS(ctx, testDomains, config.DNS)
+	if err != nil {
+		return nil, nil, err
+	}
+	strategy := &Strategy{DNS: json.RawMessage(resolver.ID)}
+	var dnsDialer transport.StreamDialer
+	if resolver.Resolver == nil {
+		if _, ok := f.StreamDialer.(*transport.TCPDialer); !ok {
+			return nil, nil, fmt.Errorf("cannot use system resolver with base dialer of type %T", f.StreamDialer)
+		}
+		dnsDialer = f.StreamDialer
+	} else {
+		cachingResolver, err := dns.NewCachingResolver(resolver.Resolver, dns.CachingResolverOptions{MaxEntries: 100})
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse address: %w", err)
+			return nil, nil, fmt.Errorf("dns.NewCachingResolver failed: %w", err)
 		}
-		portNum, err := net.DefaultResolver.LookupPort(ctx, "tcp", portStr)
+		dnsDialer, err = dns.NewStreamDialer(cachingResolver, f.StreamDialer)
 		if err != nil {
-			return nil, fmt.Errorf("could not resolve port: %w", err)
+			return nil, nil, fmt.Errorf("dns.NewStreamDialer failed: %w", err)
+		}
+	}
+
+	if len(config.TLS) == 0 {
+		return dnsDialer, strategy, nil
+	}
+	tlsDialer, tlsConfig, err := f.findTLS(ctx, testDomains, dnsDialer, config.TLS, allTLS)
+	if err != nil {
+		if f.Diagnose && f.LogWriter != nil {
+			f.diagnose(ctx, testDomains[0], config.DNS)
+		}
+		return nil, nil, err
+	}
+	strategy.TLS = tlsConfig
+	return tlsDialer, strategy, nil
+}
+
+// cachedConfig returns the config with only the strategy stored in the Cache for the current network.
+// It returns an error if there's no usable cached strategy, including when it's expired or no longer part of config.
+func (f *StrategyFinder) cachedConfig(config configJSON) (configJSON, error) {
+	strategy, err := f.Cache.Load(f.NetworkID)
+	if err != nil {
+		return configJSON{}, fmt.Errorf("failed to load strategy: %w", err)
+	}
+	if strategy == nil {
+		return configJSON{}, errors.New("no cached strategy")
+	}
+	if !time.Now().Before(strategy.Expiration) {
+		return configJSON{}, errors.New("cached strategy expired")
+	}
+	var cached configJSON
+	var dnsEntry dnsEntryJSON
+	if err := json.Unmarshal(strategy.DNS, &dnsEntry); err != nil {
+		return configJSON{}, fmt.Errorf("invalid cached DNS entry: %w", err)
+	}
+	// Compare the serialized entries, since that's how they are identified.
+	cachedID, err := json.Marshal(dnsEntry)
+	if err != nil {
+		return configJSON{}, err
+	}
+	for _, entry := range config.DNS {
+		if id, err := json.Marshal(entry); err == nil && string(id) == string(cachedID) {
+			cached.DNS = []dnsEntryJSON{entry}
+			break
+		}
+	}
+	if len(cached.DNS) == 0 {
+		return configJSON{}, errors.New("cached DNS entry is not in the config")
+	}
+	if len(config.TLS) == 0 {
+		if strategy.TLS != "" {
+			return configJSON{}, errors.New("cached TLS strategy is not in the config")
+		}
+		return cached, nil
+	}
+	if !slices.Contains(config.TLS, strategy.TLS) {
+		return configJSON{}, errors.New("cached TLS strategy is not in the config")
+	}
+	cached.TLS = []string{strategy.TLS}
+	return cached, nil
+}
+
+// selectedStrategy identifies the config entries used by a dialer found in a search.
+type selectedStrategy struct {
+	// local is the selected DNS and TLS strategy. It's nil if a fallback was selected.
+	local *Strategy
+	// fallback is the selected fallback entry, if any.
+	fallback *fallbackEntryJSON
+	// stop releases the resources of the fallback, if not nil.
+	stop func()
+}
+
+func (s *selectedStrategy) String() string {
+	if s.fallback != nil {
+		return fmt.Sprintf("fallback '%v'", s.fallback.id())
+	}
+	if s.local.TLS == "" {
+		return fmt.Sprintf("DNS %s", s.local.DNS)
+	}
+	return fmt.Sprintf("DNS %s, TLS '%v'", s.local.DNS, s.local.TLS)
+}
+
+// search finds a strategy for the config, trying the cached strategy first if useCache is true.
+// If no DNS and TLS strategy works, it searches the fallbacks.
+func (f *StrategyFinder) search(ctx context.Context, testDomains []string, config configJSON, useCache bool) (transport.StreamDialer, *selectedStrategy, error) {
+	if f.Cache != nil && useCache {
+		cachedConfig, err := f.cachedConfig(config)
+		if err == nil {
+			f.log("💾 trying cached strategy for network %q\n", f.NetworkID)
+			var dialer transport.StreamDialer
+			var strategy *Strategy
+			if dialer, strategy, err = f.findStrategy(ctx, testDomains, cachedConfig, config.TLS); err == nil {
+				return dialer, &selectedStrategy{local: strategy}, nil
+			}
+		}
+		f.log("💾 cached strategy not usable: %v\n\n", err)
+	}
+
+	dialer, strategy, err := f.findStrategy(ctx, testDomains, config, config.TLS)
+	if err != nil {
+		if len(config.Fallback) == 0 || ctx.Err() != nil {
+			return nil, nil, err
 		}
-		selectedDialer := baseDialer
-		if portNum == 443 || portNum == 853 {
-			selectedDialer = tlsDialer
+		f.log("❌ could not find a strategy, trying fallbacks: %v\n\n", err)
+		fallbackDialer, selected, fallbackErr := f.findFallback(ctx, testDomains, config.Fallback)
+		if fallbackErr != nil {
+			return nil, nil, errors.Join(err, fallbackErr)
+		}
+		return fallbackDialer, selected, nil
+	}
+	if f.Cache != nil {
+		ttl := f.CacheTTL
+		if ttl <= 0 {
+			ttl = DefaultStrategyTTL
 		}
-		return selectedDialer.DialStream(ctx, raddr)
-	}), nil
+		strategy.Expiration = time.Now().Add(ttl)
+		if err := f.Cache.Store(f.NetworkID, strategy); err != nil {
+			f.log("💾 failed to store strategy: %v\n", err)
+		}
+	}
+	return dialer, &selectedStrategy{local: strategy}, nil
 }
 
 // NewDialer uses the config in configBytes to search for a strategy that unblocks DNS and TLS for all of the testDomains, returning a dialer with the found strategy.
 // It returns an error if no strategy was found that unblocks the testDomains.
 // The testDomains must be domains with a TLS service running on port 443.
+//
+// If no DNS and TLS strategy works, it searches the "fallback" section of the config for a transport
+// that can reach the testDomains, which will then be used for all connections.
+//
+// If a Cache is set, the strategy previously found for the NetworkID is tested first, and the full search
+// only runs if it fails. The newly found strategy is then stored in the Cache.
+//
+// If Health is set, the returned dialer monitors the connections and searches for a new strategy in the
+// background when the current one starts failing. See [HealthOptions].
 func (f *StrategyFinder) NewDialer(ctx context.Context, testDomains []string, configBytes []byte) (transport.StreamDialer, error) {
-	var parsedConfig configJSON
-	err := json.Unmarshal(configBytes, &parsedConfig)
+	var rawConfig rawConfigJSON
+	err := json.Unmarshal(configBytes, &rawConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse config: %v", err)
 	}
@@ -308,26 +539,17 @@ func (f *StrategyFinder) NewDialer(ctx context.Context, testDomains []string, co
 		testDomains[di] = makeFullyQualified(domain)
 	}
 
-	resolver, err := f.findDNS(ctx, testDomains, parsedConfig.DNS)
+	parsedConfig, err := expandConfig(rawConfig, testDomains)
 	if err != nil {
 		return nil, err
 	}
-	var dnsDialer transport.StreamDialer
-	if resolver == nil {
-		if _, ok := f.StreamDialer.(*transport.TCPDialer); !ok {
-			return nil, fmt.Errorf("cannot use system resolver with base dialer of type %T", f.StreamDialer)
-		}
-		dnsDialer = f.StreamDialer
-	} else {
-		resolver = newSimpleLRUCacheResolver(resolver, 100)
-		dnsDialer, err = dns.NewStreamDialer(resolver, f.StreamDialer)
-		if err != nil {
-			return nil, fmt.Errorf("dns.NewStreamDialer failed: %w", err)
-		}
-	}
 
-	if len(parsedConfig.TLS) == 0 {
-		return dnsDialer, nil
+	dialer, selected, err := f.search(ctx, testDomains, parsedConfig, true)
+	if err != nil {
+		return nil, err
+	}
+	if f.Health == nil {
+		return dialer, nil
 	}
-	return f.findTLS(ctx, testDomains, dnsDialer, parsedConfig.TLS)
+	return f.newHealthDialer(ctx, testDomains, parsedConfig, dialer, selected), nil
 }
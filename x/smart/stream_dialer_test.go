@@ -0,0 +1,478 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smart
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNewDialer_NoFallbackWhenUnblocked(t *testing.T) {
+	network := newTestNetwork(t, "blocked.example")
+	proxy := newTestSOCKS5Server(t, network.tlsAddr)
+	finder, logs := network.newFinder()
+
+	config := network.config([]string{""}, "socks5://"+proxy.addr)
+	dialer, err := finder.NewDialer(context.Background(), []string{"open.example"}, config)
+	require.NoError(t, err)
+	require.NoError(t, testHandshake(dialer, network.roots, "open.example"))
+	require.Zero(t, proxy.numConns.Load())
+	require.NotContains(t, logs.String(), "fallback")
+}
+
+func TestNewDialer_FallbackOnBlockedSNI(t *testing.T) {
+	network := newTestNetwork(t, "blocked.example")
+	proxy := newTestSOCKS5Server(t, network.tlsAddr)
+	finder, logs := network.newFinder()
+
+	config := network.config([]string{""}, "socks5://"+proxy.addr)
+	dialer, err := finder.NewDialer(context.Background(), []string{"blocked.example"}, config)
+	require.NoError(t, err)
+	require.Contains(t, logs.String(), fmt.Sprintf("selected fallback 'socks5://%v'", proxy.addr))
+	// The diagnosis only runs if enabled.
+	require.NotContains(t, logs.String(), "diagnosis")
+
+	numConns := proxy.numConns.Load()
+	require.NoError(t, testHandshake(dialer, network.roots, "blocked.example"))
+	require.Equal(t, numConns+1, proxy.numConns.Load())
+
+	// The fallback is only used if no strategy works for all test domains.
+	network.Unblock("blocked.example")
+	finder, _ = network.newFinder()
+	_, err = finder.NewDialer(context.Background(), []string{"blocked.example"}, config)
+	require.NoError(t, err)
+	require.Equal(t, numConns+1, proxy.numConns.Load())
+}
+
+func TestNewDialer_FallbackSkipsFailingEntries(t *testing.T) {
+	network := newTestNetwork(t, "blocked.example")
+	proxy := newTestSOCKS5Server(t, network.tlsAddr)
+	finder, logs := network.newFinder()
+
+	closedAddr := newClosedAddress(t)
+	config := network.config([]string{""}, "socks5://"+closedAddr, "invalid-transport:", "socks5://"+proxy.addr)
+	dialer, err := finder.NewDialer(context.Background(), []string{"blocked.example"}, config)
+	require.NoError(t, err)
+	require.Contains(t, logs.String(), fmt.Sprintf("selected fallback 'socks5://%v'", proxy.addr))
+	require.NoError(t, testHandshake(dialer, network.roots, "blocked.example"))
+}
+
+func TestNewDialer_AllFallbacksFail(t *testing.T) {
+	network := newTestNetwork(t, "blocked.example")
+	finder, logs := network.newFinder()
+	finder.Diagnose = true
+
+	config := network.config([]string{""}, "socks5://"+newClosedAddress(t))
+	_, err := finder.NewDialer(context.Background(), []string{"blocked.example"}, config)
+	require.ErrorContains(t, err, "could not find TLS strategy")
+	require.ErrorContains(t, err, "could not find fallback")
+	require.Contains(t, logs.String(), "diagnosis for blocked.example.: sni_reset")
+}
+
+func TestFallbackEntryJSON(t *testing.T) {
+	var config configJSON
+	err := json.Unmarshal([]byte(`{"fallback": ["ss://example.com:443", {"psiphon": {"PropagationChannelId": "ID"}}]}`), &config)
+	require.NoError(t, err)
+	require.Equal(t, []fallbackEntryJSON{
+		{Config: "ss://example.com:443"},
+		{Psiphon: json.RawMessage(`{"PropagationChannelId": "ID"}`)},
+	}, config.Fallback)
+	require.Equal(t, "ss://example.com:443", config.Fallback[0].id())
+	require.Equal(t, "psiphon", config.Fallback[1].id())
+
+	require.Error(t, json.Unmarshal([]byte(`{"fallback": [{"other": {}}]}`), &config))
+	require.Error(t, json.Unmarshal([]byte(`{"fallback": [1]}`), &config))
+}
+
+/********** Test Utilities **********/
+
+// The IP the test DNS server returns for all domains. Connections to it are routed to the censor.
+const testServerIP = "203.0.113.1"
+
+// testNetwork simulates a network with a censor that resets TLS connections with blocked SNIs.
+type testNetwork struct {
+	// Address of the TLS server, which serves all the test domains. It's not reachable through the censored dialer.
+	tlsAddr string
+	// Address of the UDP DNS server, which resolves all domains to testServerIP.
+	dnsAddr string
+	// Roots to validate the TLS server certificate.
+	roots *x509.CertPool
+
+	censorAddr string
+	mu         sync.Mutex
+	blocked    map[string]bool
+}
+
+func newTestNetwork(t *testing.T, blockedSNIs ...string) *testNetwork {
+	network := &testNetwork{blocked: make(map[string]bool)}
+	for _, sni := range blockedSNIs {
+		network.blocked[sni] = true
+	}
+	var cert tls.Certificate
+	cert, network.roots = newTestCertificate(t, "blocked.example", "www.blocked.example", "open.example")
+	network.tlsAddr = newTestTLSServer(t, cert)
+	network.dnsAddr = newTestDNSServer(t, testServerIP)
+	network.censorAddr = network.newCensor(t)
+	return network
+}
+
+// Block makes the censor reset connections with the given SNI.
+func (n *testNetwork) Block(sni string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.blocked[sni] = true
+}
+
+// Unblock makes the censor allow connections with the given SNI.
+func (n *testNetwork) Unblock(sni string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.blocked, sni)
+}
+
+func (n *testNetwork) isBlocked(clientHello []byte) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for sni := range n.blocked {
+		if bytes.Contains(clientHello, []byte(sni)) {
+			return true
+		}
+	}
+	return false
+}
+
+// newCensor starts the middlebox that all connections to testServerIP:443 go through.
+func (n *testNetwork) newCensor(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			clientConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer clientConn.Close()
+				// Read the first TLS record, which carries the ClientHello.
+				header := make([]byte, 5)
+				if _, err := io.ReadFull(clientConn, header); err != nil {
+					return
+				}
+				record := make([]byte, 5+binary.BigEndian.Uint16(header[3:]))
+				copy(record, header)
+				if _, err := io.ReadFull(clientConn, record[5:]); err != nil {
+					return
+				}
+				if n.isBlocked(record) {
+					clientConn.(*net.TCPConn).SetLinger(0)
+					return
+				}
+				serverConn, err := net.Dial("tcp", n.tlsAddr)
+				if err != nil {
+					return
+				}
+				defer serverConn.Close()
+				if _, err := serverConn.Write(record); err != nil {
+					return
+				}
+				relay(clientConn, serverConn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// streamDialer returns the dialer for the censored network.
+func (n *testNetwork) streamDialer() transport.StreamDialer {
+	baseDialer := &transport.TCPDialer{}
+	return transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if host == testServerIP {
+			if port != "443" {
+				return nil, fmt.Errorf("connection refused: %v", addr)
+			}
+			addr = n.censorAddr
+		}
+		return baseDialer.DialStream(ctx, addr)
+	})
+}
+
+func (n *testNetwork) newFinder() (*StrategyFinder, *lockedBuffer) {
+	logs := &lockedBuffer{}
+	return &StrategyFinder{
+		TestTimeout:  2 * time.Second,
+		LogWriter:    logs,
+		StreamDialer: n.streamDialer(),
+		PacketDialer: &transport.UDPDialer{},
+		rootCAs:      n.roots,
+	}, logs
+}
+
+// config returns the smart dialer config with the network DNS server and the given TLS and fallback entries.
+func (n *testNetwork) config(tlsConfig []string, fallbacks ...string) []byte {
+	config := configJSON{
+		DNS: []dnsEntryJSON{{UDP: &udpEntryJSON{Address: n.dnsAddr}}},
+		TLS: tlsConfig,
+	}
+	for _, fallback := range fallbacks {
+		config.Fallback = append(config.Fallback, fallbackEntryJSON{Config: fallback})
+	}
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		panic(err)
+	}
+	return configBytes
+}
+
+func testHandshake(dialer transport.StreamDialer, roots *x509.CertPool, domain string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := dialer.DialStream(ctx, net.JoinHostPort(domain, "443"))
+	if err != nil {
+		return err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: domain, RootCAs: roots})
+	defer tlsConn.Close()
+	return tlsConn.HandshakeContext(ctx)
+}
+
+// newTestCertificate creates a self-signed certificate for the domains, and a pool that trusts it.
+func newTestCertificate(t *testing.T, domains ...string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: domains[0]},
+		DNSNames:              domains,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
+
+// newTestTLSServer starts a TLS server that completes the handshake and then waits for the client to close.
+func newTestTLSServer(t *testing.T, cert tls.Certificate) string {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// newTestDNSServer starts a UDP DNS server that resolves all domains to ip.
+func newTestDNSServer(t *testing.T, ip string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	answerIP := net.ParseIP(ip).To4()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var request dnsmessage.Message
+			if err := request.Unpack(buf[:n]); err != nil || len(request.Questions) != 1 {
+				continue
+			}
+			q := request.Questions[0]
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: request.ID, Response: true, RecursionAvailable: true},
+				Questions: request.Questions,
+			}
+			if q.Type == dnsmessage.TypeA {
+				response.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: [4]byte(answerIP)},
+				}}
+			} else {
+				response.Authorities = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body: &dnsmessage.SOAResource{
+						NS: dnsmessage.MustNewName("ns.example."), MBox: dnsmessage.MustNewName("admin.example."),
+						Serial: 1, Refresh: 60, Retry: 60, Expire: 60, MinTTL: 60,
+					},
+				}}
+			}
+			packed, err := response.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+type testSOCKS5Server struct {
+	addr     string
+	numConns atomic.Int32
+}
+
+// newTestSOCKS5Server starts a SOCKS5 proxy outside of the censored network, which connects all requests to targetAddr.
+func newTestSOCKS5Server(t *testing.T, targetAddr string) *testSOCKS5Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	server := &testSOCKS5Server{addr: listener.Addr().String()}
+	go func() {
+		for {
+			clientConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.numConns.Add(1)
+			go func() {
+				defer clientConn.Close()
+				if err := readSOCKS5Request(clientConn); err != nil {
+					return
+				}
+				targetConn, err := net.Dial("tcp", targetAddr)
+				if err != nil {
+					return
+				}
+				defer targetConn.Close()
+				// Succeeded, bound to 0.0.0.0:0.
+				if _, err := clientConn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+					return
+				}
+				relay(clientConn, targetConn)
+			}()
+		}
+	}()
+	return server
+}
+
+// readSOCKS5Request reads the method negotiation without authentication and the CONNECT request.
+func readSOCKS5Request(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return err
+	}
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return err
+	}
+	var addrLen int
+	switch request[3] {
+	case 1:
+		addrLen = 4
+	case 4:
+		addrLen = 16
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		addrLen = int(length[0])
+	default:
+		return errors.New("invalid address type")
+	}
+	// Address and port.
+	_, err := io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+func relay(left, right net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(right, left)
+		right.(*net.TCPConn).CloseWrite()
+		close(done)
+	}()
+	io.Copy(left, right)
+	left.(*net.TCPConn).CloseWrite()
+	<-done
+}
+
+// newClosedAddress returns a local address with no listener.
+func newClosedAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+// lockedBuffer is a [bytes.Buffer] that is safe for concurrent use, to capture the logs.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,233 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smart
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+)
+
+// maxRunningTLSTests bounds the TLS strategies tested at the same time, since templates can generate many of them.
+const maxRunningTLSTests = 8
+
+// maxTemplateCandidates bounds the number of strategies a single template can generate.
+const maxTemplateCandidates = 256
+
+// paramTemplateJSON specifies the values to generate for a strategy parameter. In JSON, it's either
+// an object with an inclusive "range" (e.g. {"range": [1, 64]}), or the string "sni-offset", which generates
+// the positions that split the server name in the ClientHello.
+type paramTemplateJSON struct {
+	Range     []int
+	SNIOffset bool
+}
+
+func (p *paramTemplateJSON) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		if name != "sni-offset" {
+			return fmt.Errorf("unsupported parameter template %q", name)
+		}
+		*p = paramTemplateJSON{SNIOffset: true}
+		return nil
+	}
+	var param struct {
+		Range []int `json:"range"`
+	}
+	if err := json.Unmarshal(data, &param); err != nil {
+		return fmt.Errorf("parameter template must be \"sni-offset\" or an object: %w", err)
+	}
+	if len(param.Range) != 2 {
+		return errors.New("range must have the form [min, max]")
+	}
+	if param.Range[0] < 1 || param.Range[1] < param.Range[0] {
+		return fmt.Errorf("invalid range %v: must be positive and increasing", param.Range)
+	}
+	if param.Range[1]-param.Range[0] >= maxTemplateCandidates {
+		return fmt.Errorf("range %v is too large: can have at most %v values", param.Range, maxTemplateCandidates)
+	}
+	*p = paramTemplateJSON{Range: param.Range}
+	return nil
+}
+
+// tlsTemplateJSON is an entry of the "tls" config. In JSON, it's either a config string, as accepted by
+// [configurl], or a template that generates config strings, such as {"split": {"range": [1, 64]}} or
+// {"tlsfrag": "sni-offset"}.
+type tlsTemplateJSON struct {
+	Config  string
+	Split   *paramTemplateJSON
+	TLSFrag *paramTemplateJSON
+}
+
+func (e *tlsTemplateJSON) UnmarshalJSON(data []byte) error {
+	var config string
+	if err := json.Unmarshal(data, &config); err == nil {
+		*e = tlsTemplateJSON{Config: config}
+		return nil
+	}
+	var template struct {
+		Split   *paramTemplateJSON `json:"split,omitempty"`
+		TLSFrag *paramTemplateJSON `json:"tlsfrag,omitempty"`
+	}
+	if err := json.Unmarshal(data, &template); err != nil {
+		return fmt.Errorf("tls entry must be a config string or a template: %w", err)
+	}
+	if (template.Split == nil) == (template.TLSFrag == nil) {
+		return errors.New("tls template must have exactly one of split or tlsfrag")
+	}
+	*e = tlsTemplateJSON{Split: template.Split, TLSFrag: template.TLSFrag}
+	return nil
+}
+
+// rawConfigJSON is the config as written by the user, before the TLS templates are expanded into a [configJSON].
+type rawConfigJSON struct {
+	DNS      []dnsEntryJSON      `json:"dns,omitempty"`
+	TLS      []tlsTemplateJSON   `json:"tls,omitempty"`
+	Fallback []fallbackEntryJSON `json:"fallback,omitempty"`
+}
+
+// expandConfig generates the TLS strategies from the templates in the config. The SNI offsets are computed
+// for the testDomains. The generated strategies take the place of the template, in order, skipping duplicates.
+func expandConfig(raw rawConfigJSON, testDomains []string) (configJSON, error) {
+	config := configJSON{DNS: raw.DNS, Fallback: raw.Fallback}
+	var sniOffsets []int
+	add := func(tlsConfig string) {
+		if !slices.Contains(config.TLS, tlsConfig) {
+			config.TLS = append(config.TLS, tlsConfig)
+		}
+	}
+	for ei, entry := range raw.TLS {
+		var prefix string
+		var param *paramTemplateJSON
+		// The split offsets count the TLS record header, while the tlsfrag ones are in the record content.
+		var headerLen int
+		switch {
+		case entry.Split != nil:
+			prefix, param, headerLen = "split", entry.Split, 5
+		case entry.TLSFrag != nil:
+			prefix, param = "tlsfrag", entry.TLSFrag
+		default:
+			add(entry.Config)
+			continue
+		}
+		if param.SNIOffset {
+			if sniOffsets == nil {
+				var err error
+				if sniOffsets, err = sniSplitOffsets(testDomains); err != nil {
+					return configJSON{}, fmt.Errorf("failed to expand tls entry %v: %w", ei, err)
+				}
+			}
+			for _, offset := range sniOffsets {
+				add(fmt.Sprintf("%v:%v", prefix, headerLen+offset))
+			}
+			continue
+		}
+		for value := param.Range[0]; value <= param.Range[1]; value++ {
+			add(fmt.Sprintf("%v:%v", prefix, value))
+		}
+	}
+	return config, nil
+}
+
+// sniSplitOffsets returns the offsets in the ClientHello message where splitting separates the server name
+// of any of the domains: right before it, and in its middle.
+func sniSplitOffsets(domains []string) ([]int, error) {
+	var offsets []int
+	for _, domain := range domains {
+		nameStart, nameLen, err := findSNI(strings.TrimSuffix(domain, "."))
+		if err != nil {
+			return nil, err
+		}
+		for _, offset := range []int{nameStart, nameStart + nameLen/2} {
+			if !slices.Contains(offsets, offset) {
+				offsets = append(offsets, offset)
+			}
+		}
+	}
+	slices.Sort(offsets)
+	return offsets, nil
+}
+
+// findSNI returns the position and length of the server name in the ClientHello message that [crypto/tls]
+// generates for the serverName. The position is relative to the start of the handshake message,
+// which is the content of the TLS record.
+func findSNI(serverName string) (int, int, error) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		tls.Client(clientConn, &tls.Config{ServerName: serverName}).Handshake()
+		clientConn.Close()
+	}()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(serverConn, header); err != nil {
+		return 0, 0, fmt.Errorf("failed to read ClientHello: %w", err)
+	}
+	hello := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(serverConn, hello); err != nil {
+		return 0, 0, fmt.Errorf("failed to read ClientHello: %w", err)
+	}
+	nameStart, nameLen, err := parseSNI(hello)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse ClientHello: %w", err)
+	}
+	return nameStart, nameLen, nil
+}
+
+// parseSNI returns the position and length of the host name in the server_name extension
+// of the ClientHello handshake message.
+func parseSNI(hello []byte) (int, int, error) {
+	// Handshake type (1), length (3), version (2) and random (32).
+	pos := 4 + 2 + 32
+	// Skip the session ID, cipher suites and compression methods.
+	for _, lenSize := range []int{1, 2, 1} {
+		if len(hello) < pos+lenSize {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+		fieldLen := 0
+		for _, b := range hello[pos : pos+lenSize] {
+			fieldLen = fieldLen<<8 | int(b)
+		}
+		pos += lenSize + fieldLen
+	}
+	if len(hello) < pos+2 {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	extensionsEnd := min(pos+2+int(binary.BigEndian.Uint16(hello[pos:])), len(hello))
+	pos += 2
+	for pos+4 <= extensionsEnd {
+		extType := binary.BigEndian.Uint16(hello[pos:])
+		extLen := int(binary.BigEndian.Uint16(hello[pos+2:]))
+		pos += 4
+		if extType == 0 {
+			// Server name list length (2), name type (1) and name length (2).
+			if extLen < 5 || pos+5 > extensionsEnd {
+				return 0, 0, errors.New("invalid server_name extension")
+			}
+			nameLen := int(binary.BigEndian.Uint16(hello[pos+3:]))
+			if pos+5+nameLen > extensionsEnd {
+				return 0, 0, errors.New("invalid server_name extension")
+			}
+			return pos + 5, nameLen, nil
+		}
+		pos += extLen
+	}
+	return 0, 0, errors.New("server_name extension not found")
+}
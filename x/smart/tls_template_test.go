@@ -0,0 +1,120 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package smart
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindSNI(t *testing.T) {
+	for _, domain := range []string{"example.com", "www.very-long-subdomain.example.co.uk"} {
+		t.Run(domain, func(t *testing.T) {
+			nameStart, nameLen, err := findSNI(domain)
+			require.NoError(t, err)
+			require.Equal(t, len(domain), nameLen)
+			hello := newTestClientHello(t, domain)
+			require.Equal(t, domain, string(hello[nameStart:nameStart+nameLen]))
+		})
+	}
+}
+
+func TestParseSNI_Invalid(t *testing.T) {
+	hello := newTestClientHello(t, "example.com")
+	_, _, err := parseSNI(hello[:40])
+	require.Error(t, err)
+
+	// A ClientHello without the server name.
+	hello = newTestClientHello(t, "")
+	_, _, err = parseSNI(hello)
+	require.ErrorContains(t, err, "server_name extension not found")
+}
+
+func TestExpandConfig(t *testing.T) {
+	var raw rawConfigJSON
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"dns": [{"system": {}}],
+		"tls": ["", "split:2", {"split": {"range": [1, 3]}}, {"tlsfrag": "sni-offset"}, {"split": "sni-offset"}],
+		"fallback": ["socks5://proxy:1080"]
+	}`), &raw))
+	config, err := expandConfig(raw, []string{"example.com."})
+	require.NoError(t, err)
+	require.Equal(t, raw.DNS, config.DNS)
+	require.Equal(t, raw.Fallback, config.Fallback)
+
+	nameStart, nameLen, err := findSNI("example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"", "split:2", "split:1", "split:3",
+		fmt.Sprintf("tlsfrag:%v", nameStart), fmt.Sprintf("tlsfrag:%v", nameStart+nameLen/2),
+		fmt.Sprintf("split:%v", 5+nameStart), fmt.Sprintf("split:%v", 5+nameStart+nameLen/2),
+	}, config.TLS)
+}
+
+func TestTLSTemplateJSON_Invalid(t *testing.T) {
+	for _, entry := range []string{
+		`{"split": {"range": [0, 5]}}`,
+		`{"split": {"range": [5, 1]}}`,
+		`{"split": {"range": [1]}}`,
+		`{"split": {"range": [1, 1000]}}`,
+		`{"split": "other"}`,
+		`{"split": "sni-offset", "tlsfrag": "sni-offset"}`,
+		`{}`,
+		`1`,
+	} {
+		t.Run(entry, func(t *testing.T) {
+			var template tlsTemplateJSON
+			require.Error(t, json.Unmarshal([]byte(entry), &template))
+		})
+	}
+}
+
+func TestNewDialer_SNIOffsetTemplate(t *testing.T) {
+	network := newTestNetwork(t, "blocked.example")
+	finder, logs := network.newFinder()
+
+	config := fmt.Sprintf(`{"dns": [{"udp": {"address": %q}}], "tls": ["", {"tlsfrag": "sni-offset"}]}`, network.dnsAddr)
+	dialer, err := finder.NewDialer(context.Background(), []string{"blocked.example"}, []byte(config))
+	require.NoError(t, err)
+	require.Contains(t, logs.String(), "selected TLS strategy 'tlsfrag:")
+	require.NoError(t, testHandshake(dialer, network.roots, "blocked.example"))
+}
+
+/********** Test Utilities **********/
+
+// newTestClientHello returns the ClientHello handshake message crypto/tls sends for the serverName.
+func newTestClientHello(t *testing.T, serverName string) []byte {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		tls.Client(clientConn, &tls.Config{ServerName: serverName, InsecureSkipVerify: serverName == ""}).Handshake()
+		clientConn.Close()
+	}()
+	header := make([]byte, 5)
+	_, err := io.ReadFull(serverConn, header)
+	require.NoError(t, err)
+	hello := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	_, err = io.ReadFull(serverConn, hello)
+	require.NoError(t, err)
+	return hello
+}
@@ -0,0 +1,125 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/Jigsaw-Code/outline-sdk/network"
+	"github.com/songgao/water"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Config describes the TUN device to create with [New].
+type Config struct {
+	// Name is the name of the network interface.
+	Name string
+	// Addresses are assigned to the device. The device is routable for the families of these addresses.
+	Addresses []netip.Prefix
+	// MTU of the device. Zero keeps the system default.
+	MTU int
+}
+
+// Device is a Linux TUN device that implements [network.IPDevice].
+type Device struct {
+	*water.Interface
+	link      netlink.Link
+	addresses []netip.Prefix
+}
+
+var _ network.IPDevice = (*Device)(nil)
+
+// New creates a TUN device with the given configuration and brings it up. The device is removed from the system
+// when it is closed, or when the process exits.
+func New(config Config) (d *Device, err error) {
+	if len(config.Name) == 0 {
+		return nil, errors.New("name is required for TUN device")
+	}
+	if len(config.Addresses) == 0 {
+		return nil, errors.New("at least one address is required for TUN device")
+	}
+	if config.MTU < 0 {
+		return nil, errors.New("MTU must not be negative")
+	}
+
+	tun, err := water.New(water.Config{
+		DeviceType: water.TUN,
+		PlatformSpecificParams: water.PlatformSpecificParams{
+			Name:    config.Name,
+			Persist: false,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TUN device: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tun.Close()
+		}
+	}()
+
+	link, err := netlink.LinkByName(tun.Name())
+	if err != nil {
+		return nil, fmt.Errorf("newly created TUN device '%s' not found: %w", tun.Name(), err)
+	}
+	if config.MTU > 0 {
+		if err := netlink.LinkSetMTU(link, config.MTU); err != nil {
+			return nil, fmt.Errorf("failed to set MTU of TUN device '%s': %w", tun.Name(), err)
+		}
+	}
+	for _, prefix := range config.Addresses {
+		addr := &netlink.Addr{IPNet: prefixToIPNet(prefix)}
+		if prefix.Addr().Is6() {
+			// There are no other hosts on the link, so Duplicate Address Detection would only delay its use.
+			addr.Flags = unix.IFA_F_NODAD
+		}
+		if err := netlink.AddrReplace(link, addr); err != nil {
+			return nil, fmt.Errorf("failed to add address %v to TUN device '%s': %w", prefix, tun.Name(), err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("failed to bring TUN device '%s' up: %w", tun.Name(), err)
+	}
+	// Refresh the attributes, so that MTU reports the actual value.
+	if link, err = netlink.LinkByIndex(link.Attrs().Index); err != nil {
+		return nil, fmt.Errorf("TUN device '%s' not found: %w", tun.Name(), err)
+	}
+	return &Device{
+		Interface: tun,
+		link:      link,
+		addresses: append([]netip.Prefix(nil), config.Addresses...),
+	}, nil
+}
+
+// MTU implements [network.IPDevice].MTU.
+func (d *Device) MTU() int {
+	return d.link.Attrs().MTU
+}
+
+// Addresses returns the addresses assigned to the device by [New].
+func (d *Device) Addresses() []netip.Prefix {
+	return append([]netip.Prefix(nil), d.addresses...)
+}
+
+func prefixToIPNet(prefix netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   prefix.Addr().AsSlice(),
+		Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tun provides the building blocks to send the system traffic through a [network.IPDevice], such as the
+// one created by [github.com/Jigsaw-Code/outline-sdk/network/lwip2transport].
+//
+// On Linux, [New] creates a TUN device, [SetUpRouting] configures the policy routing that sends the traffic to it,
+// and [RecoverRouting] reverts the routing left behind by a process that didn't exit cleanly. [SetUpKillSwitch]
+// installs an nftables firewall that blocks the traffic that would bypass the device, and [RecoverKillSwitch]
+// removes it after a crash. [Run] copies the packets between the TUN device and the [network.IPDevice] until its
+// context is done.
+//
+// Creating devices and changing the routing requires the CAP_NET_ADMIN capability. The tests can run without
+// privileges inside a network namespace:
+//
+//	unshare --user --map-root-user --net go test ./tun
+package tun
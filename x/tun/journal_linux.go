@@ -0,0 +1,100 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+)
+
+// The journals record the system changes, so they can be reverted by another process.
+
+// routingJournal records the routing changes.
+type routingJournal struct {
+	Routes []routeEntry `json:"routes"`
+	Rules  []ruleEntry  `json:"rules"`
+}
+
+// routeEntry is a route to Dst through Device, in the routing table Table. If Type is RTN_UNREACHABLE, Dst is
+// unreachable instead, and Device is empty.
+type routeEntry struct {
+	Device string       `json:"device,omitempty"`
+	Table  int          `json:"table"`
+	Dst    netip.Prefix `json:"dst"`
+	Type   int          `json:"type,omitempty"`
+}
+
+// ruleEntry is an ip rule that selects Table for the traffic to Dst, or all the traffic of the Family if Dst is
+// not valid.
+type ruleEntry struct {
+	Priority int          `json:"priority"`
+	Table    int          `json:"table"`
+	Family   int          `json:"family"`
+	Dst      netip.Prefix `json:"dst"`
+}
+
+// killSwitchJournal records the nftables table of the kill switch.
+type killSwitchJournal struct {
+	Table string `json:"table"`
+}
+
+// writeJournal atomically replaces the journal at path with the JSON encoding of journal.
+func writeJournal(path string, journal any) error {
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create journal directory: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	return nil
+}
+
+// readJournal decodes the journal at path into journal. It returns false if the journal doesn't exist.
+func readJournal(path string, journal any) (bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read journal: %w", err)
+	}
+	if err := json.Unmarshal(data, journal); err != nil {
+		return false, fmt.Errorf("failed to parse journal '%s': %w", path, err)
+	}
+	return true, nil
+}
+
+func removeJournal(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove journal: %w", err)
+	}
+	return nil
+}
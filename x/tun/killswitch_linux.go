@@ -0,0 +1,175 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// KillSwitchConfig describes the firewall created by [SetUpKillSwitch].
+type KillSwitchConfig struct {
+	// TableName is the nftables table that holds the kill switch. It must not be used by anything else.
+	TableName string
+	// DeviceName is the network interface that may send any traffic, usually a [Device].
+	DeviceName string
+	// Allowed are the destinations that may be reached outside of the device, such as the address of the proxy server.
+	Allowed []netip.Prefix
+	// JournalPath is the file that records the kill switch, so that it can be removed with [RecoverKillSwitch]
+	// if the process exits without calling [KillSwitch.Close]. Empty disables the journal.
+	JournalPath string
+}
+
+// KillSwitch is the firewall set up by [SetUpKillSwitch].
+type KillSwitch struct {
+	mu          sync.Mutex
+	table       *nftables.Table
+	journalPath string
+}
+
+// SetUpKillSwitch installs an nftables table that drops all the outgoing traffic, except the traffic sent through
+// the loopback interface, through config.DeviceName, or to config.Allowed. It keeps blocking the traffic if the
+// process dies, or if the device goes away, until it is removed with [KillSwitch.Close] or [RecoverKillSwitch].
+//
+// SetUpKillSwitch replaces the table if it already exists, so it's safe to call it again. The journal is written
+// before the table is installed.
+func SetUpKillSwitch(config KillSwitchConfig) (*KillSwitch, error) {
+	if config.TableName == "" {
+		return nil, errors.New("TableName is required")
+	}
+	if config.DeviceName == "" {
+		return nil, errors.New("DeviceName is required")
+	}
+	if len(config.DeviceName) >= unix.IFNAMSIZ {
+		return nil, fmt.Errorf("DeviceName '%s' is too long", config.DeviceName)
+	}
+	for _, prefix := range config.Allowed {
+		if !prefix.IsValid() {
+			return nil, fmt.Errorf("invalid allowed destination %v", prefix)
+		}
+	}
+	if config.JournalPath != "" {
+		if err := writeJournal(config.JournalPath, &killSwitchJournal{Table: config.TableName}); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nftables: %w", err)
+	}
+	table := &nftables.Table{Name: config.TableName, Family: nftables.TableFamilyINet}
+	// Adding the table before deleting it makes the deletion succeed if it doesn't exist yet.
+	conn.AddTable(table)
+	conn.DelTable(table)
+	conn.AddTable(table)
+	policy := nftables.ChainPolicyDrop
+	chain := conn.AddChain(&nftables.Chain{
+		Name:     "output",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	})
+	for _, ifname := range []string{"lo", config.DeviceName} {
+		conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifnameData(ifname)},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		}})
+	}
+	for _, prefix := range config.Allowed {
+		conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: destinationExprs(prefix.Masked(), expr.VerdictAccept)})
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to install kill switch: %w", err), removeJournal(config.JournalPath))
+	}
+	return &KillSwitch{table: table, journalPath: config.JournalPath}, nil
+}
+
+// Close removes the kill switch and its journal. It's safe to call it multiple times.
+func (k *KillSwitch) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.table == nil {
+		return nil
+	}
+	if err := deleteTable(k.table.Name); err != nil {
+		return err
+	}
+	k.table = nil
+	return removeJournal(k.journalPath)
+}
+
+// RecoverKillSwitch removes the kill switch recorded in the journal at journalPath, and the journal.
+// It does nothing if the journal doesn't exist.
+func RecoverKillSwitch(journalPath string) error {
+	journal := &killSwitchJournal{}
+	if found, err := readJournal(journalPath, journal); err != nil || !found {
+		return err
+	}
+	if err := deleteTable(journal.Table); err != nil {
+		return err
+	}
+	return removeJournal(journalPath)
+}
+
+// deleteTable deletes the kill switch table. It succeeds if the table doesn't exist.
+func deleteTable(name string) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed to connect to nftables: %w", err)
+	}
+	conn.DelTable(&nftables.Table{Name: name, Family: nftables.TableFamilyINet})
+	if err := conn.Flush(); err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("failed to remove kill switch table '%s': %w", name, err)
+	}
+	return nil
+}
+
+// ifnameData returns the interface name in the format used by the kernel, padded to IFNAMSIZ.
+func ifnameData(name string) []byte {
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name)
+	return data
+}
+
+// destinationExprs returns the expressions that apply the verdict to the packets sent to prefix.
+func destinationExprs(prefix netip.Prefix, verdict expr.VerdictKind) []expr.Any {
+	proto, offset := byte(unix.NFPROTO_IPV4), uint32(16)
+	if prefix.Addr().Is6() {
+		proto, offset = unix.NFPROTO_IPV6, 24
+	}
+	addr := prefix.Addr().AsSlice()
+	mask := make([]byte, len(addr))
+	for i := 0; i < prefix.Bits(); i++ {
+		mask[i/8] |= 0x80 >> (i % 8)
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(addr))},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: uint32(len(addr)), Mask: mask, Xor: make([]byte, len(addr))},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr},
+		&expr.Verdict{Kind: verdict},
+	}
+}
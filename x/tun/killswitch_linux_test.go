@@ -0,0 +1,128 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tun
+
+import (
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const testKillSwitchTable = "tuntest_killswitch"
+
+func TestKillSwitch(t *testing.T) {
+	enterNewNetNS(t)
+	tunnel := newTestDevice(t)
+	defer tunnel.Close()
+	// Stands for the physical network interface.
+	physical, err := New(Config{Name: "tunphys0", Addresses: []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.100/24"), netip.MustParsePrefix("2001:db8::100/64"),
+	}})
+	require.NoError(t, err)
+	defer physical.Close()
+	addTestRoute(t, tunnel, "203.0.113.0/24")
+	addTestRoute(t, physical, "198.51.100.0/24")
+
+	config := KillSwitchConfig{
+		TableName:   testKillSwitchTable,
+		DeviceName:  testDeviceName,
+		Allowed:     []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32"), netip.MustParsePrefix("2001:db8::1/128")},
+		JournalPath: filepath.Join(t.TempDir(), "killswitch.json"),
+	}
+	killSwitch, err := SetUpKillSwitch(config)
+	require.NoError(t, err)
+	// Setting it up again replaces the table.
+	_, err = SetUpKillSwitch(config)
+	require.NoError(t, err)
+	require.FileExists(t, config.JournalPath)
+
+	require.NoError(t, sendUDP("203.0.113.1"))
+	require.NoError(t, sendUDP("192.0.2.1"))
+	require.NoError(t, sendUDP("2001:db8::1"))
+	require.ErrorIs(t, sendUDP("192.0.2.2"), unix.EPERM)
+	require.ErrorIs(t, sendUDP("198.51.100.1"), unix.EPERM)
+	require.ErrorIs(t, sendUDP("2001:db8::2"), unix.EPERM)
+
+	require.NoError(t, killSwitch.Close())
+	require.NoError(t, killSwitch.Close())
+	require.NoError(t, sendUDP("198.51.100.1"))
+	require.Empty(t, listTestTables(t))
+	require.NoFileExists(t, config.JournalPath)
+}
+
+func TestRecoverKillSwitch(t *testing.T) {
+	enterNewNetNS(t)
+	tunnel := newTestDevice(t)
+	addTestRoute(t, tunnel, "203.0.113.0/24")
+
+	config := KillSwitchConfig{
+		TableName:   testKillSwitchTable,
+		DeviceName:  testDeviceName,
+		JournalPath: filepath.Join(t.TempDir(), "killswitch.json"),
+	}
+	_, err := SetUpKillSwitch(config)
+	require.NoError(t, err)
+	// The kill switch keeps blocking after the device goes away.
+	require.NoError(t, tunnel.Close())
+	require.Len(t, listTestTables(t), 1)
+
+	require.NoError(t, RecoverKillSwitch(config.JournalPath))
+	require.Empty(t, listTestTables(t))
+	require.NoFileExists(t, config.JournalPath)
+	require.NoError(t, RecoverKillSwitch(config.JournalPath))
+}
+
+func TestSetUpKillSwitch_InvalidConfig(t *testing.T) {
+	_, err := SetUpKillSwitch(KillSwitchConfig{DeviceName: testDeviceName})
+	require.Error(t, err)
+	_, err = SetUpKillSwitch(KillSwitchConfig{TableName: testKillSwitchTable})
+	require.Error(t, err)
+	_, err = SetUpKillSwitch(KillSwitchConfig{TableName: testKillSwitchTable, DeviceName: "name-longer-than-ifnamsiz"})
+	require.Error(t, err)
+	_, err = SetUpKillSwitch(KillSwitchConfig{TableName: testKillSwitchTable, DeviceName: testDeviceName, Allowed: []netip.Prefix{{}}})
+	require.Error(t, err)
+}
+
+/********** Test Utilities **********/
+
+func addTestRoute(t *testing.T, device *Device, dst string) {
+	route := &netlink.Route{LinkIndex: device.link.Attrs().Index, Dst: prefixToIPNet(netip.MustParsePrefix(dst))}
+	require.NoError(t, netlink.RouteAdd(route))
+}
+
+// sendUDP sends a datagram to the address. It returns EPERM if the firewall drops it.
+func sendUDP(addr string) error {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP(addr), Port: 53})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("request"))
+	return err
+}
+
+func listTestTables(t *testing.T) []*nftables.Table {
+	conn, err := nftables.New()
+	require.NoError(t, err)
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyINet)
+	require.NoError(t, err)
+	return tables
+}
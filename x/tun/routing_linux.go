@@ -0,0 +1,284 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// RoutingConfig describes the policy routing created by [SetUpRouting].
+type RoutingConfig struct {
+	// DeviceName is the network interface that receives the routed traffic, usually a [Device].
+	DeviceName string
+	// Destinations are routed through the device, for example 0.0.0.0/0 and ::/0 to route all the traffic.
+	Destinations []netip.Prefix
+	// Bypass are destinations that keep using the main routing table, such as the address of the proxy server.
+	Bypass []netip.Prefix
+	// Blocked are destinations that become unreachable, so that their traffic doesn't leak outside of the device.
+	// For example, ::/0 blocks IPv6 when the device only handles IPv4.
+	Blocked []netip.Prefix
+	// TableID is the routing table that holds the routes through the device. It must not be used by anything else.
+	TableID int
+	// RulePriority is the priority of the ip rules that send the traffic to the bypass destinations to the main table.
+	// The rules that select TableID use RulePriority+1.
+	RulePriority int
+	// JournalPath is the file that records the routing changes, so that they can be reverted with [RecoverRouting]
+	// if the process exits without calling [Routing.Close]. Empty disables the journal.
+	JournalPath string
+}
+
+// Routing is the policy routing set up by [SetUpRouting].
+type Routing struct {
+	mu          sync.Mutex
+	journal     *routingJournal
+	journalPath string
+}
+
+// SetUpRouting adds the routes and ip rules described by config. It's idempotent: entries that already exist are
+// left in place, so it's safe to call it again after a partial failure. If the journal of a previous run exists at
+// config.JournalPath, SetUpRouting reverts it first.
+//
+// The changes are recorded in the journal before they are applied. On failure, the applied changes are reverted.
+func SetUpRouting(config RoutingConfig) (*Routing, error) {
+	journal, err := newRoutingJournal(config)
+	if err != nil {
+		return nil, err
+	}
+	link, err := netlink.LinkByName(config.DeviceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find device '%s': %w", config.DeviceName, err)
+	}
+	if config.JournalPath != "" {
+		if err := RecoverRouting(config.JournalPath); err != nil {
+			return nil, fmt.Errorf("failed to revert the routing of a previous run: %w", err)
+		}
+		if err := writeJournal(config.JournalPath, journal); err != nil {
+			return nil, err
+		}
+	}
+	r := &Routing{journal: journal, journalPath: config.JournalPath}
+	if err := journal.apply(link); err != nil {
+		return nil, errors.Join(err, r.Close())
+	}
+	return r, nil
+}
+
+// Close reverts the routing changes and removes the journal. It's safe to call it multiple times.
+func (r *Routing) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.journal == nil {
+		return nil
+	}
+	if err := r.journal.revert(); err != nil {
+		return err
+	}
+	r.journal = nil
+	return removeJournal(r.journalPath)
+}
+
+// RecoverRouting reverts the routing changes recorded in the journal at journalPath, and removes the journal.
+// It does nothing if the journal doesn't exist.
+func RecoverRouting(journalPath string) error {
+	journal := &routingJournal{}
+	if found, err := readJournal(journalPath, journal); err != nil || !found {
+		return err
+	}
+	if err := journal.revert(); err != nil {
+		return err
+	}
+	return removeJournal(journalPath)
+}
+
+func newRoutingJournal(config RoutingConfig) (*routingJournal, error) {
+	if config.DeviceName == "" {
+		return nil, errors.New("DeviceName is required")
+	}
+	if len(config.Destinations) == 0 {
+		return nil, errors.New("at least one destination is required")
+	}
+	switch config.TableID {
+	case unix.RT_TABLE_UNSPEC, unix.RT_TABLE_COMPAT, unix.RT_TABLE_DEFAULT, unix.RT_TABLE_MAIN, unix.RT_TABLE_LOCAL:
+		return nil, fmt.Errorf("TableID %v is reserved", config.TableID)
+	}
+	if config.TableID < 0 {
+		return nil, errors.New("TableID must not be negative")
+	}
+	if config.RulePriority <= 0 {
+		return nil, errors.New("RulePriority must be greater than 0")
+	}
+
+	journal := &routingJournal{}
+	families := make(map[int]bool)
+	for _, dst := range config.Destinations {
+		if !dst.IsValid() {
+			return nil, fmt.Errorf("invalid destination %v", dst)
+		}
+		journal.Routes = append(journal.Routes, routeEntry{Device: config.DeviceName, Table: config.TableID, Dst: dst.Masked()})
+		families[prefixFamily(dst)] = true
+	}
+	for _, dst := range config.Blocked {
+		if !dst.IsValid() {
+			return nil, fmt.Errorf("invalid blocked destination %v", dst)
+		}
+		journal.Routes = append(journal.Routes, routeEntry{Table: config.TableID, Dst: dst.Masked(), Type: unix.RTN_UNREACHABLE})
+		families[prefixFamily(dst)] = true
+	}
+	for _, dst := range config.Bypass {
+		if !dst.IsValid() {
+			return nil, fmt.Errorf("invalid bypass destination %v", dst)
+		}
+		journal.Rules = append(journal.Rules, ruleEntry{
+			Priority: config.RulePriority, Table: unix.RT_TABLE_MAIN, Family: prefixFamily(dst), Dst: dst.Masked(),
+		})
+	}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		if families[family] {
+			journal.Rules = append(journal.Rules, ruleEntry{
+				Priority: config.RulePriority + 1, Table: config.TableID, Family: family,
+			})
+		}
+	}
+	return journal, nil
+}
+
+func prefixFamily(prefix netip.Prefix) int {
+	if prefix.Addr().Is4() {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+// isNotExist reports whether err means that the entry to delete doesn't exist.
+func isNotExist(err error) bool {
+	var linkErr netlink.LinkNotFoundError
+	return errors.Is(err, unix.ESRCH) || errors.Is(err, unix.ENOENT) || errors.As(err, &linkErr)
+}
+
+// route returns the netlink route for the entry. link is ignored for unreachable routes.
+func (e *routeEntry) route(link netlink.Link) *netlink.Route {
+	if e.Type == unix.RTN_UNREACHABLE {
+		return &netlink.Route{Table: e.Table, Dst: prefixToIPNet(e.Dst), Type: e.Type}
+	}
+	return &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Table:     e.Table,
+		Dst:       prefixToIPNet(e.Dst),
+		Scope:     netlink.SCOPE_LINK,
+	}
+}
+
+// String describes the route for error messages.
+func (e *routeEntry) String() string {
+	if e.Type == unix.RTN_UNREACHABLE {
+		return fmt.Sprintf("unreachable route to %v in table %v", e.Dst, e.Table)
+	}
+	return fmt.Sprintf("route to %v via '%s' in table %v", e.Dst, e.Device, e.Table)
+}
+
+func (e *ruleEntry) rule() *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Priority = e.Priority
+	rule.Family = e.Family
+	rule.Table = e.Table
+	if e.Dst.IsValid() {
+		rule.Dst = prefixToIPNet(e.Dst)
+	}
+	return rule
+}
+
+// exists reports whether an equivalent rule is already installed.
+func (e *ruleEntry) exists() (bool, error) {
+	rules, err := netlink.RuleList(e.Family)
+	if err != nil {
+		return false, fmt.Errorf("failed to list ip rules: %w", err)
+	}
+	want := e.rule()
+	for _, rule := range rules {
+		if rule.Priority == want.Priority && rule.Table == want.Table && !rule.Invert &&
+			rule.Src == nil && rule.Dst.String() == want.Dst.String() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// apply adds the routes through link, then the rules that select them.
+func (j *routingJournal) apply(link netlink.Link) error {
+	for _, entry := range j.Routes {
+		route := entry.route(link)
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to add %v: %w", &entry, err)
+		}
+	}
+	for _, entry := range j.Rules {
+		exists, err := entry.exists()
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if err := netlink.RuleAdd(entry.rule()); err != nil {
+			return fmt.Errorf("failed to add ip rule (priority %v, table %v, dst %v): %w", entry.Priority, entry.Table, entry.Dst, err)
+		}
+	}
+	return nil
+}
+
+// revert deletes the rules, then the routes. Entries that don't exist are ignored.
+func (j *routingJournal) revert() error {
+	var revertErr error
+	for _, entry := range j.Rules {
+		// Delete all copies, in case the rule was added more than once.
+		for {
+			err := netlink.RuleDel(entry.rule())
+			if isNotExist(err) {
+				break
+			}
+			if err != nil {
+				revertErr = errors.Join(revertErr, fmt.Errorf("failed to delete ip rule (priority %v, table %v, dst %v): %w", entry.Priority, entry.Table, entry.Dst, err))
+				break
+			}
+		}
+	}
+	for _, entry := range j.Routes {
+		if entry.Type == unix.RTN_UNREACHABLE {
+			if err := netlink.RouteDel(entry.route(nil)); err != nil && !isNotExist(err) {
+				revertErr = errors.Join(revertErr, fmt.Errorf("failed to delete %v: %w", &entry, err))
+			}
+			continue
+		}
+		link, err := netlink.LinkByName(entry.Device)
+		if isNotExist(err) {
+			// The routes are removed with the device.
+			continue
+		}
+		if err != nil {
+			revertErr = errors.Join(revertErr, fmt.Errorf("failed to find device '%s': %w", entry.Device, err))
+			continue
+		}
+		if err := netlink.RouteDel(entry.route(link)); err != nil && !isNotExist(err) {
+			revertErr = errors.Join(revertErr, fmt.Errorf("failed to delete %v: %w", &entry, err))
+		}
+	}
+	return revertErr
+}
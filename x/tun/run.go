@@ -0,0 +1,90 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Jigsaw-Code/outline-sdk/network"
+)
+
+// maxPacketSize is the size of the buffers used by [Run] when the devices report no MTU.
+const maxPacketSize = 65535
+
+// Run copies the packets read from tun to device, and the packets read from device to tun, until ctx is done or
+// one of the devices fails. It closes both devices before returning, which unblocks the pending reads.
+//
+// Run returns nil if it stopped because ctx is done and the devices closed cleanly. Otherwise, it returns the
+// error that stopped the copy, joined with the errors closing the devices.
+func Run(ctx context.Context, device network.IPDevice, tun network.IPDevice) error {
+	if device == nil {
+		return errors.New("argument device must not be nil")
+	}
+	if tun == nil {
+		return errors.New("argument tun must not be nil")
+	}
+	copyCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var copyErr error
+	var errOnce sync.Once
+	pump := func(dst, src network.IPDevice, direction string) {
+		defer wg.Done()
+		err := copyPackets(dst, src)
+		// Errors after the shutdown started are caused by the devices being closed.
+		if copyCtx.Err() == nil {
+			errOnce.Do(func() {
+				copyErr = fmt.Errorf("failed to copy packets %s: %w", direction, err)
+			})
+		}
+		cancel()
+	}
+	wg.Add(2)
+	go pump(device, tun, "from tun to device")
+	go pump(tun, device, "from device to tun")
+
+	<-copyCtx.Done()
+	closeErr := errors.Join(tun.Close(), device.Close())
+	wg.Wait()
+	return errors.Join(copyErr, closeErr)
+}
+
+// copyPackets copies packets from src to dst, one Read and one Write per packet. Unlike [io.Copy], it
+// never merges or splits packets. It returns the error that stopped the copy, which is never nil.
+func copyPackets(dst, src network.IPDevice) error {
+	size := src.MTU()
+	if dstMTU := dst.MTU(); dstMTU > size {
+		size = dstMTU
+	}
+	if size <= 0 {
+		size = maxPacketSize
+	}
+	buf := make([]byte, size)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tun
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/network"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	device, tun := newFakeDevice(), newFakeDevice()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Run(ctx, device, tun)
+	}()
+
+	tun.in <- []byte("outgoing packet")
+	require.Equal(t, []byte("outgoing packet"), <-device.out)
+	device.in <- []byte("incoming packet")
+	require.Equal(t, []byte("incoming packet"), <-tun.out)
+
+	cancel()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "Run didn't stop")
+	}
+	require.True(t, device.isClosed())
+	require.True(t, tun.isClosed())
+}
+
+func TestRun_StopsOnError(t *testing.T) {
+	device, tun := newFakeDevice(), newFakeDevice()
+	errRead := errors.New("read failed")
+	tun.readErr = errRead
+	close(tun.in)
+
+	err := Run(context.Background(), device, tun)
+	require.ErrorIs(t, err, errRead)
+	require.True(t, device.isClosed())
+	require.True(t, tun.isClosed())
+}
+
+func TestRun_NilArguments(t *testing.T) {
+	require.Error(t, Run(context.Background(), nil, newFakeDevice()))
+	require.Error(t, Run(context.Background(), newFakeDevice(), nil))
+}
+
+/********** Test Utilities **********/
+
+// fakeDevice returns the packets sent to in from Read, and sends the packets passed to Write to out.
+// If in is closed, Read returns readErr.
+type fakeDevice struct {
+	in, out   chan []byte
+	readErr   error
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var _ network.IPDevice = (*fakeDevice)(nil)
+
+func newFakeDevice() *fakeDevice {
+	return &fakeDevice{in: make(chan []byte), out: make(chan []byte), closed: make(chan struct{})}
+}
+
+func (d *fakeDevice) MTU() int {
+	return 1500
+}
+
+func (d *fakeDevice) Read(p []byte) (int, error) {
+	select {
+	case packet, ok := <-d.in:
+		if !ok {
+			return 0, d.readErr
+		}
+		return copy(p, packet), nil
+	case <-d.closed:
+		return 0, network.ErrClosed
+	}
+}
+
+func (d *fakeDevice) Write(b []byte) (int, error) {
+	select {
+	case d.out <- append([]byte(nil), b...):
+		return len(b), nil
+	case <-d.closed:
+		return 0, network.ErrClosed
+	}
+}
+
+func (d *fakeDevice) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
+
+func (d *fakeDevice) isClosed() bool {
+	select {
+	case <-d.closed:
+		return true
+	default:
+		return false
+	}
+}
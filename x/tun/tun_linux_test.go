@@ -0,0 +1,359 @@
+// Copyright 2024 The Outline Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tun
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	testDeviceName   = "tuntest0"
+	testTableID      = 233
+	testRulePriority = 23333
+)
+
+var testDeviceIP = netip.MustParseAddr("10.233.233.1")
+
+func TestNew(t *testing.T) {
+	enterNewNetNS(t)
+	device, err := New(Config{Name: testDeviceName, Addresses: []netip.Prefix{netip.PrefixFrom(testDeviceIP, 32)}, MTU: 1400})
+	require.NoError(t, err)
+	defer device.Close()
+
+	require.Equal(t, testDeviceName, device.Name())
+	require.Equal(t, 1400, device.MTU())
+	link, err := netlink.LinkByName(testDeviceName)
+	require.NoError(t, err)
+	require.NotZero(t, link.Attrs().Flags&net.FlagUp)
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	require.NoError(t, err)
+	require.Len(t, addrs, 1)
+	require.Equal(t, "10.233.233.1/32", addrs[0].IPNet.String())
+
+	require.NoError(t, device.Close())
+	_, err = netlink.LinkByName(testDeviceName)
+	require.Error(t, err)
+}
+
+func TestNew_InvalidConfig(t *testing.T) {
+	_, err := New(Config{Addresses: []netip.Prefix{netip.PrefixFrom(testDeviceIP, 32)}})
+	require.Error(t, err)
+	_, err = New(Config{Name: testDeviceName})
+	require.Error(t, err)
+	_, err = New(Config{Name: testDeviceName, Addresses: []netip.Prefix{netip.PrefixFrom(testDeviceIP, 32)}, MTU: -1})
+	require.Error(t, err)
+}
+
+func TestSetUpRouting(t *testing.T) {
+	enterNewNetNS(t)
+	device := newTestDevice(t)
+	defer device.Close()
+
+	config := testRoutingConfig()
+	routing, err := SetUpRouting(config)
+	require.NoError(t, err)
+	// Setting up the same routing again doesn't duplicate the entries.
+	again, err := SetUpRouting(config)
+	require.NoError(t, err)
+	requireRouting(t, true)
+
+	require.NoError(t, routing.Close())
+	requireRouting(t, false)
+	require.NoError(t, routing.Close())
+	require.NoError(t, again.Close())
+}
+
+func TestSetUpRouting_IPv6(t *testing.T) {
+	enterNewNetNS(t)
+	device, err := New(Config{Name: testDeviceName, Addresses: []netip.Prefix{
+		netip.PrefixFrom(testDeviceIP, 32), netip.MustParsePrefix("fd00:233::1/128"),
+	}})
+	if err != nil {
+		t.Skipf("failed to create TUN device: %v", err)
+	}
+	defer device.Close()
+
+	config := testRoutingConfig()
+	config.Destinations = append(config.Destinations, netip.MustParsePrefix("::/0"))
+	config.Bypass = append(config.Bypass, netip.MustParsePrefix("2001:db8::1/128"))
+	routing, err := SetUpRouting(config)
+	require.NoError(t, err)
+	requireRouting(t, true)
+
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{Table: testTableID}, netlink.RT_FILTER_TABLE)
+	require.NoError(t, err)
+	require.Len(t, routes, 1)
+	require.Equal(t, device.link.Attrs().Index, routes[0].LinkIndex)
+	rules, err := netlink.RuleList(netlink.FAMILY_V6)
+	require.NoError(t, err)
+	require.Equal(t, 1, countRules(rules, testRulePriority, unix.RT_TABLE_MAIN, "2001:db8::1/128"))
+	require.Equal(t, 1, countRules(rules, testRulePriority+1, testTableID, "<nil>"))
+
+	require.NoError(t, routing.Close())
+	requireRouting(t, false)
+	rules, err = netlink.RuleList(netlink.FAMILY_V6)
+	require.NoError(t, err)
+	require.Zero(t, countRules(rules, testRulePriority, unix.RT_TABLE_MAIN, "2001:db8::1/128"))
+	require.Zero(t, countRules(rules, testRulePriority+1, testTableID, "<nil>"))
+}
+
+func TestSetUpRouting_Blocked(t *testing.T) {
+	enterNewNetNS(t)
+	device := newTestDevice(t)
+	defer device.Close()
+	lo, err := netlink.LinkByName("lo")
+	require.NoError(t, err)
+	require.NoError(t, netlink.LinkSetUp(lo))
+	// Without the block, the traffic would go through this route in the main table.
+	require.NoError(t, netlink.RouteAdd(&netlink.Route{LinkIndex: lo.Attrs().Index, Dst: prefixToIPNet(netip.MustParsePrefix("::/0"))}))
+
+	config := testRoutingConfig()
+	config.JournalPath = filepath.Join(t.TempDir(), "routing.json")
+	config.Blocked = []netip.Prefix{netip.MustParsePrefix("::/0")}
+	_, err = SetUpRouting(config)
+	require.NoError(t, err)
+
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{Table: testTableID}, netlink.RT_FILTER_TABLE)
+	require.NoError(t, err)
+	require.Len(t, routes, 1)
+	require.Equal(t, unix.RTN_UNREACHABLE, routes[0].Type)
+	_, err = net.DialUDP("udp6", nil, &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 53})
+	require.True(t, errors.Is(err, unix.EHOSTUNREACH) || errors.Is(err, unix.ENETUNREACH), err)
+
+	require.NoError(t, RecoverRouting(config.JournalPath))
+	routes, err = netlink.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{Table: testTableID}, netlink.RT_FILTER_TABLE)
+	require.NoError(t, err)
+	require.Empty(t, routes)
+	conn, err := net.DialUDP("udp6", nil, &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 53})
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestSetUpRouting_InvalidConfig(t *testing.T) {
+	config := testRoutingConfig()
+	config.DeviceName = ""
+	_, err := SetUpRouting(config)
+	require.Error(t, err)
+
+	config = testRoutingConfig()
+	config.Destinations = nil
+	_, err = SetUpRouting(config)
+	require.Error(t, err)
+
+	config = testRoutingConfig()
+	config.TableID = unix.RT_TABLE_MAIN
+	_, err = SetUpRouting(config)
+	require.Error(t, err)
+
+	config = testRoutingConfig()
+	config.RulePriority = 0
+	_, err = SetUpRouting(config)
+	require.Error(t, err)
+}
+
+func TestRecoverRouting(t *testing.T) {
+	enterNewNetNS(t)
+	device := newTestDevice(t)
+	defer device.Close()
+
+	config := testRoutingConfig()
+	config.JournalPath = filepath.Join(t.TempDir(), "state", "routing.json")
+	// Simulate a crash by not closing the routing.
+	_, err := SetUpRouting(config)
+	require.NoError(t, err)
+	requireRouting(t, true)
+	require.FileExists(t, config.JournalPath)
+
+	require.NoError(t, RecoverRouting(config.JournalPath))
+	requireRouting(t, false)
+	require.NoFileExists(t, config.JournalPath)
+	// Nothing to recover.
+	require.NoError(t, RecoverRouting(config.JournalPath))
+}
+
+func TestRecoverRouting_DeviceRemoved(t *testing.T) {
+	enterNewNetNS(t)
+	device := newTestDevice(t)
+
+	config := testRoutingConfig()
+	config.JournalPath = filepath.Join(t.TempDir(), "routing.json")
+	_, err := SetUpRouting(config)
+	require.NoError(t, err)
+	// The device goes away with the process, but the ip rules remain.
+	require.NoError(t, device.Close())
+
+	// A new run recovers the previous routing before applying its own.
+	device = newTestDevice(t)
+	defer device.Close()
+	routing, err := SetUpRouting(config)
+	require.NoError(t, err)
+	requireRouting(t, true)
+	require.NoError(t, routing.Close())
+	requireRouting(t, false)
+	require.NoFileExists(t, config.JournalPath)
+}
+
+func TestRecoverRouting_InvalidJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routing.json")
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0o600))
+	require.Error(t, RecoverRouting(path))
+}
+
+func TestRunWithDevice(t *testing.T) {
+	enterNewNetNS(t)
+	tun := newTestDevice(t)
+	routing, err := SetUpRouting(testRoutingConfig())
+	require.NoError(t, err)
+	defer routing.Close()
+
+	device := newFakeDevice()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Run(ctx, device, tun)
+	}()
+
+	// The socket is created in the namespace of the locked thread.
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 53})
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("request"))
+	require.NoError(t, err)
+
+	var request []byte
+	for request == nil {
+		select {
+		case packet := <-device.out:
+			// Skip unrelated packets, such as IPv6 router solicitations.
+			if len(packet) >= 28 && packet[0]>>4 == 4 && packet[9] == unix.IPPROTO_UDP {
+				request = packet
+			}
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "timed out waiting for the request")
+		}
+	}
+	require.Equal(t, []byte{198, 51, 100, 1}, request[16:20])
+	require.Equal(t, testDeviceIP.AsSlice(), request[12:16])
+	require.Equal(t, []byte("request"), request[28:])
+
+	localPort := conn.LocalAddr().(*net.UDPAddr).Port
+	device.in <- udpPacket(netip.AddrPortFrom(netip.MustParseAddr("198.51.100.1"), 53),
+		netip.AddrPortFrom(testDeviceIP, uint16(localPort)), []byte("response"))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 100)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "response", string(buf[:n]))
+
+	cancel()
+	require.NoError(t, <-done)
+	require.True(t, device.isClosed())
+}
+
+/********** Test Utilities **********/
+
+// enterNewNetNS moves the test goroutine to a new network namespace, so the tests don't change the host networking.
+func enterNewNetNS(t *testing.T) {
+	// The thread is never unlocked, so the runtime discards it when the test goroutine exits.
+	runtime.LockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("failed to create network namespace, run with `unshare --user --map-root-user --net`: %v", err)
+	}
+}
+
+func newTestDevice(t *testing.T) *Device {
+	device, err := New(Config{Name: testDeviceName, Addresses: []netip.Prefix{netip.PrefixFrom(testDeviceIP, 32)}})
+	if err != nil {
+		t.Skipf("failed to create TUN device: %v", err)
+	}
+	return device
+}
+
+func testRoutingConfig() RoutingConfig {
+	return RoutingConfig{
+		DeviceName:   testDeviceName,
+		Destinations: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+		Bypass:       []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")},
+		TableID:      testTableID,
+		RulePriority: testRulePriority,
+	}
+}
+
+// requireRouting checks whether the routing of testRoutingConfig is installed, with no duplicates.
+func requireRouting(t *testing.T, installed bool) {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: testTableID}, netlink.RT_FILTER_TABLE)
+	require.NoError(t, err)
+	rules, err := netlink.RuleList(netlink.FAMILY_V4)
+	require.NoError(t, err)
+	bypassRules := countRules(rules, testRulePriority, unix.RT_TABLE_MAIN, "192.0.2.1/32")
+	tableRules := countRules(rules, testRulePriority+1, testTableID, "<nil>")
+	if installed {
+		require.Len(t, routes, 1)
+		require.Nil(t, routes[0].Dst)
+		require.Equal(t, 1, bypassRules)
+		require.Equal(t, 1, tableRules)
+	} else {
+		require.Empty(t, routes)
+		require.Zero(t, bypassRules)
+		require.Zero(t, tableRules)
+	}
+}
+
+// countRules returns the number of rules with the given priority, table and destination.
+func countRules(rules []netlink.Rule, priority, table int, dst string) int {
+	var count int
+	for _, rule := range rules {
+		if rule.Priority == priority && rule.Table == table && rule.Dst.String() == dst {
+			count++
+		}
+	}
+	return count
+}
+
+// udpPacket builds an IPv4 UDP packet. The UDP checksum is optional in IPv4, so it's left as zero.
+func udpPacket(src, dst netip.AddrPort, payload []byte) []byte {
+	packet := make([]byte, 28, 28+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(28+len(payload)))
+	packet[8] = 64
+	packet[9] = unix.IPPROTO_UDP
+	copy(packet[12:16], src.Addr().AsSlice())
+	copy(packet[16:20], dst.Addr().AsSlice())
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(packet[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	binary.BigEndian.PutUint16(packet[10:], ^uint16(sum))
+	binary.BigEndian.PutUint16(packet[20:], src.Port())
+	binary.BigEndian.PutUint16(packet[22:], dst.Port())
+	binary.BigEndian.PutUint16(packet[24:], uint16(8+len(payload)))
+	return append(packet, payload...)
+}